@@ -0,0 +1,458 @@
+//go:build integration
+
+// run tests with this command: go test -tags integration -run TestAPI .
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"imperatorapp/auth/oauth"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/auth/throttle"
+	"imperatorapp/handlers"
+	"imperatorapp/middleware"
+	"imperatorapp/models"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/arc41t3ct/imperator"
+	"github.com/arc41t3ct/imperator/render"
+	chi "github.com/go-chi/chi/v5"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	dockertest "github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+var (
+	apiHost     = "localhost"
+	apiUser     = "imperator"
+	apiPassword = "password"
+	apiDBName   = "imperator_api_test"
+	apiPort     = "5436"
+	apiDSN      = "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=UTC connect_timeout=5"
+)
+
+var apiServer *httptest.Server
+var apiModels models.Models
+
+func TestMain(m *testing.M) {
+	os.Setenv("DATABASE_TYPE", "postgres")
+	os.Setenv("UPPER_DB_LOG", "ERROR")
+	os.Setenv("APP_URL", webURL)
+	os.Setenv("SERVER_NAME", "localhost")
+
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Fatalf("could not connect to docker")
+	}
+
+	opts := dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "13.4",
+		Env: []string{
+			"POSTGRES_USER=" + apiUser,
+			"POSTGRES_PASSWORD=" + apiPassword,
+			"POSTGRES_DB=" + apiDBName,
+		},
+		ExposedPorts: []string{"5432"},
+		PortBindings: map[docker.Port][]docker.PortBinding{
+			"5432": {
+				{HostIP: "0.0.0.0", HostPort: apiPort},
+			},
+		},
+	}
+
+	resource, err := pool.RunWithOptions(&opts)
+	if err != nil {
+		_ = pool.Purge(resource)
+		log.Fatalf("could not start resource with error: %s", err)
+	}
+
+	var db *sql.DB
+	if err := pool.Retry(func() error {
+		var err error
+		db, err = sql.Open("pgx", fmt.Sprintf(apiDSN, apiHost, apiPort, apiUser, apiPassword, apiDBName))
+		if err != nil {
+			return err
+		}
+		return db.Ping()
+	}); err != nil {
+		_ = pool.Purge(resource)
+		log.Fatalf("could not connect to docker with error: %s", err)
+	}
+
+	if err := runMigrations(db); err != nil {
+		_ = pool.Purge(resource)
+		log.Fatalf("error running the migrations: %s", err)
+	}
+
+	imp := &imperator.Imperator{
+		AppName:       "imperatorapp",
+		InfoLog:       log.New(io.Discard, "", 0),
+		ErrorLog:      log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+		Render:        &render.Render{},
+		Session:       scs.New(),
+		EncryptionKey: webEncryptionKey,
+		Routes:        chi.NewRouter(),
+	}
+	// the web routes need the session loaded like the routes of imperator do
+	imp.Routes.Use(imp.Session.LoadAndSave)
+	captureMail(imp)
+	apiModels = models.New(db)
+	sessionIndex := sessions.New(imp.Session, imp.EncryptionKey)
+	app := &application{
+		App:       imp,
+		Middlware: &middleware.Middleware{App: imp, Models: apiModels, SessionIndex: sessionIndex},
+		Handlers: &handlers.Handlers{
+			App:           imp,
+			Models:        apiModels,
+			LoginThrottle: throttle.NewLogin(nil, throttle.DefaultEmailConfig, throttle.DefaultIPConfig),
+			MailThrottle:  throttle.New(nil, throttle.DefaultMailConfig),
+			SessionIndex:  sessionIndex,
+		},
+		Models: apiModels,
+	}
+	app.Handlers.OAuth = oauth.FromEnv(webURL, app.Handlers.LoadOAuthKeys)
+	if err := app.Handlers.RotateOAuthKeys(); err != nil {
+		_ = pool.Purge(resource)
+		log.Fatalf("error generating the oauth signing key: %s", err)
+	}
+	apiServer = httptest.NewServer(app.apiRoutes())
+	webApp = app
+	webRoutes = app.routes()
+
+	code := m.Run()
+
+	apiServer.Close()
+	if err := pool.Purge(resource); err != nil {
+		log.Fatalf("could not purge resource: %s", err)
+	}
+	os.Exit(code)
+}
+
+// runMigrations applies the up migrations in order so the tests run against the real schema
+func runMigrations(db *sql.DB) error {
+	files, err := filepath.Glob("migrations/*.up.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		stmt, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(string(stmt)); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// apiEnvelope is the json envelope returned by the api
+type apiEnvelope struct {
+	Error   bool              `json:"error"`
+	Message string            `json:"message"`
+	Data    json.RawMessage   `json:"data"`
+	Errors  map[string]string `json:"errors"`
+}
+
+// apiCall sends a json request to the api and decodes the envelope of the response
+func apiCall(t *testing.T, method, path, token string, body interface{}) (int, apiEnvelope) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reader = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, apiServer.URL+path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var env apiEnvelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatalf("%s %s: response is not a json envelope: %s", method, path, err)
+	}
+	return resp.StatusCode, env
+}
+
+// apiToken issues a token through the api
+func apiToken(t *testing.T, email string, scopes []string) string {
+	t.Helper()
+	status, env := apiCall(t, "POST", "/tokens", "", map[string]interface{}{
+		"email": email, "password": "password", "scopes": scopes,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("failed to issue token, got %d: %s", status, env.Message)
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(env.Data, &token)
+	return token.Token
+}
+
+func TestAPI_Users(t *testing.T) {
+	verified := time.Now()
+	adminID, err := apiModels.Users.Insert(models.User{
+		FirstName: "Ada", LastName: "Admin", Email: "admin@example.com", Active: 1, Password: "password",
+		EmailVerifiedAt: &verified,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	role, _ := apiModels.Roles.GetByName(models.SuperAdminRole)
+	if err := apiModels.Roles.AssignToUser(role.ID, adminID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiModels.Users.Insert(models.User{
+		FirstName: "Rita", LastName: "Reader", Email: "reader@example.com", Active: 1, Password: "password",
+		EmailVerifiedAt: &verified,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong credentials never get a token
+	status, env := apiCall(t, "POST", "/tokens", "", map[string]string{"email": "admin@example.com", "password": "wrong"})
+	if status != http.StatusUnauthorized || !env.Error {
+		t.Error("token issued for a wrong password:", status)
+	}
+	status, env = apiCall(t, "POST", "/tokens", "", map[string]string{})
+	if status != http.StatusUnprocessableEntity || env.Errors["email"] == "" || env.Errors["password"] == "" {
+		t.Error("missing credentials did not fail validation:", status, env.Errors)
+	}
+
+	// requests without a token are rejected
+	if status, _ := apiCall(t, "GET", "/users", "", nil); status != http.StatusUnauthorized {
+		t.Error("users listed without a token:", status)
+	}
+
+	admin := apiToken(t, "admin@example.com", []string{models.ScopeUsersRead, models.ScopeUsersWrite})
+	readOnly := apiToken(t, "admin@example.com", []string{models.ScopeUsersRead})
+	reader := apiToken(t, "reader@example.com", []string{models.ScopeUsersRead, models.ScopeUsersWrite})
+
+	status, env = apiCall(t, "GET", "/users?sort=email", admin, nil)
+	var list struct {
+		Users []struct {
+			ID    int    `json:"id"`
+			Email string `json:"email"`
+		} `json:"users"`
+		Total int `json:"total"`
+	}
+	_ = json.Unmarshal(env.Data, &list)
+	if status != http.StatusOK || list.Total != 2 || list.Users[0].Email != "admin@example.com" {
+		t.Error("wrong user list:", status, string(env.Data))
+	}
+
+	// the reader has the scope but no permission, the read only token lacks the scope
+	if status, _ := apiCall(t, "GET", "/users", reader, nil); status != http.StatusForbidden {
+		t.Error("user without permission listed users:", status)
+	}
+	if status, _ := apiCall(t, "POST", "/users", readOnly, map[string]string{}); status != http.StatusForbidden {
+		t.Error("token without users:write scope created a user:", status)
+	}
+
+	status, env = apiCall(t, "POST", "/users", admin, map[string]string{"email": "not-an-email", "password": "short"})
+	if status != http.StatusUnprocessableEntity {
+		t.Error("invalid user was created:", status)
+	}
+	for _, field := range []string{"first_name", "last_name", "email", "password"} {
+		if env.Errors[field] == "" {
+			t.Errorf("no validation error for %s: %v", field, env.Errors)
+		}
+	}
+
+	status, env = apiCall(t, "POST", "/users", admin, map[string]interface{}{
+		"first_name": "New", "last_name": "User", "email": "new@example.com", "password": "long enough",
+	})
+	var created struct {
+		ID     int  `json:"id"`
+		Active bool `json:"active"`
+	}
+	_ = json.Unmarshal(env.Data, &created)
+	if status != http.StatusCreated || created.ID == 0 || !created.Active {
+		t.Fatal("failed to create user:", status, env.Message, env.Errors)
+	}
+	if bytes.Contains(env.Data, []byte("password")) {
+		t.Error("password returned by the api")
+	}
+
+	path := fmt.Sprintf("/users/%d", created.ID)
+	status, env = apiCall(t, "PATCH", path, admin, map[string]interface{}{"last_name": "Renamed", "active": false})
+	if status != http.StatusOK {
+		t.Error("failed to update user:", status, env.Errors)
+	}
+	status, env = apiCall(t, "GET", path, readOnly, nil)
+	var got struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Active    bool   `json:"active"`
+	}
+	_ = json.Unmarshal(env.Data, &got)
+	if status != http.StatusOK || got.FirstName != "New" || got.LastName != "Renamed" || got.Active {
+		t.Error("update not applied:", string(env.Data))
+	}
+	if status, _ := apiCall(t, "PUT", path, admin, map[string]string{"email": "reader@example.com"}); status != http.StatusUnprocessableEntity {
+		t.Error("user updated to a duplicate email:", status)
+	}
+
+	if status, _ := apiCall(t, "DELETE", fmt.Sprintf("/users/%d", adminID), admin, nil); status != http.StatusConflict {
+		t.Error("token user deleted themselves:", status)
+	}
+	if status, _ := apiCall(t, "DELETE", path, admin, nil); status != http.StatusOK {
+		t.Error("failed to delete user:", status)
+	}
+	if status, env := apiCall(t, "GET", path, admin, nil); status != http.StatusNotFound || !env.Error {
+		t.Error("deleted user still found:", status)
+	}
+	if status, _ := apiCall(t, "GET", "/nothing", admin, nil); status != http.StatusNotFound {
+		t.Error("unknown route did not return 404:", status)
+	}
+}
+
+func TestAPI_TokenRevoke(t *testing.T) {
+	token := apiToken(t, "admin@example.com", []string{models.ScopeUsersRead})
+	other := apiToken(t, "admin@example.com", []string{models.ScopeUsersRead})
+	readerToken := apiToken(t, "reader@example.com", []string{models.ScopeUsersRead})
+
+	reader, _ := apiModels.Tokens.GetUserForToken(readerToken)
+	if status, _ := apiCall(t, "DELETE", fmt.Sprintf("/tokens/%d", reader.Token.ID), token, nil); status != http.StatusNotFound {
+		t.Error("revoked the token of another user:", status)
+	}
+
+	if status, _ := apiCall(t, "DELETE", "/tokens", token, nil); status != http.StatusOK {
+		t.Error("failed to revoke token:", status)
+	}
+	if status, _ := apiCall(t, "GET", "/users", token, nil); status != http.StatusUnauthorized {
+		t.Error("revoked token still accepted:", status)
+	}
+	if status, _ := apiCall(t, "GET", "/users", other, nil); status != http.StatusOK {
+		t.Error("revoking one token revoked the others:", status)
+	}
+}
+
+func TestAPI_TokenThrottle(t *testing.T) {
+	body := map[string]string{"email": "nobody@example.com", "password": "guess"}
+	for i := 0; i <= throttle.DefaultEmailConfig.FreeAttempts; i++ {
+		if status, _ := apiCall(t, "POST", "/tokens", "", body); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401 and got %d", i+1, status)
+		}
+	}
+	status, env := apiCall(t, "POST", "/tokens", "", body)
+	if status != http.StatusTooManyRequests || !env.Error {
+		t.Error("guessing was not throttled:", status)
+	}
+}
+
+func TestAPI_TokenGates(t *testing.T) {
+	verified := time.Now()
+	for _, user := range []models.User{
+		{FirstName: "Una", LastName: "Unverified", Email: "unverified@example.com", Active: 1, Password: "password"},
+		{FirstName: "Ina", LastName: "Inactive", Email: "inactive@example.com", Active: 0, Password: "password", EmailVerifiedAt: &verified},
+	} {
+		if _, err := apiModels.Users.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := map[string]string{"email": "unverified@example.com", "password": "password"}
+	if status, _ := apiCall(t, "POST", "/tokens", "", body); status != http.StatusForbidden {
+		t.Error("unverified user got a token:", status)
+	}
+	body = map[string]string{"email": "inactive@example.com", "password": "password"}
+	if status, _ := apiCall(t, "POST", "/tokens", "", body); status != http.StatusUnauthorized {
+		t.Error("deactivated user got a token:", status)
+	}
+
+	// a passkey is a second factor too, the password alone must not get around it
+	id, err := apiModels.Users.Insert(models.User{
+		FirstName: "Pia", LastName: "Passkey", Email: "passkey@example.com", Active: 1, Password: "password",
+		EmailVerifiedAt: &verified,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiModels.Credentials.Insert(models.Credential{
+		UserID: id, Name: "key", CredentialID: []byte("passkey-only"), PublicKey: []byte("key"), AAGUID: make([]byte, 16),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	body = map[string]string{"email": "passkey@example.com", "password": "password"}
+	if status, env := apiCall(t, "POST", "/tokens", "", body); status != http.StatusForbidden || !env.Error {
+		t.Error("passkey user got a token with the password alone:", status)
+	}
+}
+
+func TestAPI_ManageOutrankedUsers(t *testing.T) {
+	verified := time.Now()
+	id, err := apiModels.Users.Insert(models.User{
+		FirstName: "Ed", LastName: "Editor", Email: "api-editor@example.com", Active: 1, Password: "password",
+		EmailVerifiedAt: &verified,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleID, err := apiModels.Roles.Insert(models.Role{Name: "api-editors", Description: "Edit users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"users.view", "users.edit", "users.delete"} {
+		permission, _ := apiModels.Permissions.GetByName(name)
+		if err := apiModels.Roles.GrantPermission(roleID, permission.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := apiModels.Roles.AssignToUser(roleID, id); err != nil {
+		t.Fatal(err)
+	}
+	editor := apiToken(t, "api-editor@example.com", []string{models.ScopeUsersRead, models.ScopeUsersWrite})
+
+	admin, err := apiModels.Users.GetByEmail("admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/users/%d", admin.ID)
+	if status, _ := apiCall(t, "PATCH", path, editor, map[string]interface{}{"email": "api-taken@example.com"}); status != http.StatusForbidden {
+		t.Error("an editor changed a super admin:", status)
+	}
+	if status, _ := apiCall(t, "DELETE", path, editor, nil); status != http.StatusForbidden {
+		t.Error("an editor deleted a super admin:", status)
+	}
+}
+
+func TestAPI_DeactivateRevokesAccess(t *testing.T) {
+	verified := time.Now()
+	id, err := apiModels.Users.Insert(models.User{
+		FirstName: "Dee", LastName: "Activated", Email: "deactivated@example.com", Active: 1, Password: "password",
+		EmailVerifiedAt: &verified,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := apiToken(t, "deactivated@example.com", []string{models.ScopeUsersRead})
+	admin := apiToken(t, "admin@example.com", []string{models.ScopeUsersRead, models.ScopeUsersWrite})
+
+	if status, _ := apiCall(t, "PATCH", fmt.Sprintf("/users/%d", id), admin, map[string]interface{}{"active": false}); status != http.StatusOK {
+		t.Fatal("failed to deactivate user:", status)
+	}
+	if _, err := apiModels.Tokens.GetUserForToken(token); err == nil {
+		t.Error("the api token of a deactivated user still exists")
+	}
+}
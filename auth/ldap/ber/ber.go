@@ -0,0 +1,250 @@
+// Package ber encodes and decodes the subset of the Basic Encoding Rules of ASN.1 that LDAP
+// messages use (RFC 4511 section 5.1): definite lengths and tag numbers below 31.
+package ber
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Classes and the constructed bit of an identifier octet
+const (
+	ClassUniversal   byte = 0x00
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+	Constructed      byte = 0x20
+)
+
+// Universal tags
+const (
+	TagBoolean     byte = 0x01
+	TagInteger     byte = 0x02
+	TagOctetString byte = 0x04
+	TagNull        byte = 0x05
+	TagEnumerated  byte = 0x0a
+	TagSequence    byte = 0x10 | Constructed
+	TagSet         byte = 0x11 | Constructed
+)
+
+// MaxPacketSize limits the size of a decoded message so a peer can not make us allocate any
+// amount of memory
+const MaxPacketSize = 16 << 20
+
+// ErrMalformed is returned for data that is not valid BER or uses features LDAP does not need
+var ErrMalformed = errors.New("ber: malformed packet")
+
+// Packet is a BER element. Tag is the whole identifier octet, primitive elements have a Value
+// and constructed elements have Children.
+type Packet struct {
+	Tag      byte
+	Value    []byte
+	Children []*Packet
+}
+
+// New returns a primitive element
+func New(tag byte, value []byte) *Packet {
+	return &Packet{Tag: tag, Value: value}
+}
+
+// Seq returns a constructed element of the children, the tag must have the Constructed bit set
+func Seq(tag byte, children ...*Packet) *Packet {
+	return &Packet{Tag: tag, Children: children}
+}
+
+// String returns an octet string element, tag allows context specific string types
+func String(tag byte, s string) *Packet {
+	return New(tag, []byte(s))
+}
+
+// Int returns an integer element, tag allows enumerated values
+func Int(tag byte, n int64) *Packet {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		// stop once the remaining bits are only the sign of the first octet
+		if (n == 0 && b[0]&0x80 == 0) || (n == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return New(tag, b)
+}
+
+// Bool returns a boolean element
+func Bool(v bool) *Packet {
+	if v {
+		return New(TagBoolean, []byte{0xff})
+	}
+	return New(TagBoolean, []byte{0x00})
+}
+
+// IsConstructed reports whether the element holds children
+func (p *Packet) IsConstructed() bool {
+	return p.Tag&Constructed != 0
+}
+
+// Str returns the value as string
+func (p *Packet) Str() string {
+	return string(p.Value)
+}
+
+// Int returns the value of an integer or enumerated element
+func (p *Packet) Int() (int64, error) {
+	if p.IsConstructed() || len(p.Value) == 0 || len(p.Value) > 8 {
+		return 0, ErrMalformed
+	}
+	n := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// Bool returns the value of a boolean element
+func (p *Packet) Bool() (bool, error) {
+	if p.IsConstructed() || len(p.Value) != 1 {
+		return false, ErrMalformed
+	}
+	return p.Value[0] != 0, nil
+}
+
+// Child returns the child at index i or nil when there is none
+func (p *Packet) Child(i int) *Packet {
+	if i < 0 || i >= len(p.Children) {
+		return nil
+	}
+	return p.Children[i]
+}
+
+// Bytes returns the encoding of the element
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	if p.IsConstructed() {
+		content = nil
+		for _, c := range p.Children {
+			content = append(content, c.Bytes()...)
+		}
+	}
+	out := append([]byte{p.Tag}, encodeLength(len(content))...)
+	return append(out, content...)
+}
+
+// encodeLength returns the definite length octets, the short form below 128
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Read reads one element from r
+func Read(r *bufio.Reader) (*Packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return decode(tag, content)
+}
+
+// Parse decodes an element that must fill b completely
+func Parse(b []byte) (*Packet, error) {
+	p, rest, err := parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(rest))
+	}
+	return p, nil
+}
+
+// parse decodes the first element of b and returns the bytes after it
+func parse(b []byte) (*Packet, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrMalformed
+	}
+	tag := b[0]
+	length, n := int(b[1]), 2
+	if length&0x80 != 0 {
+		octets := length & 0x7f
+		if octets == 0 || octets > 4 || len(b) < 2+octets {
+			return nil, nil, ErrMalformed
+		}
+		length = 0
+		for _, c := range b[2 : 2+octets] {
+			length = length<<8 | int(c)
+		}
+		n += octets
+	}
+	if length > len(b)-n {
+		return nil, nil, ErrMalformed
+	}
+	p, err := decode(tag, b[n:n+length])
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, b[n+length:], nil
+}
+
+// decode builds the element of the tag from its content
+func decode(tag byte, content []byte) (*Packet, error) {
+	// tag numbers of 31 and above use more identifier octets, LDAP never needs them
+	if tag&0x1f == 0x1f {
+		return nil, fmt.Errorf("%w: high tag number", ErrMalformed)
+	}
+	p := &Packet{Tag: tag}
+	if !p.IsConstructed() {
+		p.Value = content
+		return p, nil
+	}
+	for len(content) > 0 {
+		child, rest, err := parse(content)
+		if err != nil {
+			return nil, err
+		}
+		p.Children = append(p.Children, child)
+		content = rest
+	}
+	return p, nil
+}
+
+// readLength reads definite length octets, the indefinite form is not allowed in LDAP
+func readLength(r *bufio.Reader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first&0x80 == 0 {
+		return int(first), nil
+	}
+	octets := int(first & 0x7f)
+	if octets == 0 || octets > 4 {
+		return 0, fmt.Errorf("%w: unsupported length", ErrMalformed)
+	}
+	length := 0
+	for i := 0; i < octets; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > MaxPacketSize {
+		return 0, fmt.Errorf("%w: packet of %d bytes is too large", ErrMalformed, length)
+	}
+	return length, nil
+}
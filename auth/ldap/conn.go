@@ -0,0 +1,360 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"imperatorapp/auth/ldap/ber"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Protocol operations of an LDAP message (RFC 4511 section 4.2 and following)
+const (
+	OpBindRequest      = ber.ClassApplication | ber.Constructed | 0
+	OpBindResponse     = ber.ClassApplication | ber.Constructed | 1
+	OpUnbindRequest    = ber.ClassApplication | 2
+	OpSearchRequest    = ber.ClassApplication | ber.Constructed | 3
+	OpSearchEntry      = ber.ClassApplication | ber.Constructed | 4
+	OpSearchDone       = ber.ClassApplication | ber.Constructed | 5
+	OpSearchReference  = ber.ClassApplication | ber.Constructed | 19
+	OpExtendedRequest  = ber.ClassApplication | ber.Constructed | 23
+	OpExtendedResponse = ber.ClassApplication | ber.Constructed | 24
+
+	// TagSimpleAuth is the password of a simple bind
+	TagSimpleAuth = ber.ClassContext | 0
+	// TagRequestName is the oid of an extended request
+	TagRequestName = ber.ClassContext | 0
+)
+
+// Result codes
+const (
+	ResultSuccess            = 0
+	ResultOperationsError    = 1
+	ResultProtocolError      = 2
+	ResultSizeLimitExceeded  = 4
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+	ResultUnwillingToPerform = 53
+)
+
+// StartTLSOID is the name of the StartTLS extended operation
+const StartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+const (
+	protocolVersion = 3
+	defaultPort     = "389"
+	defaultTLSPort  = "636"
+)
+
+// Search scopes
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+// ErrEmptyPassword is returned by Bind for an empty password, servers treat such a bind as an
+// unauthenticated bind that succeeds without checking anything (RFC 4513 section 5.1.2)
+var ErrEmptyPassword = errors.New("ldap: empty password")
+
+// ResultError is a result code other than success returned by the server
+type ResultError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsResult reports whether err is a ResultError with the code
+func IsResult(err error, code int64) bool {
+	var re *ResultError
+	return errors.As(err, &re) && re.Code == code
+}
+
+// Entry is an entry returned by a search, the attribute names are lower case
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the attribute or ""
+func (e *Entry) Get(name string) string {
+	values := e.Attributes[strings.ToLower(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns all values of the attribute
+func (e *Entry) Values(name string) []string {
+	return e.Attributes[strings.ToLower(name)]
+}
+
+// SearchRequest is a search below BaseDN, Filter is in the string representation of RFC 4515
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Conn is a connection to a directory server. Requests are sent one at a time, a Conn must not be
+// used by more than one goroutine.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	host    string
+	timeout time.Duration
+	lastID  int64
+}
+
+// Dial connects to the server of an ldap:// or ldaps:// url. ldaps connects with TLS right away,
+// for ldap urls StartTLS can upgrade the connection afterwards. timeout limits every request.
+func Dial(ctx context.Context, rawURL string, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid url: %w", err)
+	}
+	host, port := u.Hostname(), u.Port()
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = defaultPort
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if port == "" {
+			port = defaultTLSPort
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: withServerName(tlsConfig, host)}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: failed to connect: %w", err)
+	}
+	return &Conn{conn: conn, reader: bufio.NewReader(conn), host: host, timeout: timeout}, nil
+}
+
+// withServerName returns a copy of the config that verifies the certificate for host
+func withServerName(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+// StartTLS upgrades the connection to TLS (RFC 4511 section 4.14), it must be the first request
+func (c *Conn) StartTLS(config *tls.Config) error {
+	op := ber.Seq(OpExtendedRequest, ber.String(TagRequestName, StartTLSOID))
+	response, err := c.roundTrip(op, OpExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := result(response); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, withServerName(config, c.host))
+	if err := c.deadline(); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("ldap: tls handshake failed: %w", err)
+	}
+	c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind authenticates the connection with a simple bind, a wrong password is a ResultError with
+// ResultInvalidCredentials
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	op := ber.Seq(OpBindRequest,
+		ber.Int(ber.TagInteger, protocolVersion),
+		ber.String(ber.TagOctetString, dn),
+		ber.String(TagSimpleAuth, password),
+	)
+	response, err := c.roundTrip(op, OpBindResponse)
+	if err != nil {
+		return err
+	}
+	return result(response)
+}
+
+// Search returns the entries found by the request, search references are ignored
+func (c *Conn) Search(req SearchRequest) ([]*Entry, error) {
+	filter, err := CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attributes := ber.Seq(ber.TagSequence)
+	for _, a := range req.Attributes {
+		attributes.Children = append(attributes.Children, ber.String(ber.TagOctetString, a))
+	}
+	op := ber.Seq(OpSearchRequest,
+		ber.String(ber.TagOctetString, req.BaseDN),
+		ber.Int(ber.TagEnumerated, int64(req.Scope)),
+		ber.Int(ber.TagEnumerated, 0), // never dereference aliases
+		ber.Int(ber.TagInteger, int64(req.SizeLimit)),
+		ber.Int(ber.TagInteger, int64(c.timeout/time.Second)),
+		ber.Bool(false),
+		filter,
+		attributes,
+	)
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		response, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch response.Tag {
+		case OpSearchEntry:
+			entry, err := parseEntry(response)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case OpSearchReference:
+			// referrals to other servers are not followed
+		case OpSearchDone:
+			if err := result(response); err != nil {
+				return entries, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected response 0x%02x to a search", ber.ErrMalformed, response.Tag)
+		}
+	}
+}
+
+// Close sends an unbind request and closes the connection
+func (c *Conn) Close() error {
+	_, _ = c.send(ber.New(OpUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+// roundTrip sends a request and reads its single response of the expected type
+func (c *Conn) roundTrip(op *ber.Packet, expected byte) (*ber.Packet, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if response.Tag != expected {
+		return nil, fmt.Errorf("%w: unexpected response 0x%02x", ber.ErrMalformed, response.Tag)
+	}
+	return response, nil
+}
+
+// send writes the request in a message with the next message id
+func (c *Conn) send(op *ber.Packet) (int64, error) {
+	c.lastID++
+	message := ber.Seq(ber.TagSequence, ber.Int(ber.TagInteger, c.lastID), op)
+	if err := c.deadline(); err != nil {
+		return 0, err
+	}
+	if _, err := c.conn.Write(message.Bytes()); err != nil {
+		return 0, fmt.Errorf("ldap: failed to send request: %w", err)
+	}
+	return c.lastID, nil
+}
+
+// receive reads the next message, which must answer the request with the id
+func (c *Conn) receive(id int64) (*ber.Packet, error) {
+	if err := c.deadline(); err != nil {
+		return nil, err
+	}
+	message, err := ber.Read(c.reader)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: failed to read response: %w", err)
+	}
+	if message.Tag != ber.TagSequence || len(message.Children) < 2 {
+		return nil, ber.ErrMalformed
+	}
+	messageID, err := message.Children[0].Int()
+	if err != nil {
+		return nil, err
+	}
+	op := message.Children[1]
+	if messageID == 0 && op.Tag == OpExtendedResponse {
+		// the server is about to close the connection (RFC 4511 section 4.4.1)
+		if err := result(op); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("ldap: server sent a notice of disconnection")
+	}
+	if messageID != id {
+		return nil, fmt.Errorf("%w: response to message %d, expected %d", ber.ErrMalformed, messageID, id)
+	}
+	return op, nil
+}
+
+// deadline limits the next read or write to the timeout of the connection
+func (c *Conn) deadline() error {
+	if c.timeout <= 0 {
+		return nil
+	}
+	return c.conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+// result returns the error of an LDAPResult or nil when it is a success
+func result(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return ber.ErrMalformed
+	}
+	code, err := op.Children[0].Int()
+	if err != nil {
+		return err
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	return &ResultError{Code: code, Message: op.Children[2].Str()}
+}
+
+// parseEntry decodes a SearchResultEntry
+func parseEntry(op *ber.Packet) (*Entry, error) {
+	if len(op.Children) < 2 {
+		return nil, ber.ErrMalformed
+	}
+	entry := &Entry{DN: op.Children[0].Str(), Attributes: make(map[string][]string)}
+	for _, attribute := range op.Children[1].Children {
+		if len(attribute.Children) < 2 {
+			return nil, ber.ErrMalformed
+		}
+		name := strings.ToLower(attribute.Children[0].Str())
+		for _, v := range attribute.Children[1].Children {
+			entry.Attributes[name] = append(entry.Attributes[name], v.Str())
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,196 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"imperatorapp/auth/ldap/ber"
+	"strings"
+)
+
+// Filter choices of a search request (RFC 4511 section 4.5.1.7)
+const (
+	FilterAnd            = ber.ClassContext | ber.Constructed | 0
+	FilterOr             = ber.ClassContext | ber.Constructed | 1
+	FilterNot            = ber.ClassContext | ber.Constructed | 2
+	FilterEquality       = ber.ClassContext | ber.Constructed | 3
+	FilterSubstrings     = ber.ClassContext | ber.Constructed | 4
+	FilterGreaterOrEqual = ber.ClassContext | ber.Constructed | 5
+	FilterLessOrEqual    = ber.ClassContext | ber.Constructed | 6
+	FilterPresent        = ber.ClassContext | 7
+	FilterApprox         = ber.ClassContext | ber.Constructed | 8
+
+	// the parts of a substrings filter
+	SubstringInitial = ber.ClassContext | 0
+	SubstringAny     = ber.ClassContext | 1
+	SubstringFinal   = ber.ClassContext | 2
+)
+
+// ErrFilter is returned for a search filter that can not be parsed
+var ErrFilter = errors.New("ldap: invalid filter")
+
+// EscapeFilter escapes a value for use in a search filter (RFC 4515 section 3), values from a
+// login form must always be escaped so they can not change the filter
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// CompileFilter returns the encoding of a filter in the string representation of RFC 4515.
+// Extensible matches are not supported.
+func CompileFilter(filter string) (*ber.Packet, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		// a bare item is allowed as a shortcut, like uid=jdoe
+		filter = "(" + filter + ")"
+	}
+	p, rest, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrFilter, rest)
+	}
+	return p, nil
+}
+
+// compileFilter compiles the parenthesized filter at the start of s and returns what follows it
+func compileFilter(s string) (*ber.Packet, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return nil, "", fmt.Errorf("%w: expected (", ErrFilter)
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := byte(FilterAnd)
+		if s[0] == '|' {
+			tag = FilterOr
+		}
+		set := ber.Seq(tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := compileFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			set.Children = append(set.Children, child)
+			s = rest
+		}
+		return closeFilter(set, s)
+	case '!':
+		child, rest, err := compileFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		return closeFilter(ber.Seq(FilterNot, child), rest)
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("%w: missing )", ErrFilter)
+	}
+	item, err := compileItem(s[:end])
+	if err != nil {
+		return nil, "", err
+	}
+	return item, s[end+1:], nil
+}
+
+// closeFilter consumes the ) that ends a filter
+func closeFilter(p *ber.Packet, s string) (*ber.Packet, string, error) {
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("%w: missing )", ErrFilter)
+	}
+	return p, s[1:], nil
+}
+
+// compileItem compiles a comparison like mail=jdoe@example.com without its parentheses
+func compileItem(item string) (*ber.Packet, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("%w: %q has no attribute", ErrFilter, item)
+	}
+	attr, value, tag := item[:eq], item[eq+1:], byte(FilterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		attr, tag = attr[:len(attr)-1], FilterGreaterOrEqual
+	case '<':
+		attr, tag = attr[:len(attr)-1], FilterLessOrEqual
+	case '~':
+		attr, tag = attr[:len(attr)-1], FilterApprox
+	}
+	if attr == "" || strings.ContainsAny(attr, "()*\\ ") {
+		return nil, fmt.Errorf("%w: invalid attribute %q", ErrFilter, attr)
+	}
+
+	if tag == FilterEquality && value == "*" {
+		return ber.String(FilterPresent, attr), nil
+	}
+	if tag == FilterEquality && strings.Contains(value, "*") {
+		return compileSubstrings(attr, value)
+	}
+	unescaped, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return ber.Seq(tag, ber.String(ber.TagOctetString, attr), ber.String(ber.TagOctetString, unescaped)), nil
+}
+
+// compileSubstrings compiles a value with wildcards like jd*@example.*
+func compileSubstrings(attr, value string) (*ber.Packet, error) {
+	parts := strings.Split(value, "*")
+	subs := ber.Seq(ber.TagSequence)
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		unescaped, err := unescapeFilter(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(SubstringAny)
+		switch i {
+		case 0:
+			tag = SubstringInitial
+		case len(parts) - 1:
+			tag = SubstringFinal
+		}
+		subs.Children = append(subs.Children, ber.String(tag, unescaped))
+	}
+	if len(subs.Children) == 0 {
+		return nil, fmt.Errorf("%w: empty substrings", ErrFilter)
+	}
+	return ber.Seq(FilterSubstrings, ber.String(ber.TagOctetString, attr), subs), nil
+}
+
+// unescapeFilter decodes the \xx escapes of a filter value
+func unescapeFilter(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("%w: truncated escape", ErrFilter)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid escape", ErrFilter)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
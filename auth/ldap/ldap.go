@@ -0,0 +1,369 @@
+// Package ldap checks logins against an LDAP directory or Active Directory. It finds the entry of
+// a login with a search, checks the password by binding as the entry and maps the groups of the
+// entry to roles. The protocol client only implements bind, search, StartTLS and unbind.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for the optional settings
+const (
+	DefaultUserFilter     = "(&(objectClass=person)(|(mail=%s)(uid=%s)))"
+	DefaultIDAttribute    = "entryUUID"
+	DefaultGroupAttribute = "memberOf"
+	defaultTimeout        = 5 * time.Second
+)
+
+var (
+	// ErrUserNotFound is returned when no entry matches the login
+	ErrUserNotFound = errors.New("ldap: user not found")
+	// ErrAmbiguousUser is returned when more than one entry matches the login, the filter has to
+	// be changed so a login identifies a single entry
+	ErrAmbiguousUser = errors.New("ldap: more than one user matches the login")
+	// ErrInvalidCredentials is returned when the entry exists but the password is wrong
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+)
+
+// Config is the configuration of a directory
+type Config struct {
+	// URL is the ldap:// or ldaps:// url of the server
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS before the first bind
+	StartTLS bool
+	// TLS verifies the certificate of the server, nil uses the system roots
+	TLS     *tls.Config
+	Timeout time.Duration
+
+	// BindDN and BindPassword are the service account that searches for users, without them
+	// the search is anonymous
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched
+	BaseDN string
+	// UserFilter finds the entry of a login, every %s is replaced by the escaped login
+	UserFilter string
+	// IDAttribute holds the stable id of an entry, the DN is used when the entry has none
+	IDAttribute string
+
+	// GroupAttribute of the user entry lists the DNs of its groups
+	GroupAttribute string
+	// GroupFilter, when set, searches the groups below GroupBaseDN instead, every %s is replaced
+	// by the escaped DN of the user
+	GroupFilter string
+	GroupBaseDN string
+	// GroupRoles maps group DNs to role names
+	GroupRoles map[string]string
+
+	// Provision creates users on their first login, otherwise only existing users can log in
+	Provision bool
+	// FallbackRoles are the roles of local accounts that may still log in with their own
+	// password, "*" allows every local account
+	FallbackRoles []string
+}
+
+// User is the entry a login was checked against
+type User struct {
+	DN        string
+	ID        string
+	Email     string
+	FirstName string
+	LastName  string
+	Groups    []string
+	// Roles are the roles the groups are mapped to
+	Roles []string
+}
+
+// Directory checks logins against the configured server
+type Directory struct {
+	Config Config
+}
+
+// New returns a directory with the defaults applied to the config
+func New(config Config) *Directory {
+	if config.UserFilter == "" {
+		config.UserFilter = DefaultUserFilter
+	}
+	if config.IDAttribute == "" {
+		config.IDAttribute = DefaultIDAttribute
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = DefaultGroupAttribute
+	}
+	if config.GroupBaseDN == "" {
+		config.GroupBaseDN = config.BaseDN
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	roles := make(map[string]string, len(config.GroupRoles))
+	for group, role := range config.GroupRoles {
+		roles[NormalizeDN(group)] = role
+	}
+	config.GroupRoles = roles
+	return &Directory{Config: config}
+}
+
+// FromEnv returns the directory configured in .env or nil when LDAP_URL is not set
+func FromEnv() (*Directory, error) {
+	config := Config{
+		URL:            os.Getenv("LDAP_URL"),
+		StartTLS:       os.Getenv("LDAP_START_TLS") == "true",
+		BindDN:         os.Getenv("LDAP_BIND_DN"),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         os.Getenv("LDAP_BASE_DN"),
+		UserFilter:     os.Getenv("LDAP_USER_FILTER"),
+		IDAttribute:    os.Getenv("LDAP_ID_ATTRIBUTE"),
+		GroupAttribute: os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		GroupFilter:    os.Getenv("LDAP_GROUP_FILTER"),
+		GroupBaseDN:    os.Getenv("LDAP_GROUP_BASE_DN"),
+		Provision:      os.Getenv("LDAP_PROVISION") == "true",
+		FallbackRoles:  []string{"super-admin"},
+	}
+	if config.URL == "" {
+		return nil, nil
+	}
+	if config.BaseDN == "" {
+		return nil, errors.New("ldap: LDAP_BASE_DN is required")
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("LDAP_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		config.Timeout = time.Duration(seconds) * time.Second
+	}
+	if roles, ok := os.LookupEnv("LDAP_FALLBACK_ROLES"); ok {
+		config.FallbackRoles = splitList(roles, ",")
+	}
+
+	groupRoles, err := ParseGroupRoles(os.Getenv("LDAP_GROUP_ROLES"))
+	if err != nil {
+		return nil, err
+	}
+	config.GroupRoles = groupRoles
+
+	config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	if file := os.Getenv("LDAP_CA_FILE"); file != "" {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: failed to read LDAP_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ldap: LDAP_CA_FILE holds no certificate")
+		}
+		config.TLS.RootCAs = pool
+	}
+	// only for testing against a server with a certificate that can not be verified
+	config.TLS.InsecureSkipVerify = os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true"
+	return New(config), nil
+}
+
+// ParseGroupRoles parses the group to role mapping of LDAP_GROUP_ROLES, pairs of role and group
+// DN separated by semicolons like "super-admin=cn=admins,ou=groups,dc=example,dc=com"
+func ParseGroupRoles(s string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range splitList(s, ";") {
+		role, group, ok := strings.Cut(pair, "=")
+		role, group = strings.TrimSpace(role), strings.TrimSpace(group)
+		if !ok || role == "" || group == "" {
+			return nil, fmt.Errorf("ldap: invalid group role mapping %q", pair)
+		}
+		roles[group] = role
+	}
+	return roles, nil
+}
+
+// NormalizeDN returns the DN in lower case without spaces around its separators so DNs written
+// in different ways compare equal
+func NormalizeDN(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		attr, value, _ := strings.Cut(rdn, "=")
+		rdns[i] = strings.TrimSpace(attr) + "=" + strings.TrimSpace(value)
+	}
+	return strings.ToLower(strings.Join(rdns, ","))
+}
+
+// Authenticate checks the password of the login and returns its entry. It is ErrUserNotFound
+// when no entry matches and ErrInvalidCredentials when the password is wrong, any other error
+// means the directory could not be asked.
+func (d *Directory) Authenticate(ctx context.Context, login, password string) (*User, error) {
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := d.findUser(conn, login)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if IsResult(err, ResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	user := &User{
+		DN:        entry.DN,
+		ID:        d.entryID(entry),
+		Email:     entry.Get("mail"),
+		FirstName: entry.Get("givenName"),
+		LastName:  entry.Get("sn"),
+		Groups:    entry.Values(d.Config.GroupAttribute),
+	}
+	if user.FirstName == "" && user.LastName == "" {
+		user.FirstName, user.LastName, _ = strings.Cut(entry.Get("cn"), " ")
+	}
+	if d.Config.GroupFilter != "" {
+		// the user may not see the groups, search them as the service account again
+		if d.Config.BindDN != "" {
+			if err := conn.Bind(d.Config.BindDN, d.Config.BindPassword); err != nil {
+				return nil, fmt.Errorf("ldap: failed to bind as %s: %w", d.Config.BindDN, err)
+			}
+		}
+		if user.Groups, err = d.findGroups(conn, entry.DN); err != nil {
+			return nil, err
+		}
+	}
+	user.Roles = d.Roles(user.Groups)
+	return user, nil
+}
+
+// Roles returns the roles the groups are mapped to
+func (d *Directory) Roles(groups []string) []string {
+	var roles []string
+	for _, group := range groups {
+		role, ok := d.Config.GroupRoles[NormalizeDN(group)]
+		if ok && !contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// ManagedRoles returns every role of the mapping, the directory decides who has them
+func (d *Directory) ManagedRoles() []string {
+	var roles []string
+	for _, role := range d.Config.GroupRoles {
+		if !contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// AllowsFallback reports whether a local account with the roles may log in with its password
+func (d *Directory) AllowsFallback(roles []string) bool {
+	for _, allowed := range d.Config.FallbackRoles {
+		if allowed == "*" || contains(roles, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// connect dials the server, upgrades the connection to TLS and binds as the service account
+func (d *Directory) connect(ctx context.Context) (*Conn, error) {
+	conn, err := Dial(ctx, d.Config.URL, d.Config.TLS, d.Config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if d.Config.StartTLS {
+		if err := conn.StartTLS(d.Config.TLS); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: StartTLS failed: %w", err)
+		}
+	}
+	if d.Config.BindDN != "" {
+		if err := conn.Bind(d.Config.BindDN, d.Config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: failed to bind as %s: %w", d.Config.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// findUser returns the single entry matching the login
+func (d *Directory) findUser(conn *Conn, login string) (*Entry, error) {
+	entries, err := conn.Search(SearchRequest{
+		BaseDN:     d.Config.BaseDN,
+		Scope:      ScopeWholeSubtree,
+		Filter:     strings.ReplaceAll(d.Config.UserFilter, "%s", EscapeFilter(login)),
+		Attributes: []string{"mail", "givenName", "sn", "cn", d.Config.IDAttribute, d.Config.GroupAttribute},
+		SizeLimit:  2,
+	})
+	switch {
+	case IsResult(err, ResultSizeLimitExceeded) || (err == nil && len(entries) > 1):
+		return nil, ErrAmbiguousUser
+	case IsResult(err, ResultNoSuchObject):
+		return nil, ErrUserNotFound
+	case err != nil:
+		return nil, err
+	case len(entries) == 0:
+		return nil, ErrUserNotFound
+	}
+	return entries[0], nil
+}
+
+// findGroups returns the DNs of the groups found with the group filter for the user
+func (d *Directory) findGroups(conn *Conn, userDN string) ([]string, error) {
+	entries, err := conn.Search(SearchRequest{
+		BaseDN:     d.Config.GroupBaseDN,
+		Scope:      ScopeWholeSubtree,
+		Filter:     strings.ReplaceAll(d.Config.GroupFilter, "%s", EscapeFilter(userDN)),
+		Attributes: []string{"1.1"}, // no attributes, only the DNs
+	})
+	if err != nil && !IsResult(err, ResultNoSuchObject) {
+		return nil, err
+	}
+	groups := make([]string, 0, len(entries))
+	for _, e := range entries {
+		groups = append(groups, e.DN)
+	}
+	return groups, nil
+}
+
+// entryID returns the stable id of the entry, Active Directory's objectGUID is binary and hex
+// encoded. Entries without the attribute are identified by their DN.
+func (d *Directory) entryID(entry *Entry) string {
+	id := entry.Get(d.Config.IDAttribute)
+	if id == "" {
+		return NormalizeDN(entry.DN)
+	}
+	if strings.EqualFold(d.Config.IDAttribute, "objectGUID") {
+		return hex.EncodeToString([]byte(id))
+	}
+	return id
+}
+
+// splitList splits a list at sep and drops empty items
+func splitList(s, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
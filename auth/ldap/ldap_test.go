@@ -0,0 +1,251 @@
+//go:build unit
+
+package ldap_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"imperatorapp/auth/ldap"
+	"imperatorapp/auth/ldap/ber"
+	"imperatorapp/auth/ldap/ldaptest"
+	"strings"
+	"testing"
+)
+
+const (
+	baseDN    = "dc=example,dc=com"
+	serviceDN = "cn=portal,ou=services,dc=example,dc=com"
+	adminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+	staffDN   = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+func testEntries() []*ldaptest.Entry {
+	return []*ldaptest.Entry{
+		{DN: serviceDN, Password: "service-secret"},
+		{
+			DN:       "uid=jdoe,ou=people,dc=example,dc=com",
+			Password: "correct horse",
+			Attributes: map[string][]string{
+				"objectClass": {"person", "inetOrgPerson"},
+				"uid":         {"jdoe"},
+				"mail":        {"jdoe@example.com"},
+				"givenName":   {"Jane"},
+				"sn":          {"Doe"},
+				"entryUUID":   {"5b1f6b6e-0000-4000-8000-000000000001"},
+				"memberOf":    {"CN=Admins, OU=Groups, DC=example, DC=com", "cn=other,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			DN:       "uid=rroe,ou=people,dc=example,dc=com",
+			Password: "battery staple",
+			Attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {"rroe"},
+				"mail":        {"rroe@example.com"},
+				"cn":          {"Richard Roe"},
+			},
+		},
+		{
+			DN:         staffDN,
+			Attributes: map[string][]string{"objectClass": {"groupOfNames"}, "member": {"uid=rroe,ou=people,dc=example,dc=com"}},
+		},
+	}
+}
+
+func newTestDirectory(t *testing.T, config ldap.Config) (*ldap.Directory, *ldaptest.Server) {
+	t.Helper()
+	server := ldaptest.NewServer(testEntries()...)
+	t.Cleanup(server.Close)
+	config.URL = server.URL()
+	config.BaseDN = baseDN
+	if config.BindDN == "" {
+		config.BindDN, config.BindPassword = serviceDN, "service-secret"
+	}
+	config.GroupRoles = map[string]string{adminsDN: "super-admin", staffDN: "editor"}
+	return ldap.New(config), server
+}
+
+func TestCompileFilter(t *testing.T) {
+	tests := []string{
+		"(uid=jdoe)",
+		"uid=jdoe",
+		"(&(objectClass=person)(|(mail=jdoe@example.com)(uid=jdoe)))",
+		"(!(uid=jdoe))",
+		"(mail=*)",
+		"(cn=J*n*e)",
+		"(uidNumber>=1000)",
+		"(cn=a\\2ab)",
+	}
+	for _, filter := range tests {
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			t.Errorf("%s: %s", filter, err)
+		}
+	}
+	for _, filter := range []string{"(uid=jdoe", "(=jdoe)", "(&(uid=jdoe)", "(cn=\\2)", "(uid=a)(uid=b)"} {
+		if _, err := ldap.CompileFilter(filter); !errors.Is(err, ldap.ErrFilter) {
+			t.Errorf("%s: expected ErrFilter, got %v", filter, err)
+		}
+	}
+
+	p, _ := ldap.CompileFilter("(cn=" + ldap.EscapeFilter("a*b)(uid=*") + ")")
+	if p.Tag != ldap.FilterEquality || p.Children[1].Str() != "a*b)(uid=*" {
+		t.Error("an escaped value must stay a single equality match")
+	}
+}
+
+func TestBER(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40} {
+		p, err := ber.Parse(ber.Int(ber.TagInteger, n).Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := p.Int(); got != n {
+			t.Errorf("expected %d, got %d", n, got)
+		}
+	}
+	long := ber.String(ber.TagOctetString, strings.Repeat("x", 300))
+	p, err := ber.Parse(ber.Seq(ber.TagSequence, long, ber.Bool(true)).Bytes())
+	if err != nil || len(p.Children) != 2 || len(p.Children[0].Value) != 300 {
+		t.Error("failed to decode a long sequence:", err)
+	}
+	if _, err := ber.Parse([]byte{0x30, 0x05, 0x04, 0x01}); !errors.Is(err, ber.ErrMalformed) {
+		t.Error("expected a truncated packet to be malformed")
+	}
+}
+
+func TestDirectory_Authenticate(t *testing.T) {
+	d, server := newTestDirectory(t, ldap.Config{})
+	ctx := context.Background()
+
+	user, err := d.Authenticate(ctx, "jdoe@example.com", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DN != "uid=jdoe,ou=people,dc=example,dc=com" || user.Email != "jdoe@example.com" || user.FirstName != "Jane" || user.LastName != "Doe" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if user.ID != "5b1f6b6e-0000-4000-8000-000000000001" {
+		t.Errorf("unexpected id %s", user.ID)
+	}
+	if strings.Join(user.Roles, ",") != "super-admin" {
+		t.Errorf("expected the admins group to map to super-admin, got %v", user.Roles)
+	}
+	if binds := server.Binds(); len(binds) != 2 || binds[0] != serviceDN {
+		t.Errorf("expected a service bind and a user bind, got %v", binds)
+	}
+
+	// the uid works as login too and the name falls back to the cn
+	user, err = d.Authenticate(ctx, "rroe", "battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FirstName != "Richard" || user.LastName != "Roe" || user.ID != "uid=rroe,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	if _, err := d.Authenticate(ctx, "jdoe", "wrong"); !errors.Is(err, ldap.ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := d.Authenticate(ctx, "jdoe", ""); !errors.Is(err, ldap.ErrInvalidCredentials) {
+		t.Errorf("an empty password must never bind, got %v", err)
+	}
+	if _, err := d.Authenticate(ctx, "nobody", "x"); !errors.Is(err, ldap.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+	// a wildcard in the login must not match every entry
+	if _, err := d.Authenticate(ctx, "*", "correct horse"); !errors.Is(err, ldap.ErrUserNotFound) {
+		t.Errorf("expected the login to be escaped, got %v", err)
+	}
+}
+
+func TestDirectory_Ambiguous(t *testing.T) {
+	d, _ := newTestDirectory(t, ldap.Config{UserFilter: "(objectClass=person)"})
+	if _, err := d.Authenticate(context.Background(), "jdoe", "correct horse"); !errors.Is(err, ldap.ErrAmbiguousUser) {
+		t.Errorf("expected ErrAmbiguousUser, got %v", err)
+	}
+}
+
+func TestDirectory_GroupFilter(t *testing.T) {
+	d, _ := newTestDirectory(t, ldap.Config{GroupFilter: "(&(objectClass=groupOfNames)(member=%s))"})
+	user, err := d.Authenticate(context.Background(), "rroe", "battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Groups) != 1 || user.Groups[0] != staffDN || strings.Join(user.Roles, ",") != "editor" {
+		t.Errorf("expected the staff group and the editor role, got %v %v", user.Groups, user.Roles)
+	}
+}
+
+func TestDirectory_ServiceAccount(t *testing.T) {
+	d, _ := newTestDirectory(t, ldap.Config{BindDN: serviceDN, BindPassword: "wrong"})
+	_, err := d.Authenticate(context.Background(), "jdoe", "correct horse")
+	if err == nil || errors.Is(err, ldap.ErrInvalidCredentials) || errors.Is(err, ldap.ErrUserNotFound) {
+		t.Errorf("a broken service account must not look like a wrong password, got %v", err)
+	}
+}
+
+func TestDirectory_TLS(t *testing.T) {
+	server := ldaptest.NewTLSServer(testEntries()...)
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	config := ldap.Config{URL: server.URL(), BaseDN: baseDN, BindDN: serviceDN, BindPassword: "service-secret"}
+	config.TLS = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if _, err := ldap.New(config).Authenticate(context.Background(), "jdoe", "correct horse"); err != nil {
+		t.Errorf("failed to authenticate over ldaps: %s", err)
+	}
+
+	config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	if _, err := ldap.New(config).Authenticate(context.Background(), "jdoe", "correct horse"); err == nil {
+		t.Error("expected an untrusted certificate to be rejected")
+	}
+}
+
+func TestDirectory_StartTLS(t *testing.T) {
+	server := ldaptest.NewServer(testEntries()...)
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	config := ldap.Config{URL: server.URL(), StartTLS: true, BaseDN: baseDN, BindDN: serviceDN, BindPassword: "service-secret"}
+	config.TLS = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if _, err := ldap.New(config).Authenticate(context.Background(), "jdoe", "correct horse"); err != nil {
+		t.Errorf("failed to authenticate after StartTLS: %s", err)
+	}
+}
+
+func TestDirectory_Unavailable(t *testing.T) {
+	d, server := newTestDirectory(t, ldap.Config{})
+	server.Close()
+	_, err := d.Authenticate(context.Background(), "jdoe", "correct horse")
+	if err == nil || errors.Is(err, ldap.ErrInvalidCredentials) || errors.Is(err, ldap.ErrUserNotFound) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := ldap.ParseGroupRoles("super-admin=" + adminsDN + "; editor = " + staffDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles[adminsDN] != "super-admin" || roles[staffDN] != "editor" {
+		t.Errorf("unexpected mapping %v", roles)
+	}
+	if _, err := ldap.ParseGroupRoles("super-admin"); err == nil {
+		t.Error("expected a pair without group to be rejected")
+	}
+
+	d := ldap.New(ldap.Config{FallbackRoles: []string{"super-admin"}, GroupRoles: roles})
+	if !d.AllowsFallback([]string{"editor", "super-admin"}) || d.AllowsFallback([]string{"editor"}) {
+		t.Error("only super admins may fall back to local passwords")
+	}
+	if !ldap.New(ldap.Config{FallbackRoles: []string{"*"}}).AllowsFallback(nil) {
+		t.Error("expected * to allow every local account")
+	}
+	if len(d.ManagedRoles()) != 2 {
+		t.Errorf("unexpected managed roles %v", d.ManagedRoles())
+	}
+}
@@ -0,0 +1,436 @@
+// Package ldaptest runs a fake LDAP directory in process for tests and local development. It
+// answers simple binds, searches with the filters of RFC 4515 except extensible matches,
+// StartTLS and unbind, over plain TCP or TLS.
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"imperatorapp/auth/ldap"
+	"imperatorapp/auth/ldap/ber"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultInsufficientAccess is returned for searches before a bind
+const resultInsufficientAccess = 50
+
+// Entry is an entry of the directory, users have a Password to bind with
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is a fake directory. Entries may be changed between requests.
+type Server struct {
+	Listener net.Listener
+	// AnonymousSearch allows searches without a bind
+	AnonymousSearch bool
+
+	mu       sync.Mutex
+	entries  []*Entry
+	binds    []string
+	conns    map[net.Conn]struct{}
+	tls      *tls.Config
+	cert     *x509.Certificate
+	implicit bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a directory serving plain LDAP, StartTLS upgrades connections to TLS
+func NewServer(entries ...*Entry) *Server {
+	return start(false, entries)
+}
+
+// NewTLSServer starts a directory serving LDAP over TLS like an ldaps:// server
+func NewTLSServer(entries ...*Entry) *Server {
+	return start(true, entries)
+}
+
+func start(implicitTLS bool, entries []*Entry) *Server {
+	s := &Server{entries: entries, conns: make(map[net.Conn]struct{}), implicit: implicitTLS}
+	s.tls, s.cert = selfSigned()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("ldaptest: failed to listen: " + err.Error())
+	}
+	if implicitTLS {
+		listener = tls.NewListener(listener, s.tls)
+	}
+	s.Listener = listener
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// URL returns the url to connect to
+func (s *Server) URL() string {
+	if s.implicit {
+		return "ldaps://" + s.Listener.Addr().String()
+	}
+	return "ldap://" + s.Listener.Addr().String()
+}
+
+// Certificate returns the self signed certificate of the server to trust in clients
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// Add adds an entry to the directory
+func (s *Server) Add(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+// Binds returns the DNs of the successful binds so far
+func (s *Server) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.binds...)
+}
+
+// Close stops the server and closes the open connections
+func (s *Server) Close() {
+	s.Listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// session is the state of a connection
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	bound  bool
+}
+
+func (s *Server) handle(conn net.Conn) {
+	sess := &session{conn: conn, reader: bufio.NewReader(conn)}
+	defer func() { sess.conn.Close() }()
+	for {
+		_ = sess.conn.SetDeadline(time.Now().Add(10 * time.Second))
+		message, err := ber.Read(sess.reader)
+		if err != nil || message.Tag != ber.TagSequence || len(message.Children) < 2 {
+			return
+		}
+		id, err := message.Children[0].Int()
+		if err != nil {
+			return
+		}
+		op := message.Children[1]
+		switch op.Tag {
+		case ldap.OpBindRequest:
+			s.bind(sess, id, op)
+		case ldap.OpSearchRequest:
+			s.search(sess, id, op)
+		case ldap.OpExtendedRequest:
+			if !s.extended(sess, id, op) {
+				return
+			}
+		case ldap.OpUnbindRequest:
+			return
+		default:
+			sess.reply(id, ldapResult(ldap.OpExtendedResponse, ldap.ResultProtocolError, "unsupported operation"))
+			return
+		}
+	}
+}
+
+func (s *Server) bind(sess *session, id int64, op *ber.Packet) {
+	if len(op.Children) < 3 || op.Children[2].Tag != ldap.TagSimpleAuth {
+		sess.reply(id, ldapResult(ldap.OpBindResponse, ldap.ResultProtocolError, "only simple binds are supported"))
+		return
+	}
+	dn, password := op.Children[1].Str(), op.Children[2].Str()
+	sess.bound = false
+	if dn == "" && password == "" {
+		sess.reply(id, ldapResult(ldap.OpBindResponse, ldap.ResultSuccess, ""))
+		return
+	}
+
+	s.mu.Lock()
+	var ok bool
+	for _, e := range s.entries {
+		if ldap.NormalizeDN(e.DN) == ldap.NormalizeDN(dn) && e.Password != "" && e.Password == password {
+			ok = true
+			s.binds = append(s.binds, e.DN)
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		sess.reply(id, ldapResult(ldap.OpBindResponse, ldap.ResultInvalidCredentials, "invalid credentials"))
+		return
+	}
+	sess.bound = true
+	sess.reply(id, ldapResult(ldap.OpBindResponse, ldap.ResultSuccess, ""))
+}
+
+func (s *Server) search(sess *session, id int64, op *ber.Packet) {
+	if len(op.Children) < 8 {
+		sess.reply(id, ldapResult(ldap.OpSearchDone, ldap.ResultProtocolError, "malformed search"))
+		return
+	}
+	if !sess.bound && !s.AnonymousSearch {
+		sess.reply(id, ldapResult(ldap.OpSearchDone, resultInsufficientAccess, "bind first"))
+		return
+	}
+	base := ldap.NormalizeDN(op.Children[0].Str())
+	scope, _ := op.Children[1].Int()
+	sizeLimit, _ := op.Children[3].Int()
+	filter := op.Children[6]
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, strings.ToLower(a.Str()))
+	}
+
+	s.mu.Lock()
+	var found []*Entry
+	baseExists := false
+	for _, e := range s.entries {
+		dn := ldap.NormalizeDN(e.DN)
+		if dn == base {
+			baseExists = true
+		}
+		if inScope(dn, base, scope) && matches(e, filter) {
+			found = append(found, e)
+		}
+	}
+	s.mu.Unlock()
+
+	// a missing base is fine when entries are below it, the fake has no entries for every level
+	if !baseExists && len(found) == 0 && base != "" {
+		sess.reply(id, ldapResult(ldap.OpSearchDone, ldap.ResultNoSuchObject, "no such object"))
+		return
+	}
+	for i, e := range found {
+		if sizeLimit > 0 && int64(i) >= sizeLimit {
+			sess.reply(id, ldapResult(ldap.OpSearchDone, ldap.ResultSizeLimitExceeded, ""))
+			return
+		}
+		sess.reply(id, searchEntry(e, attributes))
+	}
+	sess.reply(id, ldapResult(ldap.OpSearchDone, ldap.ResultSuccess, ""))
+}
+
+// extended answers StartTLS, it returns false when the connection has to be closed
+func (s *Server) extended(sess *session, id int64, op *ber.Packet) bool {
+	if len(op.Children) == 0 || op.Children[0].Str() != ldap.StartTLSOID || s.implicit {
+		sess.reply(id, ldapResult(ldap.OpExtendedResponse, ldap.ResultProtocolError, "unsupported extended operation"))
+		return true
+	}
+	sess.reply(id, ldapResult(ldap.OpExtendedResponse, ldap.ResultSuccess, ""))
+	tlsConn := tls.Server(sess.conn, s.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	sess.conn, sess.reader = tlsConn, bufio.NewReader(tlsConn)
+	return true
+}
+
+func (sess *session) reply(id int64, op *ber.Packet) {
+	message := ber.Seq(ber.TagSequence, ber.Int(ber.TagInteger, id), op)
+	_, _ = sess.conn.Write(message.Bytes())
+}
+
+// ldapResult returns an LDAPResult of the operation
+func ldapResult(tag byte, code int64, message string) *ber.Packet {
+	return ber.Seq(tag,
+		ber.Int(ber.TagEnumerated, code),
+		ber.String(ber.TagOctetString, ""),
+		ber.String(ber.TagOctetString, message),
+	)
+}
+
+// searchEntry returns the requested attributes of the entry, all of them when none were named
+func searchEntry(e *Entry, attributes []string) *ber.Packet {
+	list := ber.Seq(ber.TagSequence)
+	for name, values := range e.Attributes {
+		if len(attributes) > 0 && !contains(attributes, strings.ToLower(name)) {
+			continue
+		}
+		set := ber.Seq(ber.TagSet)
+		for _, v := range values {
+			set.Children = append(set.Children, ber.String(ber.TagOctetString, v))
+		}
+		list.Children = append(list.Children, ber.Seq(ber.TagSequence, ber.String(ber.TagOctetString, name), set))
+	}
+	return ber.Seq(ldap.OpSearchEntry, ber.String(ber.TagOctetString, e.DN), list)
+}
+
+// inScope reports whether the normalized dn is in the scope of the search below base
+func inScope(dn, base string, scope int64) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == base
+	case ldap.ScopeSingleLevel:
+		parent := ""
+		if i := strings.IndexByte(dn, ','); i >= 0 {
+			parent = dn[i+1:]
+		}
+		return parent == base
+	default:
+		return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+// matches evaluates the filter for the entry, values compare without case
+func matches(e *Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, c := range filter.Children {
+			if !matches(e, c) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range filter.Children {
+			if matches(e, c) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matches(e, filter.Children[0])
+	case ldap.FilterPresent:
+		return len(values(e, filter.Str())) > 0
+	case ldap.FilterEquality, ldap.FilterApprox, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		want := strings.ToLower(filter.Children[1].Str())
+		for _, v := range values(e, filter.Children[0].Str()) {
+			v = strings.ToLower(v)
+			switch {
+			case filter.Tag == ldap.FilterGreaterOrEqual && v >= want,
+				filter.Tag == ldap.FilterLessOrEqual && v <= want,
+				(filter.Tag == ldap.FilterEquality || filter.Tag == ldap.FilterApprox) && v == want:
+				return true
+			}
+		}
+		return false
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, v := range values(e, filter.Children[0].Str()) {
+			if matchSubstrings(strings.ToLower(v), filter.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		s := strings.ToLower(part.Str())
+		switch part.Tag {
+		case ldap.SubstringInitial:
+			if !strings.HasPrefix(v, s) {
+				return false
+			}
+			v = v[len(s):]
+		case ldap.SubstringAny:
+			i := strings.Index(v, s)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(s):]
+		case ldap.SubstringFinal:
+			if !strings.HasSuffix(v, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// values returns the values of the attribute, the name compares without case
+func values(e *Entry, name string) []string {
+	if strings.EqualFold(name, "dn") || strings.EqualFold(name, "distinguishedName") {
+		return []string{e.DN}
+	}
+	for n, v := range e.Attributes {
+		if strings.EqualFold(n, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSigned returns a TLS config with a new certificate for 127.0.0.1 and localhost
+func selfSigned() (*tls.Config, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("ldaptest: failed to generate key: " + err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ldaptest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic("ldaptest: failed to create certificate: " + err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic("ldaptest: failed to parse certificate: " + err.Error())
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return config, cert
+}
@@ -0,0 +1,92 @@
+package oauth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Error is an OAuth2 error response as defined in RFC 6749, it is sent as json by the token and
+// introspection endpoints and as query parameters to the redirect uri of the client
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	// Status is the http status of a json error response
+	Status int `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return "oauth: " + e.Code
+	}
+	return "oauth: " + e.Code + ": " + e.Description
+}
+
+// the error codes of RFC 6749 and OpenID Connect, each returns an error with the description
+func ErrInvalidRequest(description string) *Error {
+	return &Error{"invalid_request", description, http.StatusBadRequest}
+}
+
+func ErrInvalidClient(description string) *Error {
+	return &Error{"invalid_client", description, http.StatusUnauthorized}
+}
+
+func ErrInvalidGrant(description string) *Error {
+	return &Error{"invalid_grant", description, http.StatusBadRequest}
+}
+
+func ErrUnauthorizedClient(description string) *Error {
+	return &Error{"unauthorized_client", description, http.StatusBadRequest}
+}
+
+func ErrUnsupportedGrantType(description string) *Error {
+	return &Error{"unsupported_grant_type", description, http.StatusBadRequest}
+}
+
+func ErrUnsupportedResponseType(description string) *Error {
+	return &Error{"unsupported_response_type", description, http.StatusBadRequest}
+}
+
+func ErrInvalidScope(description string) *Error {
+	return &Error{"invalid_scope", description, http.StatusBadRequest}
+}
+
+func ErrAccessDenied(description string) *Error {
+	return &Error{"access_denied", description, http.StatusForbidden}
+}
+
+func ErrLoginRequired(description string) *Error {
+	return &Error{"login_required", description, http.StatusBadRequest}
+}
+
+func ErrConsentRequired(description string) *Error {
+	return &Error{"consent_required", description, http.StatusBadRequest}
+}
+
+func ErrServerError(description string) *Error {
+	return &Error{"server_error", description, http.StatusInternalServerError}
+}
+
+// RedirectURL returns the redirect uri with the values added to its query, it is used to send
+// codes and errors back to the client
+func RedirectURL(redirectURI string, values url.Values) string {
+	separator := "?"
+	if strings.Contains(redirectURI, "?") {
+		separator = "&"
+	}
+	return redirectURI + separator + values.Encode()
+}
+
+// ErrorRedirectURL returns the redirect uri carrying the error and the state of the request
+func ErrorRedirectURL(redirectURI, state, issuer string, e *Error) string {
+	values := url.Values{}
+	values.Set("error", e.Code)
+	if e.Description != "" {
+		values.Set("error_description", e.Description)
+	}
+	if state != "" {
+		values.Set("state", state)
+	}
+	values.Set("iss", issuer)
+	return RedirectURL(redirectURI, values)
+}
@@ -0,0 +1,96 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// types of the tokens in the typ header, access tokens follow RFC 9068 so they can not be used
+// as ID tokens and the other way around
+const (
+	typeIDToken     = "JWT"
+	typeAccessToken = "at+jwt"
+)
+
+var (
+	ErrInvalidToken = errors.New("oauth: invalid token")
+	ErrUnknownKey   = errors.New("oauth: token signed with an unknown key")
+	ErrExpired      = errors.New("oauth: token expired")
+)
+
+// header is the JOSE header of the tokens
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Sign returns the claims as a compact RS256 JWS signed with the newest key
+func (s *KeySet) Sign(typ string, claims interface{}) (string, error) {
+	key, err := s.Signing()
+	if err != nil {
+		return "", err
+	}
+	head, err := json.Marshal(header{Alg: "RS256", Typ: typ, Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks that raw was signed by one of the keys with the type and decodes its claims into
+// v, the claims themselves are checked by the caller
+func (s *KeySet) Verify(raw, typ string, v interface{}) error {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: not a compact jws", ErrInvalidToken)
+	}
+	var head header
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if head.Alg != "RS256" || head.Typ != typ {
+		return fmt.Errorf("%w: unexpected %s token signed with %s", ErrInvalidToken, head.Typ, head.Alg)
+	}
+	key, err := s.find(head.Kid)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PrivateKey.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+	if err := decodeSegment(parts[1], v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
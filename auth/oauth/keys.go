@@ -0,0 +1,197 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// keyBits is the size of generated signing keys
+const keyBits = 2048
+
+// keyRefresh is how long loaded keys are used before they are loaded again, so a key rotated by
+// another instance is picked up
+const keyRefresh = time.Minute
+
+// keyActivation is how long a new key is only published before it signs, relying parties that
+// cache the key set have picked it up by then
+const keyActivation = 10 * time.Minute
+
+// ErrNoSigningKey is returned when there is no key to sign tokens with
+var ErrNoSigningKey = errors.New("oauth: no signing key")
+
+// Key is a RSA key the provider signs tokens with
+type Key struct {
+	// ID is the RFC 7638 thumbprint of the public key and the kid of the tokens it signs
+	ID         string
+	PrivateKey *rsa.PrivateKey
+	CreatedAt  time.Time
+}
+
+// JWK is the public part of a signing key as published in the key set
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the published key set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// GenerateKey creates a new signing key
+func GenerateKey() (*Key, error) {
+	private, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ID: thumbprint(&private.PublicKey), PrivateKey: private, CreatedAt: time.Now()}, nil
+}
+
+// MarshalPEM returns the private key as a PKCS #8 PEM block for storage
+func (k *Key) MarshalPEM() (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParseKey reads a key stored with MarshalPEM
+func ParseKey(pemText string, createdAt time.Time) (*Key, error) {
+	block, _ := pem.Decode([]byte(pemText))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("oauth: no private key in pem")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("oauth: signing key is not a rsa key")
+	}
+	return &Key{ID: thumbprint(&private.PublicKey), PrivateKey: private, CreatedAt: createdAt}, nil
+}
+
+// JWK returns the public key for the key set
+func (k *Key) JWK() JWK {
+	n, e := publicParts(&k.PrivateKey.PublicKey)
+	return JWK{Kty: "RSA", Kid: k.ID, Use: "sig", Alg: "RS256", N: n, E: e}
+}
+
+func publicParts(public *rsa.PublicKey) (string, string) {
+	return base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+}
+
+// thumbprint returns the RFC 7638 thumbprint of a public key
+func thumbprint(public *rsa.PublicKey) string {
+	n, e := publicParts(public)
+	// the members are in lexicographic order without whitespace as the rfc requires
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// KeySet holds the keys of the provider. The newest key signs once it has been published for a
+// while, older keys stay published until the tokens they signed have expired. Keys come from load
+// and are cached for a minute.
+type KeySet struct {
+	load func() ([]*Key, error)
+
+	mu       sync.Mutex
+	keys     []*Key
+	loadedAt time.Time
+	now      func() time.Time
+}
+
+// NewKeySet returns a key set loading its keys with load
+func NewKeySet(load func() ([]*Key, error)) *KeySet {
+	return &KeySet{load: load, now: time.Now}
+}
+
+// Keys returns all published keys
+func (s *KeySet) Keys() ([]*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys != nil && s.now().Sub(s.loadedAt) < keyRefresh {
+		return s.keys, nil
+	}
+	keys, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.keys, s.loadedAt = keys, s.now()
+	return keys, nil
+}
+
+// Invalidate makes the next call load the keys again, it is called after a rotation
+func (s *KeySet) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = nil
+}
+
+// Signing returns the newest key that was published long enough, a new key is only used right
+// away when there is no other
+func (s *KeySet) Signing() (*Key, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	activeBefore := s.now().Add(-keyActivation)
+	var newest, active *Key
+	for _, k := range keys {
+		if newest == nil || k.CreatedAt.After(newest.CreatedAt) {
+			newest = k
+		}
+		if k.CreatedAt.Before(activeBefore) && (active == nil || k.CreatedAt.After(active.CreatedAt)) {
+			active = k
+		}
+	}
+	if active != nil {
+		return active, nil
+	}
+	if newest == nil {
+		return nil, ErrNoSigningKey
+	}
+	return newest, nil
+}
+
+// JWKS returns the public keys for the jwks endpoint
+func (s *KeySet) JWKS() (JWKS, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return JWKS{}, err
+	}
+	set := JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.JWK())
+	}
+	return set, nil
+}
+
+// find returns the key with the id
+func (s *KeySet) find(kid string) (*Key, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.ID == kid {
+			return k, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
@@ -0,0 +1,219 @@
+// Package oauth implements the protocol side of the OAuth2 and OpenID Connect provider that lets
+// other apps log their users in with the portal: errors, PKCE, scopes, client authentication,
+// the configuration and the signed ID and access tokens with a rotating key set. Clients, codes
+// and refresh tokens are stored by the models.
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grant types a client can be allowed to use
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// GrantTypes lists the supported grant types
+var GrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials}
+
+// defaults of the lifetimes that can be set in .env
+const (
+	defaultAccessTokenMinutes = 15
+	defaultRefreshTokenDays   = 30
+	defaultKeyRotationDays    = 30
+)
+
+// codeTTL is how long an authorization code can be exchanged, RFC 6749 recommends ten minutes at
+// most and clients exchange it right away
+const codeTTL = time.Minute
+
+// leeway is the clock skew allowed when checking the expiry of tokens
+const leeway = time.Minute
+
+// Server is the configuration of the provider and its keys
+type Server struct {
+	// Issuer is the url of the provider, it is the iss of every token
+	Issuer          string
+	CodeTTL         time.Duration
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// KeyRotation is how long a key signs tokens before a new one is generated
+	KeyRotation time.Duration
+	Keys        *KeySet
+
+	now func() time.Time
+}
+
+// AccessClaims are the claims of a JWT access token as in RFC 9068. The subject is the user id,
+// or the client id for tokens issued with client credentials.
+type AccessClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	JWTID    string `json:"jti"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+// IDClaims are the claims of an ID token, the profile and email claims are only set when their
+// scopes were granted. Without issuer, audience and times they are the userinfo response.
+type IDClaims struct {
+	Issuer        string `json:"iss,omitempty"`
+	Subject       string `json:"sub"`
+	Audience      string `json:"aud,omitempty"`
+	IssuedAt      int64  `json:"iat,omitempty"`
+	Expiry        int64  `json:"exp,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+}
+
+// Discovery is the OpenID Connect discovery document of the provider
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+// FromEnv returns the provider configured in .env, the issuer defaults to the app url. load
+// returns the stored signing keys.
+func FromEnv(appURL string, load func() ([]*Key, error)) *Server {
+	issuer := os.Getenv("OAUTH_ISSUER")
+	if issuer == "" {
+		issuer = appURL
+	}
+	return &Server{
+		Issuer:          strings.TrimSuffix(issuer, "/"),
+		CodeTTL:         codeTTL,
+		AccessTokenTTL:  time.Duration(envInt("OAUTH_ACCESS_TOKEN_MINUTES", defaultAccessTokenMinutes)) * time.Minute,
+		RefreshTokenTTL: time.Duration(envInt("OAUTH_REFRESH_TOKEN_DAYS", defaultRefreshTokenDays)) * 24 * time.Hour,
+		KeyRotation:     time.Duration(envInt("OAUTH_KEY_ROTATION_DAYS", defaultKeyRotationDays)) * 24 * time.Hour,
+		Keys:            NewKeySet(load),
+		now:             time.Now,
+	}
+}
+
+// envInt reads a positive number from .env
+func envInt(name string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// KeyRetention is how long a key stays published after it was created: it signs until the next
+// rotation and then stays until every token it signed has expired
+func (s *Server) KeyRetention() time.Duration {
+	return s.KeyRotation + s.AccessTokenTTL + 24*time.Hour
+}
+
+// Discovery returns the discovery document
+func (s *Server) Discovery() Discovery {
+	return Discovery{
+		Issuer:                            s.Issuer,
+		AuthorizationEndpoint:             s.Issuer + "/oauth/authorize",
+		TokenEndpoint:                     s.Issuer + "/oauth/token",
+		UserinfoEndpoint:                  s.Issuer + "/oauth/userinfo",
+		JWKSURI:                           s.Issuer + "/oauth/jwks",
+		IntrospectionEndpoint:             s.Issuer + "/oauth/introspect",
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               GrantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "email", "email_verified", "name", "given_name", "family_name"},
+		AuthorizationResponseIssParameter: true,
+	}
+}
+
+// IssueAccessToken returns a signed access token for the subject and its claims
+func (s *Server) IssueAccessToken(subject, clientID string, scopes []string) (string, *AccessClaims, error) {
+	jti, err := RandomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.now()
+	claims := &AccessClaims{
+		Issuer:   s.Issuer,
+		Subject:  subject,
+		Audience: clientID,
+		ClientID: clientID,
+		Scope:    strings.Join(scopes, " "),
+		JWTID:    jti,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(s.AccessTokenTTL).Unix(),
+	}
+	token, err := s.Keys.Sign(typeAccessToken, claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// IssueIDToken signs the ID token for the client, issuer and times are filled in
+func (s *Server) IssueIDToken(claims IDClaims) (string, error) {
+	now := s.now()
+	claims.Issuer = s.Issuer
+	claims.IssuedAt = now.Unix()
+	claims.Expiry = now.Add(s.AccessTokenTTL).Unix()
+	return s.Keys.Sign(typeIDToken, claims)
+}
+
+// VerifyAccessToken checks the signature, issuer and expiry of an access token issued by the
+// provider and returns its claims
+func (s *Server) VerifyAccessToken(raw string) (*AccessClaims, error) {
+	var claims AccessClaims
+	if err := s.Keys.Verify(raw, typeAccessToken, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != s.Issuer || claims.Subject == "" || claims.ClientID == "" {
+		return nil, ErrInvalidToken
+	}
+	if s.now().After(time.Unix(claims.Expiry, 0).Add(leeway)) {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+// Scopes returns the granted scopes of the token
+func (c *AccessClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// RandomToken returns 256 random bits base64url encoded, it is used for client secrets,
+// authorization codes and refresh tokens
+func RandomToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
@@ -0,0 +1,215 @@
+//go:build unit
+
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, keys ...*Key) *Server {
+	t.Helper()
+	return &Server{
+		Issuer:         "https://portal.example.com",
+		AccessTokenTTL: 15 * time.Minute,
+		Keys:           NewKeySet(func() ([]*Key, error) { return keys, nil }),
+		now:            time.Now,
+	}
+}
+
+func newTestKey(t *testing.T, age time.Duration) *Key {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.CreatedAt = time.Now().Add(-age)
+	return key
+}
+
+func TestVerifyChallenge(t *testing.T) {
+	verifier := strings.Repeat("a", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	if !ValidChallenge(challenge) {
+		t.Error("expected the challenge to be valid")
+	}
+	if !VerifyChallenge(challenge, "S256", verifier) {
+		t.Error("expected the verifier to match")
+	}
+	if VerifyChallenge(challenge, "plain", verifier) {
+		t.Error("the plain method must not be accepted")
+	}
+	if VerifyChallenge(challenge, "S256", strings.Repeat("b", 43)) {
+		t.Error("another verifier must not match")
+	}
+	if VerifyChallenge(challenge, "S256", "short") {
+		t.Error("a verifier shorter than 43 characters must not match")
+	}
+	if ValidChallenge("not-a-challenge") {
+		t.Error("expected a short challenge to be invalid")
+	}
+}
+
+func TestScopes(t *testing.T) {
+	scopes := ParseScopes("openid  email openid profile")
+	if strings.Join(scopes, " ") != "openid email profile" {
+		t.Errorf("unexpected scopes %v", scopes)
+	}
+	if !Subset([]string{"openid", "email"}, scopes) {
+		t.Error("expected the scopes to be a subset")
+	}
+	if Subset([]string{"openid", "admin"}, scopes) {
+		t.Error("expected admin not to be allowed")
+	}
+	if ValidScope(`bad"scope`) || ValidScope("") {
+		t.Error("expected the scope to be invalid")
+	}
+}
+
+func TestCheckRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri string
+		ok  bool
+	}{
+		{"https://app.example.com/callback", true},
+		{"http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://app.example.com/callback", false},
+		{"https://app.example.com/callback#fragment", false},
+		{"/callback", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		err := CheckRedirectURI(tt.uri)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok %v, got %v", tt.uri, tt.ok, err)
+		}
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	r := httptest.NewRequest("POST", "/oauth/token", nil)
+	r.SetBasicAuth(url.QueryEscape("client"), url.QueryEscape("s3cret/+"))
+	r.PostForm = url.Values{}
+	id, secret, basic, err := ClientCredentials(r)
+	if err != nil || id != "client" || secret != "s3cret/+" || !basic {
+		t.Errorf("unexpected credentials %q %q %v %v", id, secret, basic, err)
+	}
+
+	r.PostForm = url.Values{"client_secret": {"other"}}
+	if _, _, _, err := ClientCredentials(r); err == nil || err.Code != "invalid_request" {
+		t.Errorf("expected invalid_request for two methods, got %v", err)
+	}
+
+	r = httptest.NewRequest("POST", "/oauth/token", nil)
+	r.PostForm = url.Values{"client_id": {"client"}, "client_secret": {"s3cret"}}
+	id, secret, basic, err = ClientCredentials(r)
+	if err != nil || id != "client" || secret != "s3cret" || basic {
+		t.Errorf("unexpected credentials %q %q %v %v", id, secret, basic, err)
+	}
+}
+
+func TestKey_PEM(t *testing.T) {
+	key := newTestKey(t, 0)
+	text, err := key.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseKey(text, key.CreatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ID != key.ID {
+		t.Errorf("expected key id %s, got %s", key.ID, parsed.ID)
+	}
+}
+
+func TestKeySet_Signing(t *testing.T) {
+	if _, err := newTestServer(t).Keys.Signing(); !errors.Is(err, ErrNoSigningKey) {
+		t.Errorf("expected ErrNoSigningKey, got %v", err)
+	}
+
+	old := newTestKey(t, 24*time.Hour)
+	fresh := newTestKey(t, time.Minute)
+	s := newTestServer(t, fresh, old)
+	key, err := s.Keys.Signing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != old.ID {
+		t.Error("a key must be published for a while before it signs")
+	}
+	jwks, err := s.Keys.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Errorf("expected both keys to be published, got %d", len(jwks.Keys))
+	}
+
+	s = newTestServer(t, fresh)
+	if key, err := s.Keys.Signing(); err != nil || key.ID != fresh.ID {
+		t.Error("expected the only key to sign right away")
+	}
+}
+
+func TestServer_AccessToken(t *testing.T) {
+	s := newTestServer(t, newTestKey(t, time.Hour))
+	raw, issued, err := s.IssueAccessToken("42", "client", []string{"openid", "email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.VerifyAccessToken(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.ClientID != "client" || claims.JWTID != issued.JWTID {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if strings.Join(claims.Scopes(), " ") != "openid email" {
+		t.Errorf("unexpected scopes %v", claims.Scopes())
+	}
+
+	// an id token is signed by the same keys but must not pass as an access token
+	id, err := s.IssueIDToken(IDClaims{Subject: "42", Audience: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.VerifyAccessToken(id); err == nil {
+		t.Error("expected an id token to be rejected")
+	}
+
+	parts := strings.Split(raw, ".")
+	if _, err := s.VerifyAccessToken(parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-4] + "AAAA"); err == nil {
+		t.Error("expected a tampered signature to be rejected")
+	}
+
+	other := newTestServer(t, newTestKey(t, time.Hour))
+	if _, err := other.VerifyAccessToken(raw); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+
+	s.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := s.VerifyAccessToken(raw); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestErrorRedirectURL(t *testing.T) {
+	u, err := url.Parse(ErrorRedirectURL("https://app.example.com/cb?x=1", "abc", "https://portal.example.com", ErrAccessDenied("denied")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("x") != "1" || q.Get("error") != "access_denied" || q.Get("state") != "abc" || q.Get("iss") != "https://portal.example.com" {
+		t.Errorf("unexpected redirect %s", u)
+	}
+}
@@ -0,0 +1,141 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// scopes of OpenID Connect, a client may be allowed any other scope the apps behind it check
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// scopeDescriptions explain the OpenID Connect scopes on the consent screen
+var scopeDescriptions = map[string]string{
+	ScopeOpenID:  "Sign you in with your account",
+	ScopeProfile: "See your name",
+	ScopeEmail:   "See your email address",
+}
+
+// scopeToken is the syntax of a single scope in RFC 6749
+var scopeToken = regexp.MustCompile(`^[\x21\x23-\x5B\x5D-\x7E]+$`)
+
+// verifierSyntax is the syntax of a PKCE code verifier in RFC 7636
+var verifierSyntax = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// ErrRedirectURI is returned for redirect uris a client may not register
+var ErrRedirectURI = errors.New("redirect uri must be an absolute https url without fragment, http is only allowed for localhost")
+
+// ParseScopes splits a space separated scope parameter, duplicates are removed
+func ParseScopes(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// ValidScope reports whether s is a syntactically valid scope
+func ValidScope(s string) bool {
+	return scopeToken.MatchString(s)
+}
+
+// Subset reports whether every requested scope is one of the allowed ones
+func Subset(requested, allowed []string) bool {
+	for _, s := range requested {
+		if !contains(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// DescribeScope returns what a scope allows in words for the consent screen
+func DescribeScope(scope string) string {
+	if description, ok := scopeDescriptions[scope]; ok {
+		return description
+	}
+	return "Access " + scope
+}
+
+// VerifyChallenge checks the PKCE code verifier against the challenge of the authorization
+// request, only the S256 method is supported
+func VerifyChallenge(challenge, method, verifier string) bool {
+	if method != "S256" || challenge == "" || !verifierSyntax.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// ValidChallenge reports whether the challenge of an authorization request has the length and
+// alphabet of a S256 challenge
+func ValidChallenge(challenge string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// CheckRedirectURI checks that a client may register the redirect uri
+func CheckRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" || strings.Contains(uri, "#") {
+		return ErrRedirectURI
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if isLoopback(u.Hostname()) {
+			return nil
+		}
+	}
+	return ErrRedirectURI
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ClientCredentials returns the client id and secret a client authenticated the request with,
+// either with http basic auth or in the form body. basic reports which one was used so an
+// invalid_client error can ask for basic auth. The form must be parsed.
+func ClientCredentials(r *http.Request) (id, secret string, basic bool, err *Error) {
+	if user, password, ok := r.BasicAuth(); ok {
+		if r.PostForm.Get("client_secret") != "" {
+			return "", "", true, ErrInvalidRequest("the client authenticated with more than one method")
+		}
+		// basic auth credentials are form encoded before they are put into the header
+		id, errID := url.QueryUnescape(user)
+		secret, errSecret := url.QueryUnescape(password)
+		if errID != nil || errSecret != nil {
+			return "", "", true, ErrInvalidClient("malformed client credentials")
+		}
+		return id, secret, true, nil
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), false, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
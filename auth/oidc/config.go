@@ -0,0 +1,86 @@
+package oidc
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// validName limits provider names to what is safe in urls and env variable names
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Registry holds the configured providers in the order they are shown on the login page
+type Registry struct {
+	providers []*Provider
+}
+
+// NewRegistry returns a registry of the providers
+func NewRegistry(providers ...*Provider) *Registry {
+	return &Registry{providers: providers}
+}
+
+// Get returns the provider with the name
+func (r *Registry) Get(name string) (*Provider, bool) {
+	if r == nil {
+		return nil, false
+	}
+	for _, p := range r.providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// All returns every provider
+func (r *Registry) All() []*Provider {
+	if r == nil {
+		return nil
+	}
+	return r.providers
+}
+
+// FromEnv reads the providers from .env. OIDC_PROVIDERS is a comma separated list of names and
+// each provider is configured with variables named after it, for the provider corp these are
+// OIDC_CORP_ISSUER, OIDC_CORP_CLIENT_ID, OIDC_CORP_CLIENT_SECRET and the optional
+// OIDC_CORP_LABEL, OIDC_CORP_SCOPES, OIDC_CORP_PROVISION and OIDC_CORP_TRUSTED. Callbacks are
+// served below appURL.
+func FromEnv(appURL string) (*Registry, error) {
+	registry := &Registry{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("oidc: invalid provider name %q", name)
+		}
+		if _, exists := registry.Get(name); exists {
+			return nil, fmt.Errorf("oidc: provider %q is configured twice", name)
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		config := Config{
+			Name:         name,
+			Label:        os.Getenv(prefix + "LABEL"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  CallbackURL(appURL, name),
+			Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " ")),
+			Provision:    os.Getenv(prefix+"PROVISION") == "true",
+			Trusted:      os.Getenv(prefix+"TRUSTED") == "true",
+		}
+		if config.Issuer == "" || config.ClientID == "" {
+			return nil, fmt.Errorf("oidc: %sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		registry.providers = append(registry.providers, New(config))
+	}
+	return registry, nil
+}
+
+// CallbackURL returns the redirect uri of the provider to register with the identity provider
+func CallbackURL(appURL, name string) string {
+	return fmt.Sprintf("%s/auth/oidc/%s/callback", strings.TrimSuffix(appURL, "/"), name)
+}
@@ -0,0 +1,211 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // registers SHA384 and SHA512 for the RS, PS and ES algorithms
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minRefresh limits how often the key set is fetched, so tokens with made up key ids can not be
+// used to hammer the provider
+const minRefresh = time.Minute
+
+// jwk is a JSON web key as published in the jwks_uri of the provider
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the signing keys of a provider by key id
+type keySet struct {
+	uri     string
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// get returns the key with the id kid, tokens without a key id can only be used when the
+// provider has a single key
+func (s *keySet) get(kid string) (crypto.PublicKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the key set unless that was done less than minRefresh ago
+func (s *keySet) refresh(ctx context.Context, client *http.Client, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys != nil && now.Sub(s.fetched) < minRefresh {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: failed to fetch keys: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: failed to fetch keys: status %d", res.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(&set); err != nil {
+		return fmt.Errorf("oidc: failed to decode keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// keys of unsupported types are skipped, the provider may publish others for other clients
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	s.keys = keys
+	s.fetched = now
+	return nil
+}
+
+// publicKey parses the key material of an RSA or EC key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || n.BitLen() < 2048 {
+			return nil, errors.New("oidc: weak rsa key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("oidc: ec point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("oidc: invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// algorithm verifies the signatures of one JWS algorithm
+type algorithm struct {
+	hash crypto.Hash
+	// pss selects RSASSA-PSS instead of PKCS #1 v1.5 for rsa keys
+	pss bool
+	// ec is true for ecdsa algorithms, size is the byte length of r and s
+	ec   bool
+	size int
+}
+
+// algorithms are the asymmetric algorithms accepted for ID tokens, none and the HMAC algorithms
+// are missing on purpose
+var algorithms = map[string]algorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"PS256": {hash: crypto.SHA256, pss: true},
+	"PS384": {hash: crypto.SHA384, pss: true},
+	"PS512": {hash: crypto.SHA512, pss: true},
+	"ES256": {hash: crypto.SHA256, ec: true, size: 32},
+	"ES384": {hash: crypto.SHA384, ec: true, size: 48},
+	"ES512": {hash: crypto.SHA512, ec: true, size: 66},
+}
+
+// verify checks the signature of signed with the key, the key type must match the algorithm
+func (a algorithm) verify(key crypto.PublicKey, signed, signature []byte) error {
+	h := a.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	if a.ec {
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || (pub.Curve.Params().BitSize+7)/8 != a.size || len(signature) != 2*a.size {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(signature[:a.size])
+		s := new(big.Int).SetBytes(signature[a.size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrSignature
+		}
+		return nil
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return ErrSignature
+	}
+	var err error
+	if a.pss {
+		err = rsa.VerifyPSS(pub, a.hash, digest, signature, nil)
+	} else {
+		err = rsa.VerifyPKCS1v15(pub, a.hash, digest, signature)
+	}
+	if err != nil {
+		return ErrSignature
+	}
+	return nil
+}
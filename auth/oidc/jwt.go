@@ -0,0 +1,164 @@
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims are the claims of an ID token we use. The email and names may also come from the
+// userinfo endpoint.
+type Claims struct {
+	Issuer          string       `json:"iss"`
+	Subject         string       `json:"sub"`
+	Audience        audience     `json:"aud"`
+	AuthorizedParty string       `json:"azp"`
+	Expiry          int64        `json:"exp"`
+	IssuedAt        int64        `json:"iat"`
+	NotBefore       int64        `json:"nbf"`
+	Nonce           string       `json:"nonce"`
+	Email           string       `json:"email"`
+	EmailVerified   flexibleBool `json:"email_verified"`
+	Name            string       `json:"name"`
+	GivenName       string       `json:"given_name"`
+	FamilyName      string       `json:"family_name"`
+}
+
+// audience is a single audience or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// flexibleBool accepts true and "true", some providers send email_verified as a string
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	switch string(bytes.Trim(data, `"`)) {
+	case "true":
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// header is the JOSE header of an ID token
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// VerifyIDToken checks the signature and the claims of a raw ID token and returns its claims.
+// nonce is the nonce kept in the session for this login.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact jws", ErrInvalidToken)
+	}
+	var head header
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	verifier, ok := algorithms[head.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: algorithm %q is not allowed", ErrInvalidToken, head.Alg)
+	}
+	key, err := p.key(ctx, head.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.verify(key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if err := p.checkClaims(&claims, metadata.Issuer, nonce); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// checkClaims validates the claims of a token with a valid signature
+func (p *Provider) checkClaims(claims *Claims, issuer, nonce string) error {
+	if claims.Issuer != issuer {
+		return ErrIssuer
+	}
+	if !contains(claims.Audience, p.ClientID) {
+		return ErrAudience
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return ErrAudience
+	}
+	now := p.now()
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(leeway)) {
+		return ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if claims.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(claims.IssuedAt, 0)) {
+		return fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	}
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return ErrNonce
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return nil
+}
+
+// key returns the signing key with the id kid. The key set is fetched again when the key is
+// unknown, providers publish new keys before they use them.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	keys := p.keys
+	p.mu.Unlock()
+	if key, ok := keys.get(kid); ok {
+		return key, nil
+	}
+	if err := keys.refresh(ctx, p.Client, p.now()); err != nil {
+		return nil, err
+	}
+	if key, ok := keys.get(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
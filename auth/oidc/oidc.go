@@ -0,0 +1,291 @@
+// Package oidc logs users in with an OpenID Connect identity provider using the authorization
+// code flow with PKCE. Provider metadata comes from discovery and ID tokens are verified against
+// the signing keys the provider publishes.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leeway is the clock skew allowed between us and the provider
+const leeway = time.Minute
+
+// maxResponseSize limits what is read from the provider
+const maxResponseSize = 1 << 20
+
+var (
+	ErrDiscovery     = errors.New("oidc: invalid provider metadata")
+	ErrExchange      = errors.New("oidc: code exchange failed")
+	ErrInvalidToken  = errors.New("oidc: invalid id token")
+	ErrSignature     = errors.New("oidc: invalid id token signature")
+	ErrUnknownKey    = errors.New("oidc: id token signed with an unknown key")
+	ErrIssuer        = errors.New("oidc: id token issuer mismatch")
+	ErrAudience      = errors.New("oidc: id token was not issued for this client")
+	ErrExpired       = errors.New("oidc: id token expired")
+	ErrNonce         = errors.New("oidc: id token nonce mismatch")
+	ErrUserInfo      = errors.New("oidc: userinfo request failed")
+	ErrStateMismatch = errors.New("oidc: state mismatch")
+)
+
+// Config configures one identity provider
+type Config struct {
+	// Name identifies the provider in urls and in linked identities
+	Name string
+	// Label is shown on the login button
+	Label        string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// Provision creates a user on the first login of an unknown email, otherwise only existing
+	// users can log in
+	Provision bool
+	// Trusted links the first login to the account with the same verified email. Without it the
+	// owner has to be logged in to the account to link it, the provider could be used to take
+	// over any account by its email otherwise.
+	Trusted bool
+}
+
+// Metadata is the part of the discovery document we use
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Tokens is the response of the token endpoint
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Provider is a configured identity provider. Metadata and keys are fetched on first use, so an
+// unreachable provider does not stop the app from starting.
+type Provider struct {
+	Config
+	// Client is used for every request to the provider
+	Client *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     *keySet
+	now      func() time.Time
+}
+
+// New returns the provider for the config
+func New(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if !contains(config.Scopes, "openid") {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	if config.Label == "" {
+		config.Label = config.Name
+	}
+	return &Provider{
+		Config: config,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+// Discover returns the metadata of the provider, fetching it on the first call
+func (p *Provider) Discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	var metadata Metadata
+	if err := p.getJSON(ctx, wellKnown, "", &metadata); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrDiscovery, metadata.Issuer, p.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: endpoints are missing", ErrDiscovery)
+	}
+	p.metadata = &metadata
+	p.keys = &keySet{uri: metadata.JWKSURI}
+	return p.metadata, nil
+}
+
+// AuthCodeURL returns the url of the provider the browser is sent to. state and nonce must be
+// kept in the session and the verifier is the PKCE code verifier for the exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", Challenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens, the client authenticates with http basic
+// auth when it has a secret
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*Tokens, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var failure struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		_ = json.Unmarshal(body, &failure)
+		return nil, fmt.Errorf("%w: status %d %s %s", ErrExchange, res.StatusCode, failure.Error, failure.Description)
+	}
+	var tokens Tokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id token in the response", ErrExchange)
+	}
+	return &tokens, nil
+}
+
+// UserInfo fills in the email and names the ID token left out from the userinfo endpoint, some
+// providers only put them there
+func (p *Provider) UserInfo(ctx context.Context, accessToken string, claims *Claims) error {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	if metadata.UserinfoEndpoint == "" {
+		return nil
+	}
+	var info Claims
+	if err := p.getJSON(ctx, metadata.UserinfoEndpoint, accessToken, &info); err != nil {
+		return fmt.Errorf("%w: %v", ErrUserInfo, err)
+	}
+	// the userinfo response must be about the user of the id token
+	if info.Subject != claims.Subject {
+		return fmt.Errorf("%w: subject mismatch", ErrUserInfo)
+	}
+	if claims.Email == "" {
+		claims.Email, claims.EmailVerified = info.Email, info.EmailVerified
+	}
+	if claims.GivenName == "" && claims.FamilyName == "" {
+		claims.GivenName, claims.FamilyName = info.GivenName, info.FamilyName
+	}
+	if claims.Name == "" {
+		claims.Name = info.Name
+	}
+	return nil
+}
+
+// getJSON gets url and decodes the json response into v, bearer is sent as access token when set
+func (p *Provider) getJSON(ctx context.Context, url, bearer string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", res.StatusCode, url)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RandomString returns a random base64url string for state, nonce and the PKCE verifier
+func RandomString() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// Challenge returns the S256 PKCE code challenge for the verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CheckState compares the state returned by the provider with the one kept in the session
+func CheckState(expected, got string) error {
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(got)) != 1 {
+		return ErrStateMismatch
+	}
+	return nil
+}
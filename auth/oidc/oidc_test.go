@@ -0,0 +1,286 @@
+//go:build unit
+
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"imperatorapp/auth/oidc/oidctest"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Server) {
+	t.Helper()
+	idp := oidctest.NewServer("portal", "s3cret/+")
+	t.Cleanup(idp.Close)
+	p := New(Config{
+		Name:         "fake",
+		Issuer:       idp.Issuer(),
+		ClientID:     "portal",
+		ClientSecret: "s3cret/+",
+		RedirectURL:  "http://localhost:4000/auth/oidc/fake/callback",
+	})
+	return p, idp
+}
+
+// login runs the browser part of the flow and returns the tokens of the exchange
+func login(t *testing.T, p *Provider, idp *oidctest.Server, nonce string) *Tokens {
+	t.Helper()
+	ctx := context.Background()
+	state, _ := RandomString()
+	verifier, _ := RandomString()
+	authURL, err := p.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		t.Fatal("failed to build the authorization url:", err)
+	}
+	reply, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatal("authorization failed:", err)
+	}
+	if err := CheckState(state, reply.Get("state")); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := p.Exchange(ctx, reply.Get("code"), verifier)
+	if err != nil {
+		t.Fatal("exchange failed:", err)
+	}
+	return tokens
+}
+
+func TestProvider_Flow(t *testing.T) {
+	p, idp := newTestProvider(t)
+	ctx := context.Background()
+
+	tokens := login(t, p, idp, "nonce-1")
+	claims, err := p.VerifyIDToken(ctx, tokens.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatal("failed to verify the id token:", err)
+	}
+	if claims.Subject != "fake-subject" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// the email may only be available from the userinfo endpoint
+	withoutEmail := &Claims{Subject: claims.Subject}
+	if err := p.UserInfo(ctx, tokens.AccessToken, withoutEmail); err != nil {
+		t.Fatal("userinfo failed:", err)
+	}
+	if withoutEmail.Email != "user@example.com" || withoutEmail.GivenName != "Fake" {
+		t.Errorf("userinfo did not fill in the claims: %+v", withoutEmail)
+	}
+	other := &Claims{Subject: "someone-else"}
+	if err := p.UserInfo(ctx, tokens.AccessToken, other); !errors.Is(err, ErrUserInfo) {
+		t.Error("expected a subject mismatch, got", err)
+	}
+}
+
+func TestProvider_AuthCodeURL(t *testing.T) {
+	p, _ := newTestProvider(t)
+	authURL, err := p.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	sum := sha256.Sum256([]byte("verifier"))
+	if q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) || q.Get("code_challenge_method") != "S256" {
+		t.Error("missing or wrong pkce challenge:", q)
+	}
+	if q.Get("scope") != "openid email profile" || q.Get("state") != "state" || q.Get("nonce") != "nonce" {
+		t.Error("unexpected query:", q)
+	}
+}
+
+func TestProvider_ExchangeRejections(t *testing.T) {
+	p, idp := newTestProvider(t)
+	ctx := context.Background()
+
+	state, verifier := "state", "the-right-verifier"
+	authURL, _ := p.AuthCodeURL(ctx, state, "nonce", verifier)
+	reply, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(ctx, reply.Get("code"), "a-wrong-verifier"); !errors.Is(err, ErrExchange) {
+		t.Error("expected the exchange to fail for a wrong verifier, got", err)
+	}
+	// the code was used up by the failed attempt
+	if _, err := p.Exchange(ctx, reply.Get("code"), verifier); !errors.Is(err, ErrExchange) {
+		t.Error("expected a used code to be rejected, got", err)
+	}
+
+	reply, _ = idp.Authorize(authURL)
+	p.ClientSecret = "wrong"
+	if _, err := p.Exchange(ctx, reply.Get("code"), verifier); !errors.Is(err, ErrExchange) {
+		t.Error("expected a wrong client secret to be rejected, got", err)
+	}
+
+	if err := CheckState("expected", "forged"); !errors.Is(err, ErrStateMismatch) {
+		t.Error("expected a state mismatch, got", err)
+	}
+	if err := CheckState("", ""); !errors.Is(err, ErrStateMismatch) {
+		t.Error("expected an empty state to be rejected, got", err)
+	}
+}
+
+func TestProvider_VerifyRejections(t *testing.T) {
+	p, idp := newTestProvider(t)
+	ctx := context.Background()
+	user := oidctest.User{Subject: "sub", Email: "user@example.com", EmailVerified: true}
+
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+		want   error
+	}{
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, ErrIssuer},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, ErrAudience},
+		{"foreign azp", func(c map[string]interface{}) { c["aud"] = []string{"portal", "other"}; c["azp"] = "other" }, ErrAudience},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, ErrExpired},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, ErrExpired},
+		{"future", func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }, ErrInvalidToken},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }, ErrNonce},
+		{"no subject", func(c map[string]interface{}) { c["sub"] = "" }, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		claims := idp.IDTokenClaims(user, "nonce")
+		tt.change(claims)
+		if _, err := p.VerifyIDToken(ctx, idp.SignIDToken(claims), "nonce"); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// multiple audiences are fine when we are the authorized party
+	claims := idp.IDTokenClaims(user, "nonce")
+	claims["aud"], claims["azp"] = []string{"portal", "other"}, "portal"
+	if _, err := p.VerifyIDToken(ctx, idp.SignIDToken(claims), "nonce"); err != nil {
+		t.Error("token for multiple audiences rejected:", err)
+	}
+
+	valid := idp.SignIDToken(idp.IDTokenClaims(user, "nonce"))
+	parts := strings.Split(valid, ".")
+	tampered := idp.IDTokenClaims(user, "nonce")
+	tampered["email"] = "admin@example.com"
+	body, _ := json.Marshal(tampered)
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(body) + "." + parts[2]
+	if _, err := p.VerifyIDToken(ctx, forged, "nonce"); !errors.Is(err, ErrSignature) {
+		t.Error("expected a tampered token to fail, got", err)
+	}
+
+	none, _ := json.Marshal(map[string]string{"alg": "none"})
+	unsigned := base64.RawURLEncoding.EncodeToString(none) + "." + parts[1] + "."
+	if _, err := p.VerifyIDToken(ctx, unsigned, "nonce"); !errors.Is(err, ErrInvalidToken) {
+		t.Error("expected alg none to be rejected, got", err)
+	}
+	if _, err := p.VerifyIDToken(ctx, "not-a-token", "nonce"); !errors.Is(err, ErrInvalidToken) {
+		t.Error("expected garbage to be rejected, got", err)
+	}
+}
+
+func TestProvider_KeyRotation(t *testing.T) {
+	p, idp := newTestProvider(t)
+	ctx := context.Background()
+	user := oidctest.User{Subject: "sub"}
+
+	if _, err := p.VerifyIDToken(ctx, idp.SignIDToken(idp.IDTokenClaims(user, "n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	idp.RotateKey()
+	// the new key id is unknown, but the keys were fetched moments ago
+	if _, err := p.VerifyIDToken(ctx, idp.SignIDToken(idp.IDTokenClaims(user, "n")), "n"); !errors.Is(err, ErrUnknownKey) {
+		t.Error("expected the key set not to be fetched again right away, got", err)
+	}
+	p.now = func() time.Time { return time.Now().Add(2 * minRefresh) }
+	if _, err := p.VerifyIDToken(ctx, idp.SignIDToken(idp.IDTokenClaims(user, "n")), "n"); err != nil {
+		t.Error("token signed with the rotated key rejected:", err)
+	}
+}
+
+func TestAlgorithm_ES256(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signed := []byte("header.payload")
+	digest := sha256.Sum256(signed)
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	jwk := jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+	pub, err := jwk.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := algorithms["ES256"].verify(pub, signed, signature); err != nil {
+		t.Error("valid ES256 signature rejected:", err)
+	}
+	if err := algorithms["RS256"].verify(pub, signed, signature); !errors.Is(err, ErrSignature) {
+		t.Error("expected an ec key to be rejected for RS256")
+	}
+	signature[5] ^= 0xff
+	if err := algorithms["ES256"].verify(pub, signed, signature); !errors.Is(err, ErrSignature) {
+		t.Error("expected a broken ES256 signature to fail")
+	}
+
+	weak := jwk
+	weak.Kty, weak.N, weak.E = "RSA", base64.RawURLEncoding.EncodeToString(big.NewInt(3233).Bytes()), "AQAB"
+	if _, err := weak.publicKey(); err == nil {
+		t.Error("expected a weak rsa key to be rejected")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "corp, google-ws")
+	t.Setenv("OIDC_CORP_ISSUER", "https://login.example.com")
+	t.Setenv("OIDC_CORP_CLIENT_ID", "portal")
+	t.Setenv("OIDC_CORP_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_CORP_LABEL", "Example Corp")
+	t.Setenv("OIDC_CORP_PROVISION", "true")
+	t.Setenv("OIDC_CORP_TRUSTED", "true")
+	t.Setenv("OIDC_GOOGLE_WS_ISSUER", "https://accounts.google.com")
+	t.Setenv("OIDC_GOOGLE_WS_CLIENT_ID", "id")
+	t.Setenv("OIDC_GOOGLE_WS_SCOPES", "email,profile")
+
+	registry, err := FromEnv("http://localhost:4000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.All()) != 2 {
+		t.Fatal("expected 2 providers, got", len(registry.All()))
+	}
+	corp, ok := registry.Get("corp")
+	if !ok || corp.Label != "Example Corp" || !corp.Provision || !corp.Trusted || corp.RedirectURL != "http://localhost:4000/auth/oidc/corp/callback" {
+		t.Errorf("unexpected corp provider %+v", corp)
+	}
+	google, _ := registry.Get("google-ws")
+	if google.Label != "google-ws" || google.Provision || google.Trusted || strings.Join(google.Scopes, " ") != "openid email profile" {
+		t.Errorf("unexpected google provider %+v", google.Config)
+	}
+
+	t.Setenv("OIDC_PROVIDERS", "broken")
+	if _, err := FromEnv("http://localhost:4000"); err == nil {
+		t.Error("expected a provider without issuer to fail")
+	}
+	t.Setenv("OIDC_PROVIDERS", "../evil")
+	if _, err := FromEnv("http://localhost:4000"); err == nil {
+		t.Error("expected an invalid name to fail")
+	}
+	t.Setenv("OIDC_PROVIDERS", "")
+	if registry, err := FromEnv("http://localhost:4000"); err != nil || len(registry.All()) != 0 {
+		t.Error("expected no providers, got", registry.All(), err)
+	}
+}
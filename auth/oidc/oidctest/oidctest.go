@@ -0,0 +1,321 @@
+// Package oidctest runs a fake OpenID Connect provider on httptest for tests and local
+// development. It implements discovery, the authorization code flow with PKCE, the token,
+// userinfo and jwks endpoints and signs ID tokens with RS256.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is who the fake provider logs in
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// Server is a fake identity provider. Set User before a login to choose who logs in and Claims
+// to tamper with the next ID tokens.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	User         User
+	// Claims, when set, may change the claims of an ID token before it is signed
+	Claims func(claims map[string]interface{})
+
+	mu     sync.Mutex
+	keys   []*signingKey
+	codes  map[string]grant
+	tokens map[string]User
+}
+
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// grant is an issued authorization code
+type grant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	user        User
+}
+
+// NewServer starts a fake provider for the client, call Close when done
+func NewServer(clientID, clientSecret string) *Server {
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		User: User{
+			Subject:       "fake-subject",
+			Email:         "user@example.com",
+			EmailVerified: true,
+			GivenName:     "Fake",
+			FamilyName:    "User",
+		},
+		codes:  map[string]grant{},
+		tokens: map[string]User{},
+	}
+	s.RotateKey()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/userinfo", s.userinfo)
+	mux.HandleFunc("/jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Issuer returns the issuer identifier of the provider
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// RotateKey adds a new signing key and signs the next tokens with it, older keys stay published
+func (s *Server) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, &signingKey{kid: fmt.Sprintf("key-%d", len(s.keys)+1), key: key})
+}
+
+// Authorize follows the browser to the authorization endpoint and returns the query of the
+// redirect back to the client, with code and state or an error
+func (s *Server) Authorize(authURL string) (url.Values, error) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	res, err := client.Get(authURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("oidctest: authorization failed with status %d", res.StatusCode)
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+	return location.Query(), nil
+}
+
+// SignIDToken signs claims with the current key, it is used to build tokens the provider would
+// never issue
+func (s *Server) SignIDToken(claims map[string]interface{}) string {
+	s.mu.Lock()
+	current := s.keys[len(s.keys)-1]
+	s.mu.Unlock()
+	return Sign(current.key, current.kid, claims)
+}
+
+// Sign returns a compact RS256 JWS of the claims
+func Sign(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	head, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// IDTokenClaims returns the claims of an ID token for the user
+func (s *Server) IDTokenClaims(user User, nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            s.Issuer(),
+		"sub":            user.Subject,
+		"aud":            s.ClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"given_name":     user.GivenName,
+		"family_name":    user.FamilyName,
+	}
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.Issuer(),
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"userinfo_endpoint":                     s.URL + "/userinfo",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+	if q.Get("client_id") != s.ClientID || redirectURI == "" {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	reply := url.Values{}
+	reply.Set("state", q.Get("state"))
+	switch {
+	case q.Get("response_type") != "code":
+		reply.Set("error", "unsupported_response_type")
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		reply.Set("error", "invalid_request")
+	case !strings.Contains(" "+q.Get("scope")+" ", " openid "):
+		reply.Set("error", "invalid_scope")
+	default:
+		code := randomString()
+		s.mu.Lock()
+		s.codes[code] = grant{
+			redirectURI: redirectURI,
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			user:        s.User,
+		}
+		s.mu.Unlock()
+		reply.Set("code", code)
+	}
+	target.RawQuery = reply.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != s.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(s.ClientSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oidctest"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.Form.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	code := r.Form.Get("code")
+	s.mu.Lock()
+	g, ok := s.codes[code]
+	// codes are single use, even when the exchange fails
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !ok || g.redirectURI != r.Form.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	claims := s.IDTokenClaims(g.user, g.nonce)
+	if s.Claims != nil {
+		s.Claims(claims)
+	}
+	accessToken := randomString()
+	s.mu.Lock()
+	s.tokens[accessToken] = g.user
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     s.SignIDToken(claims),
+	})
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	user, ok := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":            user.Subject,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"given_name":     user.GivenName,
+		"family_name":    user.FamilyName,
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]map[string]string, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": k.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	randomBytes := make([]byte, 24)
+	if _, err := rand.Read(randomBytes); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes)
+}
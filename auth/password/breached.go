@@ -0,0 +1,209 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// commonPasswords is the built in list of the most used passwords, one per line
+//
+//go:embed common.txt
+var commonPasswords []byte
+
+// bloomFalsePositives is the rate of good passwords a bloom filter rejects by mistake
+const bloomFalsePositives = 0.001
+
+// Checker finds passwords that are known from data breaches
+type Checker interface {
+	Breached(password string) (bool, error)
+}
+
+// Checkers asks every checker in turn
+type Checkers []Checker
+
+// Breached reports whether any of the checkers knows the password
+func (c Checkers) Breached(password string) (bool, error) {
+	for _, checker := range c {
+		breached, err := checker.Breached(password)
+		if err != nil || breached {
+			return breached, err
+		}
+	}
+	return false, nil
+}
+
+var (
+	common     *Bloom
+	commonErr  error
+	commonOnce sync.Once
+)
+
+// Common returns the bloom filter of the built in list of common passwords
+func Common() (*Bloom, error) {
+	commonOnce.Do(func() {
+		common, commonErr = LoadList(bytes.NewReader(commonPasswords))
+	})
+	return common, commonErr
+}
+
+// Open returns the checker for a list file or for a directory of range files
+func Open(path string) (Checker, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return RangeDir(path), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadList(file)
+}
+
+// Digest returns the sha1 of the password, breach lists like Have I Been Pwned identify passwords
+// by it
+func Digest(password string) [sha1.Size]byte {
+	return sha1.Sum([]byte(password))
+}
+
+// Bloom is a bloom filter of password digests. It can tell for sure that a password is not in
+// the list and is wrong about a password being in it at the rate it was built for, in a fraction
+// of the memory the list needs.
+type Bloom struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// NewBloom returns an empty filter sized for n passwords with the false positive rate
+func NewBloom(n int, falsePositives float64) *Bloom {
+	if n < 1 {
+		n = 1
+	}
+	size := uint64(math.Ceil(-float64(n) * math.Log(falsePositives) / (math.Ln2 * math.Ln2)))
+	hashes := int(math.Round(float64(size) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &Bloom{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+// LoadList builds a filter from a list with one entry per line. An entry is either a sha1 in hex,
+// optionally followed by :count like in the Have I Been Pwned downloads, or a plain password.
+// Empty lines and lines starting with # are skipped.
+func LoadList(r io.Reader) (*Bloom, error) {
+	var digests [][sha1.Size]byte
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, ok := parseDigest(line)
+		if !ok {
+			digest = Digest(line)
+		}
+		digests = append(digests, digest)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	bloom := NewBloom(len(digests), bloomFalsePositives)
+	for _, digest := range digests {
+		bloom.AddDigest(digest)
+	}
+	return bloom, nil
+}
+
+// parseDigest reads a line of a hash list, sha1 in hex with an optional :count
+func parseDigest(line string) ([sha1.Size]byte, bool) {
+	var digest [sha1.Size]byte
+	hash, _, _ := strings.Cut(line, ":")
+	if len(hash) != hex.EncodedLen(sha1.Size) {
+		return digest, false
+	}
+	if _, err := hex.Decode(digest[:], []byte(hash)); err != nil {
+		return digest, false
+	}
+	return digest, true
+}
+
+// Add puts the password into the filter
+func (b *Bloom) Add(password string) {
+	b.AddDigest(Digest(password))
+}
+
+// AddDigest puts the password with the sha1 into the filter
+func (b *Bloom) AddDigest(digest [sha1.Size]byte) {
+	h1, h2 := bloomHashes(digest)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Breached reports whether the password is probably in the filter
+func (b *Bloom) Breached(password string) (bool, error) {
+	h1, h2 := bloomHashes(Digest(password))
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// bloomHashes derives the two hashes of the double hashing scheme from the digest, a sha1 is
+// evenly distributed already so its bytes can be used as they are
+func bloomHashes(digest [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(digest[0:8]), binary.BigEndian.Uint64(digest[8:16]) | 1
+}
+
+// RangeDir is a directory of range files like the Have I Been Pwned downloader writes them. The
+// file named after the first five hex digits of a sha1 lists the remaining digits of every
+// breached password with that prefix, one SUFFIX:COUNT per line. Only one file is read per check
+// so the full corpus does not have to fit into memory.
+type RangeDir string
+
+// Breached looks up the password in its range file, a missing file means no password with the
+// prefix is known
+func (d RangeDir) Breached(password string) (bool, error) {
+	digest := Digest(password)
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	file, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("password: failed to read range file %s: %w", prefix, err)
+	}
+	return false, nil
+}
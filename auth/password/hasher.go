@@ -0,0 +1,173 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned for a stored hash none of the hashers can read
+var ErrUnknownHash = errors.New("password: unknown hash format")
+
+// Hasher hashes new passwords with the algorithm and cost it was configured with
+type Hasher interface {
+	// Hash returns the encoded hash of the password, it holds everything needed to verify it
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether the hash was made with another algorithm or a lower cost
+	NeedsRehash(hash string) bool
+}
+
+// HasherFromEnv returns the hasher configured with PASSWORD_HASHER in .env, bcrypt or argon2id,
+// with BCRYPT_COST or ARGON2_MEMORY, ARGON2_TIME and ARGON2_THREADS
+func HasherFromEnv() (Hasher, error) {
+	switch algorithm := strings.ToLower(os.Getenv("PASSWORD_HASHER")); algorithm {
+	case "", "bcrypt":
+		hasher := DefaultBcrypt
+		if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil {
+			if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+				return nil, fmt.Errorf("password: BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+			}
+			hasher.Cost = cost
+		}
+		return hasher, nil
+	case "argon2id":
+		hasher := DefaultArgon2id
+		if n, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil && n > 0 {
+			hasher.Memory = uint32(n)
+		}
+		if n, err := strconv.ParseUint(os.Getenv("ARGON2_TIME"), 10, 32); err == nil && n > 0 {
+			hasher.Time = uint32(n)
+		}
+		if n, err := strconv.ParseUint(os.Getenv("ARGON2_THREADS"), 10, 8); err == nil && n > 0 {
+			hasher.Threads = uint8(n)
+		}
+		return hasher, nil
+	default:
+		return nil, fmt.Errorf("password: unknown PASSWORD_HASHER %q", algorithm)
+	}
+}
+
+// Verify reports whether the password matches the hash made by any of the hashers, the
+// parameters are read from the hash so it does not matter how the hashers are configured
+func Verify(hash, password string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// isBcrypt reports whether the hash is in the modular crypt format of bcrypt
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Bcrypt hashes with bcrypt at the cost
+type Bcrypt struct {
+	Cost int
+}
+
+// DefaultBcrypt is the cost passwords were always hashed with
+var DefaultBcrypt = Bcrypt{Cost: 12}
+
+// Hash returns the bcrypt hash of the password
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+// NeedsRehash reports whether the hash is not bcrypt or has a lower cost
+func (b Bcrypt) NeedsRehash(hash string) bool {
+	if !isBcrypt(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
+
+// Argon2id hashes with argon2id, the hashes are PHC strings like
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key with salt and key in unpadded base64
+type Argon2id struct {
+	// Memory is in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	// SaltLength and KeyLength are in bytes
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// DefaultArgon2id follows the second recommendation of RFC 9106 with 64 MiB of memory
+var DefaultArgon2id = Argon2id{Memory: 64 * 1024, Time: 3, Threads: 4, SaltLength: 16, KeyLength: 32}
+
+// Hash returns the PHC string of the argon2id hash of the password with a random salt
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// NeedsRehash reports whether the hash is not argon2id or uses less memory, time or key length
+func (a Argon2id) NeedsRehash(hash string) bool {
+	params, _, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Memory < a.Memory || params.Time < a.Time || uint32(len(key)) < a.KeyLength
+}
+
+// decodeArgon2id reads the parameters, salt and key of a PHC string
+func decodeArgon2id(hash string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	parts := strings.Split(hash, "$")
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("password: unsupported argon2 version %q", parts[2])
+	}
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &threads); err != nil {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2 parameters %q", parts[3])
+	}
+	if params.Memory == 0 || params.Time == 0 || threads == 0 || threads > 255 {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2 parameters %q", parts[3])
+	}
+	params.Threads = uint8(threads)
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2 key: %v", err)
+	}
+	params.SaltLength, params.KeyLength = uint32(len(salt)), uint32(len(key))
+	return params, salt, key, nil
+}
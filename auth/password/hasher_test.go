@@ -0,0 +1,131 @@
+//go:build unit
+
+package password
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// TestArgon2id_Reference checks the hashes against the argon2id test vector of the reference
+// implementation, the vector of RFC 9106 needs a secret and associated data argon2.IDKey does not take
+func TestArgon2id_Reference(t *testing.T) {
+	key := argon2.IDKey([]byte("password"), []byte("somesalt"), 2, 65536, 1, 32)
+	expected := "09316115d5cf24ed5a15a31a3ba326e5cf32edc24702987c02b6566f61913cf7"
+	if got := hex.EncodeToString(key); got != expected {
+		t.Errorf("expected tag %s, got %s", expected, got)
+	}
+	hash := "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	if ok, err := Verify(hash, "password"); !ok || err != nil {
+		t.Errorf("expected the reference hash to match, got %v %v", ok, err)
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	hasher := Argon2id{Memory: 64, Time: 1, Threads: 2, SaltLength: 16, KeyLength: 32}
+	hash, err := hasher.Hash("Tr0ub4dor&3x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=2$") {
+		t.Errorf("unexpected PHC string %s", hash)
+	}
+	if ok, err := Verify(hash, "Tr0ub4dor&3x"); !ok || err != nil {
+		t.Errorf("expected the password to match, got %v %v", ok, err)
+	}
+	if ok, err := Verify(hash, "Tr0ub4dor&3y"); ok || err != nil {
+		t.Errorf("expected a mismatch, got %v %v", ok, err)
+	}
+	if other, _ := hasher.Hash("Tr0ub4dor&3x"); other == hash {
+		t.Error("expected a new salt for every hash")
+	}
+
+	if hasher.NeedsRehash(hash) {
+		t.Error("a hash with the configured parameters does not need a rehash")
+	}
+	stronger := hasher
+	stronger.Memory = 128
+	if !stronger.NeedsRehash(hash) {
+		t.Error("expected a rehash for more memory")
+	}
+	if (Argon2id{Memory: 32, Time: 1, KeyLength: 16}).NeedsRehash(hash) {
+		t.Error("a stronger hash must not be rehashed to weaker parameters")
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	hash, err := Bcrypt{Cost: 4}.Hash("Tr0ub4dor&3x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Verify(hash, "Tr0ub4dor&3x"); !ok || err != nil {
+		t.Errorf("expected the password to match, got %v %v", ok, err)
+	}
+	if ok, err := Verify(hash, "wrong"); ok || err != nil {
+		t.Errorf("expected a mismatch, got %v %v", ok, err)
+	}
+	if (Bcrypt{Cost: 4}).NeedsRehash(hash) {
+		t.Error("a hash at the configured cost does not need a rehash")
+	}
+	if !(Bcrypt{Cost: 5}).NeedsRehash(hash) {
+		t.Error("expected a rehash for a higher cost")
+	}
+
+	// switching the algorithm rehashes on the next login
+	if !(Argon2id{Memory: 64, Time: 1, Threads: 1, KeyLength: 32}).NeedsRehash(hash) {
+		t.Error("expected a bcrypt hash to be rehashed with argon2id")
+	}
+	argon, _ := Argon2id{Memory: 64, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}.Hash("x")
+	if !(Bcrypt{Cost: 4}).NeedsRehash(argon) {
+		t.Error("expected an argon2id hash to be rehashed with bcrypt")
+	}
+}
+
+func TestVerify_Invalid(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"plain",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2id$v=19$m=64,t=1,p=1$!!$a2V5",
+	} {
+		if ok, err := Verify(hash, "x"); ok || err == nil {
+			t.Errorf("%q: expected an error, got %v %v", hash, ok, err)
+		}
+	}
+}
+
+func TestHasherFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_HASHER", "")
+	t.Setenv("BCRYPT_COST", "")
+	if hasher, err := HasherFromEnv(); err != nil || hasher != DefaultBcrypt {
+		t.Errorf("expected the default bcrypt hasher, got %v %v", hasher, err)
+	}
+	t.Setenv("BCRYPT_COST", "40")
+	if _, err := HasherFromEnv(); err == nil {
+		t.Error("expected an error for a cost out of range")
+	}
+
+	t.Setenv("PASSWORD_HASHER", "argon2id")
+	t.Setenv("ARGON2_MEMORY", "19456")
+	t.Setenv("ARGON2_TIME", "2")
+	t.Setenv("ARGON2_THREADS", "1")
+	hasher, err := HasherFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Argon2id{Memory: 19456, Time: 2, Threads: 1, SaltLength: 16, KeyLength: 32}
+	if hasher != expected {
+		t.Errorf("expected %+v, got %+v", expected, hasher)
+	}
+
+	t.Setenv("PASSWORD_HASHER", "scrypt")
+	if _, err := HasherFromEnv(); err == nil {
+		t.Error("expected an error for an unknown hasher")
+	}
+}
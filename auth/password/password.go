@@ -0,0 +1,152 @@
+package password
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/arc41t3ct/imperator"
+)
+
+// MaxBytes is the longest password bcrypt can hash, longer passwords are rejected instead of
+// being cut off silently
+const MaxBytes = 72
+
+// minPersonalLength is the shortest part of the email or name that may not be in a password,
+// shorter parts would reject too many good passwords
+const minPersonalLength = 3
+
+// Policy is what a new password has to look like
+type Policy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// Classes is how many of lower case, upper case, digits and symbols must be used
+	Classes int
+	// History is the number of previous passwords, the current one included, that can not be
+	// used again
+	History int
+	// Breached finds passwords known from data breaches, nil turns the check off
+	Breached Checker
+}
+
+// DefaultPolicy is used for settings missing in .env
+var DefaultPolicy = Policy{MinLength: 8, Classes: 1, History: 5}
+
+// Subject is the user a password is meant for
+type Subject struct {
+	Email     string
+	FirstName string
+	LastName  string
+	// Hashes are the hashes of the current and the previous passwords, newest first
+	Hashes []string
+}
+
+// FromEnv returns the policy configured with PASSWORD_MIN_LENGTH, PASSWORD_CHARACTER_CLASSES,
+// PASSWORD_HISTORY and PASSWORD_BREACHED_LIST in .env. Passwords are always checked against the
+// built in list of common passwords, PASSWORD_BREACHED_LIST adds a list file or a directory of
+// range files.
+func FromEnv() (*Policy, error) {
+	policy := DefaultPolicy
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		policy.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_CHARACTER_CLASSES")); err == nil && n > 0 && n <= 4 {
+		policy.Classes = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_HISTORY")); err == nil && n >= 0 {
+		policy.History = n
+	}
+	common, err := Common()
+	if err != nil {
+		return nil, err
+	}
+	checkers := Checkers{common}
+	if path := strings.TrimSpace(os.Getenv("PASSWORD_BREACHED_LIST")); path != "" {
+		list, err := Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("password: failed to load PASSWORD_BREACHED_LIST: %w", err)
+		}
+		checkers = append(checkers, list)
+	}
+	policy.Breached = checkers
+	return &policy, nil
+}
+
+// Validate adds an error for field to the validator when the password breaks the policy. The
+// expensive checks only run for passwords that passed the others. An error means the breached
+// list could not be read, the password is not rejected for it.
+func (p *Policy) Validate(v *imperator.Validation, field, password string, s Subject) error {
+	length := utf8.RuneCountInString(password)
+	v.Check(length >= p.MinLength, field, fmt.Sprintf("Password must be at least %d characters long", p.MinLength))
+	v.Check(len(password) <= MaxBytes, field, fmt.Sprintf("Password must not be longer than %d bytes", MaxBytes))
+	v.Check(Classes(password) >= p.Classes, field, fmt.Sprintf("Password must use at least %d of lower case letters, upper case letters, digits and symbols", p.Classes))
+	if part := personalPart(password, s); part != "" {
+		v.AddError(field, "Password must not contain your name or email")
+	}
+	if _, failed := v.Errors[field]; failed {
+		return nil
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Breached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			v.AddError(field, "This password has appeared in a data breach, please choose another one")
+			return nil
+		}
+	}
+	for i, hash := range s.Hashes {
+		if i >= p.History {
+			break
+		}
+		if matches, _ := Verify(hash, password); matches {
+			v.AddError(field, fmt.Sprintf("Password must not be one of your last %d passwords", p.History))
+			break
+		}
+	}
+	return nil
+}
+
+// Classes returns how many of lower case, upper case, digits and symbols the password uses
+func Classes(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// personalPart returns the part of the email or name found in the password or ""
+func personalPart(password string, s Subject) string {
+	password = strings.ToLower(password)
+	local := strings.ToLower(s.Email)
+	if at := strings.LastIndex(local, "@"); at >= 0 {
+		local = local[:at]
+	}
+	parts := []string{local, strings.ToLower(s.FirstName), strings.ToLower(s.LastName)}
+	// john.doe+work finds john and doe too
+	parts = append(parts, strings.FieldsFunc(local, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})...)
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if utf8.RuneCountInString(part) >= minPersonalLength && strings.Contains(password, part) {
+			return part
+		}
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+//go:build unit
+
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arc41t3ct/imperator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func validate(t *testing.T, p *Policy, password string, s Subject) string {
+	t.Helper()
+	v := &imperator.Validation{Errors: map[string]string{}}
+	if err := p.Validate(v, "password", password, s); err != nil {
+		t.Fatal(err)
+	}
+	return v.Errors["password"]
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	p := &Policy{MinLength: 10, Classes: 3}
+	subject := Subject{Email: "jane.doe+work@example.com", FirstName: "Jane", LastName: "Doe"}
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"Tr0ub4dor&3x", true},
+		{"Tr0ub4d&3", false},                     // too short
+		{"troubadorandthree", false},             // one class only
+		{"Ünïcödé-Pässwörd", true},               // letters of any script count
+		{strings.Repeat("Ab1", 24) + "x", false}, // longer than bcrypt takes
+		{"MyNameIsJane-77", false},
+		{"Doe-Family-1999", false},
+		{"JANE.DOE+work!1", false},
+	}
+	for _, test := range tests {
+		if got := validate(t, p, test.password, subject); (got == "") != test.valid {
+			t.Errorf("%s: expected valid %v, got %q", test.password, test.valid, got)
+		}
+	}
+
+	// short names are too common to reject
+	if msg := validate(t, p, "Al-Horizon-88", Subject{FirstName: "Al", Email: "al@example.com"}); msg != "" {
+		t.Errorf("expected a two letter name to be allowed, got %q", msg)
+	}
+}
+
+func TestPolicy_History(t *testing.T) {
+	var hashes []string
+	for _, old := range []string{"Newest-Secret-3", "Older-Secret-2", "Oldest-Secret-1"} {
+		hash, _ := bcrypt.GenerateFromPassword([]byte(old), bcrypt.MinCost)
+		hashes = append(hashes, string(hash))
+	}
+	p := &Policy{MinLength: 8, Classes: 1, History: 2}
+	s := Subject{Hashes: hashes}
+	if validate(t, p, "Newest-Secret-3", s) == "" || validate(t, p, "Older-Secret-2", s) == "" {
+		t.Error("expected the last two passwords to be rejected")
+	}
+	if msg := validate(t, p, "Oldest-Secret-1", s); msg != "" {
+		t.Errorf("expected passwords past the history to be allowed, got %q", msg)
+	}
+}
+
+func TestPolicy_Breached(t *testing.T) {
+	common, err := Common()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Policy{MinLength: 8, Classes: 1, Breached: common}
+	for _, password := range []string{"password123", "qwertyuiop", "P@ssw0rd"} {
+		if validate(t, p, password, Subject{}) == "" {
+			t.Errorf("expected %s to be known as breached", password)
+		}
+	}
+	if msg := validate(t, p, "correct horse battery staple", Subject{}); msg != "" {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestBloom(t *testing.T) {
+	n := 10000
+	b := NewBloom(n, 0.01)
+	for i := 0; i < n; i++ {
+		b.Add(fmt.Sprintf("in-%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if ok, _ := b.Breached(fmt.Sprintf("in-%d", i)); !ok {
+			t.Fatalf("in-%d was added but not found", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := b.Breached(fmt.Sprintf("out-%d", i)); ok {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/50 {
+		t.Errorf("%d false positives in %d, expected about 1%%", falsePositives, n)
+	}
+}
+
+func TestLoadList(t *testing.T) {
+	digest := sha1.Sum([]byte("hunter2-from-hibp"))
+	list := "# comment\n\nplain-secret\n" + strings.ToUpper(hex.EncodeToString(digest[:])) + ":42\r\n"
+	b, err := LoadList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"plain-secret", "hunter2-from-hibp"} {
+		if ok, _ := b.Breached(password); !ok {
+			t.Errorf("expected %s in the list", password)
+		}
+	}
+	if ok, _ := b.Breached("# comment"); ok {
+		t.Error("comments must not be added")
+	}
+}
+
+func TestRangeDir(t *testing.T) {
+	dir := t.TempDir()
+	digest := sha1.Sum([]byte("range-secret"))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	content := "0000000000000000000000000000000000A:1\r\n" + strings.ToLower(hash[5:]) + ":7\r\n"
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	checker, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := checker.Breached("range-secret"); !ok || err != nil {
+		t.Errorf("expected range-secret to be found, got %v %v", ok, err)
+	}
+	// a prefix without a file is not an error
+	if ok, err := checker.Breached("not-in-any-range"); ok || err != nil {
+		t.Errorf("unexpected %v %v", ok, err)
+	}
+}
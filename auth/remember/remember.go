@@ -0,0 +1,80 @@
+// Package remember holds the remember me cookie. The cookie carries a series that identifies the
+// device and a secret that is rotated on every automatic login, see models.RememberToken.
+package remember
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	scs "github.com/alexedwards/scs/v2"
+)
+
+// SessionKey is the session key holding the series the session was logged in with
+const SessionKey = "remember_series"
+
+// defaultDays is how long a device is remembered when REMEMBER_ME_DAYS is not set
+const defaultDays = 30
+
+// CookieName returns the name of the remember me cookie of the app
+func CookieName(appName string) string {
+	return fmt.Sprintf("_%s_remember", appName)
+}
+
+// Lifetime reads REMEMBER_ME_DAYS from .env, the time after which a device has to log in with
+// the password again no matter how often it was used
+func Lifetime() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("REMEMBER_ME_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Encode returns the cookie value for a series and its secret
+func Encode(series, secret string) string {
+	return series + "|" + secret
+}
+
+// Decode splits a cookie value into series and secret
+func Decode(value string) (series, secret string, ok bool) {
+	series, secret, ok = strings.Cut(value, "|")
+	if !ok || series == "" || secret == "" {
+		return "", "", false
+	}
+	return series, secret, true
+}
+
+// SetCookie sets the remember me cookie until expires, it follows the domain and secure settings
+// of the session cookie
+func SetCookie(w http.ResponseWriter, session *scs.SessionManager, appName, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName(appName),
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Domain:   session.Cookie.Domain,
+		Secure:   session.Cookie.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ClearCookie removes the remember me cookie from the browser
+func ClearCookie(w http.ResponseWriter, session *scs.SessionManager, appName string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName(appName),
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now().Add(-100 * time.Hour),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Domain:   session.Cookie.Domain,
+		Secure:   session.Cookie.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,36 @@
+//go:build unit
+
+package remember
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	series, secret, ok := Decode(Encode("series", "secret"))
+	if !ok || series != "series" || secret != "secret" {
+		t.Errorf("round trip failed, got %q %q %v", series, secret, ok)
+	}
+
+	for _, value := range []string{"", "series", "|secret", "series|", "|"} {
+		if _, _, ok := Decode(value); ok {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	t.Setenv("REMEMBER_ME_DAYS", "")
+	if got := Lifetime(); got != defaultDays*24*time.Hour {
+		t.Error("expected the default lifetime, got", got)
+	}
+	t.Setenv("REMEMBER_ME_DAYS", "7")
+	if got := Lifetime(); got != 7*24*time.Hour {
+		t.Error("expected 7 days, got", got)
+	}
+	t.Setenv("REMEMBER_ME_DAYS", "-1")
+	if got := Lifetime(); got != defaultDays*24*time.Hour {
+		t.Error("expected the default lifetime for a negative value, got", got)
+	}
+}
@@ -0,0 +1,51 @@
+package sessions
+
+import "strings"
+
+// browsers and systems are matched in order, the first match wins so more specific names come
+// before the ones they contain, e.g. Edge before Chrome and Chrome before Safari
+var (
+	browsers = [][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systems = [][2]string{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// Describe turns a user agent into a short name like "Firefox on Linux" for the session list
+func Describe(userAgent string) string {
+	browser := match(userAgent, browsers)
+	system := match(userAgent, systems)
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	case userAgent == "":
+		return "Unknown device"
+	}
+	return userAgent
+}
+
+func match(userAgent string, names [][2]string) string {
+	for _, n := range names {
+		if strings.Contains(userAgent, n[0]) {
+			return n[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,226 @@
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"imperatorapp/auth/remember"
+	"imperatorapp/models"
+	"time"
+
+	scs "github.com/alexedwards/scs/v2"
+	"github.com/arc41t3ct/imperator"
+	up "github.com/upper/db/v4"
+)
+
+// Key is the session key holding the id of the session in the index
+const Key = "session_key"
+
+// ImpersonatorKey is the session key holding the id of the admin who is logged in as the user in
+// userID, the session belongs to the admin
+const ImpersonatorKey = "impersonator_id"
+
+// touchInterval limits how often the last seen time of a session is written
+const touchInterval = time.Minute
+
+// Index keeps the user_sessions table in step with the sessions of logged in users. It only
+// relies on the session manager and its store interface, so it works the same for the postgres,
+// mysql, redis and memory stores.
+type Index struct {
+	Session       *scs.SessionManager
+	EncryptionKey string
+	sessions      models.UserSession
+	rememberMe    models.RememberToken
+}
+
+// New returns the index for the sessions of the session manager, store tokens are encrypted
+// with the encryption key of the app
+func New(session *scs.SessionManager, encryptionKey string) *Index {
+	return &Index{Session: session, EncryptionKey: encryptionKey}
+}
+
+// Track indexes the session of a logged in user on every request and keeps its store token and
+// last seen time up to date. It returns false when the session was revoked, the session is
+// destroyed then and the request continues without a user.
+func (i *Index) Track(ctx context.Context, ip, userAgent string) (bool, error) {
+	userID := i.Session.GetInt(ctx, "userID")
+	if userID == 0 {
+		return true, nil
+	}
+	if admin := i.Session.GetInt(ctx, ImpersonatorKey); admin != 0 {
+		userID = admin
+	}
+	key := i.Session.GetString(ctx, Key)
+	if key == "" {
+		return true, i.add(ctx, userID, ip, userAgent)
+	}
+
+	session, err := i.sessions.GetByKey(key)
+	if errors.Is(err, up.ErrNoMoreRows) || (err == nil && session.UserID != userID) {
+		if err := i.Session.Destroy(ctx); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	// the store token changes whenever the session is renewed
+	token := i.Session.Token(ctx)
+	if hashToken(token) == session.TokenHash && time.Since(session.LastSeenAt) < touchInterval {
+		return true, nil
+	}
+	encrypted, err := i.encrypt(token)
+	if err != nil {
+		return true, err
+	}
+	return true, i.sessions.Touch(session.ID, encrypted, hashToken(token), ip)
+}
+
+// Current returns the id in the index of the session of the request, 0 when it is not indexed
+func (i *Index) Current(ctx context.Context) int {
+	key := i.Session.GetString(ctx, Key)
+	if key == "" {
+		return 0
+	}
+	session, err := i.sessions.GetByKey(key)
+	if err != nil {
+		return 0
+	}
+	return session.ID
+}
+
+// Forget removes the session of the request from the index, it is used when logging out
+func (i *Index) Forget(ctx context.Context) error {
+	key := i.Session.GetString(ctx, Key)
+	if key == "" {
+		return nil
+	}
+	session, err := i.sessions.GetByKey(key)
+	if errors.Is(err, up.ErrNoMoreRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return i.sessions.Delete(session.ID)
+}
+
+// Revoke ends a session. Its data is deleted from the store and the remember me device that
+// created it is removed, should the store miss the session Track ends it on the next request.
+func (i *Index) Revoke(session *models.UserSession) error {
+	if session.StoreToken != "" {
+		token, err := i.decrypt(session.StoreToken)
+		if err != nil {
+			return err
+		}
+		if err := i.Session.Store.Delete(token); err != nil {
+			return err
+		}
+	}
+	if session.RememberTokenID != 0 {
+		if err := i.rememberMe.DeleteForUser(session.RememberTokenID, session.UserID); err != nil {
+			return err
+		}
+	}
+	return i.sessions.Delete(session.ID)
+}
+
+// RevokeOthers ends every session and remember me device of the user except the session with
+// the id keep and the remember me device it was created by
+func (i *Index) RevokeOthers(userID, keep int) error {
+	all, err := i.sessions.GetForUser(userID)
+	if err != nil {
+		return err
+	}
+	keepRemember := 0
+	for _, session := range all {
+		if session.ID == keep {
+			keepRemember = session.RememberTokenID
+			continue
+		}
+		if err := i.Revoke(session); err != nil {
+			return err
+		}
+	}
+	return i.rememberMe.DeleteAllForUser(userID, keepRemember)
+}
+
+// RevokeRemembered ends the sessions that were logged in through the remember me device with
+// the id rememberID and removes the device
+func (i *Index) RevokeRemembered(userID, rememberID int) error {
+	all, err := i.sessions.GetForUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, session := range all {
+		if session.RememberTokenID != rememberID {
+			continue
+		}
+		if err := i.Revoke(session); err != nil {
+			return err
+		}
+	}
+	return i.rememberMe.DeleteForUser(rememberID, userID)
+}
+
+// RevokeAll ends every session and remember me device of the user
+func (i *Index) RevokeAll(userID int) error {
+	return i.RevokeOthers(userID, 0)
+}
+
+// add indexes the session of the request and stores the key of the index in the session
+func (i *Index) add(ctx context.Context, userID int, ip, userAgent string) error {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(randomBytes)
+	token := i.Session.Token(ctx)
+	encrypted, err := i.encrypt(token)
+	if err != nil {
+		return err
+	}
+	session := models.UserSession{
+		UserID:     userID,
+		SessionKey: key,
+		StoreToken: encrypted,
+		TokenHash:  hashToken(token),
+		UserAgent:  userAgent,
+		IP:         ip,
+	}
+	if series := i.Session.GetString(ctx, remember.SessionKey); series != "" {
+		if rt, err := i.rememberMe.GetBySeries(series); err == nil && rt.UserID == userID {
+			session.RememberTokenID = rt.ID
+		}
+	}
+	if _, err := i.sessions.Insert(session); err != nil {
+		return err
+	}
+	i.Session.Put(ctx, Key, key)
+	return nil
+}
+
+func (i *Index) encrypt(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	enc := imperator.Encryption{Key: []byte(i.EncryptionKey)}
+	return enc.Encrypt(token)
+}
+
+func (i *Index) decrypt(encrypted string) (string, error) {
+	enc := imperator.Encryption{Key: []byte(i.EncryptionKey)}
+	return enc.Decrypt(encrypted)
+}
+
+func hashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
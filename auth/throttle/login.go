@@ -0,0 +1,103 @@
+package throttle
+
+import (
+	"context"
+	"time"
+
+	"github.com/arc41t3ct/imperator/cache"
+)
+
+// DefaultEmailConfig slows down guessing the password of one account and locks it after 10 failures
+var DefaultEmailConfig = Config{
+	Name:         "login-email",
+	FreeAttempts: 3,
+	MaxFailures:  10,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	Lockout:      15 * time.Minute,
+	Window:       time.Hour,
+}
+
+// DefaultIPConfig slows down one address trying many accounts, it allows more failures than the
+// email config since many users can share an address
+var DefaultIPConfig = Config{
+	Name:         "login-ip",
+	FreeAttempts: 10,
+	MaxFailures:  100,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	Lockout:      time.Hour,
+	Window:       time.Hour,
+}
+
+// Login throttles login attempts by the email address and by the ip address they come from
+type Login struct {
+	Email *Throttle
+	IP    *Throttle
+}
+
+// NewLogin returns the login throttle storing its state in c, see New for a nil cache
+func NewLogin(c cache.Cache, email, ip Config) *Login {
+	if c == nil {
+		c = NewMemoryCache()
+	}
+	return &Login{Email: New(c, email), IP: New(c, ip)}
+}
+
+// Check returns the status of the email or the ip, whichever has to wait longer
+func (l *Login) Check(ctx context.Context, email, ip string) (Status, error) {
+	byEmail, err := l.Email.Check(ctx, Key(email))
+	if err != nil {
+		return Status{}, err
+	}
+	byIP, err := l.IP.Check(ctx, Key(ip))
+	if err != nil {
+		return Status{}, err
+	}
+	return longest(byEmail, byIP), nil
+}
+
+// Fail records a failed login for the email and the ip. locked reports if this failure locked
+// the account of the email.
+func (l *Login) Fail(ctx context.Context, email, ip string) (Status, bool, error) {
+	byEmail, locked, err := l.Email.Fail(ctx, Key(email))
+	if err != nil {
+		return Status{}, false, err
+	}
+	byIP, _, err := l.IP.Fail(ctx, Key(ip))
+	if err != nil {
+		return Status{}, false, err
+	}
+	return longest(byEmail, byIP), locked, nil
+}
+
+// FailIP records a failure for the ip only, for failures the owner of the account did not cause
+// like a sign-in link opened in another browser, so they can not lock the account
+func (l *Login) FailIP(ctx context.Context, ip string) (Status, error) {
+	status, _, err := l.IP.Fail(ctx, Key(ip))
+	return status, err
+}
+
+// Succeed forgets the failures of the email after a successful login, the failures of the ip
+// are kept so one known password does not reset guessing from the same address
+func (l *Login) Succeed(ctx context.Context, email string) error {
+	return l.Email.Reset(ctx, Key(email))
+}
+
+// Unlock removes the lockout of an account
+func (l *Login) Unlock(ctx context.Context, email string) error {
+	return l.Email.Reset(ctx, Key(email))
+}
+
+// Locked reports if the account of the email is locked
+func (l *Login) Locked(ctx context.Context, email string) (bool, error) {
+	status, err := l.Email.Check(ctx, Key(email))
+	return status.Locked, err
+}
+
+func longest(a, b Status) Status {
+	if b.RetryAfter > a.RetryAfter {
+		return b
+	}
+	return a
+}
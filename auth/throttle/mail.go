@@ -0,0 +1,23 @@
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultMailConfig limits how often anonymous visitors can make the app send an email, e.g. a
+// verification link, to the same address or from the same ip address
+var DefaultMailConfig = Config{
+	Name:         "mail",
+	FreeAttempts: 3,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	Window:       time.Hour,
+}
+
+// Hit records an attempt that is limited no matter if it succeeded, like sending an email, and
+// returns the status after it
+func (t *Throttle) Hit(ctx context.Context, key string) (Status, error) {
+	status, _, err := t.Fail(ctx, key)
+	return status, err
+}
@@ -0,0 +1,114 @@
+package throttle
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryCache is a cache.Cache kept in the memory of the process. It is used when no redis or
+// badger cache is configured.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// NewMemoryCache returns an empty in-memory cache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryEntry)}
+}
+
+func (c *MemoryCache) Has(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.get(key)
+	return ok, nil
+}
+
+func (c *MemoryCache) Get(key string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, _ := c.get(key)
+	return entry.value, nil
+}
+
+// Set stores the value, the optional expires is in seconds like for the redis and badger caches
+func (c *MemoryCache) Set(key string, value interface{}, expires ...int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := memoryEntry{value: value}
+	if len(expires) > 0 {
+		entry.expires = time.Now().Add(time.Duration(expires[0]) * time.Second)
+	}
+	c.entries[key] = entry
+	c.sweep()
+	return nil
+}
+
+// Increment counts under the lock of the cache
+func (c *MemoryCache) Increment(key string, expires int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, _ := c.get(key)
+	count, _ := entry.value.(int)
+	count++
+	c.entries[key] = memoryEntry{value: count, expires: time.Now().Add(time.Duration(expires) * time.Second)}
+	return count, nil
+}
+
+func (c *MemoryCache) Count(key string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, _ := c.get(key)
+	count, _ := entry.value.(int)
+	return count, nil
+}
+
+func (c *MemoryCache) Forget(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+func (c *MemoryCache) EmptyMatching(prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) Empty() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]memoryEntry)
+	return nil
+}
+
+// get returns an entry that has not expired, the lock must be held
+func (c *MemoryCache) get(key string) (memoryEntry, bool) {
+	entry, ok := c.entries[key]
+	if !ok || (!entry.expires.IsZero() && entry.expires.Before(time.Now())) {
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+// sweep drops expired entries so the map does not grow forever, the lock must be held
+func (c *MemoryCache) sweep() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && entry.expires.Before(now) {
+			delete(c.entries, key)
+		}
+	}
+}
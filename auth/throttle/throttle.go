@@ -0,0 +1,266 @@
+package throttle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arc41t3ct/imperator/cache"
+)
+
+// Config controls how fast a key is slowed down and when it is locked
+type Config struct {
+	// Name separates the keys of different throttles in the cache
+	Name string
+	// FreeAttempts is the number of failures that do not cause any delay
+	FreeAttempts int
+	// MaxFailures locks the key when it is reached, 0 never locks
+	MaxFailures int
+	// BaseDelay is the delay after the first failure past the free attempts, it doubles with
+	// every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Lockout is how long a key stays locked
+	Lockout time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// Status is the state of a key
+type Status struct {
+	Failures   int
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+// Throttle counts failures per key in a cache and tells callers how long to wait before the
+// next attempt is allowed. The cache has to implement cache.Counter so concurrent failures are
+// all counted. Lookups in a cache.ContextCache are recorded in the trace of the ctx passed to the
+// methods.
+type Throttle struct {
+	Cache  cache.Cache
+	Config Config
+	// now can be replaced in tests
+	now func() time.Time
+}
+
+// New returns a throttle storing its state in c, a nil cache falls back to an in-memory cache
+// which only works for a single instance of the app
+func New(c cache.Cache, config Config) *Throttle {
+	if c == nil {
+		c = NewMemoryCache()
+	}
+	return &Throttle{Cache: c, Config: config, now: time.Now}
+}
+
+// Key builds a key out of the value, the value is hashed so emails are not stored in the cache
+func Key(value string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Check returns the status of the key without changing it
+func (t *Throttle) Check(ctx context.Context, key string) (Status, error) {
+	s, err := t.load(ctx, key)
+	if err != nil {
+		return Status{}, err
+	}
+	return s.status(t.now()), nil
+}
+
+// Fail records a failed attempt for the key. locked reports if this failure locked the key, of
+// concurrent failures only the one that reached MaxFailures does.
+func (t *Throttle) Fail(ctx context.Context, key string) (status Status, locked bool, err error) {
+	s, err := t.load(ctx, key)
+	if err != nil {
+		return Status{}, false, err
+	}
+	now := t.now()
+	if !s.lockedUntil.IsZero() && !s.lockedUntil.After(now) {
+		// the lockout is over, start counting again
+		if err := t.Reset(ctx, key); err != nil {
+			return Status{}, false, err
+		}
+		s = state{}
+	}
+
+	// the failure is counted by the cache, a count read and written back here would lose the
+	// failures of parallel requests
+	if s.failures, err = t.increment(ctx, key, t.ttl(s, now)); err != nil {
+		return Status{}, false, err
+	}
+	if t.Config.MaxFailures > 0 && s.failures >= t.Config.MaxFailures {
+		if s.failures == t.Config.MaxFailures {
+			s.lockedUntil = now.Add(t.Config.Lockout)
+			locked = true
+			if err := t.setTime(ctx, t.cacheKey(key)+"-locked", s.lockedUntil, t.ttl(s, now)); err != nil {
+				return Status{}, false, err
+			}
+		}
+	} else if s.failures > t.Config.FreeAttempts {
+		s.nextAttempt = now.Add(t.delay(s.failures - t.Config.FreeAttempts))
+		if err := t.setTime(ctx, t.cacheKey(key)+"-next", s.nextAttempt, t.ttl(s, now)); err != nil {
+			return Status{}, false, err
+		}
+	}
+	return s.status(now), locked, nil
+}
+
+// Reset forgets all failures of the key, it is used after a successful attempt and to unlock
+func (t *Throttle) Reset(ctx context.Context, key string) error {
+	for _, k := range []string{t.cacheKey(key), t.cacheKey(key) + "-next", t.cacheKey(key) + "-locked"} {
+		var err error
+		if c, ok := t.Cache.(cache.ContextCache); ok {
+			err = c.ForgetContext(ctx, k)
+		} else {
+			err = t.Cache.Forget(k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delay returns the exponential backoff for the nth failure
+func (t *Throttle) delay(n int) time.Duration {
+	d := t.Config.BaseDelay
+	for i := 1; i < n; i++ {
+		d *= 2
+		if t.Config.MaxDelay > 0 && d >= t.Config.MaxDelay {
+			return t.Config.MaxDelay
+		}
+	}
+	if t.Config.MaxDelay > 0 && d > t.Config.MaxDelay {
+		return t.Config.MaxDelay
+	}
+	return d
+}
+
+func (t *Throttle) cacheKey(key string) string {
+	return fmt.Sprintf("throttle-%s-%s", t.Config.Name, key)
+}
+
+// state is what is stored for each key
+type state struct {
+	failures    int
+	nextAttempt time.Time
+	lockedUntil time.Time
+}
+
+func (s state) status(now time.Time) Status {
+	st := Status{Failures: s.failures}
+	if s.lockedUntil.After(now) {
+		st.Locked = true
+		st.RetryAfter = s.lockedUntil.Sub(now)
+	} else if s.nextAttempt.After(now) {
+		st.RetryAfter = s.nextAttempt.Sub(now)
+	}
+	return st
+}
+
+// ttl returns how long the entries of a key are kept, as long as they can still matter
+func (t *Throttle) ttl(s state, now time.Time) int {
+	ttl := t.Config.Window
+	if until := s.lockedUntil.Sub(now); until > ttl {
+		ttl = until
+	}
+	if until := s.nextAttempt.Sub(now); until > ttl {
+		ttl = until
+	}
+	seconds := int(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// load reads the state of a key. The number of failures is a counter of the cache, the times are
+// stored as strings so they survive the gob encoding of the redis and badger caches without
+// registering types.
+func (t *Throttle) load(ctx context.Context, key string) (state, error) {
+	var s state
+	var err error
+	if s.failures, err = t.count(ctx, key); err != nil {
+		return s, err
+	}
+	if s.nextAttempt, err = t.time(ctx, t.cacheKey(key)+"-next"); err != nil {
+		return s, err
+	}
+	if s.lockedUntil, err = t.time(ctx, t.cacheKey(key)+"-locked"); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func (t *Throttle) counter() (cache.Counter, error) {
+	c, ok := t.Cache.(cache.Counter)
+	if !ok {
+		return nil, fmt.Errorf("throttle: cache %T can not count", t.Cache)
+	}
+	return c, nil
+}
+
+func (t *Throttle) count(ctx context.Context, key string) (int, error) {
+	if c, ok := t.Cache.(cache.ContextCounter); ok {
+		return c.CountContext(ctx, t.cacheKey(key))
+	}
+	c, err := t.counter()
+	if err != nil {
+		return 0, err
+	}
+	return c.Count(t.cacheKey(key))
+}
+
+func (t *Throttle) increment(ctx context.Context, key string, expires int) (int, error) {
+	if c, ok := t.Cache.(cache.ContextCounter); ok {
+		return c.IncrementContext(ctx, t.cacheKey(key), expires)
+	}
+	c, err := t.counter()
+	if err != nil {
+		return 0, err
+	}
+	return c.Increment(t.cacheKey(key), expires)
+}
+
+// time reads a time stored by setTime, a missing or broken entry is the zero time
+func (t *Throttle) time(ctx context.Context, cacheKey string) (time.Time, error) {
+	var exists bool
+	var err error
+	c, traced := t.Cache.(cache.ContextCache)
+	if traced {
+		exists, err = c.HasContext(ctx, cacheKey)
+	} else {
+		exists, err = t.Cache.Has(cacheKey)
+	}
+	if err != nil || !exists {
+		return time.Time{}, err
+	}
+	var value interface{}
+	if traced {
+		value, err = c.GetContext(ctx, cacheKey)
+	} else {
+		value, err = t.Cache.Get(cacheKey)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	encoded, _ := value.(string)
+	nanos, err := strconv.ParseInt(encoded, 10, 64)
+	if err != nil || nanos <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, nanos), nil
+}
+
+func (t *Throttle) setTime(ctx context.Context, cacheKey string, value time.Time, expires int) error {
+	encoded := strconv.FormatInt(value.UnixNano(), 10)
+	if c, ok := t.Cache.(cache.ContextCache); ok {
+		return c.SetContext(ctx, cacheKey, encoded, expires)
+	}
+	return t.Cache.Set(cacheKey, encoded, expires)
+}
@@ -0,0 +1,307 @@
+//go:build unit
+
+package throttle
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	Name:         "test",
+	FreeAttempts: 2,
+	MaxFailures:  6,
+	BaseDelay:    time.Second,
+	MaxDelay:     3 * time.Second,
+	Lockout:      time.Minute,
+	Window:       time.Hour,
+}
+
+var ctx = context.Background()
+
+// clock is a fake time source the tests move forward
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestThrottle() (*Throttle, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	th := New(nil, testConfig)
+	th.now = c.now
+	return th, c
+}
+
+func TestThrottle_Backoff(t *testing.T) {
+	th, _ := newTestThrottle()
+	key := Key("user@example.com")
+
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second, 3 * time.Second}
+	for i, want := range expected {
+		status, locked, err := th.Fail(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked || status.Locked {
+			t.Fatalf("locked after %d failures", i+1)
+		}
+		if status.RetryAfter != want {
+			t.Errorf("failure %d: expected delay %s and got %s", i+1, want, status.RetryAfter)
+		}
+	}
+
+	if err := th.Reset(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := th.Check(ctx, key)
+	if status.Failures != 0 || status.RetryAfter != 0 {
+		t.Error("failures kept after reset:", status)
+	}
+}
+
+func TestThrottle_Lockout(t *testing.T) {
+	th, c := newTestThrottle()
+	key := Key("user@example.com")
+
+	lockedCount := 0
+	for i := 0; i < testConfig.MaxFailures+2; i++ {
+		_, locked, err := th.Fail(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked {
+			lockedCount++
+		}
+	}
+	if lockedCount != 1 {
+		t.Errorf("expected the key to be locked once and got %d", lockedCount)
+	}
+
+	status, _ := th.Check(ctx, key)
+	if !status.Locked || status.RetryAfter != testConfig.Lockout {
+		t.Error("key is not locked:", status)
+	}
+
+	c.t = c.t.Add(testConfig.Lockout + time.Second)
+	status, _ = th.Check(ctx, key)
+	if status.Locked || status.RetryAfter != 0 {
+		t.Error("key still locked after the lockout:", status)
+	}
+	status, locked, _ := th.Fail(ctx, key)
+	if locked || status.Failures != 1 {
+		t.Error("failures not reset after the lockout ended:", status)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	l := NewLogin(nil, testConfig, Config{Name: "ip", MaxFailures: 3, Lockout: time.Hour, Window: time.Hour})
+
+	// failures for different emails add up on the ip
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if _, _, err := l.Fail(ctx, email, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, _ := l.Check(ctx, "d@example.com", "192.0.2.1")
+	if !status.Locked {
+		t.Error("ip not locked after too many failures")
+	}
+	status, _ = l.Check(ctx, "d@example.com", "192.0.2.2")
+	if status.Locked || status.RetryAfter != 0 {
+		t.Error("other ip throttled:", status)
+	}
+
+	for i := 0; i < testConfig.MaxFailures; i++ {
+		_, _, _ = l.Fail(ctx, "Locked@Example.com ", "192.0.2.3")
+	}
+	if locked, _ := l.Locked(ctx, "locked@example.com"); !locked {
+		t.Error("email key is not normalized")
+	}
+	if err := l.Unlock(ctx, "locked@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := l.Locked(ctx, "locked@example.com"); locked {
+		t.Error("account still locked after unlock")
+	}
+}
+
+func TestLogin_FailIP(t *testing.T) {
+	l := NewLogin(nil, Config{Name: "email", MaxFailures: 1, Lockout: time.Hour, Window: time.Hour}, Config{Name: "ip", MaxFailures: 2, Lockout: time.Hour, Window: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.FailIP(ctx, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if locked, _ := l.Locked(ctx, "victim@example.com"); locked {
+		t.Error("failures of the ip locked the account")
+	}
+	if status, _ := l.Check(ctx, "victim@example.com", "192.0.2.1"); !status.Locked {
+		t.Error("ip not locked after too many failures")
+	}
+}
+
+func TestThrottle_HitNeverLocks(t *testing.T) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	th := New(nil, DefaultMailConfig)
+	th.now = c.now
+	key := Key("user@example.com")
+
+	var status Status
+	for i := 0; i < 20; i++ {
+		var err error
+		if status, err = th.Hit(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.Locked {
+		t.Error("mail throttle must not lock")
+	}
+	if status.RetryAfter != DefaultMailConfig.MaxDelay {
+		t.Errorf("expected a wait of %s, got %s", DefaultMailConfig.MaxDelay, status.RetryAfter)
+	}
+
+	c.t = c.t.Add(DefaultMailConfig.MaxDelay)
+	if status, _ = th.Check(ctx, key); status.RetryAfter != 0 {
+		t.Error("expected the wait to be over")
+	}
+}
+
+func TestThrottle_ConcurrentFailures(t *testing.T) {
+	th, _ := newTestThrottle()
+	th.Config.MaxFailures = 100
+	key := Key("user@example.com")
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := th.Fail(ctx, key); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if status, _ := th.Check(ctx, key); status.Failures != n {
+		t.Errorf("expected %d failures and got %d", n, status.Failures)
+	}
+}
+
+func TestThrottle_ConcurrentLockout(t *testing.T) {
+	th, _ := newTestThrottle()
+	key := Key("user@example.com")
+
+	var locks atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3*testConfig.MaxFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, locked, _ := th.Fail(ctx, key); locked {
+				locks.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if locks.Load() != 1 {
+		t.Errorf("expected the key to be locked once and got %d", locks.Load())
+	}
+	if status, _ := th.Check(ctx, key); !status.Locked {
+		t.Error("key is not locked:", status)
+	}
+}
+
+func TestMemoryCache_Expiry(t *testing.T) {
+	c := NewMemoryCache()
+	_ = c.Set("a", "1", 60)
+	_ = c.Set("b", "2")
+	c.entries["a"] = memoryEntry{value: "1", expires: time.Now().Add(-time.Second)}
+	if ok, _ := c.Has("a"); ok {
+		t.Error("expired entry found")
+	}
+	if v, _ := c.Get("b"); v != "2" {
+		t.Error("wrong value:", v)
+	}
+	_ = c.EmptyMatching("b")
+	if ok, _ := c.Has("b"); ok {
+		t.Error("entry not removed by prefix")
+	}
+}
+
+// contextCache is a cache.ContextCache that remembers the contexts it was called with
+type contextCache struct {
+	*MemoryCache
+	calls []context.Context
+}
+
+func (c *contextCache) HasContext(ctx context.Context, key string) (bool, error) {
+	c.calls = append(c.calls, ctx)
+	return c.Has(key)
+}
+
+func (c *contextCache) GetContext(ctx context.Context, key string) (interface{}, error) {
+	c.calls = append(c.calls, ctx)
+	return c.Get(key)
+}
+
+func (c *contextCache) SetContext(ctx context.Context, key string, value interface{}, expires ...int) error {
+	c.calls = append(c.calls, ctx)
+	return c.Set(key, value, expires...)
+}
+
+func (c *contextCache) ForgetContext(ctx context.Context, key string) error {
+	c.calls = append(c.calls, ctx)
+	return c.Forget(key)
+}
+
+func (c *contextCache) IncrementContext(ctx context.Context, key string, expires int) (int, error) {
+	c.calls = append(c.calls, ctx)
+	return c.Increment(key, expires)
+}
+
+func (c *contextCache) CountContext(ctx context.Context, key string) (int, error) {
+	c.calls = append(c.calls, ctx)
+	return c.Count(key)
+}
+
+func (c *contextCache) EmptyMatchingContext(ctx context.Context, prefix string) error {
+	return c.EmptyMatching(prefix)
+}
+
+func (c *contextCache) EmptyContext(ctx context.Context) error {
+	return c.Empty()
+}
+
+func TestThrottle_ContextCache(t *testing.T) {
+	type requestKey struct{}
+	request := context.WithValue(context.Background(), requestKey{}, "request")
+	c := &contextCache{MemoryCache: NewMemoryCache()}
+	th := New(c, testConfig)
+	key := Key("user@example.com")
+
+	if _, _, err := th.Fail(request, key); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := th.Check(request, key); status.Failures != 1 {
+		t.Error("failure was not stored:", status)
+	}
+	if err := th.Reset(request, key); err != nil {
+		t.Fatal(err)
+	}
+	// count, two has and increment for the first failure, count and two has for the check and
+	// three forgets for the reset
+	if len(c.calls) != 10 {
+		t.Fatalf("expected 10 cache calls with a context and got %d", len(c.calls))
+	}
+	for _, call := range c.calls {
+		if call != request {
+			t.Error("cache was called without the context of the request")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Defaults as recommended by RFC 6238 and understood by all common authenticator apps
+const (
+	Digits     = 6
+	Period     = 30
+	SecretSize = 20
+	// Skew is the number of periods before and after the current one that we still accept
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32 encoded secret for a user to enroll with
+func GenerateSecret() (string, error) {
+	randomBytes := make([]byte, SecretSize)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(randomBytes), nil
+}
+
+// ProvisioningURI returns the otpauth:// uri that authenticator apps read from the QR code
+func ProvisioningURI(secret, issuer, account string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, account))
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", Digits))
+	params.Set("period", fmt.Sprintf("%d", Period))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// QRCode returns the provisioning uri as a png QR code in a data uri, it is rendered on the
+// server so the secret never leaves it for a script
+func QRCode(uri string, size int) (string, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, size)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// GenerateCode returns the code for the given secret at time t
+func GenerateCode(secret string, t time.Time) (string, error) {
+	return generateCode(secret, counter(t))
+}
+
+// Validate checks the code against the secret allowing for Skew periods of clock drift
+func Validate(code, secret string, t time.Time) bool {
+	_, ok := Match(code, secret, t)
+	return ok
+}
+
+// Match checks the code like Validate and returns the counter of the period it belongs to. A
+// code is valid for several periods, callers store the counter and only accept higher ones so
+// a code can not be used twice.
+func Match(code, secret string, t time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	c := counter(t)
+	for i := -Skew; i <= Skew; i++ {
+		moving := uint64(int64(c) + int64(i))
+		expected, err := generateCode(secret, moving)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return moving, true
+		}
+	}
+	return 0, false
+}
+
+// counter returns the moving factor for time t
+func counter(t time.Time) uint64 {
+	return uint64(t.Unix() / Period)
+}
+
+// generateCode implements the HOTP algorithm from RFC 4226 for a given counter
+func generateCode(secret string, c uint64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		return "", errors.New("empty totp secret")
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, c)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
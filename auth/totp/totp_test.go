@@ -0,0 +1,116 @@
+//go:build unit
+
+package totp
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the shared secret used in the RFC 6238 appendix B test vectors
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+var codeData = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+}
+
+func TestGenerateCode(t *testing.T) {
+	for _, tt := range codeData {
+		code, err := GenerateCode(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Error("failed to generate code:", err)
+		}
+		if code != tt.code {
+			t.Errorf("wrong code at %d: expected %s and got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	if !Validate("005924", rfcSecret, now) {
+		t.Error("valid code reported as invalid")
+	}
+	if !Validate("005924", rfcSecret, now.Add(Period*time.Second)) {
+		t.Error("code from previous period not accepted within skew")
+	}
+	if Validate("005924", rfcSecret, now.Add(3*Period*time.Second)) {
+		t.Error("code outside of skew accepted")
+	}
+	if Validate("123", rfcSecret, now) {
+		t.Error("code of wrong length accepted")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	c, ok := Match("005924", rfcSecret, now)
+	if !ok || c != counter(now) {
+		t.Errorf("expected counter %d and got %d %v", counter(now), c, ok)
+	}
+	// the same code a period later still matches the period it was generated for
+	if later, ok := Match("005924", rfcSecret, now.Add(Period*time.Second)); !ok || later != c {
+		t.Errorf("expected counter %d and got %d %v", c, later, ok)
+	}
+	if _, ok := Match("000000", rfcSecret, now); ok {
+		t.Error("wrong code matched")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Error("failed to generate secret:", err)
+	}
+	code, err := GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Error("failed to generate code for new secret:", err)
+	}
+	if !Validate(code, secret, time.Now()) {
+		t.Error("code for new secret reported as invalid")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("ABC", "Imperator", "test@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Imperator:test@example.com?") {
+		t.Error("wrong uri prefix:", uri)
+	}
+	if !strings.Contains(uri, "secret=ABC") {
+		t.Error("secret missing in uri:", uri)
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	data, err := QRCode(ProvisioningURI("ABC", "Imperator", "test@example.com"), 200)
+	if err != nil {
+		t.Fatal("failed to render QR code:", err)
+	}
+	encoded, ok := strings.CutPrefix(data, "data:image/png;base64,")
+	if !ok {
+		t.Fatal("not a png data uri:", data)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal("invalid base64 in data uri:", err)
+	}
+	img, err := png.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("invalid png in data uri:", err)
+	}
+	if size := img.Bounds().Dx(); size != 200 {
+		t.Error("wrong QR code size:", size)
+	}
+}
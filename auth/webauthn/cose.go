@@ -0,0 +1,111 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers we accept for credentials
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// COSE key types and curves
+const (
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// SupportedAlgorithms are offered to the authenticator in order of preference
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// publicKey is a parsed COSE_Key that can verify signatures
+type publicKey struct {
+	alg int
+	key crypto.PublicKey
+}
+
+// parsePublicKey parses a CBOR encoded COSE_Key as stored with the credential
+func parsePublicKey(coseKey []byte) (*publicKey, error) {
+	v, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("cose key is not a map")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch kty {
+	case coseKtyEC2:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if alg != AlgES256 || crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported ec2 cose key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("ec2 cose key is not on the curve")
+		}
+		return &publicKey{alg: AlgES256, key: pub}, nil
+	case coseKtyOKP:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if alg != AlgEdDSA || crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported okp cose key")
+		}
+		return &publicKey{alg: AlgEdDSA, key: ed25519.PublicKey(x)}, nil
+	case coseKtyRSA:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if alg != AlgRS256 || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("unsupported rsa cose key")
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &publicKey{alg: AlgRS256, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, nil
+	}
+	return nil, fmt.Errorf("unsupported cose key type %d", kty)
+}
+
+// verify checks the signature over data
+func (p *publicKey) verify(data, sig []byte) error {
+	switch k := p.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return errors.New("unsupported public key")
+}
@@ -0,0 +1,443 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+	flagExtensionData    = 0x80
+)
+
+// Timeout in milliseconds the browser gives the user to complete a ceremony
+const Timeout = 120000
+
+var (
+	ErrInvalidSignature = errors.New("webauthn: invalid signature")
+	ErrChallenge        = errors.New("webauthn: challenge mismatch")
+	ErrOrigin           = errors.New("webauthn: origin not allowed")
+	ErrRelyingParty     = errors.New("webauthn: relying party id mismatch")
+	ErrUserPresence     = errors.New("webauthn: user not present")
+	ErrUserVerification = errors.New("webauthn: user not verified")
+	// ErrPossibleClone is returned when the signature counter did not increase which means the
+	// private key may have been copied to another authenticator
+	ErrPossibleClone = errors.New("webauthn: signature counter did not increase, credential may be cloned")
+)
+
+// encoding is used for every binary value exchanged with the browser
+var encoding = base64.RawURLEncoding
+
+// RelyingParty holds the settings of our site as the webauthn relying party
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// NewChallenge returns a new random base64url encoded challenge
+func NewChallenge() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(randomBytes), nil
+}
+
+// CredentialDescriptor identifies a credential in the options sent to the browser
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// CreationOptions are passed to navigator.credentials.create after decoding the base64url fields
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get after decoding the base64url fields
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int                    `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions builds the options for registering a new credential for a user. Existing
+// credentials are excluded so the same authenticator is not registered twice.
+func (rp *RelyingParty) CreationOptions(challenge string, userHandle []byte, name, displayName string, exclude []CredentialDescriptor) CreationOptions {
+	var opts CreationOptions
+	opts.Challenge = challenge
+	opts.RP.ID = rp.ID
+	opts.RP.Name = rp.Name
+	opts.User.ID = encoding.EncodeToString(userHandle)
+	opts.User.Name = name
+	opts.User.DisplayName = displayName
+	for _, alg := range SupportedAlgorithms {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{"public-key", alg})
+	}
+	opts.Timeout = Timeout
+	opts.ExcludeCredentials = exclude
+	if opts.ExcludeCredentials == nil {
+		opts.ExcludeCredentials = []CredentialDescriptor{}
+	}
+	// resident keys let the credential be used for passwordless login without typing an email
+	opts.AuthenticatorSelection.ResidentKey = "preferred"
+	opts.AuthenticatorSelection.UserVerification = "preferred"
+	opts.Attestation = "none"
+	return opts
+}
+
+// RequestOptions builds the options for an assertion. An empty allow list lets the browser
+// offer any discoverable credential for our relying party.
+func (rp *RelyingParty) RequestOptions(challenge string, allow []CredentialDescriptor, userVerification string) RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          Timeout,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// RegistrationResponse is the PublicKeyCredential returned by navigator.credentials.create
+// with all binary fields base64url encoded
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by navigator.credentials.get with
+// all binary fields base64url encoded
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// CredentialID returns the decoded raw id of the credential used in the assertion
+func (a *AssertionResponse) CredentialID() ([]byte, error) {
+	return encoding.DecodeString(a.RawID)
+}
+
+// UserHandle returns the decoded user handle, it is only set for discoverable credentials
+func (a *AssertionResponse) UserHandle() ([]byte, error) {
+	return encoding.DecodeString(a.Response.UserHandle)
+}
+
+// Credential is a verified, newly registered credential ready to be stored
+type Credential struct {
+	ID           []byte
+	PublicKey    []byte
+	SignCount    uint32
+	AAGUID       []byte
+	Transports   []string
+	UserVerified bool
+}
+
+// AssertionResult is the outcome of a verified assertion
+type AssertionResult struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// VerifyRegistration validates the response of a registration ceremony against the challenge
+// we stored in the session and returns the credential to store for the user
+func (rp *RelyingParty) VerifyRegistration(resp RegistrationResponse, challenge string, requireUserVerification bool) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: wrong credential type")
+	}
+	clientDataJSON, err := encoding.DecodeString(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAttestation, err := encoding.DecodeString(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: attestation object is not a map")
+	}
+	format, _ := attestation["fmt"].(string)
+	attStmt, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(authData, requireUserVerification); err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedCredData == 0 {
+		return nil, errors.New("webauthn: no attested credential data")
+	}
+
+	pub, err := parsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyAttestationStatement(format, attStmt, signed, pub); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:           authData.credentialID,
+		PublicKey:    authData.publicKey,
+		SignCount:    authData.signCount,
+		AAGUID:       authData.aaguid,
+		Transports:   resp.Response.Transports,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// VerifyAssertion validates the response of an authentication ceremony against the stored
+// public key. When the signature counter did not increase the result is returned together
+// with ErrPossibleClone so the caller can flag the credential.
+func (rp *RelyingParty) VerifyAssertion(resp AssertionResponse, challenge string, storedPublicKey []byte, storedSignCount uint32, requireUserVerification bool) (*AssertionResult, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: wrong credential type")
+	}
+	clientDataJSON, err := encoding.DecodeString(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+	rawAuthData, err := encoding.DecodeString(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(authData, requireUserVerification); err != nil {
+		return nil, err
+	}
+
+	signature, err := encoding.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKey(storedPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := pub.verify(signed, signature); err != nil {
+		return nil, err
+	}
+
+	result := &AssertionResult{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}
+	// authenticators that do not implement a counter always send zero
+	if (authData.signCount != 0 || storedSignCount != 0) && authData.signCount <= storedSignCount {
+		return result, ErrPossibleClone
+	}
+	return result, nil
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony, challenge string) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return err
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("webauthn: wrong client data type %q", cd.Type)
+	}
+	expected, err := encoding.DecodeString(challenge)
+	if err != nil || len(expected) == 0 {
+		return ErrChallenge
+	}
+	received, err := encoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(expected, received) != 1 {
+		return ErrChallenge
+	}
+	for _, origin := range rp.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return ErrOrigin
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(authData *authenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return ErrRelyingParty
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return ErrUserPresence
+	}
+	if requireUserVerification && authData.flags&flagUserVerified == 0 {
+		return ErrUserVerification
+	}
+	return nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+	if ad.flags&flagAttestedCredData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("webauthn: attested credential data too short")
+		}
+		ad.aaguid = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return nil, errors.New("webauthn: invalid credential id length")
+		}
+		ad.credentialID = rest[:idLen]
+		rest = rest[idLen:]
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		ad.publicKey = rest[:n]
+		rest = rest[n:]
+	}
+	if ad.flags&flagExtensionData != 0 {
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("webauthn: trailing bytes in authenticator data")
+	}
+	return ad, nil
+}
+
+// verifyAttestationStatement checks the attestation formats we accept. We ask for "none" so
+// most browsers strip attestation; "packed" is verified when an authenticator still sends it.
+// We do not check attestation certificates against a trust store.
+func verifyAttestationStatement(format string, attStmt map[interface{}]interface{}, signed []byte, credentialKey *publicKey) error {
+	switch format {
+	case "none":
+		return nil
+	case "packed":
+		alg, _ := attStmt["alg"].(int64)
+		sig, _ := attStmt["sig"].([]byte)
+		x5c, hasCerts := attStmt["x5c"].([]interface{})
+		if !hasCerts {
+			// self attestation is signed with the credential key itself
+			if int(alg) != credentialKey.alg {
+				return errors.New("webauthn: self attestation algorithm mismatch")
+			}
+			return credentialKey.verify(signed, sig)
+		}
+		if len(x5c) == 0 {
+			return errors.New("webauthn: empty attestation certificate chain")
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		var sigAlg x509.SignatureAlgorithm
+		switch alg {
+		case AlgES256:
+			sigAlg = x509.ECDSAWithSHA256
+		case AlgRS256:
+			sigAlg = x509.SHA256WithRSA
+		case AlgEdDSA:
+			sigAlg = x509.PureEd25519
+		default:
+			return fmt.Errorf("webauthn: unsupported attestation algorithm %d", alg)
+		}
+		return cert.CheckSignature(sigAlg, signed, sig)
+	}
+	return fmt.Errorf("webauthn: unsupported attestation format %q", format)
+}
@@ -0,0 +1,242 @@
+//go:build unit
+
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testRP = RelyingParty{
+	ID:      "localhost",
+	Name:    "Imperator",
+	Origins: []string{"http://localhost:4000"},
+}
+
+// cborPair keeps map entries in a fixed order for encoding
+type cborPair struct {
+	key interface{}
+	val interface{}
+}
+
+// encodeCBOR is a tiny encoder for the values a software authenticator needs to produce
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+	switch x := v.(type) {
+	case int:
+		if x >= 0 {
+			return head(0, uint64(x))
+		}
+		return head(1, uint64(-1-x))
+	case []byte:
+		return append(head(2, uint64(len(x))), x...)
+	case string:
+		return append(head(3, uint64(len(x))), x...)
+	case []cborPair:
+		out := head(5, uint64(len(x)))
+		for _, p := range x {
+			out = append(out, encodeCBOR(p.key)...)
+			out = append(out, encodeCBOR(p.val)...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+// softAuthenticator acts like a security key so we can run both ceremonies in tests
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+	userHandle   []byte
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id, rpID: testRP.ID, origin: testRP.Origins[0]}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR([]cborPair{
+		{1, coseKtyEC2}, {3, AlgES256}, {-1, coseCrvP256}, {-2, x}, {-3, y},
+	})
+}
+
+func (a *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	out := append([]byte{}, rpIDHash[:]...)
+	out = append(out, flags)
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, a.signCount)
+	out = append(out, count...)
+	if attested {
+		out = append(out, make([]byte, 16)...)
+		idLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(idLen, uint16(len(a.credentialID)))
+		out = append(out, idLen...)
+		out = append(out, a.credentialID...)
+		out = append(out, a.coseKey()...)
+	}
+	return out
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	out, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return out
+}
+
+func (a *softAuthenticator) create(challenge string) RegistrationResponse {
+	authData := a.authData(flagUserPresent|flagUserVerified|flagAttestedCredData, true)
+	attestation := encodeCBOR([]cborPair{
+		{"fmt", "none"}, {"attStmt", []cborPair{}}, {"authData", authData},
+	})
+	var resp RegistrationResponse
+	resp.ID = encoding.EncodeToString(a.credentialID)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = encoding.EncodeToString(a.clientData("webauthn.create", challenge))
+	resp.Response.AttestationObject = encoding.EncodeToString(attestation)
+	return resp
+}
+
+func (a *softAuthenticator) get(t *testing.T, challenge string, flags byte) AssertionResponse {
+	a.signCount++
+	authData := a.authData(flags, false)
+	cd := a.clientData("webauthn.get", challenge)
+	hash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp AssertionResponse
+	resp.ID = encoding.EncodeToString(a.credentialID)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = encoding.EncodeToString(cd)
+	resp.Response.AuthenticatorData = encoding.EncodeToString(authData)
+	resp.Response.Signature = encoding.EncodeToString(sig)
+	resp.Response.UserHandle = encoding.EncodeToString(a.userHandle)
+	return resp
+}
+
+func TestRelyingParty_Ceremonies(t *testing.T) {
+	auth := newSoftAuthenticator(t)
+
+	challenge, _ := NewChallenge()
+	cred, err := testRP.VerifyRegistration(auth.create(challenge), challenge, true)
+	if err != nil {
+		t.Fatal("failed to verify registration:", err)
+	}
+	if string(cred.ID) != string(auth.credentialID) {
+		t.Error("wrong credential id returned")
+	}
+
+	challenge, _ = NewChallenge()
+	res, err := testRP.VerifyAssertion(auth.get(t, challenge, flagUserPresent|flagUserVerified), challenge, cred.PublicKey, cred.SignCount, true)
+	if err != nil {
+		t.Fatal("failed to verify assertion:", err)
+	}
+	if res.SignCount != 1 {
+		t.Error("expected sign count 1 and got", res.SignCount)
+	}
+
+	// a cloned authenticator replays an old counter
+	challenge, _ = NewChallenge()
+	auth.signCount = 0
+	_, err = testRP.VerifyAssertion(auth.get(t, challenge, flagUserPresent), challenge, cred.PublicKey, res.SignCount, false)
+	if !errors.Is(err, ErrPossibleClone) {
+		t.Error("expected clone detection and got:", err)
+	}
+}
+
+func TestRelyingParty_Rejections(t *testing.T) {
+	auth := newSoftAuthenticator(t)
+	challenge, _ := NewChallenge()
+	cred, err := testRP.VerifyRegistration(auth.create(challenge), challenge, false)
+	if err != nil {
+		t.Fatal("failed to verify registration:", err)
+	}
+
+	other, _ := NewChallenge()
+	if _, err := testRP.VerifyRegistration(auth.create(challenge), other, false); !errors.Is(err, ErrChallenge) {
+		t.Error("expected challenge mismatch and got:", err)
+	}
+
+	challenge, _ = NewChallenge()
+	if _, err := testRP.VerifyAssertion(auth.get(t, challenge, flagUserPresent), challenge, cred.PublicKey, 0, true); !errors.Is(err, ErrUserVerification) {
+		t.Error("expected missing user verification and got:", err)
+	}
+
+	auth.origin = "https://evil.example.com"
+	challenge, _ = NewChallenge()
+	if _, err := testRP.VerifyAssertion(auth.get(t, challenge, flagUserPresent), challenge, cred.PublicKey, 0, false); !errors.Is(err, ErrOrigin) {
+		t.Error("expected origin mismatch and got:", err)
+	}
+
+	auth.origin = testRP.Origins[0]
+	auth.rpID = "evil.example.com"
+	challenge, _ = NewChallenge()
+	if _, err := testRP.VerifyAssertion(auth.get(t, challenge, flagUserPresent), challenge, cred.PublicKey, 0, false); !errors.Is(err, ErrRelyingParty) {
+		t.Error("expected relying party mismatch and got:", err)
+	}
+
+	auth.rpID = testRP.ID
+	challenge, _ = NewChallenge()
+	resp := auth.get(t, challenge, flagUserPresent)
+	resp.Response.Signature = encoding.EncodeToString([]byte("not a signature"))
+	if _, err := testRP.VerifyAssertion(resp, challenge, cred.PublicKey, 0, false); !errors.Is(err, ErrInvalidSignature) {
+		t.Error("expected invalid signature and got:", err)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	data := encodeCBOR([]cborPair{{"a", 1}, {-2, []byte{1, 2}}, {"long", -500}})
+	v, n, err := decodeCBOR(append(data, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("expected %d bytes consumed and got %d", len(data), n)
+	}
+	m := v.(map[interface{}]interface{})
+	if m["a"] != int64(1) || m["long"] != int64(-500) || len(m[int64(-2)].([]byte)) != 2 {
+		t.Error("wrong values decoded:", m)
+	}
+
+	if _, _, err := decodeCBOR(data[:len(data)-1]); err == nil {
+		t.Error("truncated data decoded without error")
+	}
+}
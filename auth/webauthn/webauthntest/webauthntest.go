@@ -0,0 +1,182 @@
+// Package webauthntest is a software authenticator for tests. It holds one ES256 credential and
+// answers the registration and authentication ceremonies like a security key would, with "none"
+// attestation.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"imperatorapp/auth/webauthn"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// COSE key type and curve of the credential
+const (
+	coseKtyEC2  = 2
+	coseCrvP256 = 1
+)
+
+var encoding = base64.RawURLEncoding
+
+// Authenticator is a security key with a single credential for the relying party RPID, it signs
+// client data for Origin. UserHandle is returned with assertions like a discoverable credential.
+type Authenticator struct {
+	RPID         string
+	Origin       string
+	CredentialID []byte
+	UserHandle   []byte
+	SignCount    uint32
+
+	key *ecdsa.PrivateKey
+}
+
+// New returns an authenticator with a new credential for the relying party
+func New(rpID, origin string) *Authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return &Authenticator{RPID: rpID, Origin: origin, CredentialID: id, key: key}
+}
+
+// PublicKey returns the CBOR encoded COSE key of the credential as the relying party stores it
+func (a *Authenticator) PublicKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR([]pair{
+		{1, coseKtyEC2}, {3, webauthn.AlgES256}, {-1, coseCrvP256}, {-2, x}, {-3, y},
+	})
+}
+
+// Create answers navigator.credentials.create for the challenge
+func (a *Authenticator) Create(challenge string) webauthn.RegistrationResponse {
+	authData := a.authData(flagUserPresent|flagUserVerified|flagAttestedCredData, true)
+	attestation := encodeCBOR([]pair{
+		{"fmt", "none"}, {"attStmt", []pair{}}, {"authData", authData},
+	})
+	var resp webauthn.RegistrationResponse
+	resp.ID = encoding.EncodeToString(a.CredentialID)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = encoding.EncodeToString(a.clientData("webauthn.create", challenge))
+	resp.Response.AttestationObject = encoding.EncodeToString(attestation)
+	return resp
+}
+
+// Get answers navigator.credentials.get for the challenge, userVerified tells whether the
+// authenticator checked a PIN or biometric. Every assertion increases the signature counter.
+func (a *Authenticator) Get(challenge string, userVerified bool) webauthn.AssertionResponse {
+	a.SignCount++
+	flags := byte(flagUserPresent)
+	if userVerified {
+		flags |= flagUserVerified
+	}
+	authData := a.authData(flags, false)
+	clientData := a.clientData("webauthn.get", challenge)
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	var resp webauthn.AssertionResponse
+	resp.ID = encoding.EncodeToString(a.CredentialID)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = encoding.EncodeToString(clientData)
+	resp.Response.AuthenticatorData = encoding.EncodeToString(authData)
+	resp.Response.Signature = encoding.EncodeToString(sig)
+	resp.Response.UserHandle = encoding.EncodeToString(a.UserHandle)
+	return resp
+}
+
+// authData builds the authenticator data, attested adds the credential for a registration
+func (a *Authenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+	out := append([]byte{}, rpIDHash[:]...)
+	out = append(out, flags)
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, a.SignCount)
+	out = append(out, count...)
+	if attested {
+		// the aaguid of an authenticator that does not tell its model
+		out = append(out, make([]byte, 16)...)
+		idLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(idLen, uint16(len(a.CredentialID)))
+		out = append(out, idLen...)
+		out = append(out, a.CredentialID...)
+		out = append(out, a.PublicKey()...)
+	}
+	return out
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) []byte {
+	out, _ := json.Marshal(struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{ceremony, challenge, a.Origin})
+	return out
+}
+
+// pair keeps map entries in a fixed order for encoding
+type pair struct {
+	key interface{}
+	val interface{}
+}
+
+// encodeCBOR encodes the few CBOR types an authenticator needs to produce
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+	switch x := v.(type) {
+	case int:
+		if x >= 0 {
+			return head(0, uint64(x))
+		}
+		return head(1, uint64(-1-x))
+	case []byte:
+		return append(head(2, uint64(len(x))), x...)
+	case string:
+		return append(head(3, uint64(len(x))), x...)
+	case []pair:
+		out := head(5, uint64(len(x)))
+		for _, p := range x {
+			out = append(out, encodeCBOR(p.key)...)
+			out = append(out, encodeCBOR(p.val)...)
+		}
+		return out
+	}
+	panic("webauthntest: unsupported cbor type")
+}
@@ -2,16 +2,18 @@ module imperatorapp
 
 go 1.23.0
 
-replace github.com/arc41t3ct/imperator => ../imperator
+replace github.com/arc41t3ct/imperator => ./imperator
 
 require (
 	github.com/CloudyKit/jet/v6 v6.2.0
 	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/alexedwards/scs/v2 v2.8.0
 	github.com/arc41t3ct/imperator v0.0.0-20241021230139-888751a00383
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/jackc/pgconn v1.14.3
 	github.com/jackc/pgx/v4 v4.18.3
 	github.com/ory/dockertest/v3 v3.11.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/upper/db/v4 v4.9.0
 	golang.org/x/crypto v0.28.0
 )
@@ -29,7 +31,6 @@ require (
 	github.com/alexedwards/scs/mysqlstore v0.0.0-20240316134038-7e11d57e8885 // indirect
 	github.com/alexedwards/scs/postgresstore v0.0.0-20240316134038-7e11d57e8885 // indirect
 	github.com/alexedwards/scs/redisstore v0.0.0-20240316134038-7e11d57e8885 // indirect
-	github.com/alexedwards/scs/v2 v2.8.0 // indirect
 	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/asaskevich/govalidator v0.0.0-20230301143203-a9d515a09cc2 // indirect
 	github.com/bwmarrin/go-alone v0.0.0-20190806015146-742bb55d1631 // indirect
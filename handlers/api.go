@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"errors"
+	"imperatorapp/middleware"
+	"imperatorapp/models"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	chi "github.com/go-chi/chi/v5"
+	up "github.com/upper/db/v4"
+)
+
+// apiDefaultTokenDays is the lifetime of tokens issued by the api when no expiry is requested
+const apiDefaultTokenDays = 30
+
+// apiMaxPerPage caps the per_page parameter of api lists
+const apiMaxPerPage = 100
+
+// apiResponse is the envelope of every api response
+type apiResponse struct {
+	Error   bool              `json:"error"`
+	Message string            `json:"message,omitempty"`
+	Data    interface{}       `json:"data,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// apiUser is the representation of a user in the api
+type apiUser struct {
+	ID        int       `json:"id"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// apiUserInput is the body accepted when creating or updating a user, fields that are left out
+// are not changed on update
+type apiUserInput struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	Active    *bool   `json:"active"`
+	Password  *string `json:"password"`
+}
+
+// apiUserList is the data of a page of users
+type apiUserList struct {
+	Users   []apiUser `json:"users"`
+	Total   int       `json:"total"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+}
+
+// apiToken is the representation of a token in the api, the plain text is only set once
+type apiToken struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	Expires   *time.Time `json:"expires"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func newAPIUser(u *models.User) apiUser {
+	return apiUser{
+		ID:        u.ID,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Email:     u.Email,
+		Active:    u.Active == 1,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// APIUsers lists users with the same search, sort and page parameters as the admin user list
+func (h *Handlers) APIUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage < 1 || perPage > apiMaxPerPage {
+		perPage = usersPerPage
+	}
+
+	users, total, err := h.models(r).Users.Search(q.Get("q"), q.Get("sort"), q.Get("dir") == "desc", page, perPage)
+	if err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	list := apiUserList{Users: []apiUser{}, Total: total, Page: page, PerPage: perPage}
+	for _, u := range users {
+		list.Users = append(list.Users, newAPIUser(u))
+	}
+	h.apiWrite(w, http.StatusOK, apiResponse{Data: list})
+}
+
+// APIUser returns a single user
+func (h *Handlers) APIUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.apiUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	h.apiWrite(w, http.StatusOK, apiResponse{Data: newAPIUser(user)})
+}
+
+// APIUserCreate creates a user
+func (h *Handlers) APIUserCreate(w http.ResponseWriter, r *http.Request) {
+	var input apiUserInput
+	if err := h.App.RequestReadJSON(w, r, &input); err != nil {
+		h.apiError(w, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
+	}
+
+	user := &models.User{Active: 1}
+	input.apply(user)
+	validator := h.App.GetValidator()
+	user.Validate(validator)
+	h.models(r).Users.ValidateUniqueEmail(validator, 0, user.Email)
+	var password string
+	if input.Password != nil {
+		password = *input.Password
+	}
+	h.validatePassword(r, validator, password, user)
+	if !validator.Valid() {
+		h.apiValidationError(w, validator.Errors)
+		return
+	}
+
+	user.Password = password
+	// users created by an admin do not have to verify their email
+	verifiedAt := time.Now()
+	user.EmailVerifiedAt = &verifiedAt
+	id, err := h.models(r).Users.Insert(*user)
+	if err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	user, err = h.models(r).Users.Get(id)
+	if err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	h.audit(r, models.AuditUserCreated, user, h.auditDiff(models.User{ID: user.ID}, *user))
+	h.apiWrite(w, http.StatusCreated, apiResponse{Message: "user created", Data: newAPIUser(user)})
+}
+
+// APIUserUpdate changes the fields of a user that are present in the body
+func (h *Handlers) APIUserUpdate(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.apiManagedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	var input apiUserInput
+	if err := h.App.RequestReadJSON(w, r, &input); err != nil {
+		h.apiError(w, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
+	}
+	before := *user
+
+	input.apply(user)
+	validator := h.App.GetValidator()
+	user.Validate(validator)
+	h.models(r).Users.ValidateUniqueEmail(validator, user.ID, user.Email)
+	validator.Check(input.Password == nil, "password", "Passwords can not be changed through the api")
+	if user.ID == middleware.TokenUser(r.Context()).ID {
+		validator.Check(user.Active == 1, "active", "You can not deactivate your own account")
+	}
+	if !validator.Valid() {
+		h.apiValidationError(w, validator.Errors)
+		return
+	}
+
+	if err := h.models(r).Users.Update(*user); err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	if before.Active == 1 && user.Active != 1 {
+		if err := h.revokeAccess(r, user.ID); err != nil {
+			h.apiServerError(w, err)
+			return
+		}
+	}
+	h.audit(r, models.AuditUserUpdated, user, h.auditDiff(before, *user))
+	h.apiWrite(w, http.StatusOK, apiResponse{Message: "user updated", Data: newAPIUser(user)})
+}
+
+// APIUserDelete deletes a user, the user of the token can not delete themselves
+func (h *Handlers) APIUserDelete(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.apiManagedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == middleware.TokenUser(r.Context()).ID {
+		h.apiError(w, http.StatusConflict, "you can not delete your own account")
+		return
+	}
+	if err := h.models(r).Users.Delete(user.ID); err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	h.audit(r, models.AuditUserDeleted, user, "")
+	h.apiWrite(w, http.StatusOK, apiResponse{Message: "user deleted"})
+}
+
+// APITokenCreate issues a token for the email and password in the body. Users with two-factor
+// authentication must also send the current totp code, users whose only second factor is a
+// passkey can not get a token here since json clients can not do webauthn.
+func (h *Handlers) APITokenCreate(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email         string   `json:"email"`
+		Password      string   `json:"password"`
+		Code          string   `json:"code"`
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays *int     `json:"expires_in_days"`
+	}
+	if err := h.App.RequestReadJSON(w, r, &input); err != nil {
+		h.apiError(w, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return
+	}
+
+	validator := h.App.GetValidator()
+	validator.Check(input.Email != "", "email", "Email is required")
+	validator.Check(input.Password != "", "password", "Password is required")
+	validator.Check(input.ExpiresInDays == nil || *input.ExpiresInDays >= 0, "expires_in_days", "Expiry can not be negative")
+	scopes := h.models(r).Tokens.ValidScopes(input.Scopes)
+	if input.Scopes == nil {
+		scopes = h.models(r).Tokens.ValidScopes([]string{models.ScopeUsersRead})
+	}
+	validator.Check(scopes != "", "scopes", "Request at least one known scope")
+	if !validator.Valid() {
+		h.apiValidationError(w, validator.Errors)
+		return
+	}
+
+	email := strings.TrimSpace(input.Email)
+	if wait, message := h.loginAllowed(r, email); message != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		h.apiError(w, http.StatusTooManyRequests, message)
+		return
+	}
+	// the password is checked like on the login form, against the directory when LDAP is set up
+	user, err := h.authenticator().Authenticate(r, email, input.Password)
+	if errors.Is(err, errLoginFailed) {
+		h.loginFailed(r, email, user)
+		h.apiError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	if err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	if !user.IsVerified() {
+		h.apiError(w, http.StatusForbidden, "verify your email before creating a token")
+		return
+	}
+	if user.Active != 1 {
+		h.apiError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	if h.requiresSecondFactor(r, user) {
+		if !user.HasTwoFactor() {
+			h.apiError(w, http.StatusForbidden, "this account signs in with a passkey, create tokens on the tokens page instead")
+			return
+		}
+		secret, err := h.decrypt(user.TOTPSecret)
+		if err != nil {
+			h.apiServerError(w, err)
+			return
+		}
+		verified, err := h.useTOTPCode(r, user.ID, input.Code, secret)
+		if err != nil {
+			h.apiServerError(w, err)
+			return
+		}
+		if !verified {
+			h.loginFailed(r, email, user)
+			h.apiError(w, http.StatusUnauthorized, "invalid or missing two-factor code")
+			return
+		}
+	}
+	h.loginSucceeded(r, email)
+
+	days := apiDefaultTokenDays
+	if input.ExpiresInDays != nil {
+		days = *input.ExpiresInDays
+	}
+	token, err := h.models(r).Tokens.GenerateToken(user.ID, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	token.Name = strings.TrimSpace(input.Name)
+	if token.Name == "" {
+		token.Name = "api"
+	}
+	token.Scopes = scopes
+	id, err := h.models(r).Tokens.Insert(*token, *user)
+	if err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+
+	h.apiWrite(w, http.StatusCreated, apiResponse{
+		Message: "token created",
+		Data: apiToken{
+			ID:        id,
+			Name:      token.Name,
+			Token:     token.PlainText,
+			Scopes:    token.ScopeList(),
+			Expires:   token.Expires,
+			CreatedAt: time.Now(),
+		},
+	})
+}
+
+// APITokenRevoke revokes the token of the request or, given an id, another token of the same user
+func (h *Handlers) APITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	user := middleware.TokenUser(r.Context())
+	id := user.Token.ID
+	if param := chi.URLParam(r, "id"); param != "" {
+		var err error
+		if id, err = strconv.Atoi(param); err != nil {
+			h.apiError(w, http.StatusNotFound, "token not found")
+			return
+		}
+	}
+
+	token, err := h.models(r).Tokens.Get(id)
+	if err != nil || token.UserID != user.ID {
+		h.apiError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if err := h.models(r).Tokens.Delete(token.ID); err != nil {
+		h.apiServerError(w, err)
+		return
+	}
+	h.apiWrite(w, http.StatusOK, apiResponse{Message: "token revoked"})
+}
+
+// apply copies the fields present in the input onto the user
+func (in apiUserInput) apply(user *models.User) {
+	if in.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*in.FirstName)
+	}
+	if in.LastName != nil {
+		user.LastName = strings.TrimSpace(*in.LastName)
+	}
+	if in.Email != nil {
+		user.Email = strings.ToLower(strings.TrimSpace(*in.Email))
+	}
+	if in.Active != nil {
+		user.Active = 0
+		if *in.Active {
+			user.Active = 1
+		}
+	}
+}
+
+// apiUserFromURL loads the user given by the id url parameter and writes a 404 when there is none
+func (h *Handlers) apiUserFromURL(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.apiError(w, http.StatusNotFound, "user not found")
+		return nil, false
+	}
+	user, err := h.models(r).Users.Get(id)
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.apiServerError(w, err)
+			return nil, false
+		}
+		h.apiError(w, http.StatusNotFound, "user not found")
+		return nil, false
+	}
+	return user, true
+}
+
+// apiManagedUserFromURL loads the user from the url for a change, the user of the token has to
+// outrank them like on the admin screens
+func (h *Handlers) apiManagedUserFromURL(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, ok := h.apiUserFromURL(w, r)
+	if !ok {
+		return nil, false
+	}
+	allowed, err := h.outranks(r, middleware.TokenUser(r.Context()).ID, user.ID)
+	if err != nil {
+		h.apiServerError(w, err)
+		return nil, false
+	}
+	if !allowed {
+		h.apiError(w, http.StatusForbidden, "the user has permissions you do not have")
+		return nil, false
+	}
+	return user, true
+}
+
+// apiWrite writes the envelope as json
+func (h *Handlers) apiWrite(w http.ResponseWriter, status int, payload apiResponse) {
+	if err := h.renderJSON(w, payload, status); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// apiError writes an error envelope with the message
+func (h *Handlers) apiError(w http.ResponseWriter, status int, message string) {
+	h.apiWrite(w, status, apiResponse{Error: true, Message: message})
+}
+
+// apiValidationError writes the validation errors of each field
+func (h *Handlers) apiValidationError(w http.ResponseWriter, fieldErrors map[string]string) {
+	h.apiWrite(w, http.StatusUnprocessableEntity, apiResponse{Error: true, Message: "validation failed", Errors: fieldErrors})
+}
+
+// apiServerError logs the error and writes a generic error envelope
+func (h *Handlers) apiServerError(w http.ResponseWriter, err error) {
+	h.App.ErrorLog.Println(err)
+	h.apiError(w, http.StatusInternalServerError, "internal server error")
+}
+
+// APINotFound answers unknown api routes with a json error
+func (h *Handlers) APINotFound(w http.ResponseWriter, r *http.Request) {
+	h.apiError(w, http.StatusNotFound, "not found")
+}
+
+// APIMethodNotAllowed answers api routes called with the wrong method with a json error
+func (h *Handlers) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	h.apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
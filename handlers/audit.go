@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/middleware"
+	"imperatorapp/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jet "github.com/CloudyKit/jet/v6"
+	chimw "github.com/go-chi/chi/v5/middleware"
+)
+
+// auditPerPage is the number of events shown on one page of the audit log
+const auditPerPage = 50
+
+// auditDateFormat is the format of the from and to filters
+const auditDateFormat = "2006-01-02"
+
+// audit records an event done by the logged in user or by the user of the api token
+func (h *Handlers) audit(r *http.Request, action string, target *models.User, changes string) {
+	h.auditActor(r, newAuditEvent(action, target, changes))
+}
+
+// auditActor records an event about any target done by the logged in user or by the user of the
+// api token
+func (h *Handlers) auditActor(r *http.Request, event models.AuditEvent) {
+	if actor := middleware.TokenUser(r.Context()); actor != nil {
+		event.ActorID, event.ActorEmail = actor.ID, actor.Email
+	} else if id := h.App.Session.GetInt(r.Context(), "userID"); id != 0 {
+		event.ActorID = id
+		if actor, err := h.models(r).Users.Get(id); err == nil {
+			event.ActorEmail = actor.Email
+		}
+		// an admin logged in as the user did it, both are named
+		if adminID := h.App.Session.GetInt(r.Context(), sessions.ImpersonatorKey); adminID != 0 {
+			event.ActorID = adminID
+			if admin, err := h.models(r).Users.Get(adminID); err == nil {
+				event.ActorEmail = fmt.Sprintf("%s as %s", admin.Email, event.ActorEmail)
+			}
+		}
+	}
+	h.recordAudit(r, event)
+}
+
+// auditAnonymous records an event of a visitor who is not logged in, like a failed login.
+// target is nil when the email does not belong to any user, label then names what was tried.
+func (h *Handlers) auditAnonymous(r *http.Request, action string, target *models.User, label string) {
+	event := newAuditEvent(action, target, "")
+	if target == nil {
+		event.TargetType = "user"
+		event.TargetLabel = label
+	}
+	h.recordAudit(r, event)
+}
+
+// recordAudit adds the details of the request to the event and stores it, failures are logged
+// since they must not stop the request
+func (h *Handlers) recordAudit(r *http.Request, event models.AuditEvent) {
+	event.IP = remoteIP(r)
+	event.UserAgent = r.UserAgent()
+	event.RequestID = chimw.GetReqID(r.Context())
+	if _, err := h.models(r).AuditEvents.Insert(event); err != nil {
+		h.App.Log(r).Error("failed to record audit event", "action", event.Action, "err", err)
+	}
+}
+
+func newAuditEvent(action string, target *models.User, changes string) models.AuditEvent {
+	event := models.AuditEvent{Action: action, Changes: changes}
+	if target != nil {
+		event.TargetType = "user"
+		event.TargetID = target.ID
+		event.TargetLabel = target.Email
+	}
+	return event
+}
+
+// auditDiff returns the changes between two versions of a model for the audit log
+func (h *Handlers) auditDiff(before, after interface{}) string {
+	changes, err := models.AuditDiff(before, after)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to diff audit changes with err:", err)
+	}
+	return changes
+}
+
+// AuditLog lists the audit events with filters
+func (h *Handlers) AuditLog(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: AuditLog")
+	filter, values := auditFilterFromURL(r)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	events, total, err := h.models(r).AuditEvents.Search(filter, page, auditPerPage)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+
+	// pageURL keeps the current filters when building page links
+	pageURL := func(page int) string {
+		v := url.Values{}
+		for key := range values {
+			v.Set(key, values.Get(key))
+		}
+		if page > 1 {
+			v.Set("page", strconv.Itoa(page))
+		}
+		return "/admin/audit?" + v.Encode()
+	}
+	var prevURL, nextURL string
+	if page > 1 {
+		prevURL = pageURL(page - 1)
+	}
+	if page*auditPerPage < total {
+		nextURL = pageURL(page + 1)
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("events", events)
+	vars.Set("total", total)
+	for _, key := range []string{"actor", "target", "action", "from", "to"} {
+		vars.Set(key, values.Get(key))
+	}
+	vars.Set("actions", models.AuditActions)
+	vars.Set("prevURL", prevURL)
+	vars.Set("nextURL", nextURL)
+	vars.Set("exportURL", "/admin/audit/export?"+values.Encode())
+	if err := h.render(w, r, "audit", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// AuditExport downloads the audit events matching the filters as csv
+func (h *Handlers) AuditExport(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: AuditExport")
+	filter, _ := auditFilterFromURL(r)
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%s.csv\"", time.Now().Format("20060102")))
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"time", "action", "actor_id", "actor", "target_type", "target_id", "target", "ip", "user_agent", "request_id", "changes"})
+	err := h.models(r).AuditEvents.Each(filter, func(e *models.AuditEvent) error {
+		return out.Write([]string{
+			e.CreatedAt.Format(time.RFC3339),
+			e.Action,
+			strconv.Itoa(e.ActorID),
+			csvCell(e.ActorEmail),
+			e.TargetType,
+			strconv.Itoa(e.TargetID),
+			csvCell(e.TargetLabel),
+			csvCell(e.IP),
+			csvCell(e.UserAgent),
+			csvCell(e.RequestID),
+			csvCell(e.Changes),
+		})
+	})
+	out.Flush()
+	if err == nil {
+		err = out.Error()
+	}
+	if err != nil {
+		// the header is already sent, all that is left is to log it
+		h.App.ErrorLog.Println("failed to export audit log with err:", err)
+	}
+}
+
+// csvCell keeps spreadsheets from running a value as a formula, users choose their names, user
+// agents and the labels of what they change, so a leading =, +, -, @, tab or carriage return is
+// escaped with a quote
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// auditFilterFromURL reads the filters from the query string, values holds the valid filters
+// to build links with
+func auditFilterFromURL(r *http.Request) (models.AuditFilter, url.Values) {
+	q := r.URL.Query()
+	values := url.Values{}
+	var filter models.AuditFilter
+	if filter.Actor = strings.TrimSpace(q.Get("actor")); filter.Actor != "" {
+		values.Set("actor", filter.Actor)
+	}
+	if filter.Target = strings.TrimSpace(q.Get("target")); filter.Target != "" {
+		values.Set("target", filter.Target)
+	}
+	if filter.Action = q.Get("action"); filter.Action != "" {
+		values.Set("action", filter.Action)
+	}
+	// events are stored in local time
+	if from, err := time.ParseInLocation(auditDateFormat, q.Get("from"), time.Local); err == nil {
+		filter.From = from
+		values.Set("from", q.Get("from"))
+	}
+	if to, err := time.ParseInLocation(auditDateFormat, q.Get("to"), time.Local); err == nil {
+		// the to date is inclusive
+		filter.To = to.AddDate(0, 0, 1)
+		values.Set("to", q.Get("to"))
+	}
+	return filter, values
+}
@@ -0,0 +1,23 @@
+//go:build unit
+
+package handlers
+
+import "testing"
+
+func TestCSVCell(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                         "",
+		"ada@example.com":          "ada@example.com",
+		"=HYPERLINK(\"http://x\")": "'=HYPERLINK(\"http://x\")",
+		"+1234":                    "'+1234",
+		"-2+3":                     "'-2+3",
+		"@SUM(A1)":                 "'@SUM(A1)",
+		"\t=1":                     "'\t=1",
+		"\r=1":                     "'\r=1",
+		"Mozilla/5.0 =1":           "Mozilla/5.0 =1",
+	} {
+		if got := csvCell(value); got != expected {
+			t.Errorf("csvCell(%q) = %q, expected %q", value, got, expected)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"imperatorapp/auth/ldap"
+	"imperatorapp/models"
+	"net/http"
+	"sort"
+	"strings"
+
+	up "github.com/upper/db/v4"
+)
+
+// ldapProvider is the provider of the identities linking users to their directory entries
+const ldapProvider = "ldap"
+
+// errLoginFailed is returned by an authenticator when the login or the password is wrong
+var errLoginFailed = errors.New("login failed")
+
+// Authenticator checks the credentials of the login form and returns the user they belong to.
+// With errLoginFailed the user is the account of the login when there is one, so the failure
+// counts against it. Other errors mean the credentials could not be checked.
+type Authenticator interface {
+	Authenticate(r *http.Request, login, password string) (*models.User, error)
+}
+
+// authenticator returns the authenticator of the login form, the directory when LDAP is set up
+func (h *Handlers) authenticator() Authenticator {
+	local := &localAuthenticator{h: h}
+	if h.LDAP == nil {
+		return local
+	}
+	return &ldapAuthenticator{h: h, directory: h.LDAP, local: local}
+}
+
+// passwordlessAllowed reports whether the user may log in without the password of the login form,
+// with LDAP only the accounts that may fall back to their local password may
+func (h *Handlers) passwordlessAllowed(r *http.Request, user *models.User) bool {
+	if h.LDAP == nil {
+		return true
+	}
+	allowed, err := (&ldapAuthenticator{h: h, directory: h.LDAP}).allowsLocal(r, user)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to check local login with err:", err)
+		return false
+	}
+	return allowed
+}
+
+// localAuthenticator checks the password of the account with the email
+type localAuthenticator struct {
+	h *Handlers
+}
+
+func (a *localAuthenticator) Authenticate(r *http.Request, login, password string) (*models.User, error) {
+	user, err := a.h.models(r).Users.GetByEmail(login)
+	if err != nil {
+		// an unknown email would fail faster than a wrong password without a hash to check
+		a.h.models(r).Users.PasswordMatchesNone(password)
+		return nil, errLoginFailed
+	}
+	matches, err := user.PasswordMatches(password)
+	if err != nil {
+		return nil, err
+	}
+	if !matches {
+		return user, errLoginFailed
+	}
+	return user, nil
+}
+
+// ldapAuthenticator checks the password against the directory. Local accounts that are not in the
+// directory can only log in with their own password when they have one of the fallback roles,
+// they are the break-glass admins for when the directory is down.
+type ldapAuthenticator struct {
+	h         *Handlers
+	directory *ldap.Directory
+	local     Authenticator
+}
+
+func (a *ldapAuthenticator) Authenticate(r *http.Request, login, password string) (*models.User, error) {
+	entry, err := a.directory.Authenticate(r.Context(), login, password)
+	switch {
+	case err == nil:
+		return a.user(r, entry)
+	case errors.Is(err, ldap.ErrInvalidCredentials):
+		// the directory has the final word on its users, their local password is never tried
+		user, _ := a.h.models(r).Users.GetByEmail(login)
+		return user, errLoginFailed
+	case errors.Is(err, ldap.ErrUserNotFound):
+	default:
+		a.h.App.ErrorLog.Println("failed to check login with the directory with err:", err)
+	}
+
+	user, err := a.local.Authenticate(r, login, password)
+	if err != nil {
+		return user, err
+	}
+	allowed, err := a.allowsLocal(r, user)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return user, errLoginFailed
+	}
+	return user, nil
+}
+
+// allowsLocal reports whether the user may log in with the local password, users linked to the
+// directory never may
+func (a *ldapAuthenticator) allowsLocal(r *http.Request, user *models.User) (bool, error) {
+	identities, err := a.h.models(r).Identities.GetForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, identity := range identities {
+		if identity.Provider == ldapProvider {
+			return false, nil
+		}
+	}
+	roles, err := a.h.models(r).Roles.GetForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	return a.directory.AllowsFallback(names), nil
+}
+
+// user returns the user of the directory entry. It is found by the linked identity, linked by
+// email on the first login or created when provisioning is on. Its roles follow the groups.
+func (a *ldapAuthenticator) user(r *http.Request, entry *ldap.User) (*models.User, error) {
+	h := a.h
+	identity, err := h.models(r).Identities.GetBySubject(ldapProvider, entry.ID)
+	switch {
+	case err == nil:
+		if err := h.models(r).Identities.Touch(identity.ID, entry.Email); err != nil {
+			h.App.ErrorLog.Println(err)
+		}
+		user, err := h.models(r).Users.Get(identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return user, a.syncRoles(r, user, entry)
+	case !errors.Is(err, up.ErrNoMoreRows):
+		return nil, err
+	}
+
+	if entry.Email == "" {
+		return nil, fmt.Errorf("ldap entry %s has no email address", entry.DN)
+	}
+	user, err := h.models(r).Users.GetByEmail(entry.Email)
+	switch {
+	case err == nil:
+		// an unverified account may have been registered by someone else with this email, it is
+		// not linked and the login asks for the verification first
+		if !user.IsVerified() {
+			return user, nil
+		}
+	case errors.Is(err, up.ErrNoMoreRows) && a.directory.Config.Provision:
+		user, err = h.provisionUser(r, entry.Email, entry.FirstName, entry.LastName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision ldap user: %w", err)
+		}
+	case errors.Is(err, up.ErrNoMoreRows):
+		return nil, fmt.Errorf("there is no account for the ldap entry %s", entry.DN)
+	default:
+		return nil, err
+	}
+
+	identity = &models.UserIdentity{
+		UserID:   user.ID,
+		Provider: ldapProvider,
+		Subject:  entry.ID,
+		Email:    entry.Email,
+	}
+	if _, err := h.models(r).Identities.Insert(*identity); err != nil {
+		return nil, fmt.Errorf("failed to link ldap identity: %w", err)
+	}
+	h.recordAudit(r, newAuditEvent(models.AuditIdentityLinked, user, h.auditDiff(models.UserIdentity{}, *identity)))
+	return user, a.syncRoles(r, user, entry)
+}
+
+// auditRoles is the role list of a user in the audit log
+type auditRoles struct {
+	Roles string `db:"roles"`
+}
+
+// syncRoles gives the user the roles its groups are mapped to and takes away the other mapped
+// roles, roles the mapping does not mention are left alone
+func (a *ldapAuthenticator) syncRoles(r *http.Request, user *models.User, entry *ldap.User) error {
+	h := a.h
+	managed := a.directory.ManagedRoles()
+	if len(managed) == 0 {
+		return nil
+	}
+	current, err := h.models(r).Roles.GetForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	var before, after []string
+	for _, role := range current {
+		before = append(before, role.Name)
+		if !contains(managed, role.Name) {
+			ids = append(ids, role.ID)
+			after = append(after, role.Name)
+		}
+	}
+	for _, name := range entry.Roles {
+		role, err := h.models(r).Roles.GetByName(name)
+		if err != nil {
+			h.App.ErrorLog.Printf("ldap groups map to the role %s which could not be loaded: %s", name, err)
+			continue
+		}
+		ids = append(ids, role.ID)
+		after = append(after, role.Name)
+	}
+
+	sort.Strings(before)
+	sort.Strings(after)
+	from, to := auditRoles{strings.Join(before, ",")}, auditRoles{strings.Join(after, ",")}
+	if from == to {
+		return nil
+	}
+	if err := h.models(r).Roles.SetForUser(user.ID, ids); err != nil {
+		return err
+	}
+	h.recordAudit(r, newAuditEvent(models.AuditUserRolesSynced, user, h.auditDiff(from, to)))
+	return nil
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// clientCertificateEmail returns the email of the client certificate the browser presented when
+// the certificate was verified against TLS_CLIENT_CA_FILE. It is the first email of the subject
+// alternative names or the common name when that is an email, "" without a verified certificate.
+func clientCertificateEmail(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if len(leaf.EmailAddresses) > 0 {
+		return strings.ToLower(leaf.EmailAddresses[0])
+	}
+	if strings.Contains(leaf.Subject.CommonName, "@") {
+		return strings.ToLower(leaf.Subject.CommonName)
+	}
+	return ""
+}
+
+// CertificateLogin logs in the user whose email is in the verified client certificate, it is a
+// first factor like the password so users with a second factor still have to provide it
+func (h *Handlers) CertificateLogin(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: CertificateLogin")
+	email := clientCertificateEmail(r)
+	if email == "" {
+		h.App.Session.Put(r.Context(), "error", "Your browser did not present a valid client certificate.")
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+	if _, message := h.loginAllowed(r, email); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := h.models(r).Users.GetByEmail(email)
+	if err != nil || user.Active != 1 || !user.IsVerified() || !h.passwordlessAllowed(r, user) {
+		if err != nil {
+			user = nil
+		}
+		h.loginFailed(r, email, user)
+		h.App.Session.Put(r.Context(), "error", "login failed")
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+	h.loginSucceeded(r, email)
+	h.finishLogin(w, r, user, false)
+}
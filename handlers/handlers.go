@@ -2,19 +2,39 @@ package handlers
 
 import (
 	"context"
+	"imperatorapp/auth/ldap"
+	"imperatorapp/auth/oauth"
+	"imperatorapp/auth/oidc"
+	"imperatorapp/auth/password"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/auth/throttle"
 	"imperatorapp/models"
 	"net/http"
 
 	"github.com/arc41t3ct/imperator"
+	"github.com/arc41t3ct/imperator/render"
 )
 
 type Handlers struct {
-	App    *imperator.Imperator
-	Models models.Models
+	App            *imperator.Imperator
+	Models         models.Models
+	LoginThrottle  *throttle.Login
+	MailThrottle   *throttle.Throttle
+	SessionIndex   *sessions.Index
+	OIDC           *oidc.Registry
+	LDAP           *ldap.Directory
+	OAuth          *oauth.Server
+	PasswordPolicy *password.Policy
 }
 
 // Convenience functions we can use in our handlers
 
+// models - returns the models with their queries bound to the context of the request, so they
+// are canceled with it and show up in its trace
+func (h *Handlers) models(r *http.Request) *models.Models {
+	return h.Models.WithContext(r.Context())
+}
+
 // appName - return the app name
 func (h *Handlers) appName() string {
 	return h.App.AppName
@@ -22,17 +42,85 @@ func (h *Handlers) appName() string {
 
 // render - renders a page using the template engine defined in .env RENDERER
 func (h *Handlers) render(w http.ResponseWriter, r *http.Request, tmpl string, variables, data interface{}) error {
-	return h.App.Render.Page(w, r, tmpl, variables, data)
+	return h.App.Render.Page(w, r, tmpl, variables, h.templateData(r, data))
 }
 
 // renderJet - renders a page using the jet template engine
 func (h *Handlers) renderJet(w http.ResponseWriter, r *http.Request, tmpl string, variables, data interface{}) error {
-	return h.App.Render.JetPage(w, r, tmpl, variables, data)
+	return h.App.Render.JetPage(w, r, tmpl, variables, h.templateData(r, data))
 }
 
 // renderGo - render a page using the go template engine
 func (h *Handlers) renderGo(w http.ResponseWriter, r *http.Request, tmpl string, variables, data interface{}) error {
-	return h.App.Render.GoPage(w, r, tmpl, variables, data)
+	return h.App.Render.GoPage(w, r, tmpl, variables, h.templateData(r, data))
+}
+
+// templateData - adds the can function to the template data so views can check permissions of
+// the logged in user with {{if .Data.can("users.edit")}}
+func (h *Handlers) templateData(r *http.Request, data interface{}) *render.TemplateData {
+	td, ok := data.(*render.TemplateData)
+	if !ok || td == nil {
+		td = &render.TemplateData{}
+	}
+	if td.Data == nil {
+		td.Data = make(map[string]interface{})
+	}
+	var permissions map[string]bool
+	var super bool
+	loaded := false
+	h.impersonationData(r, td)
+	td.Data["can"] = func(permission string) bool {
+		// permissions are loaded once per render on first use
+		if !loaded {
+			loaded = true
+			permissions, super = h.permissions(r)
+		}
+		return super || permissions[permission]
+	}
+	return td
+}
+
+// impersonationData - adds the emails of the admin and the impersonated user for the banner in the
+// base layout
+func (h *Handlers) impersonationData(r *http.Request, td *render.TemplateData) {
+	adminID := h.App.Session.GetInt(r.Context(), sessions.ImpersonatorKey)
+	if adminID == 0 {
+		return
+	}
+	admin, err := h.models(r).Users.Get(adminID)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to load impersonating admin with err:", err)
+		return
+	}
+	td.Data["impersonator"] = admin.Email
+	if user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID")); err == nil {
+		td.Data["impersonated"] = user.Email
+	}
+}
+
+// permissions - returns the permission names of the logged in user and if they are a super admin
+func (h *Handlers) permissions(r *http.Request) (map[string]bool, bool) {
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	if userID == 0 || h.sessionHas(r.Context(), pendingTwoFactorUserID) {
+		return nil, false
+	}
+	super, err := h.models(r).Users.IsSuperAdmin(userID)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to load roles with err:", err)
+		return nil, false
+	}
+	permissions, err := h.models(r).Users.PermissionNames(userID)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to load permissions with err:", err)
+		return nil, false
+	}
+	return permissions, super
+}
+
+// can - checks if the logged in user has the permission
+func (h *Handlers) can(r *http.Request, permission string) bool {
+	permissions, super := h.permissions(r)
+	return super || permissions[permission]
 }
 
 func (h *Handlers) download(w http.ResponseWriter, r *http.Request, path string, file string) error {
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"fmt"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/models"
+	"net/http"
+)
+
+// UserImpersonate logs the admin in as the user from the url so support can see what the user
+// sees. The admin stays the owner of the session and gets back with ImpersonateStop.
+func (h *Handlers) UserImpersonate(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserImpersonate")
+	user, ok := h.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	adminID := h.App.Session.GetInt(r.Context(), "userID")
+	if user.ID == adminID {
+		h.App.Session.Put(r.Context(), "error", "You can not impersonate yourself.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if user.Active != 1 {
+		h.App.Session.Put(r.Context(), "error", "Only active users can be impersonated.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	allowed, err := h.outranks(r, adminID, user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	if !allowed {
+		h.App.Session.Put(r.Context(), "error", fmt.Sprintf("You can not impersonate %s, they have permissions you do not have.", user.Email))
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	// recorded before the swap so the admin is the actor
+	h.audit(r, models.AuditImpersonationStarted, user, "")
+	_ = h.sessionRenew(r.Context())
+	h.App.Session.Put(r.Context(), sessions.ImpersonatorKey, adminID)
+	h.App.Session.Put(r.Context(), "userID", user.ID)
+	h.App.Session.Remove(r.Context(), loginRedirectKey)
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("You are now logged in as %s %s.", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/area", http.StatusSeeOther)
+}
+
+// ImpersonateStop switches the session back to the admin who started the impersonation
+func (h *Handlers) ImpersonateStop(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: ImpersonateStop")
+	if !h.stopImpersonating(r) {
+		http.Redirect(w, r, "/admin/area", http.StatusSeeOther)
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", "You are logged in as yourself again.")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// stopImpersonating gives the session back to the admin and records it, it returns false when
+// the session was not impersonating anyone
+func (h *Handlers) stopImpersonating(r *http.Request) bool {
+	adminID := h.App.Session.GetInt(r.Context(), sessions.ImpersonatorKey)
+	if adminID == 0 {
+		return false
+	}
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.ErrorLog.Println("failed to load impersonated user with err:", err)
+	}
+	_ = h.sessionRenew(r.Context())
+	h.App.Session.Put(r.Context(), "userID", adminID)
+	h.App.Session.Remove(r.Context(), sessions.ImpersonatorKey)
+	h.audit(r, models.AuditImpersonationStopped, user, "")
+	return true
+}
+
+// outranks reports whether the admin holds every permission of the user, nobody can gain
+// permissions by impersonating someone else
+func (h *Handlers) outranks(r *http.Request, adminID, userID int) (bool, error) {
+	super, err := h.models(r).Users.IsSuperAdmin(adminID)
+	if err != nil || super {
+		return super, err
+	}
+	if super, err := h.models(r).Users.IsSuperAdmin(userID); err != nil || super {
+		return false, err
+	}
+	granted, err := h.models(r).Users.PermissionNames(adminID)
+	if err != nil {
+		return false, err
+	}
+	needed, err := h.models(r).Users.PermissionNames(userID)
+	if err != nil {
+		return false, err
+	}
+	for permission := range needed {
+		if !granted[permission] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
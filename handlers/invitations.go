@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"imperatorapp/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jet "github.com/CloudyKit/jet/v6"
+	"github.com/arc41t3ct/imperator/mailer"
+	"github.com/arc41t3ct/imperator/signer"
+	chi "github.com/go-chi/chi/v5"
+	up "github.com/upper/db/v4"
+)
+
+// invitationDays is how long an invitation can be accepted
+const invitationDays = 7
+
+// Invitations lists the invitations that were neither accepted nor revoked
+func (h *Handlers) Invitations(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Invitations")
+	invitations, err := h.models(r).Invitations.Pending()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	names := h.roleNames(r.Context())
+	vars := make(jet.VarMap)
+	vars.Set("invitations", invitations)
+	vars.Set("roleName", func(id int) string {
+		return names[id]
+	})
+	if err := h.render(w, r, "invitations", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// InvitationCreate shows the form for inviting someone by email
+func (h *Handlers) InvitationCreate(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: InvitationCreate")
+	h.renderInvitationForm(w, r, "", 0, nil)
+}
+
+// InvitationCreatePost stores an invitation and emails its link
+func (h *Handlers) InvitationCreatePost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: InvitationCreatePost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+	roleID, _ := strconv.Atoi(r.Form.Get("role_id"))
+	// only admins who can assign roles to users can pick the role of an invitee
+	if !h.can(r, "roles.manage") {
+		roleID = 0
+	}
+	validator := h.App.GetValidator()
+	validator.Check(email != "", "email", "Email is required")
+	validator.IsEmail("email", email)
+	h.models(r).Users.ValidateUniqueEmail(validator, 0, email)
+	h.models(r).Invitations.ValidateUniqueEmail(validator, email)
+	if roleID != 0 {
+		_, err := h.models(r).Roles.Get(roleID)
+		validator.Check(err == nil, "role_id", "Role does not exist")
+	}
+	if !validator.Valid() {
+		h.renderInvitationForm(w, r, email, roleID, validator.Errors)
+		return
+	}
+
+	invitedBy := h.App.Session.GetInt(r.Context(), "userID")
+	invitation, token, err := h.models(r).Invitations.Create(email, roleID, invitedBy, invitationDays*24*time.Hour)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditInvitation(r, models.AuditInvitationSent, invitation)
+	if err := h.sendInvitation(r.Context(), invitation, token); err != nil {
+		h.App.ErrorLog.Println("failed to send invitation with err:", err)
+		h.App.Session.Put(r.Context(), "error", fmt.Sprintf("The invitation for %s has been saved but could not be sent, please resend it.", email))
+		http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+		return
+	}
+
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("An invitation has been sent to %s.", email))
+	http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+}
+
+// InvitationResend emails a new link for a pending invitation, earlier links stop working and
+// the invitation can be accepted for another week
+func (h *Handlers) InvitationResend(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: InvitationResend")
+	invitation, ok := h.invitationFromURL(w, r)
+	if !ok {
+		return
+	}
+	token, err := h.models(r).Invitations.Renew(invitation.ID, invitationDays*24*time.Hour)
+	if err != nil {
+		if !errors.Is(err, models.ErrInvitationInvalid) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.App.Session.Put(r.Context(), "error", "The invitation has been accepted or revoked already.")
+		http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+		return
+	}
+	h.auditInvitation(r, models.AuditInvitationSent, invitation)
+	if err := h.sendInvitation(r.Context(), invitation, token); err != nil {
+		h.App.ErrorLog.Println("failed to send invitation with err:", err)
+		h.App.Session.Put(r.Context(), "error", "Failed to send the invitation.")
+		http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("The invitation has been sent to %s again.", invitation.Email))
+	http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+}
+
+// InvitationRevoke stops a pending invitation from being accepted
+func (h *Handlers) InvitationRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: InvitationRevoke")
+	invitation, ok := h.invitationFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := h.models(r).Invitations.Revoke(invitation.ID); err != nil {
+		if !errors.Is(err, models.ErrInvitationInvalid) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.App.Session.Put(r.Context(), "error", "The invitation has been accepted or revoked already.")
+		http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+		return
+	}
+	h.auditInvitation(r, models.AuditInvitationRevoked, invitation)
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("The invitation for %s has been revoked.", invitation.Email))
+	http.Redirect(w, r, "/admin/invitations", http.StatusSeeOther)
+}
+
+// InvitationAccept shows the invitee of a signed invitation link the form for their name and
+// password
+func (h *Handlers) InvitationAccept(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: InvitationAccept")
+	invitation, ok := h.invitationFromLink(w, r)
+	if !ok {
+		return
+	}
+	h.renderInvitationAccept(w, r, &models.User{Email: invitation.Email}, nil)
+}
+
+// InvitationAcceptPost creates the account of the invitee with the role of the invitation. The
+// form is posted to the signed link so it is checked again.
+func (h *Handlers) InvitationAcceptPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: InvitationAcceptPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	invitation, ok := h.invitationFromLink(w, r)
+	if !ok {
+		return
+	}
+
+	user := &models.User{
+		FirstName: strings.TrimSpace(r.Form.Get("first_name")),
+		LastName:  strings.TrimSpace(r.Form.Get("last_name")),
+		Email:     invitation.Email,
+		Active:    1,
+	}
+	validator := h.App.GetValidator()
+	user.Validate(validator)
+	h.models(r).Users.ValidateUniqueEmail(validator, 0, user.Email)
+	password := r.Form.Get("password")
+	h.validatePassword(r, validator, password, user)
+	validator.Check(password == r.Form.Get("password_confirmation"), "password_confirmation", "Passwords do not match")
+	if !validator.Valid() {
+		h.renderInvitationAccept(w, r, user, validator.Errors)
+		return
+	}
+
+	user.Password = password
+	// the invitee proved they own the email by opening the link
+	verifiedAt := time.Now()
+	user.EmailVerifiedAt = &verifiedAt
+	// the invitation is used up together with creating the account, when anything fails it can
+	// be accepted again and a second accept of the same link creates no second account
+	err := h.Models.Tx(r.Context(), func(tx *models.Models) error {
+		if _, err := tx.Invitations.Accept(invitation.ID, r.URL.Query().Get("token")); err != nil {
+			return err
+		}
+		id, err := tx.Users.Insert(*user)
+		if err != nil {
+			return err
+		}
+		user.ID = id
+		if invitation.RoleID == 0 {
+			return nil
+		}
+		// the role may have been deleted since the invitation was sent
+		if _, err := tx.Roles.Get(invitation.RoleID); errors.Is(err, up.ErrNoMoreRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return tx.Roles.SetForUser(id, []int{invitation.RoleID})
+	})
+	if errors.Is(err, models.ErrInvitationInvalid) {
+		h.invitationInvalid(w, r, err)
+		return
+	}
+	if err != nil {
+		h.App.ErrorLog.Println("failed to accept invitation with err:", err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditAnonymous(r, models.AuditInvitationAccepted, user, "")
+	if err := h.sendWelcome(r.Context(), user); err != nil {
+		h.App.ErrorLog.Println("failed to send welcome email with err:", err)
+	}
+
+	h.App.Session.Put(r.Context(), "flash", "Your account has been created. You can log in now.")
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// sendInvitation emails the signed link to accept the invitation with the token
+func (h *Handlers) sendInvitation(ctx context.Context, invitation *models.Invitation, token string) error {
+	link := fmt.Sprintf("%s/user/invitation?invitation=%d&token=%s", appURL(), invitation.ID, url.QueryEscape(token))
+	sign := signer.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+	var data struct {
+		Link      string
+		InvitedBy string
+		Role      string
+		Days      int
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+	if inviter, err := h.Models.WithContext(ctx).Users.Get(invitation.InvitedBy); err == nil {
+		data.InvitedBy = strings.TrimSpace(inviter.FirstName + " " + inviter.LastName)
+	}
+	data.Role = h.roleNames(ctx)[invitation.RoleID]
+	data.Days = invitationDays
+	msg := mailer.Message{
+		To:       invitation.Email,
+		Subject:  "You have been invited to the Imperator Portal",
+		Template: "invitation",
+		Data:     data,
+		From:     "admin@imperator.portal",
+	}
+	return h.App.Mail.Queue(ctx, msg)
+}
+
+// invitationFromLink checks the signature of the invitation link and loads its invitation, it
+// redirects to the login with an error when the link can not be used
+func (h *Handlers) invitationFromLink(w http.ResponseWriter, r *http.Request) (*models.Invitation, bool) {
+	sign := signer.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+	testURL := fmt.Sprintf("%s%s", appURL(), r.RequestURI)
+	if !sign.VerifyToken(testURL) || sign.Expired(testURL, invitationDays*24*60) {
+		h.invitationInvalid(w, r, models.ErrInvitationInvalid)
+		return nil, false
+	}
+	id, _ := strconv.Atoi(r.URL.Query().Get("invitation"))
+	invitation, err := h.models(r).Invitations.Peek(id, r.URL.Query().Get("token"))
+	if err != nil {
+		h.invitationInvalid(w, r, err)
+		return nil, false
+	}
+	return invitation, true
+}
+
+// invitationInvalid sends the invitee to the login when the invitation can not be accepted
+func (h *Handlers) invitationInvalid(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, models.ErrInvitationInvalid) {
+		h.App.ErrorLog.Println(err)
+	}
+	h.App.Session.Put(
+		r.Context(),
+		"error",
+		"The invitation is invalid or has expired, please ask for a new one.")
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// invitationFromURL loads the invitation given by the id url parameter and writes a 404 when
+// there is none
+func (h *Handlers) invitationFromURL(w http.ResponseWriter, r *http.Request) (*models.Invitation, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	invitation, err := h.models(r).Invitations.Get(id)
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	return invitation, true
+}
+
+// auditInvitation records a change to an invitation by the logged in user
+func (h *Handlers) auditInvitation(r *http.Request, action string, invitation *models.Invitation) {
+	event := newAuditEvent(action, nil, "")
+	event.TargetType = "invitation"
+	event.TargetID = invitation.ID
+	event.TargetLabel = invitation.Email
+	h.auditActor(r, event)
+}
+
+// roleNames returns the names of all roles by id
+func (h *Handlers) roleNames(ctx context.Context) map[int]string {
+	names := make(map[int]string)
+	roles, err := h.Models.WithContext(ctx).Roles.GetAll()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+	for _, role := range roles {
+		names[role.ID] = role.Name
+	}
+	return names
+}
+
+// renderInvitationForm renders the invite form, fieldErrors holds the validation message of each
+// field
+func (h *Handlers) renderInvitationForm(w http.ResponseWriter, r *http.Request, email string, roleID int, fieldErrors map[string]string) {
+	if fieldErrors == nil {
+		fieldErrors = make(map[string]string)
+	}
+	vars := make(jet.VarMap)
+	vars.Set("email", email)
+	vars.Set("roleID", roleID)
+	vars.Set("errors", fieldErrors)
+	vars.Set("manageRoles", h.can(r, "roles.manage"))
+	if h.can(r, "roles.manage") {
+		roles, err := h.models(r).Roles.GetAll()
+		if err != nil {
+			h.App.ErrorLog.Println(err)
+		}
+		vars.Set("roles", roles)
+	} else {
+		vars.Set("roles", []*models.Role{})
+	}
+	vars.Set("days", invitationDays)
+	if err := h.render(w, r, "invitation_form", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// renderInvitationAccept renders the form of the invitee, it is posted back to the signed link
+func (h *Handlers) renderInvitationAccept(w http.ResponseWriter, r *http.Request, user *models.User, fieldErrors map[string]string) {
+	if fieldErrors == nil {
+		fieldErrors = map[string]string{}
+	}
+	vars := make(jet.VarMap)
+	vars.Set("user", user)
+	vars.Set("action", r.RequestURI)
+	vars.Set("errors", fieldErrors)
+	if err := h.render(w, r, "invitation_accept", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+	}
+}
@@ -1,19 +1,27 @@
 package handlers
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	rememberme "imperatorapp/auth/remember"
+	"imperatorapp/auth/sessions"
 	"imperatorapp/models"
 	"net/http"
-	"time"
+	"strings"
 
 	jet "github.com/CloudyKit/jet/v6"
 )
 
+// loginRedirectKey is the session key of the path to return to after the login
+const loginRedirectKey = "login_redirect"
+
 func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 	variables := make(jet.VarMap)
 	variables.Set("error", "")
+	variables.Set("registration", registrationEnabled())
+	variables.Set("providers", h.OIDC.All())
+	variables.Set("directory", h.LDAP != nil)
+	variables.Set("certificate", clientCertificateEmail(r))
 	if err := h.render(w, r, "login", variables, nil); err != nil {
 		h.App.ErrorLog.Println(err)
 	}
@@ -22,71 +30,109 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) LoginPost(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		h.App.Session.Put(r.Context(), "error", fmt.Sprintf("failed to parse form with err: %s", err))
-		http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
 		return
 	}
 
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
-	user, err := h.Models.Users.GetByEmail(email)
+	if _, message := h.loginAllowed(r, email); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := h.authenticator().Authenticate(r, email, password)
 	if err != nil {
+		if errors.Is(err, errLoginFailed) {
+			h.loginFailed(r, email, user)
+		} else {
+			h.App.ErrorLog.Println("failed to authenticate with err:", err)
+		}
 		h.App.Session.Put(r.Context(), "error", "login failed")
-		http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
 		return
 	}
 
-	matches, err := user.PasswordMatches(password)
-	if err != nil {
+	if !user.IsVerified() {
+		h.App.Session.Put(r.Context(), "error", "Please verify your email before logging in.")
+		http.Redirect(w, r, "/user/verify/resend", http.StatusSeeOther)
+		return
+	}
+	// deactivated users know their password but may not log in
+	if user.Active != 1 {
 		h.App.Session.Put(r.Context(), "error", "login failed")
-		http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
 		return
 	}
+	h.loginSucceeded(r, email)
+	h.finishLogin(w, r, user, r.Form.Get("remember") == "remember")
+}
 
-	if !matches {
+// finishLogin logs in a user whose first factor was checked, users with a second factor stay
+// unauthenticated until the second step succeeds
+func (h *Handlers) finishLogin(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) {
+	if h.requiresSecondFactor(r, user) {
+		_ = h.sessionRenew(r.Context())
+		h.App.Session.Put(r.Context(), pendingTwoFactorUserID, user.ID)
+		h.App.Session.Put(r.Context(), pendingTwoFactorRemember, remember)
+		http.Redirect(w, r, "/admin/user/two-factor", http.StatusSeeOther)
+		return
+	}
+	h.completeLogin(w, r, user, remember)
+}
+
+// requiresSecondFactor reports whether the user has a totp secret or a passkey to use as second factor
+func (h *Handlers) requiresSecondFactor(r *http.Request, user *models.User) bool {
+	if user.HasTwoFactor() {
+		return true
+	}
+	count, err := h.models(r).Credentials.CountForUser(user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to count credentials with err:", err)
+	}
+	return count > 0
+}
+
+// completeLogin logs the user in and redirects to the admin area or the page that asked for the login
+func (h *Handlers) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) {
+	if err := h.logUserIn(w, r, user, remember); err != nil {
+		h.App.ErrorLog.Println("failed to log user in with err:", err)
 		h.App.Session.Put(r.Context(), "error", "login failed")
-		http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
 		return
 	}
-	// did the user check the remember me?
-	if r.Form.Get("remember") == "remember" {
-		randomStr := h.randomString(12)
-		hasher := sha256.New()
-		_, err := hasher.Write([]byte(randomStr))
-		if err != nil {
-			h.App.Render.ErrorStatus(w, http.StatusBadRequest)
-			return
-		}
+	http.Redirect(w, r, h.loginRedirect(r), http.StatusSeeOther)
+}
 
-		sha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
-		rm := models.RememberToken{
-			UserID:        user.ID,
-			RememberToken: sha,
-		}
-		_, err = h.Models.RememberToken.Insert(rm)
-		if err != nil {
-			h.App.Session.Put(r.Context(), "error", "login failed")
-			http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
-			return
-		}
+// loginRedirect returns where to go after the login, a page that sent the visitor to the login
+// puts its path into the session under loginRedirectKey
+func (h *Handlers) loginRedirect(r *http.Request) string {
+	target := h.App.Session.PopString(r.Context(), loginRedirectKey)
+	// only paths on this site, never another host
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/admin/area"
+	}
+	return target
+}
 
-		// set cookie
-		expire := time.Now().Add(365 * 24 * 60 * 60 * time.Second)
-		cookie := http.Cookie{
-			Name:     fmt.Sprintf("_%s_remember", h.App.AppName),
-			Value:    fmt.Sprintf("%d|%s", user.ID, sha),
-			Path:     "/",
-			Expires:  expire,
-			HttpOnly: true,
-			Domain:   h.App.Session.Cookie.Domain,
-			MaxAge:   315350000, // 1 yr
-			Secure:   h.App.Session.Cookie.Secure,
-			SameSite: http.SameSiteStrictMode,
+// logUserIn puts the user into the session and sets the remember me cookie if requested
+func (h *Handlers) logUserIn(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) error {
+	// did the user check the remember me?
+	if remember {
+		token, secret, err := h.models(r).RememberToken.Issue(user.ID, r.UserAgent(), remoteIP(r), rememberme.Lifetime())
+		if err != nil {
+			return err
 		}
-		http.SetCookie(w, &cookie)
-		h.App.Session.Put(r.Context(), "remember_token", sha)
+		rememberme.SetCookie(w, h.App.Session, h.App.AppName, rememberme.Encode(token.Series, secret), token.ExpiresAt)
+		h.App.Session.Put(r.Context(), rememberme.SessionKey, token.Series)
 	}
+	_ = h.sessionRenew(r.Context())
+	// a fresh login is indexed as a new session by the TrackSession middleware
+	h.App.Session.Remove(r.Context(), sessions.Key)
 	h.App.Session.Put(r.Context(), "userID", user.ID)
+	h.audit(r, models.AuditLogin, user, "")
 	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("Welcome %s %s in the admin area", user.FirstName, user.LastName))
-	http.Redirect(w, r, "/admin/area", http.StatusSeeOther)
+	return nil
 }
@@ -1,35 +1,32 @@
 package handlers
 
 import (
-	"fmt"
+	"imperatorapp/auth/remember"
 	"imperatorapp/models"
 	"net/http"
-	"time"
 )
 
 func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
-	// delete remeber token if exists
-	if h.App.Session.Exists(r.Context(), "remember_token") {
-		rt := models.RememberToken{}
-		if err := rt.DeleteByToken(h.App.Session.GetString(r.Context(), "remember_token")); err != nil {
+	// logging out while impersonating logs out the admin
+	h.stopImpersonating(r)
+	if userID := h.App.Session.GetInt(r.Context(), "userID"); userID != 0 {
+		if user, err := h.models(r).Users.Get(userID); err == nil {
+			h.audit(r, models.AuditLogout, user, "")
+		}
+	}
+	// delete the remember me series if exists
+	if series := h.App.Session.GetString(r.Context(), remember.SessionKey); series != "" {
+		if err := h.models(r).RememberToken.DeleteBySeries(series); err != nil {
 			h.App.ErrorLog.Println("failed to delete remember token with err:", err)
 		}
 	}
-	newCookie := http.Cookie{
-		Name:     fmt.Sprintf("_%s_remember", h.App.AppName),
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Now().Add(-100 * time.Hour),
-		HttpOnly: true,
-		Domain:   h.App.Session.Cookie.Domain,
-		MaxAge:   -1, // 1 yr
-		Secure:   h.App.Session.Cookie.Secure,
-		SameSite: http.SameSiteStrictMode,
+	if err := h.SessionIndex.Forget(r.Context()); err != nil {
+		h.App.ErrorLog.Println("failed to remove session from index with err:", err)
 	}
-	http.SetCookie(w, &newCookie)
+	remember.ClearCookie(w, h.App.Session, h.App.AppName)
 	h.App.Session.RenewToken(r.Context())
 	h.App.Session.Remove(r.Context(), "userID")
-	h.App.Session.Remove(r.Context(), "remember_token")
+	h.App.Session.Remove(r.Context(), remember.SessionKey)
 	h.App.Session.Destroy(r.Context())
 	h.App.Session.Put(r.Context(), "success", "You have been successfully logged out.")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"imperatorapp/auth/throttle"
+	"imperatorapp/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arc41t3ct/imperator/mailer"
+	"github.com/arc41t3ct/imperator/signer"
+)
+
+// magicLinkMinutes is how long a sign-in link is valid
+const magicLinkMinutes = 15
+
+// magicLinkPath is where sign-in links are requested and used, the browser nonce cookie is only
+// sent to it
+const magicLinkPath = "/admin/user/magic-link"
+
+// magicLinkCookieName returns the name of the cookie holding the nonce of the browser that
+// requested a sign-in link
+func magicLinkCookieName(appName string) string {
+	return fmt.Sprintf("_%s_magic_link", appName)
+}
+
+// MagicLink shows the form to request a sign-in link by email
+func (h *Handlers) MagicLink(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: MagicLink")
+	if err := h.render(w, r, "magic_link", nil, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+	}
+}
+
+// MagicLinkPost emails a single-use sign-in link that only works in this browser. Every email gets
+// the same response and the link is queued without waiting for the mail, so neither tells who has
+// an account.
+func (h *Handlers) MagicLinkPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: MagicLinkPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(r.Form.Get("email"))
+	if _, message := h.loginAllowed(r, email); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		http.Redirect(w, r, magicLinkPath, http.StatusSeeOther)
+		return
+	}
+	if message := h.mailAllowed(r, throttle.Key(email)); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		http.Redirect(w, r, magicLinkPath, http.StatusSeeOther)
+		return
+	}
+
+	// the cookie is set for unknown emails too, otherwise it would tell who has an account
+	nonce, err := magicLinkNonce()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.setMagicLinkCookie(w, nonce)
+
+	user, err := h.models(r).Users.GetByEmail(email)
+	if err == nil && user.Active == 1 && user.IsVerified() && h.passwordlessAllowed(r, user) {
+		if err := h.sendMagicLink(r.Context(), user, nonce); err != nil {
+			h.App.ErrorLog.Println("failed to send sign-in link with err:", err)
+		} else {
+			h.auditAnonymous(r, models.AuditMagicLinkSent, user, "")
+		}
+	}
+
+	h.App.Session.Put(r.Context(), "flash", fmt.Sprintf("If there is an account for this email, a sign-in link is on its way. It works for %d minutes in this browser only.", magicLinkMinutes))
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// MagicLinkVerify logs in the user of a signed sign-in link opened in the browser that requested it
+func (h *Handlers) MagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: MagicLinkVerify")
+	sign := signer.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+	testURL := fmt.Sprintf("%s%s", appURL(), r.RequestURI)
+	if !sign.VerifyToken(testURL) || sign.Expired(testURL, magicLinkMinutes) {
+		h.magicLinkInvalid(w, r, "The sign-in link is invalid or has expired, please request a new one.")
+		return
+	}
+
+	// peek first, the token is only used up when the link is opened in the right browser so mail
+	// scanners following the link can not burn it
+	token := r.URL.Query().Get("token")
+	pending, err := h.models(r).UserTokens.Peek(token, models.PurposeMagicLink)
+	if err != nil {
+		if !errors.Is(err, models.ErrUserTokenInvalid) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.magicLinkInvalid(w, r, "The sign-in link is invalid or has expired, please request a new one.")
+		return
+	}
+	user, err := h.models(r).Users.Get(pending.UserID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.magicLinkInvalid(w, r, "The sign-in link is invalid or has expired, please request a new one.")
+		return
+	}
+	if _, message := h.loginAllowed(r, user.Email); message != "" {
+		h.magicLinkInvalid(w, r, message)
+		return
+	}
+	if !h.magicLinkBound(r, r.URL.Query().Get("binding")) {
+		// a forwarded or stolen link counts against the address that opened it, not the account,
+		// anyone who gets hold of links could lock the owner out otherwise
+		h.auditAnonymous(r, models.AuditLoginFailed, user, user.Email)
+		if _, err := h.LoginThrottle.FailIP(r.Context(), peerIP(r)); err != nil {
+			h.App.Log(r).Error("failed to record failed login", "err", err)
+		}
+		h.magicLinkInvalid(w, r, "The sign-in link has to be opened in the browser it was requested from.")
+		return
+	}
+
+	if _, err := h.models(r).UserTokens.Consume(token, models.PurposeMagicLink); err != nil {
+		if !errors.Is(err, models.ErrUserTokenInvalid) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.magicLinkInvalid(w, r, "The sign-in link is invalid or has expired, please request a new one.")
+		return
+	}
+	h.clearMagicLinkCookie(w)
+	// the account may have been deactivated or linked to the directory since the link was sent
+	if user.Active != 1 || !user.IsVerified() || !h.passwordlessAllowed(r, user) {
+		h.loginFailed(r, user.Email, user)
+		h.magicLinkInvalid(w, r, "login failed")
+		return
+	}
+	h.loginSucceeded(r, user.Email)
+	h.finishLogin(w, r, user, false)
+}
+
+// sendMagicLink emails the user a signed sign-in link with a single-use token, the link carries
+// the hash of the browser nonce so it only works where it was requested. It does not wait for
+// the mail to be sent.
+func (h *Handlers) sendMagicLink(ctx context.Context, u *models.User, nonce string) error {
+	token, err := h.Models.WithContext(ctx).UserTokens.Issue(u.ID, models.PurposeMagicLink, magicLinkMinutes*time.Minute)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s%s/verify?token=%s&binding=%s", appURL(), magicLinkPath, url.QueryEscape(token), magicLinkBinding(nonce))
+	sign := signer.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+	var data struct {
+		Link      string
+		FirstName string
+		Minutes   int
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+	data.FirstName = u.FirstName
+	data.Minutes = magicLinkMinutes
+	msg := mailer.Message{
+		To:       u.Email,
+		Subject:  "Your sign-in link",
+		Template: "magic_link",
+		Data:     data,
+		From:     "admin@imperator.portal",
+	}
+	return h.dispatchMail(ctx, msg)
+}
+
+// magicLinkBound reports whether the nonce cookie of the browser matches the binding of the link
+func (h *Handlers) magicLinkBound(r *http.Request, binding string) bool {
+	cookie, err := r.Cookie(magicLinkCookieName(h.App.AppName))
+	if err != nil || cookie.Value == "" || binding == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(magicLinkBinding(cookie.Value)), []byte(binding)) == 1
+}
+
+// setMagicLinkCookie stores the nonce in the browser until the link expires. It is lax so the
+// browser sends it when the link is opened from a mail client.
+func (h *Handlers) setMagicLinkCookie(w http.ResponseWriter, nonce string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookieName(h.App.AppName),
+		Value:    nonce,
+		Path:     magicLinkPath,
+		Expires:  time.Now().Add(magicLinkMinutes * time.Minute),
+		MaxAge:   magicLinkMinutes * 60,
+		HttpOnly: true,
+		Domain:   h.App.Session.Cookie.Domain,
+		Secure:   h.App.Session.Cookie.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearMagicLinkCookie removes the nonce cookie once its link was used
+func (h *Handlers) clearMagicLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookieName(h.App.AppName),
+		Value:    "",
+		Path:     magicLinkPath,
+		Expires:  time.Now().Add(-100 * time.Hour),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Domain:   h.App.Session.Cookie.Domain,
+		Secure:   h.App.Session.Cookie.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// magicLinkInvalid sends the visitor back to request a new link
+func (h *Handlers) magicLinkInvalid(w http.ResponseWriter, r *http.Request, message string) {
+	h.App.Session.Put(r.Context(), "error", message)
+	http.Redirect(w, r, magicLinkPath, http.StatusSeeOther)
+}
+
+// magicLinkNonce returns a random nonce for the browser cookie
+func magicLinkNonce() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// magicLinkBinding returns the hash of the nonce that goes into the link, the nonce itself never
+// leaves the browser
+func magicLinkBinding(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,710 @@
+package handlers
+
+import (
+	"errors"
+	"imperatorapp/auth/oauth"
+	"imperatorapp/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	jet "github.com/CloudyKit/jet/v6"
+	up "github.com/upper/db/v4"
+)
+
+// authorizeRequest is a checked authorization request of a client
+type authorizeRequest struct {
+	Client        *models.OAuthClient
+	RedirectURI   string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	Scopes        []string
+	Prompt        string
+}
+
+// consentScope is a scope on the consent screen
+type consentScope struct {
+	Name        string
+	Description string
+}
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// introspection is the response of the introspection endpoint as in RFC 7662
+type introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Expiry    int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	JWTID     string `json:"jti,omitempty"`
+}
+
+// tokenGrant is what the tokens of a token response are issued for
+type tokenGrant struct {
+	client *models.OAuthClient
+	user   *models.User
+	// scopes of the access token
+	scopes []string
+	// granted are all scopes the user allowed, the refresh token keeps them
+	granted string
+	nonce   string
+	family  string
+}
+
+// OAuthDiscovery serves the OpenID Connect discovery document
+func (h *Handlers) OAuthDiscovery(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthDiscovery")
+	if err := h.renderJSON(w, h.OAuth.Discovery(), http.StatusOK); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// OAuthJWKS publishes the public keys the tokens are signed with
+func (h *Handlers) OAuthJWKS(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthJWKS")
+	keys, err := h.OAuth.Keys.JWKS()
+	if err != nil {
+		h.App.ErrorLog.Println("failed to load signing keys with err:", err)
+		h.oauthError(w, oauth.ErrServerError(""))
+		return
+	}
+	headers := http.Header{}
+	headers.Set("Cache-Control", "public, max-age=300")
+	if err := h.renderJSON(w, keys, http.StatusOK, headers); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// OAuthAuthorize is the authorization endpoint. Visitors who are not logged in are sent to the
+// login and come back here, the consent screen is shown unless the user allowed the scopes
+// before or the client is trusted.
+func (h *Handlers) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthAuthorize")
+	req, oerr := h.authorizeRequest(r, r.URL.Query())
+	if req == nil {
+		h.renderConsent(w, r, nil, oerr.Description)
+		return
+	}
+	if oerr != nil {
+		h.authorizeError(w, r, req, oerr)
+		return
+	}
+
+	user := h.oauthSessionUser(r)
+	if user == nil {
+		if req.Prompt == "none" {
+			h.authorizeError(w, r, req, oauth.ErrLoginRequired(""))
+			return
+		}
+		h.App.Session.Put(r.Context(), loginRedirectKey, r.URL.RequestURI())
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+
+	if req.Prompt != "consent" && h.hasConsent(r, user, req) {
+		h.issueCode(w, r, req, user)
+		return
+	}
+	if req.Prompt == "none" {
+		h.authorizeError(w, r, req, oauth.ErrConsentRequired(""))
+		return
+	}
+	h.renderConsent(w, r, req, "")
+}
+
+// OAuthAuthorizePost handles the decision of the user on the consent screen
+func (h *Handlers) OAuthAuthorizePost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthAuthorizePost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	req, oerr := h.authorizeRequest(r, r.PostForm)
+	if req == nil {
+		h.renderConsent(w, r, nil, oerr.Description)
+		return
+	}
+	if oerr != nil {
+		h.authorizeError(w, r, req, oerr)
+		return
+	}
+	user := h.oauthSessionUser(r)
+	if user == nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+	if r.PostForm.Get("decision") != "allow" {
+		h.authorizeError(w, r, req, oauth.ErrAccessDenied("the user denied the request"))
+		return
+	}
+
+	if err := h.models(r).OAuthConsents.Grant(user.ID, req.Client.ClientID, req.Scopes); err != nil {
+		h.App.ErrorLog.Println("failed to store consent with err:", err)
+		h.authorizeError(w, r, req, oauth.ErrServerError(""))
+		return
+	}
+	h.audit(r, models.AuditOAuthConsent, user, h.auditDiff(models.OAuthConsent{}, models.OAuthConsent{
+		ClientID: req.Client.ClientID,
+		Scopes:   strings.Join(req.Scopes, " "),
+	}))
+	h.issueCode(w, r, req, user)
+}
+
+// authorizeRequest checks the parameters of an authorization request. Without a known client and
+// registered redirect uri the request is nil and the error must be shown to the user, otherwise
+// errors are sent back to the client.
+func (h *Handlers) authorizeRequest(r *http.Request, params url.Values) (*authorizeRequest, *oauth.Error) {
+	client, err := h.models(r).OAuthClients.GetByClientID(params.Get("client_id"))
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+		}
+		return nil, oauth.ErrInvalidRequest("The application is not registered.")
+	}
+	redirectURI := params.Get("redirect_uri")
+	if !client.AllowsRedirectURI(redirectURI) {
+		return nil, oauth.ErrInvalidRequest("The application sent an unregistered redirect address.")
+	}
+
+	req := &authorizeRequest{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		State:         params.Get("state"),
+		Nonce:         params.Get("nonce"),
+		CodeChallenge: params.Get("code_challenge"),
+		Scopes:        oauth.ParseScopes(params.Get("scope")),
+		Prompt:        params.Get("prompt"),
+	}
+	switch {
+	case params.Get("response_type") != "code":
+		return req, oauth.ErrUnsupportedResponseType("only the code response type is supported")
+	case !client.AllowsGrant(oauth.GrantAuthorizationCode):
+		return req, oauth.ErrUnauthorizedClient("the client may not use the authorization code grant")
+	case params.Get("code_challenge_method") != "S256" || !oauth.ValidChallenge(req.CodeChallenge):
+		return req, oauth.ErrInvalidRequest("a S256 code challenge is required")
+	case len(req.Nonce) > 255:
+		return req, oauth.ErrInvalidRequest("the nonce is too long")
+	case len(req.Scopes) == 0:
+		return req, oauth.ErrInvalidScope("the scope is required")
+	case !oauth.Subset(req.Scopes, client.ScopeList()):
+		return req, oauth.ErrInvalidScope("the client may not request the scope")
+	}
+	return req, nil
+}
+
+// hasConsent reports whether the request can be granted without asking the user
+func (h *Handlers) hasConsent(r *http.Request, user *models.User, req *authorizeRequest) bool {
+	if req.Client.Trusted {
+		return true
+	}
+	consent, err := h.models(r).OAuthConsents.Get(user.ID, req.Client.ClientID)
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+		}
+		return false
+	}
+	return consent.Covers(req.Scopes)
+}
+
+// issueCode sends the browser back to the client with a new authorization code
+func (h *Handlers) issueCode(w http.ResponseWriter, r *http.Request, req *authorizeRequest, user *models.User) {
+	code, err := h.models(r).OAuthCodes.Issue(models.OAuthCode{
+		ClientID:      req.Client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        strings.Join(req.Scopes, " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+	}, h.OAuth.CodeTTL)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to issue authorization code with err:", err)
+		h.authorizeError(w, r, req, oauth.ErrServerError(""))
+		return
+	}
+	values := url.Values{}
+	values.Set("code", code)
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+	values.Set("iss", h.OAuth.Issuer)
+	http.Redirect(w, r, oauth.RedirectURL(req.RedirectURI, values), http.StatusSeeOther)
+}
+
+// authorizeError sends the error back to the redirect uri of the client
+func (h *Handlers) authorizeError(w http.ResponseWriter, r *http.Request, req *authorizeRequest, e *oauth.Error) {
+	http.Redirect(w, r, oauth.ErrorRedirectURL(req.RedirectURI, req.State, h.OAuth.Issuer, e), http.StatusSeeOther)
+}
+
+// renderConsent shows the consent screen for the request, or the error when the request can not
+// be sent back to the client
+func (h *Handlers) renderConsent(w http.ResponseWriter, r *http.Request, req *authorizeRequest, message string) {
+	vars := make(jet.VarMap)
+	vars.Set("request", req)
+	vars.Set("message", message)
+	var scopes []consentScope
+	if req != nil {
+		for _, s := range req.Scopes {
+			scopes = append(scopes, consentScope{Name: s, Description: oauth.DescribeScope(s)})
+		}
+		vars.Set("scope", strings.Join(req.Scopes, " "))
+	}
+	vars.Set("scopes", scopes)
+	if err := h.render(w, r, "oauth_consent", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// oauthSessionUser returns the fully logged in and active user of the session or nil
+func (h *Handlers) oauthSessionUser(r *http.Request) *models.User {
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	if userID == 0 || h.sessionHas(r.Context(), pendingTwoFactorUserID) {
+		return nil
+	}
+	user, err := h.models(r).Users.Get(userID)
+	if err != nil || user.Active != 1 {
+		return nil
+	}
+	return user
+}
+
+// OAuthToken is the token endpoint, it issues tokens for the authorization code, refresh token and
+// client credentials grants
+func (h *Handlers) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthToken")
+	if err := r.ParseForm(); err != nil {
+		h.oauthError(w, oauth.ErrInvalidRequest("the body must be form encoded"))
+		return
+	}
+	client, oerr := h.oauthClient(r)
+	if oerr != nil {
+		h.oauthError(w, oerr)
+		return
+	}
+	grantType := r.PostForm.Get("grant_type")
+	if grantType == "" {
+		h.oauthError(w, oauth.ErrInvalidRequest("the grant_type is required"))
+		return
+	}
+	if !contains(oauth.GrantTypes, grantType) {
+		h.oauthError(w, oauth.ErrUnsupportedGrantType(""))
+		return
+	}
+	if !client.AllowsGrant(grantType) {
+		h.oauthError(w, oauth.ErrUnauthorizedClient("the client may not use the "+grantType+" grant"))
+		return
+	}
+
+	switch grantType {
+	case oauth.GrantAuthorizationCode:
+		h.codeGrant(w, r, client)
+	case oauth.GrantRefreshToken:
+		h.refreshGrant(w, r, client)
+	case oauth.GrantClientCredentials:
+		h.clientCredentialsGrant(w, r, client)
+	}
+}
+
+// codeGrant exchanges an authorization code
+func (h *Handlers) codeGrant(w http.ResponseWriter, r *http.Request, client *models.OAuthClient) {
+	code, err := h.models(r).OAuthCodes.Consume(r.PostForm.Get("code"), client.ClientID)
+	switch {
+	case errors.Is(err, models.ErrOAuthCodeReused):
+		// the code leaked, the tokens it was exchanged for must not be used any longer
+		h.oauthTokenReused(r, code.UserID, code.Family)
+		h.oauthError(w, oauth.ErrInvalidGrant("the code was already used"))
+		return
+	case errors.Is(err, models.ErrOAuthCodeInvalid):
+		h.oauthError(w, oauth.ErrInvalidGrant("the code is invalid or expired"))
+		return
+	case err != nil:
+		h.App.ErrorLog.Println(err)
+		h.oauthError(w, oauth.ErrServerError(""))
+		return
+	}
+	if code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		h.oauthError(w, oauth.ErrInvalidGrant("the code was issued to another redirect uri"))
+		return
+	}
+	if !oauth.VerifyChallenge(code.CodeChallenge, "S256", r.PostForm.Get("code_verifier")) {
+		h.oauthError(w, oauth.ErrInvalidGrant("the code verifier does not match the challenge"))
+		return
+	}
+	user, err := h.models(r).Users.Get(code.UserID)
+	if err != nil || user.Active != 1 {
+		h.oauthError(w, oauth.ErrInvalidGrant("the user can not log in"))
+		return
+	}
+	h.issueTokens(w, r, tokenGrant{
+		client:  client,
+		user:    user,
+		scopes:  strings.Fields(code.Scopes),
+		granted: code.Scopes,
+		nonce:   code.Nonce,
+		family:  code.Family,
+	})
+}
+
+// refreshGrant rotates a refresh token, the access token may ask for fewer scopes than granted
+func (h *Handlers) refreshGrant(w http.ResponseWriter, r *http.Request, client *models.OAuthClient) {
+	token, err := h.models(r).OAuthRefreshTokens.Use(r.PostForm.Get("refresh_token"), client.ClientID)
+	switch {
+	case errors.Is(err, models.ErrOAuthRefreshReused):
+		h.oauthTokenReused(r, token.UserID, "")
+		h.oauthError(w, oauth.ErrInvalidGrant("the refresh token was already used"))
+		return
+	case errors.Is(err, models.ErrOAuthRefreshInvalid):
+		h.oauthError(w, oauth.ErrInvalidGrant("the refresh token is invalid or expired"))
+		return
+	case err != nil:
+		h.App.ErrorLog.Println(err)
+		h.oauthError(w, oauth.ErrServerError(""))
+		return
+	}
+	granted := strings.Fields(token.Scopes)
+	scopes := granted
+	if requested := oauth.ParseScopes(r.PostForm.Get("scope")); len(requested) > 0 {
+		if !oauth.Subset(requested, granted) {
+			h.oauthError(w, oauth.ErrInvalidScope("the scope exceeds what was granted"))
+			return
+		}
+		scopes = requested
+	}
+	// the client may have lost scopes since the user allowed them
+	if !oauth.Subset(scopes, client.ScopeList()) {
+		h.oauthError(w, oauth.ErrInvalidScope("the client may no longer request the scope"))
+		return
+	}
+	user, err := h.models(r).Users.Get(token.UserID)
+	if err != nil || user.Active != 1 {
+		h.oauthError(w, oauth.ErrInvalidGrant("the user can not log in"))
+		return
+	}
+	h.issueTokens(w, r, tokenGrant{
+		client:  client,
+		user:    user,
+		scopes:  scopes,
+		granted: token.Scopes,
+		family:  token.Family,
+	})
+}
+
+// clientCredentialsGrant issues an access token to a confidential client acting for itself
+func (h *Handlers) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client *models.OAuthClient) {
+	if !client.Confidential {
+		h.oauthError(w, oauth.ErrUnauthorizedClient("public clients can not use client credentials"))
+		return
+	}
+	scopes := oauth.ParseScopes(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		for _, s := range client.ScopeList() {
+			if !isUserScope(s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	for _, s := range scopes {
+		if isUserScope(s) {
+			h.oauthError(w, oauth.ErrInvalidScope("the "+s+" scope needs a user"))
+			return
+		}
+	}
+	if !oauth.Subset(scopes, client.ScopeList()) {
+		h.oauthError(w, oauth.ErrInvalidScope("the client may not request the scope"))
+		return
+	}
+	accessToken, claims, err := h.OAuth.IssueAccessToken(client.ClientID, client.ClientID, scopes)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to sign access token with err:", err)
+		h.oauthError(w, oauth.ErrServerError(""))
+		return
+	}
+	h.oauthJSON(w, tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(h.OAuth.AccessTokenTTL.Seconds()),
+		Scope:       claims.Scope,
+	}, http.StatusOK)
+}
+
+// issueTokens writes the token response for a user: an access token, an ID token when openid was
+// granted and the next refresh token of the family when the client may refresh
+func (h *Handlers) issueTokens(w http.ResponseWriter, r *http.Request, grant tokenGrant) {
+	subject := strconv.Itoa(grant.user.ID)
+	accessToken, claims, err := h.OAuth.IssueAccessToken(subject, grant.client.ClientID, grant.scopes)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to sign access token with err:", err)
+		h.oauthError(w, oauth.ErrServerError(""))
+		return
+	}
+	res := tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(h.OAuth.AccessTokenTTL.Seconds()),
+		Scope:       claims.Scope,
+	}
+	if contains(grant.scopes, oauth.ScopeOpenID) {
+		idClaims := userClaims(grant.user, grant.scopes)
+		idClaims.Audience = grant.client.ClientID
+		idClaims.Nonce = grant.nonce
+		if res.IDToken, err = h.OAuth.IssueIDToken(idClaims); err != nil {
+			h.App.ErrorLog.Println("failed to sign id token with err:", err)
+			h.oauthError(w, oauth.ErrServerError(""))
+			return
+		}
+	}
+	if grant.client.AllowsGrant(oauth.GrantRefreshToken) {
+		res.RefreshToken, err = h.models(r).OAuthRefreshTokens.Issue(models.OAuthRefreshToken{
+			Family:   grant.family,
+			ClientID: grant.client.ClientID,
+			UserID:   grant.user.ID,
+			Scopes:   grant.granted,
+		}, h.OAuth.RefreshTokenTTL)
+		if err != nil {
+			h.App.ErrorLog.Println("failed to issue refresh token with err:", err)
+			h.oauthError(w, oauth.ErrServerError(""))
+			return
+		}
+	}
+	h.oauthJSON(w, res, http.StatusOK)
+}
+
+// oauthTokenReused revokes the refresh tokens of a family after a code or refresh token was used
+// twice and records it, family is empty when the model revoked it already
+func (h *Handlers) oauthTokenReused(r *http.Request, userID int, family string) {
+	if family != "" {
+		if err := h.models(r).OAuthRefreshTokens.RevokeFamily(family); err != nil {
+			h.App.ErrorLog.Println("failed to revoke refresh tokens with err:", err)
+		}
+	}
+	event := newAuditEvent(models.AuditOAuthTokenReused, nil, "")
+	if user, err := h.models(r).Users.Get(userID); err == nil {
+		event = newAuditEvent(models.AuditOAuthTokenReused, user, "")
+	}
+	h.recordAudit(r, event)
+}
+
+// OAuthIntrospect tells a confidential client if a token is active, access tokens of any client
+// can be introspected so apps can check the tokens sent to their apis, refresh tokens only by
+// the client they were issued to
+func (h *Handlers) OAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthIntrospect")
+	if err := r.ParseForm(); err != nil {
+		h.oauthError(w, oauth.ErrInvalidRequest("the body must be form encoded"))
+		return
+	}
+	client, oerr := h.oauthClient(r)
+	if oerr != nil {
+		h.oauthError(w, oerr)
+		return
+	}
+	if !client.Confidential {
+		h.oauthError(w, oauth.ErrUnauthorizedClient("only confidential clients can introspect tokens"))
+		return
+	}
+
+	raw := r.PostForm.Get("token")
+	if raw == "" {
+		h.oauthError(w, oauth.ErrInvalidRequest("the token is required"))
+		return
+	}
+	// the hint only decides what is tried first
+	if r.PostForm.Get("token_type_hint") == oauth.GrantRefreshToken {
+		if res, ok := h.introspectRefreshToken(r, raw, client); ok {
+			h.oauthJSON(w, res, http.StatusOK)
+			return
+		}
+	}
+	if res, ok := h.introspectAccessToken(r, raw); ok {
+		h.oauthJSON(w, res, http.StatusOK)
+		return
+	}
+	if res, ok := h.introspectRefreshToken(r, raw, client); ok {
+		h.oauthJSON(w, res, http.StatusOK)
+		return
+	}
+	h.oauthJSON(w, introspection{Active: false}, http.StatusOK)
+}
+
+// introspectAccessToken checks an access token, it is inactive once its client was deleted or
+// its user deactivated
+func (h *Handlers) introspectAccessToken(r *http.Request, raw string) (introspection, bool) {
+	claims, err := h.OAuth.VerifyAccessToken(raw)
+	if err != nil {
+		return introspection{}, false
+	}
+	if _, err := h.models(r).OAuthClients.GetByClientID(claims.ClientID); err != nil {
+		return introspection{}, false
+	}
+	res := introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		Expiry:    claims.Expiry,
+		IssuedAt:  claims.IssuedAt,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		JWTID:     claims.JWTID,
+	}
+	if claims.Subject != claims.ClientID {
+		user := h.tokenUser(r, claims)
+		if user == nil {
+			return introspection{}, false
+		}
+		res.Username = user.Email
+	}
+	return res, true
+}
+
+// introspectRefreshToken checks a refresh token of the client
+func (h *Handlers) introspectRefreshToken(r *http.Request, raw string, client *models.OAuthClient) (introspection, bool) {
+	token, err := h.models(r).OAuthRefreshTokens.Peek(raw)
+	if err != nil || token.ClientID != client.ClientID {
+		return introspection{}, false
+	}
+	user, err := h.models(r).Users.Get(token.UserID)
+	if err != nil || user.Active != 1 {
+		return introspection{}, false
+	}
+	return introspection{
+		Active:    true,
+		Scope:     token.Scopes,
+		ClientID:  token.ClientID,
+		Username:  user.Email,
+		TokenType: oauth.GrantRefreshToken,
+		Expiry:    token.ExpiresAt.Unix(),
+		IssuedAt:  token.CreatedAt.Unix(),
+		Subject:   strconv.Itoa(user.ID),
+		Issuer:    h.OAuth.Issuer,
+	}, true
+}
+
+// OAuthUserInfo returns the claims of the user of an access token with the openid scope
+func (h *Handlers) OAuthUserInfo(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthUserInfo")
+	scheme, raw, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	claims, err := h.OAuth.VerifyAccessToken(raw)
+	if !strings.EqualFold(scheme, "Bearer") || err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		h.oauthJSON(w, oauth.Error{Code: "invalid_token"}, http.StatusUnauthorized)
+		return
+	}
+	if !contains(claims.Scopes(), oauth.ScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		h.oauthJSON(w, oauth.Error{Code: "insufficient_scope"}, http.StatusForbidden)
+		return
+	}
+	user := h.tokenUser(r, claims)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		h.oauthJSON(w, oauth.Error{Code: "invalid_token"}, http.StatusUnauthorized)
+		return
+	}
+	h.oauthJSON(w, userClaims(user, claims.Scopes()), http.StatusOK)
+}
+
+// tokenUser returns the active user an access token was issued for or nil
+func (h *Handlers) tokenUser(r *http.Request, claims *oauth.AccessClaims) *models.User {
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil
+	}
+	user, err := h.models(r).Users.Get(id)
+	if err != nil || user.Active != 1 {
+		return nil
+	}
+	return user
+}
+
+// userClaims returns the claims about the user the scopes allow
+func userClaims(user *models.User, scopes []string) oauth.IDClaims {
+	claims := oauth.IDClaims{Subject: strconv.Itoa(user.ID)}
+	if contains(scopes, oauth.ScopeEmail) {
+		verified := user.IsVerified()
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	if contains(scopes, oauth.ScopeProfile) {
+		claims.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims.GivenName = user.FirstName
+		claims.FamilyName = user.LastName
+	}
+	return claims
+}
+
+// oauthClient authenticates the client of a token or introspection request, public clients only
+// send their id
+func (h *Handlers) oauthClient(r *http.Request) (*models.OAuthClient, *oauth.Error) {
+	id, secret, _, oerr := oauth.ClientCredentials(r)
+	if oerr != nil {
+		return nil, oerr
+	}
+	if id == "" {
+		return nil, oauth.ErrInvalidClient("client authentication is required")
+	}
+	client, err := h.models(r).OAuthClients.GetByClientID(id)
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+			return nil, oauth.ErrServerError("")
+		}
+		return nil, oauth.ErrInvalidClient("unknown client")
+	}
+	if client.Confidential && !client.SecretMatches(secret) {
+		return nil, oauth.ErrInvalidClient("wrong client secret")
+	}
+	if !client.Confidential && secret != "" {
+		return nil, oauth.ErrInvalidClient("public clients have no secret")
+	}
+	return client, nil
+}
+
+// oauthJSON writes a response of the token endpoints, they must never be cached
+func (h *Handlers) oauthJSON(w http.ResponseWriter, data interface{}, status int) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+	if err := h.renderJSON(w, data, status, headers); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// oauthError writes an error response of the token endpoints
+func (h *Handlers) oauthError(w http.ResponseWriter, e *oauth.Error) {
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	h.oauthJSON(w, e, e.Status)
+}
+
+// isUserScope reports whether the scope is about a user and can not be granted to a client alone
+func isUserScope(scope string) bool {
+	return scope == oauth.ScopeOpenID || scope == oauth.ScopeProfile || scope == oauth.ScopeEmail
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
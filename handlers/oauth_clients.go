@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"imperatorapp/auth/oauth"
+	"imperatorapp/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jet "github.com/CloudyKit/jet/v6"
+	"github.com/arc41t3ct/imperator"
+	chi "github.com/go-chi/chi/v5"
+	up "github.com/upper/db/v4"
+)
+
+// OAuthClients lists the apps that log their users in through the portal
+func (h *Handlers) OAuthClients(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClients")
+	h.renderOAuthClients(w, r, nil, "")
+}
+
+// OAuthClientCreate shows the form for registering a client
+func (h *Handlers) OAuthClientCreate(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClientCreate")
+	client := &models.OAuthClient{
+		Confidential: true,
+		Scopes:       strings.Join([]string{oauth.ScopeOpenID, oauth.ScopeProfile, oauth.ScopeEmail}, " "),
+		GrantTypes:   strings.Join([]string{oauth.GrantAuthorizationCode, oauth.GrantRefreshToken}, " "),
+	}
+	h.renderOAuthClientForm(w, r, client, nil)
+}
+
+// OAuthClientCreatePost registers a client and shows its secret once
+func (h *Handlers) OAuthClientCreatePost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClientCreatePost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	client := oauthClientFromForm(r, &models.OAuthClient{})
+	validator := h.App.GetValidator()
+	validateOAuthClient(validator, client)
+	if !validator.Valid() {
+		h.renderOAuthClientForm(w, r, client, validator.Errors)
+		return
+	}
+
+	id, secret, err := h.models(r).OAuthClients.Insert(*client)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	client, err = h.models(r).OAuthClients.Get(id)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditOAuthClient(r, models.AuditOAuthClientCreated, client, h.auditDiff(models.OAuthClient{ID: client.ID}, *client))
+	h.renderOAuthClients(w, r, client, secret)
+}
+
+// OAuthClientEdit shows the form for changing a client
+func (h *Handlers) OAuthClientEdit(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClientEdit")
+	client, ok := h.oauthClientFromURL(w, r)
+	if !ok {
+		return
+	}
+	h.renderOAuthClientForm(w, r, client, nil)
+}
+
+// OAuthClientEditPost saves the changes to a client, a public client that becomes confidential
+// gets a secret which is shown once
+func (h *Handlers) OAuthClientEditPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClientEditPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	client, ok := h.oauthClientFromURL(w, r)
+	if !ok {
+		return
+	}
+	before := *client
+
+	client = oauthClientFromForm(r, client)
+	validator := h.App.GetValidator()
+	validateOAuthClient(validator, client)
+	if !validator.Valid() {
+		h.renderOAuthClientForm(w, r, client, validator.Errors)
+		return
+	}
+	if err := h.models(r).OAuthClients.Update(*client); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditOAuthClient(r, models.AuditOAuthClientUpdated, client, h.auditDiff(before, *client))
+
+	if client.Confidential && !before.Confidential {
+		secret, err := h.models(r).OAuthClients.RotateSecret(client.ID)
+		if err != nil {
+			h.App.ErrorLog.Println(err)
+			h.App.Render.Error500(w, r)
+			return
+		}
+		h.auditOAuthClient(r, models.AuditOAuthSecretRotated, client, "")
+		h.renderOAuthClients(w, r, client, secret)
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("Client %s has been updated.", client.Name))
+	http.Redirect(w, r, "/admin/oauth/clients", http.StatusSeeOther)
+}
+
+// OAuthClientSecret gives a confidential client a new secret, the old one stops working
+func (h *Handlers) OAuthClientSecret(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClientSecret")
+	client, ok := h.oauthClientFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !client.Confidential {
+		h.App.Session.Put(r.Context(), "error", "Public clients have no secret.")
+		http.Redirect(w, r, "/admin/oauth/clients", http.StatusSeeOther)
+		return
+	}
+	secret, err := h.models(r).OAuthClients.RotateSecret(client.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditOAuthClient(r, models.AuditOAuthSecretRotated, client, "")
+	h.renderOAuthClients(w, r, client, secret)
+}
+
+// OAuthClientDelete removes a client, its refresh tokens stop working and its access tokens are
+// no longer active on introspection
+func (h *Handlers) OAuthClientDelete(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OAuthClientDelete")
+	client, ok := h.oauthClientFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := h.models(r).OAuthClients.Delete(client.ID); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditOAuthClient(r, models.AuditOAuthClientDeleted, client, "")
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("Client %s has been deleted.", client.Name))
+	http.Redirect(w, r, "/admin/oauth/clients", http.StatusSeeOther)
+}
+
+// renderOAuthClients renders the client list, created is the client whose secret was just
+// generated and is the only time it is shown
+func (h *Handlers) renderOAuthClients(w http.ResponseWriter, r *http.Request, created *models.OAuthClient, secret string) {
+	clients, err := h.models(r).OAuthClients.GetAll()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	vars := make(jet.VarMap)
+	vars.Set("clients", clients)
+	vars.Set("created", created)
+	vars.Set("secret", secret)
+	vars.Set("issuer", h.OAuth.Issuer)
+	if err := h.render(w, r, "oauth_clients", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// renderOAuthClientForm renders the form for a new or an existing client
+func (h *Handlers) renderOAuthClientForm(w http.ResponseWriter, r *http.Request, client *models.OAuthClient, fieldErrors map[string]string) {
+	if fieldErrors == nil {
+		fieldErrors = make(map[string]string)
+	}
+	vars := make(jet.VarMap)
+	vars.Set("client", client)
+	vars.Set("grantTypes", oauth.GrantTypes)
+	vars.Set("hasGrant", client.AllowsGrant)
+	vars.Set("errors", fieldErrors)
+	if err := h.render(w, r, "oauth_client_form", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// oauthClientFromURL loads the client of the id url parameter, it renders a 404 when there is none
+func (h *Handlers) oauthClientFromURL(w http.ResponseWriter, r *http.Request) (*models.OAuthClient, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	client, err := h.models(r).OAuthClients.Get(id)
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	return client, true
+}
+
+// auditOAuthClient records a change to a client by the logged in user
+func (h *Handlers) auditOAuthClient(r *http.Request, action string, client *models.OAuthClient, changes string) {
+	event := newAuditEvent(action, nil, changes)
+	event.TargetType = "oauth_client"
+	event.TargetID = client.ID
+	event.TargetLabel = client.Name
+	h.auditActor(r, event)
+}
+
+// oauthClientFromForm copies the submitted client fields onto the client
+func oauthClientFromForm(r *http.Request, client *models.OAuthClient) *models.OAuthClient {
+	client.Name = strings.TrimSpace(r.Form.Get("name"))
+	client.RedirectURIs = strings.Join(strings.Fields(r.Form.Get("redirect_uris")), "\n")
+	client.Scopes = strings.Join(oauth.ParseScopes(r.Form.Get("scopes")), " ")
+	var grants []string
+	for _, g := range oauth.GrantTypes {
+		if contains(r.Form["grant_types"], g) {
+			grants = append(grants, g)
+		}
+	}
+	client.GrantTypes = strings.Join(grants, " ")
+	client.Confidential = r.Form.Get("confidential") != ""
+	client.Trusted = r.Form.Get("trusted") != ""
+	return client
+}
+
+// validateOAuthClient checks the settings of a client
+func validateOAuthClient(validator *imperator.Validation, client *models.OAuthClient) {
+	validator.Check(client.Name != "", "name", "Name is required")
+	validator.Check(len(client.Name) <= 255, "name", "Name must not be longer than 255 characters")
+
+	validator.Check(client.GrantTypes != "", "grant_types", "Select at least one grant type")
+	validator.Check(!client.AllowsGrant(oauth.GrantRefreshToken) || client.AllowsGrant(oauth.GrantAuthorizationCode),
+		"grant_types", "Refresh tokens are only issued with the authorization code grant")
+	validator.Check(!client.AllowsGrant(oauth.GrantClientCredentials) || client.Confidential,
+		"grant_types", "Only confidential clients can use client credentials")
+
+	uris := client.RedirectURIList()
+	validator.Check(len(uris) > 0 || !client.AllowsGrant(oauth.GrantAuthorizationCode),
+		"redirect_uris", "The authorization code grant needs at least one redirect uri")
+	for _, uri := range uris {
+		if err := oauth.CheckRedirectURI(uri); err != nil {
+			validator.AddError("redirect_uris", fmt.Sprintf("%s: %s", uri, err))
+			break
+		}
+	}
+	validator.Check(len(client.RedirectURIs) <= 4096, "redirect_uris", "Too many redirect uris")
+
+	scopes := client.ScopeList()
+	validator.Check(len(scopes) > 0, "scopes", "Enter at least one scope")
+	validator.Check(len(client.Scopes) <= 512, "scopes", "Scopes must not be longer than 512 characters")
+	for _, s := range scopes {
+		if !oauth.ValidScope(s) {
+			validator.AddError("scopes", fmt.Sprintf("%q is not a valid scope", s))
+			break
+		}
+	}
+}
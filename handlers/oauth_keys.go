@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"imperatorapp/auth/oauth"
+	"imperatorapp/models"
+	"time"
+)
+
+// LoadOAuthKeys returns the stored signing keys of the OAuth provider, it is the loader of the key
+// set. Keys that can not be decrypted, for example after the encryption key changed, are skipped.
+func (h *Handlers) LoadOAuthKeys() ([]*oauth.Key, error) {
+	stored, err := h.Models.OAuthKeys.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*oauth.Key, 0, len(stored))
+	for _, s := range stored {
+		text, err := h.decrypt(s.PrivateKey)
+		if err != nil {
+			h.App.ErrorLog.Printf("failed to decrypt oauth key %s with err: %s", s.KeyID, err)
+			continue
+		}
+		key, err := oauth.ParseKey(text, s.CreatedAt)
+		if err != nil {
+			h.App.ErrorLog.Printf("failed to parse oauth key %s with err: %s", s.KeyID, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RotateOAuthKeys generates a new signing key when the newest one is older than the rotation
+// period and deletes the keys no token can be signed with any longer
+func (h *Handlers) RotateOAuthKeys() error {
+	keys, err := h.LoadOAuthKeys()
+	if err != nil {
+		return err
+	}
+	newest := time.Time{}
+	for _, k := range keys {
+		if k.CreatedAt.After(newest) {
+			newest = k.CreatedAt
+		}
+	}
+	if time.Since(newest) >= h.OAuth.KeyRotation {
+		key, err := oauth.GenerateKey()
+		if err != nil {
+			return err
+		}
+		text, err := key.MarshalPEM()
+		if err != nil {
+			return err
+		}
+		encrypted, err := h.encrypt(text)
+		if err != nil {
+			return err
+		}
+		if _, err := h.Models.OAuthKeys.Insert(models.OAuthKey{KeyID: key.ID, PrivateKey: encrypted, CreatedAt: key.CreatedAt}); err != nil {
+			return err
+		}
+		h.App.InfoLog.Println("generated oauth signing key", key.ID)
+	}
+	if err := h.Models.OAuthKeys.DeleteOlderThan(time.Now().Add(-h.OAuth.KeyRetention())); err != nil {
+		return err
+	}
+	h.OAuth.Keys.Invalidate()
+	return nil
+}
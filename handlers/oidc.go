@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"imperatorapp/auth/oidc"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arc41t3ct/imperator/mailer"
+	chi "github.com/go-chi/chi/v5"
+	up "github.com/upper/db/v4"
+)
+
+// session keys holding the state of a login at an identity provider until it redirects back
+const (
+	oidcProviderKey = "oidc_provider"
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcVerifierKey = "oidc_verifier"
+)
+
+// OIDCLogin sends the browser to the identity provider from the url
+func (h *Handlers) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OIDCLogin")
+	provider, ok := h.OIDC.Get(chi.URLParam(r, "provider"))
+	if !ok {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		h.App.Render.Error500(w, r)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		h.App.Render.Error500(w, r)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		h.App.Render.Error500(w, r)
+		return
+	}
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to start oidc login with err:", err)
+		h.App.Session.Put(r.Context(), "error", fmt.Sprintf("%s is not available right now, please try again later.", provider.Label))
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+
+	h.App.Session.Put(r.Context(), oidcProviderKey, provider.Name)
+	h.App.Session.Put(r.Context(), oidcStateKey, state)
+	h.App.Session.Put(r.Context(), oidcNonceKey, nonce)
+	h.App.Session.Put(r.Context(), oidcVerifierKey, verifier)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback finishes the login when the identity provider redirects back, the user is looked
+// up by the identity, linked by email to an existing account when the provider is trusted or the
+// owner is logged in, or created when the provider allows it
+func (h *Handlers) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: OIDCCallback")
+	provider, ok := h.OIDC.Get(chi.URLParam(r, "provider"))
+	if !ok {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return
+	}
+	// the values are single use, a reload of the callback must not log in again
+	name := h.App.Session.PopString(r.Context(), oidcProviderKey)
+	state := h.App.Session.PopString(r.Context(), oidcStateKey)
+	nonce := h.App.Session.PopString(r.Context(), oidcNonceKey)
+	verifier := h.App.Session.PopString(r.Context(), oidcVerifierKey)
+
+	query := r.URL.Query()
+	if name != provider.Name || oidc.CheckState(state, query.Get("state")) != nil {
+		h.oidcFailed(w, r, "The login has expired, please try again.")
+		return
+	}
+	if query.Get("error") != "" {
+		h.oidcFailed(w, r, fmt.Sprintf("The login was cancelled or denied by %s.", provider.Label))
+		return
+	}
+
+	tokens, err := provider.Exchange(r.Context(), query.Get("code"), verifier)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.oidcFailed(w, r, "login failed")
+		return
+	}
+	claims, err := provider.VerifyIDToken(r.Context(), tokens.IDToken, nonce)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.oidcFailed(w, r, "login failed")
+		return
+	}
+	if claims.Email == "" && tokens.AccessToken != "" {
+		if err := provider.UserInfo(r.Context(), tokens.AccessToken, claims); err != nil {
+			h.App.ErrorLog.Println(err)
+		}
+	}
+
+	user, message := h.oidcUser(r, provider, claims)
+	if user == nil {
+		h.oidcFailed(w, r, message)
+		return
+	}
+	// deactivated users may not log in through a provider either
+	if user.Active != 1 {
+		h.oidcFailed(w, r, "login failed")
+		return
+	}
+	h.finishLogin(w, r, user, false)
+}
+
+// oidcUser returns the user of the verified claims, on failure the message tells the visitor why
+func (h *Handlers) oidcUser(r *http.Request, provider *oidc.Provider, claims *oidc.Claims) (*models.User, string) {
+	identity, err := h.models(r).Identities.GetBySubject(provider.Name, claims.Subject)
+	if err == nil {
+		if err := h.models(r).Identities.Touch(identity.ID, claims.Email); err != nil {
+			h.App.ErrorLog.Println(err)
+		}
+		user, err := h.models(r).Users.Get(identity.UserID)
+		if err != nil {
+			h.App.ErrorLog.Println(err)
+			return nil, "login failed"
+		}
+		return user, ""
+	}
+	if !errors.Is(err, up.ErrNoMoreRows) {
+		h.App.ErrorLog.Println(err)
+		return nil, "login failed"
+	}
+
+	// the first login with this identity, the email is what it can be matched by
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		return nil, fmt.Sprintf("%s did not share a verified email address.", provider.Label)
+	}
+	user, err := h.models(r).Users.GetByEmail(claims.Email)
+	linked := false
+	switch {
+	case err == nil:
+		// an unverified account may have been registered by someone else with this email, it is
+		// not linked so its password can never be used to get into the account of the owner
+		if !user.IsVerified() {
+			return nil, "Please verify your email before logging in."
+		}
+		// a provider that is not trusted may hand out any email, the owner links it by logging in
+		// with it while logged in to the account, not while an admin impersonates them
+		if !provider.Trusted && (h.App.Session.GetInt(r.Context(), "userID") != user.ID ||
+			h.App.Session.GetInt(r.Context(), sessions.ImpersonatorKey) != 0) {
+			return nil, fmt.Sprintf("There is already an account for %s. Log in to it first, then log in with %s to link them.", claims.Email, provider.Label)
+		}
+		linked = true
+	case errors.Is(err, up.ErrNoMoreRows) && provider.Provision:
+		firstName, lastName := claims.GivenName, claims.FamilyName
+		if firstName == "" && lastName == "" {
+			firstName, lastName, _ = strings.Cut(strings.TrimSpace(claims.Name), " ")
+		}
+		user, err = h.provisionUser(r, claims.Email, firstName, lastName)
+		if err != nil {
+			h.App.ErrorLog.Println("failed to provision oidc user with err:", err)
+			return nil, "login failed"
+		}
+	case errors.Is(err, up.ErrNoMoreRows):
+		return nil, fmt.Sprintf("There is no account for %s, ask an administrator to create one.", claims.Email)
+	default:
+		h.App.ErrorLog.Println(err)
+		return nil, "login failed"
+	}
+
+	identity = &models.UserIdentity{
+		UserID:   user.ID,
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	if _, err := h.models(r).Identities.Insert(*identity); err != nil {
+		h.App.ErrorLog.Println("failed to link oidc identity with err:", err)
+		return nil, "login failed"
+	}
+	h.recordAudit(r, newAuditEvent(models.AuditIdentityLinked, user, h.auditDiff(models.UserIdentity{}, *identity)))
+	if linked {
+		if err := h.sendIdentityLinked(r.Context(), user, provider.Label); err != nil {
+			h.App.ErrorLog.Println("failed to send identity linked email with err:", err)
+		}
+	}
+	return user, ""
+}
+
+// sendIdentityLinked tells the user that a login with the provider was linked to their account
+func (h *Handlers) sendIdentityLinked(ctx context.Context, u *models.User, provider string) error {
+	var data struct {
+		FirstName string
+		Provider  string
+	}
+	data.FirstName = u.FirstName
+	data.Provider = provider
+	msg := mailer.Message{
+		To:       u.Email,
+		Subject:  "A login was linked to your account",
+		Template: "identity_linked",
+		Data:     data,
+		From:     "admin@imperator.portal",
+	}
+	return h.App.Mail.Queue(ctx, msg)
+}
+
+// provisionUser creates an active user whose email was verified by an identity provider or the
+// directory, the password is random so the account can only be used through them until the
+// user resets it
+func (h *Handlers) provisionUser(r *http.Request, email, firstName, lastName string) (*models.User, error) {
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(email, "@")
+	}
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+	verifiedAt := time.Now()
+	user := &models.User{
+		FirstName:       firstName,
+		LastName:        lastName,
+		Email:           email,
+		Password:        password,
+		Active:          1,
+		EmailVerifiedAt: &verifiedAt,
+	}
+	id, err := h.models(r).Users.Insert(*user)
+	if err != nil {
+		return nil, err
+	}
+	user.ID = id
+	h.auditAnonymous(r, models.AuditUserProvisioned, user, "")
+	return user, nil
+}
+
+// oidcFailed sends the visitor back to the login page with the message
+func (h *Handlers) oidcFailed(w http.ResponseWriter, r *http.Request, message string) {
+	h.App.Session.Put(r.Context(), "error", message)
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
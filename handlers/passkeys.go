@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"imperatorapp/auth/webauthn"
+	"imperatorapp/models"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	jet "github.com/CloudyKit/jet/v6"
+)
+
+// session keys holding the challenges of running webauthn ceremonies
+const (
+	passkeyRegisterChallenge = "webauthn_register_challenge"
+	passkeyLoginChallenge    = "webauthn_login_challenge"
+)
+
+// passkeyPayload is the json envelope returned by the passkey endpoints
+type passkeyPayload struct {
+	Error    bool        `json:"error"`
+	Message  string      `json:"message,omitempty"`
+	Redirect string      `json:"redirect,omitempty"`
+	Options  interface{} `json:"options,omitempty"`
+}
+
+// relyingParty returns our webauthn relying party settings from .env. WEBAUTHN_RP_ID defaults to
+// SERVER_NAME and WEBAUTHN_ORIGINS (comma separated) defaults to APP_URL.
+func (h *Handlers) relyingParty() *webauthn.RelyingParty {
+	rp := &webauthn.RelyingParty{
+		ID:   os.Getenv("WEBAUTHN_RP_ID"),
+		Name: os.Getenv("WEBAUTHN_RP_NAME"),
+	}
+	if rp.ID == "" {
+		rp.ID = os.Getenv("SERVER_NAME")
+	}
+	if rp.Name == "" {
+		rp.Name = h.appName()
+	}
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if origins == "" {
+		origins = os.Getenv("APP_URL")
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			rp.Origins = append(rp.Origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return rp
+}
+
+// passkeyUserHandle is the opaque user handle stored on the authenticator with the credential
+func passkeyUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// passkeyDescriptors converts stored credentials into descriptors for the browser
+func passkeyDescriptors(credentials []*models.Credential) []webauthn.CredentialDescriptor {
+	descriptors := make([]webauthn.CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		d := webauthn.CredentialDescriptor{Type: "public-key", ID: base64.RawURLEncoding.EncodeToString(c.CredentialID)}
+		if c.Transports != "" {
+			d.Transports = strings.Split(c.Transports, ",")
+		}
+		descriptors = append(descriptors, d)
+	}
+	return descriptors
+}
+
+func (h *Handlers) passkeyError(w http.ResponseWriter, status int, message string) {
+	if err := h.renderJSON(w, passkeyPayload{Error: true, Message: message}, status); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// Passkeys lists the passkeys of the logged in user and lets them register new ones
+func (h *Handlers) Passkeys(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Passkeys")
+	credentials, err := h.models(r).Credentials.GetAllForUser(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	vars := make(jet.VarMap)
+	vars.Set("credentials", credentials)
+	if err := h.render(w, r, "passkeys", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// PasskeyRegisterBegin starts the registration ceremony and returns the creation options
+func (h *Handlers) PasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: PasskeyRegisterBegin")
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.passkeyError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	existing, err := h.models(r).Credentials.GetAllForUser(user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.passkeyError(w, http.StatusInternalServerError, "could not load your passkeys")
+		return
+	}
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.passkeyError(w, http.StatusInternalServerError, "could not create a challenge")
+		return
+	}
+	h.sessionPut(r.Context(), passkeyRegisterChallenge, challenge)
+
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	opts := h.relyingParty().CreationOptions(challenge, passkeyUserHandle(user.ID), user.Email, displayName, passkeyDescriptors(existing))
+	if err := h.renderJSON(w, passkeyPayload{Options: opts}, http.StatusOK); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// PasskeyRegisterFinish verifies the new credential and stores it for the logged in user
+func (h *Handlers) PasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: PasskeyRegisterFinish")
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	challenge := h.App.Session.PopString(r.Context(), passkeyRegisterChallenge)
+	if userID == 0 || challenge == "" {
+		h.passkeyError(w, http.StatusBadRequest, "no registration in progress")
+		return
+	}
+
+	var input struct {
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+	if err := h.App.RequestReadJSON(w, r, &input); err != nil {
+		h.passkeyError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	cred, err := h.relyingParty().VerifyRegistration(input.Credential, challenge, false)
+	if err != nil {
+		h.App.ErrorLog.Println("passkey registration failed with err:", err)
+		h.passkeyError(w, http.StatusBadRequest, "the passkey could not be verified")
+		return
+	}
+	if _, err := h.models(r).Credentials.GetByCredentialID(cred.ID); err == nil {
+		h.passkeyError(w, http.StatusConflict, "this passkey is already registered")
+		return
+	}
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	_, err = h.models(r).Credentials.Insert(models.Credential{
+		UserID:       userID,
+		Name:         name,
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    int64(cred.SignCount),
+		AAGUID:       cred.AAGUID,
+		Transports:   strings.Join(cred.Transports, ","),
+	})
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.passkeyError(w, http.StatusInternalServerError, "the passkey could not be saved")
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", "Your passkey has been registered.")
+	if err := h.renderJSON(w, passkeyPayload{Redirect: "/admin/user/passkeys"}, http.StatusOK); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// PasskeyDelete removes a passkey of the logged in user
+func (h *Handlers) PasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: PasskeyDelete")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	if err := h.models(r).Credentials.DeleteForUser(id, h.App.Session.GetInt(r.Context(), "userID")); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", "The passkey has been removed.")
+	http.Redirect(w, r, "/admin/user/passkeys", http.StatusSeeOther)
+}
+
+// PasskeyLoginBegin starts the authentication ceremony. After a password check it asks for one
+// of the pending user's credentials as second factor, otherwise any discoverable credential
+// can be used to log in without a password.
+func (h *Handlers) PasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: PasskeyLoginBegin")
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.passkeyError(w, http.StatusInternalServerError, "could not create a challenge")
+		return
+	}
+
+	var allow []webauthn.CredentialDescriptor
+	userVerification := "required"
+	if pendingID := h.App.Session.GetInt(r.Context(), pendingTwoFactorUserID); pendingID != 0 {
+		credentials, err := h.models(r).Credentials.GetAllForUser(pendingID)
+		if err != nil {
+			h.App.ErrorLog.Println(err)
+			h.passkeyError(w, http.StatusInternalServerError, "could not load passkeys")
+			return
+		}
+		allow = passkeyDescriptors(credentials)
+		userVerification = "discouraged"
+	}
+	h.sessionPut(r.Context(), passkeyLoginChallenge, challenge)
+
+	opts := h.relyingParty().RequestOptions(challenge, allow, userVerification)
+	if err := h.renderJSON(w, passkeyPayload{Options: opts}, http.StatusOK); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
+
+// PasskeyLoginFinish verifies the assertion and logs the user in
+func (h *Handlers) PasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: PasskeyLoginFinish")
+	challenge := h.App.Session.PopString(r.Context(), passkeyLoginChallenge)
+	if challenge == "" {
+		h.passkeyError(w, http.StatusBadRequest, "no login in progress")
+		return
+	}
+	var assertion webauthn.AssertionResponse
+	if err := h.App.RequestReadJSON(w, r, &assertion); err != nil {
+		h.passkeyError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	credentialID, err := assertion.CredentialID()
+	if err != nil {
+		h.passkeyError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	cred, err := h.models(r).Credentials.GetByCredentialID(credentialID)
+	if err != nil || cred.CloneWarning == 1 {
+		h.passkeyError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+
+	// as second factor the credential must belong to the user who entered the password,
+	// as passwordless login the authenticator must vouch for the user with user verification
+	pendingID := h.App.Session.GetInt(r.Context(), pendingTwoFactorUserID)
+	secondFactor := pendingID != 0
+	if secondFactor && cred.UserID != pendingID {
+		h.passkeyError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	if !secondFactor {
+		userHandle, err := assertion.UserHandle()
+		if err != nil || !bytes.Equal(userHandle, passkeyUserHandle(cred.UserID)) {
+			h.passkeyError(w, http.StatusUnauthorized, "login failed")
+			return
+		}
+	}
+
+	result, err := h.relyingParty().VerifyAssertion(assertion, challenge, cred.PublicKey, uint32(cred.SignCount), !secondFactor)
+	if errors.Is(err, webauthn.ErrPossibleClone) {
+		h.App.ErrorLog.Printf("possible cloned passkey %d of user %d, disabling it", cred.ID, cred.UserID)
+		if err := h.models(r).Credentials.FlagCloned(cred.ID); err != nil {
+			h.App.ErrorLog.Println(err)
+		}
+		h.passkeyError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	if err != nil {
+		h.App.ErrorLog.Println("passkey login failed with err:", err)
+		h.passkeyError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	if err := h.models(r).Credentials.MarkUsed(cred.ID, int64(result.SignCount)); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+
+	// the passkey replaces the password, so the account must pass the same checks as LoginPost
+	user, err := h.models(r).Users.Get(cred.UserID)
+	if err != nil || user.Active != 1 || !user.IsVerified() || (!secondFactor && !h.passwordlessAllowed(r, user)) {
+		h.passkeyError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	remember := h.App.Session.GetBool(r.Context(), pendingTwoFactorRemember)
+	h.App.Session.Remove(r.Context(), pendingTwoFactorUserID)
+	h.App.Session.Remove(r.Context(), pendingTwoFactorRemember)
+	if err := h.logUserIn(w, r, user, remember); err != nil {
+		h.App.ErrorLog.Println("failed to log user in with err:", err)
+		h.passkeyError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+	if err := h.renderJSON(w, passkeyPayload{Redirect: h.loginRedirect(r)}, http.StatusOK); err != nil {
+		h.App.ErrorLog.Println("failed to write json with err:", err)
+	}
+}
@@ -1,15 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"imperatorapp/models"
 	"net/http"
+	"net/url"
+	"time"
 
 	jet "github.com/CloudyKit/jet/v6"
 	"github.com/arc41t3ct/imperator/mailer"
-	"github.com/arc41t3ct/imperator/signer"
 )
 
+// passwordResetMinutes is how long a password reset link is valid
+const passwordResetMinutes = 60
+
 // PasswordForgot handles request for people who forgot their passwords
 func (h *Handlers) PasswordForgot(w http.ResponseWriter, r *http.Request) {
 	h.App.InfoLog.Println("running handler: PasswordForgot")
@@ -27,85 +33,61 @@ func (h *Handlers) PasswordForgotPost(w http.ResponseWriter, r *http.Request) {
 		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
 		return
 	}
-	// verify email exists
+	// the response is the same for unknown emails, it would tell who has an account otherwise
 	var u *models.User
 	email := r.Form.Get("email")
 	u, err := u.GetByEmail(email)
-	if err != nil {
-		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
-		return
+	if err == nil {
+		if err := h.sendPasswordReset(r.Context(), u); err != nil {
+			h.App.ErrorLog.Println(err)
+		} else {
+			h.auditAnonymous(r, models.AuditPasswordForgot, u, "")
+		}
 	}
-	// create link to password reset form
-	link := fmt.Sprintf("%s/admin/users/reset?email=%s", h.App.Server.URL, email)
-	// sign the link with our signer
-	sign := signer.Signer{
-		Secret: []byte(h.App.EncryptionKey),
+	// redirect the user
+	h.App.Session.Put(
+		r.Context(),
+		"flash",
+		"If there is an account for this email, a reset password link is on its way.")
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// sendPasswordReset emails the user a link to the password reset form with a single-use token,
+// it does not wait for the mail to be sent
+func (h *Handlers) sendPasswordReset(ctx context.Context, u *models.User) error {
+	token, err := h.Models.WithContext(ctx).UserTokens.Issue(u.ID, models.PurposePasswordReset, passwordResetMinutes*time.Minute)
+	if err != nil {
+		return err
 	}
-	signedLink := sign.GenerateTokenFromString(link)
-	h.App.InfoLog.Println("signed new link:", signedLink)
 	// email the message
 	var data struct {
-		Link     string
-		FirsName string
+		Link      string
+		FirstName string
+		Minutes   int
 	}
-	data.Link = signedLink
-	data.FirsName = u.FirstName
+	data.Link = fmt.Sprintf("%s/admin/user/reset-password?token=%s", appURL(), url.QueryEscape(token))
+	data.FirstName = u.FirstName
+	data.Minutes = passwordResetMinutes
 	msg := mailer.Message{
 		To:       u.Email,
-		Subject:  "Password Reset for " + email,
+		Subject:  "Password Reset for " + u.Email,
 		Template: "password_reset",
 		Data:     data,
 		From:     "admin@imperator.portal",
 	}
-	h.App.Mail.Jobs <- msg
-	res := <-h.App.Mail.Results
-	if res.Error != nil {
-		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
-		return
-	}
-	// redirect the user
-	h.App.Session.Put(
-		r.Context(),
-		"flash",
-		"Check your inbox for a reset password link.")
-	http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
+	return h.dispatchMail(ctx, msg)
 }
 
 // PasswordReset handles request for resetting a password
 func (h *Handlers) PasswordReset(w http.ResponseWriter, r *http.Request) {
 	h.App.InfoLog.Println("running handler: PasswordReset")
-	// get form values
-	email := r.URL.Query().Get("email")
-	theURL := r.RequestURI
-	testUrl := fmt.Sprintf("%s%s", h.App.Server.URL, theURL)
-	// validate url and not tempered
-	signer := signer.Signer{
-		Secret: []byte(h.App.EncryptionKey),
-	}
-	valid := signer.VerifyToken(testUrl)
-	if !valid {
-		h.App.ErrorLog.Println("invalid url")
-		h.App.Render.ErrorUnauthorized(w, r)
-	}
-	// make sure it is not expired
-	expired := signer.Expired(testUrl, 60)
-	if expired {
-		h.App.ErrorLog.Print("expired url")
-		h.App.Render.ErrorUnauthorized(w, r)
-	}
-	// display form
-	encryptedEmail, err := h.encrypt(email)
-	if err != nil {
-		h.App.ErrorLog.Println(err)
-		h.App.Render.Error404(w, r)
-	}
-	vars := make(jet.VarMap)
-	vars.Set("email", encryptedEmail)
-
-	if err := h.render(w, r, "password_reset", vars, nil); err != nil {
-		h.App.ErrorLog.Println(err)
-		h.App.Render.Error404(w, r)
+	token := r.URL.Query().Get("token")
+	// the token is only checked here, it is used up when the new password is saved
+	if _, err := h.models(r).UserTokens.Peek(token, models.PurposePasswordReset); err != nil {
+		h.passwordResetInvalid(w, r, err)
+		return
 	}
+	h.renderPasswordReset(w, r, token, nil)
 }
 
 // PasswordResetPost handles request for resetting passesords
@@ -116,36 +98,69 @@ func (h *Handlers) PasswordResetPost(w http.ResponseWriter, r *http.Request) {
 		h.App.Render.Error500(w, r)
 		return
 	}
-	// get and decrypt the email
-	email, err := h.decrypt(r.Form.Get("email"))
+	token := r.Form.Get("token")
+	password := r.Form.Get("password")
+	// the policy needs the user to compare against its name and previous passwords
+	pending, err := h.models(r).UserTokens.Peek(token, models.PurposePasswordReset)
 	if err != nil {
-		h.App.Session.Put(
-			r.Context(),
-			"error",
-			"The could not reset the password.")
-		http.Redirect(w, r, "/admin/users/reset-password", http.StatusSeeOther)
+		h.passwordResetInvalid(w, r, err)
 		return
 	}
-	// get the user
-	var u models.User
-	user, err := u.GetByEmail(email)
+	user, err := h.models(r).Users.Get(pending.UserID)
 	if err != nil {
-		h.App.Session.Put(
-			r.Context(),
-			"error",
-			"The could not reset the password.")
-		http.Redirect(w, r, "/admin/users/reset-password", http.StatusSeeOther)
+		h.passwordResetInvalid(w, r, err)
+		return
+	}
+	validator := h.App.GetValidator()
+	h.validatePassword(r, validator, password, user)
+	validator.Check(password == r.Form.Get("verify-password"), "verify-password", "Passwords do not match")
+	if !validator.Valid() {
+		h.renderPasswordReset(w, r, token, validator.Errors)
+		return
+	}
+
+	// use up the token before the password is changed so it can not be replayed
+	if _, err := h.models(r).UserTokens.Consume(token, models.PurposePasswordReset); err != nil {
+		h.passwordResetInvalid(w, r, err)
 		return
 	}
 	// reset Password
-	if err := user.ResetPassword(user.ID, r.Form.Get("password")); err != nil {
-		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+	if err := user.ResetPassword(user.ID, password); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
 		return
 	}
+	h.auditAnonymous(r, models.AuditPasswordReset, user, "")
 	// redirect
 	h.App.Session.Put(
 		r.Context(),
 		"flash",
 		"The password was reset successfully. You can log in with the new one now.")
-	http.Redirect(w, r, "/admin/users/login", http.StatusSeeOther)
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// renderPasswordReset renders the form for a new password carrying the reset token
+func (h *Handlers) renderPasswordReset(w http.ResponseWriter, r *http.Request, token string, fieldErrors map[string]string) {
+	if fieldErrors == nil {
+		fieldErrors = map[string]string{}
+	}
+	vars := make(jet.VarMap)
+	vars.Set("token", token)
+	vars.Set("errors", fieldErrors)
+	if err := h.render(w, r, "password_reset", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+	}
+}
+
+// passwordResetInvalid sends the user back to request a new link when the token can not be used
+func (h *Handlers) passwordResetInvalid(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, models.ErrUserTokenInvalid) {
+		h.App.ErrorLog.Println(err)
+	}
+	h.App.Session.Put(
+		r.Context(),
+		"error",
+		"The password reset link is invalid or has expired, please request a new one.")
+	http.Redirect(w, r, "/admin/user/forgot-password", http.StatusSeeOther)
 }
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"imperatorapp/auth/throttle"
+	"imperatorapp/models"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	jet "github.com/CloudyKit/jet/v6"
+	"github.com/arc41t3ct/imperator/mailer"
+	"github.com/arc41t3ct/imperator/signer"
+)
+
+// verificationLinkMinutes is how long a verification link is valid
+const verificationLinkMinutes = 24 * 60
+
+// registrationEnabled reports if visitors can create their own account, it is configured with
+// REGISTRATION_ENABLED in .env and off by default
+func registrationEnabled() bool {
+	return os.Getenv("REGISTRATION_ENABLED") == "true"
+}
+
+// registrationDomainAllowed checks the domain of the email against the comma separated
+// REGISTRATION_ALLOWED_DOMAINS in .env, every domain is allowed when it is empty
+func registrationDomainAllowed(email string) bool {
+	allowed := strings.TrimSpace(os.Getenv("REGISTRATION_ALLOWED_DOMAINS"))
+	if allowed == "" {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range strings.Split(allowed, ",") {
+		if strings.ToLower(strings.TrimSpace(d)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Register shows the sign up form
+func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Register")
+	if !registrationEnabled() {
+		h.App.Render.Error404(w, r)
+		return
+	}
+	h.renderRegister(w, r, &models.User{}, nil)
+}
+
+// RegisterPost creates an inactive user and emails them a link to verify their email
+func (h *Handlers) RegisterPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: RegisterPost")
+	if !registrationEnabled() {
+		h.App.Render.Error404(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	user := &models.User{
+		FirstName: strings.TrimSpace(r.Form.Get("first_name")),
+		LastName:  strings.TrimSpace(r.Form.Get("last_name")),
+		Email:     strings.TrimSpace(r.Form.Get("email")),
+	}
+	validator := h.App.GetValidator()
+	user.Validate(validator)
+	validator.Check(registrationDomainAllowed(user.Email), "email", "Registration is not open for this email domain")
+	h.models(r).Users.ValidateUniqueEmail(validator, 0, user.Email)
+	password := r.Form.Get("password")
+	h.validatePassword(r, validator, password, user)
+	validator.Check(password == r.Form.Get("password_confirmation"), "password_confirmation", "Passwords do not match")
+	if !validator.Valid() {
+		h.renderRegister(w, r, user, validator.Errors)
+		return
+	}
+
+	if message := h.mailAllowed(r, throttle.Key(peerIP(r))); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		h.renderRegister(w, r, user, nil)
+		return
+	}
+
+	user.Password = password
+	user.Active = 0
+	id, err := h.models(r).Users.Insert(*user)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	user.ID = id
+	h.auditAnonymous(r, models.AuditUserRegistered, user, "")
+	if err := h.sendVerification(r.Context(), user); err != nil {
+		h.App.ErrorLog.Println("failed to send verification email with err:", err)
+	}
+
+	h.App.Session.Put(r.Context(), "flash", "Your account has been created. Check your inbox for a link to verify your email.")
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// Verify activates the user of a signed verification link
+func (h *Handlers) Verify(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Verify")
+	sign := signer.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+	testURL := fmt.Sprintf("%s%s", appURL(), r.RequestURI)
+	if !sign.VerifyToken(testURL) {
+		h.App.ErrorLog.Println("invalid verification url")
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+	if sign.Expired(testURL, verificationLinkMinutes) {
+		h.App.Session.Put(r.Context(), "error", "The verification link has expired, request a new one below.")
+		http.Redirect(w, r, "/user/verify/resend", http.StatusSeeOther)
+		return
+	}
+
+	user, err := h.models(r).Users.GetByEmail(r.URL.Query().Get("email"))
+	if err != nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+	// a verified user that is inactive was deactivated by an admin and must stay that way
+	if user.IsVerified() {
+		h.App.Session.Put(r.Context(), "flash", "Your email has already been verified.")
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+	if err := h.models(r).Users.VerifyEmail(user.ID); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.auditAnonymous(r, models.AuditUserVerified, user, "")
+	if err := h.sendWelcome(r.Context(), user); err != nil {
+		h.App.ErrorLog.Println("failed to send welcome email with err:", err)
+	}
+
+	h.App.Session.Put(r.Context(), "flash", "Your email has been verified. You can log in now.")
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// ResendVerification shows the form to request a new verification link
+func (h *Handlers) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: ResendVerification")
+	if err := h.render(w, r, "verify_resend", nil, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+	}
+}
+
+// ResendVerificationPost emails a new verification link to an unverified user, the response is
+// the same for every email so it can not be used to find out who has an account
+func (h *Handlers) ResendVerificationPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: ResendVerificationPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(r.Form.Get("email"))
+	if message := h.mailAllowed(r, throttle.Key(email)); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		http.Redirect(w, r, "/user/verify/resend", http.StatusSeeOther)
+		return
+	}
+
+	user, err := h.models(r).Users.GetByEmail(email)
+	if err == nil && !user.IsVerified() {
+		if err := h.sendVerification(r.Context(), user); err != nil {
+			h.App.ErrorLog.Println("failed to send verification email with err:", err)
+		}
+	}
+
+	h.App.Session.Put(r.Context(), "flash", "If your email is waiting for verification, a new link is on its way.")
+	http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+}
+
+// renderRegister renders the sign up form with the values of user and the field errors
+func (h *Handlers) renderRegister(w http.ResponseWriter, r *http.Request, user *models.User, fieldErrors map[string]string) {
+	if fieldErrors == nil {
+		fieldErrors = map[string]string{}
+	}
+	vars := make(jet.VarMap)
+	vars.Set("user", user)
+	vars.Set("errors", fieldErrors)
+	vars.Set("domains", strings.TrimSpace(os.Getenv("REGISTRATION_ALLOWED_DOMAINS")))
+	if err := h.render(w, r, "register", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+	}
+}
+
+// mailAllowed records an email sent on behalf of an anonymous visitor and returns a message when
+// too many were sent for the key
+func (h *Handlers) mailAllowed(r *http.Request, key string) string {
+	status, err := h.MailThrottle.Check(r.Context(), key)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to check mail throttle with err:", err)
+		return ""
+	}
+	if status.RetryAfter > 0 {
+		return fmt.Sprintf("Too many emails have been requested, please try again in %s.", waitTime(status.RetryAfter))
+	}
+	if _, err := h.MailThrottle.Hit(r.Context(), key); err != nil {
+		h.App.ErrorLog.Println("failed to record mail throttle with err:", err)
+	}
+	return ""
+}
+
+// sendVerification emails the user a signed link to verify their email without waiting for the mail
+func (h *Handlers) sendVerification(ctx context.Context, u *models.User) error {
+	link := fmt.Sprintf("%s/user/verify?email=%s", appURL(), url.QueryEscape(u.Email))
+	sign := signer.Signer{
+		Secret: []byte(h.App.EncryptionKey),
+	}
+	var data struct {
+		Link      string
+		FirstName string
+		Hours     int
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+	data.FirstName = u.FirstName
+	data.Hours = verificationLinkMinutes / 60
+	msg := mailer.Message{
+		To:       u.Email,
+		Subject:  "Please verify your email",
+		Template: "verify_email",
+		Data:     data,
+		From:     "admin@imperator.portal",
+	}
+	return h.dispatchMail(ctx, msg)
+}
+
+// sendWelcome emails the welcome mail to a user who just verified their email
+func (h *Handlers) sendWelcome(ctx context.Context, u *models.User) error {
+	msg := mailer.Message{
+		To:       u.Email,
+		Subject:  "Welcome to the Imperator Portal",
+		Template: "welcome_mail",
+		Data:     nil,
+		From:     "admin@imperator.portal",
+	}
+	return h.App.Mail.Queue(ctx, msg)
+}
+
+// dispatchMail queues the message without waiting for it to be sent, for the mails a response
+// must not wait for as the time would tell who has an account. Send errors are logged.
+func (h *Handlers) dispatchMail(ctx context.Context, msg mailer.Message) error {
+	msg.Done = func(result mailer.Result) {
+		if result.Error != nil {
+			h.App.ErrorLog.Printf("failed to send %s email with err: %v", msg.Template, result.Error)
+		}
+	}
+	return h.App.Mail.Dispatch(ctx, msg)
+}
+
+// appURL returns APP_URL from .env which links in emails are built on
+func appURL() string {
+	return strings.TrimSuffix(os.Getenv("APP_URL"), "/")
+}
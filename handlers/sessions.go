@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/models"
+	"net/http"
+	"strconv"
+
+	jet "github.com/CloudyKit/jet/v6"
+	chi "github.com/go-chi/chi/v5"
+	up "github.com/upper/db/v4"
+)
+
+// Sessions lists the sessions and remember me devices of the logged in user
+func (h *Handlers) Sessions(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Sessions")
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+	h.renderSessions(w, r, user, "/admin/user/sessions", false)
+}
+
+// SessionRevoke ends one of the other sessions of the logged in user
+func (h *Handlers) SessionRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: SessionRevoke")
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	if h.revokeSession(w, r, userID) {
+		http.Redirect(w, r, "/admin/user/sessions", http.StatusSeeOther)
+	}
+}
+
+// RememberRevoke removes one remember me device of the logged in user
+func (h *Handlers) RememberRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: RememberRevoke")
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	if h.revokeRemember(w, r, userID) {
+		http.Redirect(w, r, "/admin/user/sessions", http.StatusSeeOther)
+	}
+}
+
+// SessionsRevokeOthers logs the user out everywhere except in the current session
+func (h *Handlers) SessionsRevokeOthers(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: SessionsRevokeOthers")
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+	if err := h.SessionIndex.RevokeOthers(user.ID, h.SessionIndex.Current(r.Context())); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditSessionsRevoked, user, "")
+	h.App.Session.Put(r.Context(), "success", "You have been logged out everywhere else.")
+	http.Redirect(w, r, "/admin/user/sessions", http.StatusSeeOther)
+}
+
+// UserSessions lists the sessions and remember me devices of any user for admins
+func (h *Handlers) UserSessions(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserSessions")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	h.renderSessions(w, r, user, fmt.Sprintf("/admin/users/%d/sessions", user.ID), true)
+}
+
+// UserSessionRevoke ends one session of a user for admins
+func (h *Handlers) UserSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserSessionRevoke")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if h.revokeSession(w, r, user.ID) {
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d/sessions", user.ID), http.StatusSeeOther)
+	}
+}
+
+// UserRememberRevoke removes one remember me device of a user for admins
+func (h *Handlers) UserRememberRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserRememberRevoke")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if h.revokeRemember(w, r, user.ID) {
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d/sessions", user.ID), http.StatusSeeOther)
+	}
+}
+
+// UserSessionsRevokeAll logs a user out everywhere, the session of the admin doing it is kept
+// when they revoke their own sessions
+func (h *Handlers) UserSessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserSessionsRevokeAll")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	keep := 0
+	if user.ID == h.App.Session.GetInt(r.Context(), "userID") {
+		keep = h.SessionIndex.Current(r.Context())
+	}
+	if err := h.SessionIndex.RevokeOthers(user.ID, keep); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditSessionsRevoked, user, "")
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("User %s has been logged out everywhere.", user.Email))
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d/sessions", user.ID), http.StatusSeeOther)
+}
+
+// revokeSession ends the session from the url when it belongs to the user, the current session
+// can only be ended by logging out. It reports if the caller should redirect back.
+func (h *Handlers) revokeSession(w http.ResponseWriter, r *http.Request, userID int) bool {
+	id, err := strconv.Atoi(chi.URLParam(r, "session"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return false
+	}
+	session, err := h.models(r).UserSessions.Get(id)
+	if err != nil || session.UserID != userID {
+		if err != nil && !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return false
+	}
+	if session.ID == h.SessionIndex.Current(r.Context()) {
+		h.App.Session.Put(r.Context(), "error", "Log out to end the current session.")
+		return true
+	}
+	if err := h.SessionIndex.Revoke(session); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return false
+	}
+	if user, err := h.models(r).Users.Get(userID); err == nil {
+		h.audit(r, models.AuditSessionRevoked, user, "")
+	}
+	h.App.Session.Put(r.Context(), "success", "The session has been ended.")
+	return true
+}
+
+// revokeRemember removes the remember me device from the url when it belongs to the user and
+// ends the sessions it logged in. It reports if the caller should redirect back.
+func (h *Handlers) revokeRemember(w http.ResponseWriter, r *http.Request, userID int) bool {
+	id, err := strconv.Atoi(chi.URLParam(r, "device"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return false
+	}
+	if err := h.SessionIndex.RevokeRemembered(userID, id); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return false
+	}
+	if user, err := h.models(r).Users.Get(userID); err == nil {
+		h.audit(r, models.AuditRememberRevoked, user, "")
+	}
+	h.App.Session.Put(r.Context(), "success", "The device will no longer be remembered.")
+	return true
+}
+
+// renderSessions renders the sessions page of the user, baseURL is where the forms post to
+func (h *Handlers) renderSessions(w http.ResponseWriter, r *http.Request, user *models.User, baseURL string, admin bool) {
+	list, err := h.models(r).UserSessions.GetForUser(user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	devices, err := h.models(r).RememberToken.GetForUser(user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("user", user)
+	vars.Set("sessions", list)
+	vars.Set("devices", devices)
+	vars.Set("currentID", h.SessionIndex.Current(r.Context()))
+	vars.Set("baseURL", baseURL)
+	vars.Set("admin", admin)
+	vars.Set("device", sessions.Describe)
+	if err := h.render(w, r, "sessions", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
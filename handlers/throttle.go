@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"imperatorapp/models"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/arc41t3ct/imperator"
+	"github.com/arc41t3ct/imperator/mailer"
+)
+
+// loginAllowed checks the login throttle for the email and the address of the request and
+// returns a message for the user when they have to wait
+func (h *Handlers) loginAllowed(r *http.Request, email string) (time.Duration, string) {
+	status, err := h.LoginThrottle.Check(r.Context(), email, peerIP(r))
+	if err != nil {
+		h.App.ErrorLog.Println("failed to check login throttle with err:", err)
+		return 0, ""
+	}
+	if status.RetryAfter <= 0 {
+		return 0, ""
+	}
+	if status.Locked {
+		return status.RetryAfter, fmt.Sprintf("Too many failed login attempts, login is locked for %s.", waitTime(status.RetryAfter))
+	}
+	return status.RetryAfter, fmt.Sprintf("Too many failed login attempts, please try again in %s.", waitTime(status.RetryAfter))
+}
+
+// loginFailed records a failed login and notifies the user when this failure locked the account,
+// user is nil when the email does not belong to any account
+func (h *Handlers) loginFailed(r *http.Request, email string, user *models.User) {
+	h.auditAnonymous(r, models.AuditLoginFailed, user, email)
+	_, locked, err := h.LoginThrottle.Fail(r.Context(), email, peerIP(r))
+	if err != nil {
+		h.App.Log(r).Error("failed to record failed login", "err", err)
+		return
+	}
+	if locked {
+		h.auditAnonymous(r, models.AuditLoginLocked, user, email)
+	}
+	if locked && user != nil {
+		h.App.Log(r).Info("locked login", "locked_user_id", user.ID)
+		if err := h.sendAccountLocked(r.Context(), user, remoteIP(r)); err != nil {
+			h.App.ErrorLog.Println("failed to send account locked email with err:", err)
+		}
+	}
+}
+
+// loginSucceeded forgets the failed logins of the email
+func (h *Handlers) loginSucceeded(r *http.Request, email string) {
+	if err := h.LoginThrottle.Succeed(r.Context(), email); err != nil {
+		h.App.ErrorLog.Println("failed to reset login throttle with err:", err)
+	}
+}
+
+// loginLocked reports if the account of the email is locked, it is used by the admin screens
+func (h *Handlers) loginLocked(r *http.Request, email string) bool {
+	locked, err := h.LoginThrottle.Locked(r.Context(), email)
+	if err != nil {
+		h.App.ErrorLog.Println("failed to check login throttle with err:", err)
+	}
+	return locked
+}
+
+// sendAccountLocked tells the user that their account was locked after too many failed logins
+func (h *Handlers) sendAccountLocked(ctx context.Context, u *models.User, ip string) error {
+	var data struct {
+		FirstName string
+		Minutes   int
+		IP        string
+	}
+	data.FirstName = u.FirstName
+	data.Minutes = int(math.Ceil(h.LoginThrottle.Email.Config.Lockout.Minutes()))
+	data.IP = ip
+	msg := mailer.Message{
+		To:       u.Email,
+		Subject:  "Your account has been locked",
+		Template: "account_locked",
+		Data:     data,
+		From:     "admin@imperator.portal",
+	}
+	return h.App.Mail.Queue(ctx, msg)
+}
+
+// peerIP returns the address of the connection, the throttles count by it since the forwarded
+// address remoteIP returns is whatever the client put into the headers
+func peerIP(r *http.Request) string {
+	return imperator.PeerAddr(r)
+}
+
+// remoteIP returns the address of the client, middleware.RealIP has already applied the
+// X-Forwarded-For and X-Real-IP headers. It is what is shown to users and recorded in the audit
+// log, never use it to limit a client.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// waitTime formats a wait for humans rounded up to seconds or minutes
+func waitTime(d time.Duration) string {
+	if d <= time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(d.Seconds())))
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"imperatorapp/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jet "github.com/CloudyKit/jet/v6"
+	chi "github.com/go-chi/chi/v5"
+)
+
+// tokenExpiryDays are the expiry choices on the token form, 0 creates a token that never expires
+var tokenExpiryDays = []int{30, 90, 365, 0}
+
+// Tokens lists the personal access tokens of the logged in user with the form to create a new one
+func (h *Handlers) Tokens(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Tokens")
+	h.renderTokens(w, r, nil, nil)
+}
+
+// TokenCreatePost creates a new personal access token and shows the plain text token once
+func (h *Handlers) TokenCreatePost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TokenCreatePost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	scopes := h.models(r).Tokens.ValidScopes(r.Form["scopes"])
+	days, err := strconv.Atoi(r.Form.Get("expires"))
+	validator := h.App.GetValidator()
+	validator.Check(name != "", "name", "Name is required")
+	validator.Check(len(name) <= 255, "name", "Name must not be longer than 255 characters")
+	validator.Check(scopes != "", "scopes", "Select at least one scope")
+	validator.Check(err == nil && days >= 0, "expires", "Select when the token expires")
+	if !validator.Valid() {
+		h.renderTokens(w, r, nil, validator.Errors)
+		return
+	}
+
+	token, err := h.models(r).Tokens.GenerateToken(user.ID, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	token.Name = name
+	token.Scopes = scopes
+	if _, err := h.models(r).Tokens.Insert(*token, *user); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.renderTokens(w, r, token, nil)
+}
+
+// TokenRevoke deletes a personal access token of the logged in user
+func (h *Handlers) TokenRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TokenRevoke")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return
+	}
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	if err := h.models(r).Tokens.DeleteForUser(id, userID); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", "The token has been revoked.")
+	http.Redirect(w, r, "/admin/user/tokens", http.StatusSeeOther)
+}
+
+// AdminTokens lists the personal access tokens of all users
+func (h *Handlers) AdminTokens(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: AdminTokens")
+	tokens, err := h.models(r).Tokens.GetAll()
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	vars := make(jet.VarMap)
+	vars.Set("tokens", tokens)
+	if err := h.render(w, r, "admin_tokens", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// AdminTokenRevoke deletes the personal access token of any user
+func (h *Handlers) AdminTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: AdminTokenRevoke")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return
+	}
+	if err := h.models(r).Tokens.Delete(id); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.App.Session.Put(r.Context(), "success", "The token has been revoked.")
+	http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+}
+
+// renderTokens renders the token page, created is the token that was just created and is the
+// only time its plain text is shown
+func (h *Handlers) renderTokens(w http.ResponseWriter, r *http.Request, created *models.Token, fieldErrors map[string]string) {
+	tokens, err := h.models(r).Tokens.GetTokensForUser(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	if fieldErrors == nil {
+		fieldErrors = make(map[string]string)
+	}
+	vars := make(jet.VarMap)
+	vars.Set("tokens", tokens)
+	vars.Set("created", created)
+	vars.Set("scopes", models.TokenScopes)
+	vars.Set("expiryDays", tokenExpiryDays)
+	vars.Set("errors", fieldErrors)
+	if err := h.render(w, r, "tokens", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
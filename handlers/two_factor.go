@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"errors"
+	"imperatorapp/auth/totp"
+	"imperatorapp/models"
+	"net/http"
+	"strings"
+	"time"
+
+	jet "github.com/CloudyKit/jet/v6"
+)
+
+// session keys used while a login waits for its second factor or an enrollment is in progress
+const (
+	pendingTwoFactorUserID   = "pending_2fa_user_id"
+	pendingTwoFactorRemember = "pending_2fa_remember"
+	enrollTwoFactorSecret    = "totp_enroll_secret"
+)
+
+// TwoFactor shows the form asking for a totp or recovery code after a successful password check
+func (h *Handlers) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TwoFactor")
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), pendingTwoFactorUserID))
+	if err != nil {
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+	passkeys, err := h.models(r).Credentials.CountForUser(user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+	vars := make(jet.VarMap)
+	vars.Set("totp", user.HasTwoFactor())
+	vars.Set("passkeys", passkeys > 0)
+	if err := h.render(w, r, "two_factor", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// TwoFactorPost verifies the submitted totp or recovery code and completes the pending login
+func (h *Handlers) TwoFactorPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TwoFactorPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	userID := h.App.Session.GetInt(r.Context(), pendingTwoFactorUserID)
+	if userID == 0 {
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := h.models(r).Users.Get(userID)
+	if err != nil || !user.HasTwoFactor() {
+		h.App.Session.Remove(r.Context(), pendingTwoFactorUserID)
+		h.App.Session.Put(r.Context(), "error", "login failed")
+		http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// guessing codes counts against the same limit as guessing passwords
+	if _, message := h.loginAllowed(r, user.Email); message != "" {
+		h.App.Session.Put(r.Context(), "error", message)
+		http.Redirect(w, r, "/admin/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	verified := false
+	if code := strings.TrimSpace(r.Form.Get("code")); code != "" {
+		secret, err := h.decrypt(user.TOTPSecret)
+		if err != nil {
+			h.App.ErrorLog.Println("failed to decrypt totp secret with err:", err)
+			h.App.Render.Error500(w, r)
+			return
+		}
+		if verified, err = h.useTOTPCode(r, user.ID, code, secret); err != nil {
+			h.App.ErrorLog.Println("failed to record totp code with err:", err)
+			h.App.Render.Error500(w, r)
+			return
+		}
+	} else if recovery := strings.TrimSpace(r.Form.Get("recovery_code")); recovery != "" {
+		verified, err = h.models(r).RecoveryCodes.Use(user.ID, recovery)
+		if err != nil {
+			h.App.ErrorLog.Println("failed to check recovery code with err:", err)
+		}
+	}
+
+	if !verified {
+		h.loginFailed(r, user.Email, user)
+		h.App.Session.Put(r.Context(), "error", "invalid verification code")
+		http.Redirect(w, r, "/admin/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	h.loginSucceeded(r, user.Email)
+	remember := h.App.Session.GetBool(r.Context(), pendingTwoFactorRemember)
+	h.App.Session.Remove(r.Context(), pendingTwoFactorUserID)
+	h.App.Session.Remove(r.Context(), pendingTwoFactorRemember)
+	h.completeLogin(w, r, user, remember)
+}
+
+// TwoFactorEnroll generates a new totp secret for the logged in user and shows the QR code
+// and provisioning uri. The secret is kept in the session until it is confirmed with a code.
+func (h *Handlers) TwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TwoFactorEnroll")
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+
+	secret := h.App.Session.GetString(r.Context(), enrollTwoFactorSecret)
+	if secret == "" {
+		secret, err = totp.GenerateSecret()
+		if err != nil {
+			h.App.ErrorLog.Println(err)
+			h.App.Render.Error500(w, r)
+			return
+		}
+		h.sessionPut(r.Context(), enrollTwoFactorSecret, secret)
+	}
+
+	qr, err := totp.QRCode(totp.ProvisioningURI(secret, h.appName(), user.Email), 200)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("enabled", user.HasTwoFactor())
+	vars.Set("secret", secret)
+	vars.Set("qr", qr)
+	if err := h.render(w, r, "two_factor_enroll", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// TwoFactorEnrollPost confirms the enrollment with a code from the authenticator app, stores
+// the encrypted secret and shows the recovery codes once
+func (h *Handlers) TwoFactorEnrollPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TwoFactorEnrollPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	userID := h.App.Session.GetInt(r.Context(), "userID")
+	secret := h.App.Session.GetString(r.Context(), enrollTwoFactorSecret)
+	if userID == 0 || secret == "" {
+		http.Redirect(w, r, "/admin/user/two-factor/enroll", http.StatusSeeOther)
+		return
+	}
+
+	verified, err := h.useTOTPCode(r, userID, r.Form.Get("code"), secret)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	if !verified {
+		h.App.Session.Put(r.Context(), "error", "invalid verification code, please try again")
+		http.Redirect(w, r, "/admin/user/two-factor/enroll", http.StatusSeeOther)
+		return
+	}
+
+	encrypted, err := h.encrypt(secret)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	if err := h.models(r).Users.EnableTwoFactor(userID, encrypted); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	codes, err := h.models(r).RecoveryCodes.Generate(userID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.sessionRemove(r.Context(), enrollTwoFactorSecret)
+	if user, err := h.models(r).Users.Get(userID); err == nil {
+		h.audit(r, models.AuditTwoFactorEnabled, user, "")
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("codes", codes)
+	if err := h.render(w, r, "two_factor_recovery_codes", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// TwoFactorDisable turns off the second factor for the logged in user after confirming the password
+func (h *Handlers) TwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: TwoFactorDisable")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	user, err := h.models(r).Users.Get(h.App.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		h.App.Render.ErrorUnauthorized(w, r)
+		return
+	}
+	matches, err := user.PasswordMatches(r.Form.Get("password"))
+	if err != nil || !matches {
+		h.App.Session.Put(r.Context(), "error", "wrong password, two-factor authentication is still enabled")
+		http.Redirect(w, r, "/admin/user/two-factor/enroll", http.StatusSeeOther)
+		return
+	}
+	if err := h.models(r).Users.DisableTwoFactor(user.ID); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditTwoFactorOff, user, "")
+	h.App.Session.Put(r.Context(), "success", "Two-factor authentication has been disabled.")
+	http.Redirect(w, r, "/admin/area", http.StatusSeeOther)
+}
+
+// useTOTPCode checks a totp code of the user and records its period so the same code, or an
+// older one still in the window, is not accepted a second time
+func (h *Handlers) useTOTPCode(r *http.Request, userID int, code, secret string) (bool, error) {
+	counter, ok := totp.Match(code, secret, time.Now())
+	if !ok {
+		return false, nil
+	}
+	err := h.models(r).Users.UseTOTPCounter(userID, counter)
+	if errors.Is(err, models.ErrTOTPCodeUsed) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"imperatorapp/auth/password"
+	"imperatorapp/models"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jet "github.com/CloudyKit/jet/v6"
+	"github.com/arc41t3ct/imperator"
+	chi "github.com/go-chi/chi/v5"
+	up "github.com/upper/db/v4"
+)
+
+// usersPerPage is the number of users shown on one page of the admin user list
+const usersPerPage = 20
+
+// pageLink is a single link of the pagination shown below the user list
+type pageLink struct {
+	Number int
+	URL    string
+	Active bool
+}
+
+// Users lists all users with search, sorting and pagination
+func (h *Handlers) Users(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: Users")
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	sort := r.URL.Query().Get("sort")
+	desc := r.URL.Query().Get("dir") == "desc"
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	users, total, err := h.models(r).Users.Search(query, sort, desc, page, usersPerPage)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+
+	// listURL keeps the current search when building sort and page links
+	listURL := func(sort string, desc bool, page int) string {
+		v := url.Values{}
+		if query != "" {
+			v.Set("q", query)
+		}
+		if sort != "" {
+			v.Set("sort", sort)
+		}
+		if desc {
+			v.Set("dir", "desc")
+		}
+		if page > 1 {
+			v.Set("page", strconv.Itoa(page))
+		}
+		if len(v) == 0 {
+			return "/admin/users"
+		}
+		return "/admin/users?" + v.Encode()
+	}
+
+	pages := int(math.Ceil(float64(total) / float64(usersPerPage)))
+	var links []pageLink
+	for i := 1; i <= pages; i++ {
+		links = append(links, pageLink{Number: i, URL: listURL(sort, desc, i), Active: i == page})
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("users", users)
+	vars.Set("total", total)
+	vars.Set("query", query)
+	vars.Set("pages", links)
+	vars.Set("currentUserID", h.App.Session.GetInt(r.Context(), "userID"))
+	vars.Set("isLocked", h.loginLocked)
+	// sortLink toggles the direction when the list is already sorted by the column
+	vars.Set("sortLink", func(column string) string {
+		return listURL(column, column == sort && !desc, 1)
+	})
+	if err := h.render(w, r, "users", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// UserCreate shows the form for creating a new user
+func (h *Handlers) UserCreate(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserCreate")
+	h.renderUserForm(w, r, &models.User{Active: 1}, nil, nil)
+}
+
+// UserCreatePost validates and stores a new user
+func (h *Handlers) UserCreatePost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserCreatePost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+
+	user := userFromForm(r, &models.User{})
+	// after this only the activate and deactivate actions change whether the user is active
+	if r.Form.Get("active") != "" {
+		user.Active = 1
+	}
+	validator := h.App.GetValidator()
+	user.Validate(validator)
+	h.models(r).Users.ValidateUniqueEmail(validator, 0, user.Email)
+	password := r.Form.Get("password")
+	h.validatePassword(r, validator, password, user)
+	validator.Check(password == r.Form.Get("password_confirmation"), "password_confirmation", "Passwords do not match")
+	roleIDs := h.formRoleIDs(r)
+	if !validator.Valid() {
+		h.renderUserForm(w, r, user, roleIDs, validator.Errors)
+		return
+	}
+
+	user.Password = password
+	// users created by an admin do not have to verify their email
+	verifiedAt := time.Now()
+	user.EmailVerifiedAt = &verifiedAt
+	// the user is only created together with the roles, else an admin would have to find out
+	// which of the two went wrong
+	manageRoles := h.can(r, "roles.manage")
+	err := h.Models.Tx(r.Context(), func(tx *models.Models) error {
+		id, err := tx.Users.Insert(*user)
+		if err != nil {
+			return err
+		}
+		user.ID = id
+		if !manageRoles {
+			return nil
+		}
+		return tx.Roles.SetForUser(id, roleIDs)
+	})
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditUserCreated, user, h.auditDiff(models.User{ID: user.ID}, *user))
+
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("User %s has been created.", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// UserEdit shows the form for editing a user
+func (h *Handlers) UserEdit(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserEdit")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	roles, err := h.models(r).Roles.GetForUser(user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+	var roleIDs []int
+	for _, role := range roles {
+		roleIDs = append(roleIDs, role.ID)
+	}
+	h.renderUserForm(w, r, user, roleIDs, nil)
+}
+
+// UserEditPost validates and stores the changes to a user
+func (h *Handlers) UserEditPost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserEditPost")
+	if err := r.ParseForm(); err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusBadRequest)
+		return
+	}
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	before := *user
+
+	user = userFromForm(r, user)
+	validator := h.App.GetValidator()
+	user.Validate(validator)
+	h.models(r).Users.ValidateUniqueEmail(validator, user.ID, user.Email)
+	roleIDs := h.formRoleIDs(r)
+	if !validator.Valid() {
+		h.renderUserForm(w, r, user, roleIDs, validator.Errors)
+		return
+	}
+
+	manageRoles := h.can(r, "roles.manage")
+	err := h.Models.Tx(r.Context(), func(tx *models.Models) error {
+		if err := tx.Users.Update(*user); err != nil {
+			return err
+		}
+		if !manageRoles {
+			return nil
+		}
+		return tx.Roles.SetForUser(user.ID, roleIDs)
+	})
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditUserUpdated, user, h.auditDiff(before, *user))
+
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("User %s has been updated.", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// UserActivate allows a user to log in again
+func (h *Handlers) UserActivate(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserActivate")
+	h.setUserActive(w, r, true)
+}
+
+// UserDeactivate stops a user from logging in without deleting the account
+func (h *Handlers) UserDeactivate(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserDeactivate")
+	h.setUserActive(w, r, false)
+}
+
+// UserUnlock removes the login lockout of a user after too many failed logins
+func (h *Handlers) UserUnlock(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserUnlock")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := h.LoginThrottle.Unlock(r.Context(), user.Email); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditUserUnlocked, user, "")
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("User %s has been unlocked.", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// UserDelete asks for confirmation before deleting a user
+func (h *Handlers) UserDelete(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserDelete")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	vars := make(jet.VarMap)
+	vars.Set("user", user)
+	vars.Set("self", user.ID == h.App.Session.GetInt(r.Context(), "userID"))
+	if err := h.render(w, r, "user_delete", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
+
+// UserDeletePost deletes a user after the confirmation
+func (h *Handlers) UserDeletePost(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserDeletePost")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == h.App.Session.GetInt(r.Context(), "userID") {
+		h.App.Session.Put(r.Context(), "error", "You can not delete your own account.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err := h.models(r).Users.Delete(user.ID); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	h.audit(r, models.AuditUserDeleted, user, "")
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("User %s has been deleted.", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// UserSendReset emails a password reset link to a user
+func (h *Handlers) UserSendReset(w http.ResponseWriter, r *http.Request) {
+	h.App.InfoLog.Println("running handler: UserSendReset")
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if err := h.sendPasswordReset(r.Context(), user); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Session.Put(r.Context(), "error", "Failed to send the password reset link.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	h.audit(r, models.AuditPasswordForgot, user, "")
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("A password reset link has been sent to %s.", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// setUserActive activates or deactivates the user from the url, admins can not deactivate themselves
+func (h *Handlers) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	user, ok := h.managedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !active && user.ID == h.App.Session.GetInt(r.Context(), "userID") {
+		h.App.Session.Put(r.Context(), "error", "You can not deactivate your own account.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err := h.models(r).Users.SetActive(user.ID, active); err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return
+	}
+	if !active {
+		if err := h.revokeAccess(r, user.ID); err != nil {
+			h.App.ErrorLog.Println(err)
+			h.App.Render.Error500(w, r)
+			return
+		}
+	}
+	state, action := "deactivated", models.AuditUserDeactivated
+	if active {
+		state, action = "activated", models.AuditUserActivated
+	}
+	h.audit(r, action, user, "")
+	h.App.Session.Put(r.Context(), "success", fmt.Sprintf("User %s has been %s.", user.Email, state))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// revokeAccess logs a deactivated user out everywhere. Their sessions and remember me devices
+// end, their api tokens are deleted and the clients they logged in to can not refresh any longer.
+func (h *Handlers) revokeAccess(r *http.Request, userID int) error {
+	if err := h.SessionIndex.RevokeAll(userID); err != nil {
+		return err
+	}
+	if err := h.models(r).Tokens.DeleteAllForUser(userID); err != nil {
+		return err
+	}
+	return h.models(r).OAuthRefreshTokens.RevokeForUser(userID)
+}
+
+// userFromURL loads the user given by the id url parameter and writes a 404 when there is none
+func (h *Handlers) userFromURL(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	user, err := h.models(r).Users.Get(id)
+	if err != nil {
+		if !errors.Is(err, up.ErrNoMoreRows) {
+			h.App.ErrorLog.Println(err)
+		}
+		h.App.Render.ErrorStatus(w, http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+// managedUserFromURL loads the user from the url like userFromURL for an action on them. Admins
+// can only manage users they outrank, otherwise anyone allowed to edit users could change the
+// email of a super admin and send themselves a reset link.
+func (h *Handlers) managedUserFromURL(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, ok := h.userFromURL(w, r)
+	if !ok {
+		return nil, false
+	}
+	allowed, err := h.outranks(r, h.App.Session.GetInt(r.Context(), "userID"), user.ID)
+	if err != nil {
+		h.App.ErrorLog.Println(err)
+		h.App.Render.Error500(w, r)
+		return nil, false
+	}
+	if !allowed {
+		h.App.Session.Put(r.Context(), "error", fmt.Sprintf("You can not manage %s, they have permissions you do not have.", user.Email))
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+	return user, true
+}
+
+// userFromForm copies the submitted user fields onto the user, whether the user is active is left
+// to the activate and deactivate actions
+func userFromForm(r *http.Request, user *models.User) *models.User {
+	user.FirstName = strings.TrimSpace(r.Form.Get("first_name"))
+	user.LastName = strings.TrimSpace(r.Form.Get("last_name"))
+	user.Email = strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+	return user
+}
+
+// validatePassword checks a new password of the user against the password policy, user has no
+// id yet when it is being created
+func (h *Handlers) validatePassword(r *http.Request, validator *imperator.Validation, plain string, user *models.User) {
+	policy := h.PasswordPolicy
+	if policy == nil {
+		policy = &password.DefaultPolicy
+	}
+	subject := password.Subject{Email: user.Email, FirstName: user.FirstName, LastName: user.LastName}
+	if user.ID != 0 {
+		// the current password comes first, users from before the history have only that one
+		current, err := h.models(r).Users.Get(user.ID)
+		if err == nil {
+			subject.Hashes = append(subject.Hashes, current.Password)
+		}
+		history, err := h.models(r).PasswordHistory.Recent(user.ID, policy.History)
+		if err != nil {
+			h.App.ErrorLog.Println("failed to load password history with err:", err)
+		}
+		for _, hash := range history {
+			if len(subject.Hashes) == 0 || hash != subject.Hashes[0] {
+				subject.Hashes = append(subject.Hashes, hash)
+			}
+		}
+	}
+	if err := policy.Validate(validator, "password", plain, subject); err != nil {
+		h.App.ErrorLog.Println("failed to check breached passwords with err:", err)
+	}
+}
+
+// formRoleIDs returns the ids of the roles checked on the user form
+func (h *Handlers) formRoleIDs(r *http.Request) []int {
+	var ids []int
+	for _, value := range r.Form["roles"] {
+		if id, err := strconv.Atoi(value); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// renderUserForm renders the create or edit form, fieldErrors holds the validation message of each field
+func (h *Handlers) renderUserForm(w http.ResponseWriter, r *http.Request, user *models.User, roleIDs []int, fieldErrors map[string]string) {
+	if fieldErrors == nil {
+		fieldErrors = make(map[string]string)
+	}
+	checked := make(map[int]bool)
+	for _, id := range roleIDs {
+		checked[id] = true
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("user", user)
+	vars.Set("errors", fieldErrors)
+	vars.Set("manageRoles", h.can(r, "roles.manage"))
+	if h.can(r, "roles.manage") {
+		roles, err := h.models(r).Roles.GetAll()
+		if err != nil {
+			h.App.ErrorLog.Println(err)
+		}
+		vars.Set("roles", roles)
+	} else {
+		vars.Set("roles", []*models.Role{})
+	}
+	vars.Set("hasRole", func(id int) bool {
+		return checked[id]
+	})
+	if err := h.render(w, r, "user_form", vars, nil); err != nil {
+		h.App.ErrorLog.Println(err)
+	}
+}
@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+func TestBadgerCache_Increment(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := &BadgerCache{Conn: db}
+
+	if count, err := c.Count("missing"); err != nil || count != 0 {
+		t.Fatal("missing key counted:", count, err)
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Increment("failures", 60); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count, err := c.Count("failures"); err != nil || count != n {
+		t.Errorf("expected %d and got %d: %v", n, count, err)
+	}
+	if err := c.Forget("failures"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := c.Increment("failures", 60); count != 1 {
+		t.Error("count not reset by forget:", count)
+	}
+}
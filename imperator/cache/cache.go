@@ -0,0 +1,46 @@
+package cache
+
+import "sync/atomic"
+
+type Cache interface {
+	Has(string) (bool, error)
+	Get(string) (interface{}, error)
+	Set(string, interface{}, ...int) error
+	Forget(string) error
+	EmptyMatching(string) error
+	Empty() error
+}
+
+// Counter is implemented by caches that count atomically, increments of a key from concurrent
+// requests or app instances are never lost. Counted keys are only read with Count.
+type Counter interface {
+	// Increment adds one to the count of the key and returns the new count, a missing key
+	// starts at 0. The key expires after expires seconds.
+	Increment(key string, expires int) (int, error)
+	// Count returns the count of the key, 0 if it does not exist
+	Count(key string) (int, error)
+}
+
+// StatsReporter is implemented by caches that count their lookups
+type StatsReporter interface {
+	Stats() (hits, misses uint64)
+}
+
+// Counters counts the hits and misses of Has and Get, the drivers embed it
+type Counters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Stats returns the number of lookups that found a key and that did not
+func (c *Counters) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+func (c *Counters) count(found bool) {
+	if found {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arc41t3ct/imperator/tracing"
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/gomodule/redigo/redis"
+)
+
+// ContextCache is a Cache whose operations are recorded as spans of the trace in the context
+type ContextCache interface {
+	Cache
+	HasContext(ctx context.Context, key string) (bool, error)
+	GetContext(ctx context.Context, key string) (interface{}, error)
+	SetContext(ctx context.Context, key string, value interface{}, expires ...int) error
+	ForgetContext(ctx context.Context, key string) error
+	EmptyMatchingContext(ctx context.Context, key string) error
+	EmptyContext(ctx context.Context) error
+}
+
+// ContextCounter is a Counter whose operations are recorded as spans of the trace in the context
+type ContextCounter interface {
+	Counter
+	IncrementContext(ctx context.Context, key string, expires int) (int, error)
+	CountContext(ctx context.Context, key string) (int, error)
+}
+
+// traced runs the operation as a span of the trace in ctx, a lookup of a missing key is a miss
+// and not an error
+func traced(ctx context.Context, system, operation, key string, op func() error) error {
+	_, span := tracing.StartChild(ctx, "cache "+operation, tracing.KindClient,
+		tracing.String("db.system", system),
+		tracing.String("db.operation.name", operation),
+		tracing.String("cache.key", key),
+	)
+	err := op()
+	if errors.Is(err, redis.ErrNil) || errors.Is(err, badger.ErrKeyNotFound) {
+		span.SetAttributes(tracing.Bool("cache.hit", false))
+	} else {
+		span.RecordError(err)
+	}
+	span.End()
+	return err
+}
+
+func (c *RedisCache) HasContext(ctx context.Context, key string) (found bool, err error) {
+	err = traced(ctx, "redis", "has", key, func() error {
+		found, err = c.Has(key)
+		return err
+	})
+	return found, err
+}
+
+func (c *RedisCache) GetContext(ctx context.Context, key string) (item interface{}, err error) {
+	err = traced(ctx, "redis", "get", key, func() error {
+		item, err = c.Get(key)
+		return err
+	})
+	return item, err
+}
+
+func (c *RedisCache) SetContext(ctx context.Context, key string, value interface{}, expires ...int) error {
+	return traced(ctx, "redis", "set", key, func() error { return c.Set(key, value, expires...) })
+}
+
+func (c *RedisCache) ForgetContext(ctx context.Context, key string) error {
+	return traced(ctx, "redis", "forget", key, func() error { return c.Forget(key) })
+}
+
+func (c *RedisCache) EmptyMatchingContext(ctx context.Context, key string) error {
+	return traced(ctx, "redis", "empty", key, func() error { return c.EmptyMatching(key) })
+}
+
+func (c *RedisCache) EmptyContext(ctx context.Context) error {
+	return traced(ctx, "redis", "empty", "", c.Empty)
+}
+
+func (c *RedisCache) IncrementContext(ctx context.Context, key string, expires int) (count int, err error) {
+	err = traced(ctx, "redis", "increment", key, func() error {
+		count, err = c.Increment(key, expires)
+		return err
+	})
+	return count, err
+}
+
+func (c *RedisCache) CountContext(ctx context.Context, key string) (count int, err error) {
+	err = traced(ctx, "redis", "count", key, func() error {
+		count, err = c.Count(key)
+		return err
+	})
+	return count, err
+}
+
+func (c *BadgerCache) HasContext(ctx context.Context, key string) (found bool, err error) {
+	err = traced(ctx, "badger", "has", key, func() error {
+		found, err = c.Has(key)
+		return err
+	})
+	return found, err
+}
+
+func (c *BadgerCache) GetContext(ctx context.Context, key string) (item interface{}, err error) {
+	err = traced(ctx, "badger", "get", key, func() error {
+		item, err = c.Get(key)
+		return err
+	})
+	return item, err
+}
+
+func (c *BadgerCache) SetContext(ctx context.Context, key string, value interface{}, expires ...int) error {
+	return traced(ctx, "badger", "set", key, func() error { return c.Set(key, value, expires...) })
+}
+
+func (c *BadgerCache) ForgetContext(ctx context.Context, key string) error {
+	return traced(ctx, "badger", "forget", key, func() error { return c.Forget(key) })
+}
+
+func (c *BadgerCache) EmptyMatchingContext(ctx context.Context, key string) error {
+	return traced(ctx, "badger", "empty", key, func() error { return c.EmptyMatching(key) })
+}
+
+func (c *BadgerCache) EmptyContext(ctx context.Context) error {
+	return traced(ctx, "badger", "empty", "", c.Empty)
+}
+
+func (c *BadgerCache) IncrementContext(ctx context.Context, key string, expires int) (count int, err error) {
+	err = traced(ctx, "badger", "increment", key, func() error {
+		count, err = c.Increment(key, expires)
+		return err
+	})
+	return count, err
+}
+
+func (c *BadgerCache) CountContext(ctx context.Context, key string) (count int, err error) {
+	err = traced(ctx, "badger", "count", key, func() error {
+		count, err = c.Count(key)
+		return err
+	})
+	return count, err
+}
@@ -0,0 +1,27 @@
+package imperator
+
+import (
+	"database/sql"
+
+	_ "github.com/jackc/pgconn"
+	_ "github.com/jackc/pgx/v4"
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+func (i *Imperator) OpenDB(dbType, dsn string) (*sql.DB, error) {
+	if dbType == "postgres" || dbType == "postgresql" {
+		dbType = "pgx"
+	}
+
+	db, err := openTracedDB(dbType, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
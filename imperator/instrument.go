@@ -0,0 +1,278 @@
+package imperator
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arc41t3ct/imperator/cache"
+	"github.com/arc41t3ct/imperator/mailer"
+	"github.com/arc41t3ct/imperator/metrics"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	cron "github.com/robfig/cron/v3"
+)
+
+// metricsPath is where the metrics are served once METRICS_TOKEN or METRICS_ALLOW is set
+const metricsPath = "/metrics"
+
+// peerKey holds the address of the connection in the context of a request, RealIP replaces
+// RemoteAddr with the forwarded address which the client can set to anything
+const peerKey contextKey = "imperator.peer"
+
+// instrumentedKey marks a request Instrument records already, so the Instrument of Routes passes
+// on requests an application router it is mounted in recorded
+const instrumentedKey contextKey = "imperator.instrumented"
+
+// cronBuckets are the upper bounds in seconds of the histogram of job durations
+var cronBuckets = []float64{.01, .1, .5, 1, 5, 10, 30, 60, 300, 900}
+
+type metricsConfig struct {
+	token string
+	allow []*net.IPNet
+}
+
+// instruments are the metrics the framework records itself
+type instruments struct {
+	requests     *metrics.Counter
+	duration     *metrics.Histogram
+	inFlight     *metrics.Gauge
+	mailSent     *metrics.Counter
+	cronDuration *metrics.Histogram
+	cronLastRun  *metrics.Gauge
+}
+
+// createMetricsConfig reads METRICS_TOKEN and METRICS_ALLOW, a comma separated list of IPs and
+// CIDRs, from .env
+func createMetricsConfig() (metricsConfig, error) {
+	c := metricsConfig{token: os.Getenv("METRICS_TOKEN")}
+	for _, entry := range strings.Split(os.Getenv("METRICS_ALLOW"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return c, fmt.Errorf("imperator: invalid address %q in METRICS_ALLOW", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			c.allow = append(c.allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return c, fmt.Errorf("imperator: invalid network %q in METRICS_ALLOW", entry)
+		}
+		c.allow = append(c.allow, network)
+	}
+	return c, nil
+}
+
+// createMetrics creates the registry with the metrics of requests, the database pool, the cache,
+// the mail queue, scheduled jobs and the runtime. Values kept elsewhere are read on every scrape
+// so it can run before the database, cache and mailer are set up.
+func (i *Imperator) createMetrics() error {
+	c, err := createMetricsConfig()
+	if err != nil {
+		return err
+	}
+	i.config.metrics = c
+	i.Metrics = metrics.NewRegistry()
+	m := i.Metrics
+
+	i.instruments = instruments{
+		requests: m.NewCounter("http_requests_total", "HTTP requests by method, route pattern and status.", "method", "route", "status"),
+		duration: m.NewHistogram("http_request_duration_seconds", "Duration of HTTP requests by method and route pattern.", nil, "method", "route"),
+		inFlight: m.NewGauge("http_requests_in_flight", "HTTP requests being handled."),
+	}
+
+	stats := func(value func(s sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			if i.DB.Pool == nil {
+				return 0
+			}
+			return value(i.DB.Pool.Stats())
+		}
+	}
+	m.NewGaugeFunc("db_pool_max_open_connections", "Maximum number of open database connections.", stats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	m.NewGaugeFunc("db_pool_open_connections", "Open database connections.", stats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	m.NewGaugeFunc("db_pool_in_use_connections", "Database connections in use.", stats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	m.NewGaugeFunc("db_pool_idle_connections", "Idle database connections.", stats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	m.NewCounterFunc("db_pool_wait_count_total", "Database connections waited for.", stats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	m.NewCounterFunc("db_pool_wait_duration_seconds_total", "Time spent waiting for database connections.", stats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+
+	lookups := func(hits bool) func() float64 {
+		return func() float64 {
+			reporter, ok := i.Cache.(cache.StatsReporter)
+			if !ok {
+				return 0
+			}
+			hit, miss := reporter.Stats()
+			if hits {
+				return float64(hit)
+			}
+			return float64(miss)
+		}
+	}
+	m.NewCounterFunc("cache_hits_total", "Cache lookups that found the key.", lookups(true))
+	m.NewCounterFunc("cache_misses_total", "Cache lookups that did not find the key.", lookups(false))
+
+	m.NewGaugeFunc("mail_queue_length", "Mails waiting to be sent.", func() float64 { return float64(len(i.Mail.Jobs)) })
+	i.instruments.mailSent = m.NewCounter("mail_sent_total", "Mails sent by result, success or failure.", "result")
+
+	i.instruments.cronDuration = m.NewHistogram("cron_job_duration_seconds", "Duration of scheduled jobs.", cronBuckets, "job")
+	i.instruments.cronLastRun = m.NewGauge("cron_job_last_run_timestamp_seconds", "Unix time the scheduled job last finished.", "job")
+
+	m.NewGaugeFunc("go_goroutines", "Number of goroutines.", func() float64 { return float64(runtime.NumGoroutine()) })
+	return nil
+}
+
+// observeMail counts a sent mail, it is called by the mailer for every result
+func (i *Imperator) observeMail(result mailer.Result) {
+	if i.instruments.mailSent == nil {
+		return
+	}
+	if result.Success {
+		i.instruments.mailSent.Inc("success")
+	} else {
+		i.instruments.mailSent.Inc("failure")
+	}
+}
+
+// Schedule adds a job to the schedular like Schedular.AddFunc and records how long its runs take
+// under the name
+func (i *Imperator) Schedule(name, spec string, job func()) (cron.EntryID, error) {
+	return i.Schedular.AddFunc(spec, func() {
+		start := time.Now()
+		defer func() {
+			if i.instruments.cronDuration != nil {
+				i.instruments.cronDuration.Observe(time.Since(start).Seconds(), name)
+				i.instruments.cronLastRun.Set(float64(time.Now().Unix()), name)
+			}
+		}()
+		job()
+	})
+}
+
+// Instrument counts requests and records their durations by route pattern, a request that did
+// not match a route is recorded as unmatched so scans can not create a label per path. Routes
+// uses it, an application that mounts Routes in a router of its own uses it on that router so
+// the routes next to Routes are recorded as well, every request is recorded once.
+func (i *Imperator) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i.instruments.requests == nil || r.Context().Value(instrumentedKey) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), instrumentedKey, true))
+		start := time.Now()
+		i.instruments.inFlight.Add(1)
+		defer i.instruments.inFlight.Add(-1)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routePattern(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+			http.MethodDelete, http.MethodOptions:
+		default:
+			method = "OTHER"
+		}
+		i.instruments.requests.Inc(method, route, strconv.Itoa(status))
+		i.instruments.duration.Observe(time.Since(start).Seconds(), method, route)
+	})
+}
+
+// routePattern returns the pattern of the route the request matched, empty for none. /* is the
+// catch all of a router mounted at the root, requests that only matched it matched no route.
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.RoutePattern() == "/*" {
+		return ""
+	}
+	return rctx.RoutePattern()
+}
+
+// RememberPeer keeps the address of the connection before RealIP replaces it, see PeerAddr. An
+// application uses it on the router Routes is mounted in when its other routes use RealIP.
+func (i *Imperator) RememberPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(peerKey).(string); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey, r.RemoteAddr)))
+	})
+}
+
+// PeerAddr returns the host of the connection of the request. Unlike RemoteAddr after RealIP it
+// can not be chosen by the client with a header, so it is the address to limit and allow by.
+func PeerAddr(r *http.Request) string {
+	peer, _ := r.Context().Value(peerKey).(string)
+	if peer == "" {
+		peer = r.RemoteAddr
+	}
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		return host
+	}
+	return peer
+}
+
+// MetricsHandler writes the metrics for Prometheus. It needs the METRICS_TOKEN as bearer token
+// or a connection from an address in METRICS_ALLOW, forwarded addresses are not trusted.
+func (i *Imperator) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !i.metricsAllowed(r) {
+		if i.config.metrics.token != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := i.Metrics.WriteTo(w); err != nil {
+		i.ErrorLog.Println("failed to write metrics with err:", err)
+	}
+}
+
+func (i *Imperator) metricsAllowed(r *http.Request) bool {
+	c := i.config.metrics
+	if c.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+			return true
+		}
+	}
+	ip := net.ParseIP(PeerAddr(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
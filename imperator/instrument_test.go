@@ -0,0 +1,132 @@
+package imperator
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// newTestImperator returns an imperator with metrics and the routes of the framework
+func newTestImperator(t *testing.T) *Imperator {
+	i := &Imperator{
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ErrorLog: log.New(io.Discard, "", 0),
+		InfoLog:  log.New(io.Discard, "", 0),
+		Session:  scs.New(),
+	}
+	if err := i.createMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	i.Routes = i.routes().(*chi.Mux)
+	return i
+}
+
+// scrape returns the metrics in the text exposition format
+func scrape(t *testing.T, i *Imperator) string {
+	var buf bytes.Buffer
+	if _, err := i.Metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestImperator_InstrumentMounted(t *testing.T) {
+	t.Setenv("METRICS_TOKEN", "")
+	t.Setenv("METRICS_ALLOW", "")
+	i := newTestImperator(t)
+	i.Routes.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	i.Routes.Get("/boom", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+
+	// an application mounts its api next to Routes and instruments the router of both
+	api := chi.NewRouter()
+	api.Get("/things/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux := chi.NewRouter()
+	mux.Use(i.Instrument)
+	mux.Mount("/api/v1", api)
+	mux.Mount("/", i.Routes)
+
+	for _, path := range []string{"/users/1", "/users/2", "/api/v1/things/3", "/nothing/here", "/boom"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	metrics := scrape(t, i)
+	for _, line := range []string{
+		`http_requests_total{method="GET",route="/users/{id}",status="200"} 2`,
+		`http_requests_total{method="GET",route="/api/v1/things/{id}",status="200"} 1`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_requests_total{method="GET",route="/boom",status="500"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/users/{id}"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, metrics)
+		}
+	}
+}
+
+func TestImperator_MetricsHandler(t *testing.T) {
+	t.Setenv("METRICS_TOKEN", "secret")
+	t.Setenv("METRICS_ALLOW", "10.0.0.0/8")
+	i := newTestImperator(t)
+
+	get := func(remoteAddr string, header map[string]string) int {
+		r := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+		r.RemoteAddr = remoteAddr
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		i.Routes.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := get("192.0.2.1:1234", nil); code != http.StatusUnauthorized {
+		t.Error("expected 401 without credentials and got", code)
+	}
+	if code := get("192.0.2.1:1234", map[string]string{"Authorization": "Bearer wrong"}); code != http.StatusUnauthorized {
+		t.Error("expected 401 for a wrong token and got", code)
+	}
+	if code := get("192.0.2.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.1"}); code != http.StatusUnauthorized {
+		t.Error("a forwarded address was trusted:", code)
+	}
+	if code := get("192.0.2.1:1234", map[string]string{"Authorization": "Bearer secret"}); code != http.StatusOK {
+		t.Error("expected 200 with the token and got", code)
+	}
+	if code := get("10.1.2.3:1234", nil); code != http.StatusOK {
+		t.Error("expected 200 from an allowed address and got", code)
+	}
+}
+
+func TestPeerAddr(t *testing.T) {
+	i := newTestImperator(t)
+	var inner string
+	i.Routes.Get("/peer", func(w http.ResponseWriter, r *http.Request) { inner = PeerAddr(r) })
+
+	// the api of an application uses RealIP on its own router mounted next to Routes
+	var api string
+	apiRoutes := chi.NewRouter()
+	apiRoutes.Use(middleware.RealIP)
+	apiRoutes.Get("/peer", func(w http.ResponseWriter, r *http.Request) { api = PeerAddr(r) })
+	mux := chi.NewRouter()
+	mux.Use(i.RememberPeer)
+	mux.Mount("/api", apiRoutes)
+	mux.Mount("/", i.Routes)
+
+	for _, path := range []string{"/peer", "/api/peer"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-For", "10.0.0.1")
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if inner != "192.0.2.1" || api != "192.0.2.1" {
+		t.Errorf("expected the address of the connection and got %q and %q", inner, api)
+	}
+}
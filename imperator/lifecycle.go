@@ -0,0 +1,172 @@
+package imperator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownTimeout is how long requests, jobs and mails get to finish when the server is
+// stopped and SHUTDOWN_TIMEOUT is not set in .env
+const defaultShutdownTimeout = 30 * time.Second
+
+// Hook is a function an application runs when the server starts or stops, see OnStart and
+// OnShutdown
+type Hook func(ctx context.Context) error
+
+// OnStart registers a hook that runs before the server accepts connections, hooks run in the
+// order they were registered. The server does not start when a hook fails.
+func (i *Imperator) OnStart(hook Hook) {
+	i.startHooks = append(i.startHooks, hook)
+}
+
+// OnShutdown registers a hook that runs once the server stopped taking requests and the
+// schedular stopped, while the database, the cache and the mailer can still be used. Hooks run in
+// the reverse order they were registered in and share the drain timeout with the rest of the
+// shutdown.
+func (i *Imperator) OnShutdown(hook Hook) {
+	i.shutdownHooks = append(i.shutdownHooks, hook)
+}
+
+// shutdownTimeout returns SHUTDOWN_TIMEOUT from .env in seconds
+func shutdownTimeout() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// drainTimeout is the configured shutdown timeout or the default when there is none
+func (i *Imperator) drainTimeout() time.Duration {
+	if i.config.shutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return i.config.shutdownTimeout
+}
+
+// serve runs the server until it fails or the process receives SIGINT or SIGTERM and then shuts
+// everything down in order
+func (i *Imperator) serve(srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	servers := []*http.Server{srv}
+	listen := []func() error{srv.ListenAndServe}
+	if i.config.tls.enabled {
+		reloader, err := newCertReloader(i.config.tls, i.ErrorLog)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to load TLS certificate: %w", err), i.shutdown())
+		}
+		srv.TLSConfig = reloader.TLSConfig()
+		listen[0] = func() error { return srv.ListenAndServeTLS("", "") }
+		if i.config.tls.redirectPort != "" {
+			redirect := &http.Server{
+				Addr:         fmt.Sprintf(":%s", i.config.tls.redirectPort),
+				ErrorLog:     i.ErrorLog,
+				Handler:      http.HandlerFunc(i.redirectToHTTPS),
+				IdleTimeout:  10 * time.Second,
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			}
+			servers = append(servers, redirect)
+			listen = append(listen, redirect.ListenAndServe)
+		}
+	}
+
+	for _, hook := range i.startHooks {
+		if err := hook(ctx); err != nil {
+			return errors.Join(fmt.Errorf("start hook failed: %w", err), i.shutdown(servers...))
+		}
+	}
+
+	failed := make(chan error, len(servers))
+	for n := range servers {
+		go func(srv *http.Server, listen func() error) {
+			if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+				failed <- err
+			}
+		}(servers[n], listen[n])
+	}
+	if i.config.tls.enabled {
+		i.InfoLog.Println(i.AppName, "listening with TLS on port:", i.config.port)
+		if i.config.tls.redirectPort != "" {
+			i.InfoLog.Println(i.AppName, "redirecting http to https on port:", i.config.tls.redirectPort)
+		}
+	} else {
+		i.InfoLog.Println(i.AppName, "listening on port:", i.config.port)
+	}
+
+	select {
+	case err := <-failed:
+		return errors.Join(err, i.shutdown(servers...))
+	case <-ctx.Done():
+	}
+	// a second signal kills the process right away
+	stop()
+	i.InfoLog.Println(i.AppName, "shutting down, waiting up to", i.drainTimeout(), "for requests to finish")
+	return i.shutdown(servers...)
+}
+
+// shutdown stops taking requests and waits for the running ones, stops the schedular and waits
+// for running jobs, runs the shutdown hooks, sends the queued mails and closes the database and
+// cache connections last, everything within the drain timeout
+func (i *Imperator) shutdown(servers ...*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), i.drainTimeout())
+	defer cancel()
+	var errs []error
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+		}
+	}
+
+	if i.Schedular != nil {
+		select {
+		case <-i.Schedular.Stop().Done():
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("failed to wait for scheduled jobs: %w", ctx.Err()))
+		}
+	}
+
+	for n := len(i.shutdownHooks) - 1; n >= 0; n-- {
+		if err := i.shutdownHooks[n](ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown hook failed: %w", err))
+		}
+	}
+
+	if i.Mail.Jobs != nil {
+		if err := i.Mail.Drain(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send queued mails: %w", err))
+		}
+	}
+
+	if i.Tracer != nil {
+		if err := i.Tracer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to export spans: %w", err))
+		}
+	}
+
+	if i.DB.Pool != nil {
+		if err := i.DB.Pool.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close database: %w", err))
+		}
+	}
+	if redisPool != nil {
+		if err := redisPool.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close redis: %w", err))
+		}
+	}
+	if badgerConn != nil {
+		if err := badgerConn.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close badger: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,93 @@
+package imperator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestImperator_ShutdownHooks(t *testing.T) {
+	i := &Imperator{}
+	i.config.shutdownTimeout = time.Second
+	var order []int
+	failed := errors.New("hook failed")
+	for n := 1; n <= 3; n++ {
+		n := n
+		i.OnShutdown(func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("hook without the drain deadline")
+			}
+			order = append(order, n)
+			if n == 2 {
+				return failed
+			}
+			return nil
+		})
+	}
+
+	err := i.shutdown()
+	if !errors.Is(err, failed) {
+		t.Error("expected the error of the hook and got", err)
+	}
+	if len(order) != 3 || order[0] != 3 || order[1] != 2 || order[2] != 1 {
+		t.Error("expected hooks in reverse order and got", order)
+	}
+}
+
+func TestImperator_ShutdownWaitsForRequests(t *testing.T) {
+	i := &Imperator{}
+	i.config.shutdownTimeout = time.Second
+	started := make(chan struct{})
+	finished := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	}))
+	defer srv.Close()
+
+	go func() { _, _ = http.Get(srv.URL) }()
+	<-started
+	if err := i.shutdown(srv.Config); err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("shutdown returned before the request finished")
+	}
+}
+
+func TestImperator_ShutdownTimeout(t *testing.T) {
+	i := &Imperator{}
+	i.config.shutdownTimeout = 50 * time.Millisecond
+	i.OnShutdown(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	err := i.shutdown()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the deadline to pass and got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("shutdown took longer than the drain timeout")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Setenv("SHUTDOWN_TIMEOUT", "")
+	if got := shutdownTimeout(); got != defaultShutdownTimeout {
+		t.Error("expected the default and got", got)
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT", "5")
+	if got := shutdownTimeout(); got != 5*time.Second {
+		t.Error("expected 5s and got", got)
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT", "-1")
+	if got := shutdownTimeout(); got != defaultShutdownTimeout {
+		t.Error("expected the default for a negative value and got", got)
+	}
+}
@@ -0,0 +1,259 @@
+package imperator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arc41t3ct/imperator/tracing"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// defaultLogMaxSize is the size in MB a log file grows to before it is rotated
+	defaultLogMaxSize = 100
+	// defaultLogMaxBackups is the number of rotated log files that are kept
+	defaultLogMaxBackups = 5
+)
+
+type contextKey string
+
+// loggerKey holds the logger of a request in its context
+const loggerKey contextKey = "imperator.logger"
+
+type loggingConfig struct {
+	format     string
+	level      slog.Level
+	file       string
+	maxSize    int64
+	maxBackups int
+}
+
+// createLoggingConfig reads LOG_FORMAT, LOG_LEVEL, LOG_FILE, LOG_MAX_SIZE and LOG_MAX_BACKUPS
+// from .env. Logs are text on stdout at info level, or debug level in debug mode, by default.
+func (i *Imperator) createLoggingConfig() (loggingConfig, error) {
+	c := loggingConfig{
+		format:     strings.ToLower(os.Getenv("LOG_FORMAT")),
+		level:      slog.LevelInfo,
+		file:       os.Getenv("LOG_FILE"),
+		maxSize:    defaultLogMaxSize,
+		maxBackups: defaultLogMaxBackups,
+	}
+	switch c.format {
+	case "":
+		c.format = "text"
+	case "text", "json":
+	default:
+		return c, fmt.Errorf("imperator: unknown LOG_FORMAT %q", c.format)
+	}
+	if i.Debug {
+		c.level = slog.LevelDebug
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := c.level.UnmarshalText([]byte(level)); err != nil {
+			return c, fmt.Errorf("imperator: unknown LOG_LEVEL %q", level)
+		}
+	}
+	if c.file != "" && !filepath.IsAbs(c.file) {
+		c.file = filepath.Join(i.RootPath, c.file)
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOG_MAX_SIZE")); err == nil && n > 0 {
+		c.maxSize = int64(n)
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOG_MAX_BACKUPS")); err == nil && n >= 0 {
+		c.maxBackups = n
+	}
+	return c, nil
+}
+
+// createLogger sets up Logger from the logging config, it becomes the default logger of slog
+// and of the log package so lines of libraries end up in the same place and format
+func (i *Imperator) createLogger() error {
+	c, err := i.createLoggingConfig()
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if c.file != "" {
+		file, err := openRotatingFile(c.file, c.maxSize*1024*1024, c.maxBackups)
+		if err != nil {
+			return fmt.Errorf("imperator: failed to open LOG_FILE: %w", err)
+		}
+		out = file
+	}
+	i.config.logging = c
+	i.logOutput = out
+	i.Logger = slog.New(i.logHandler(false))
+	slog.SetDefault(i.Logger)
+	return nil
+}
+
+// logHandler returns a handler writing to the configured output in the configured format,
+// addSource adds the file and line of the caller
+func (i *Imperator) logHandler(addSource bool) slog.Handler {
+	out := i.logOutput
+	if out == nil {
+		out = os.Stdout
+	}
+	options := &slog.HandlerOptions{Level: i.config.logging.level, AddSource: addSource}
+	if i.config.logging.format == "json" {
+		return slog.NewJSONHandler(out, options)
+	}
+	return slog.NewTextHandler(out, options)
+}
+
+// RequestLogger puts a logger with the request id, method, path and the ids of the trace into the
+// context of the request, see Log, and logs every finished request at debug level
+func (i *Imperator) RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		logger := i.Logger.With(
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		)
+		if sc := tracing.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With(slog.String("trace_id", sc.TraceID.String()), slog.String("span_id", sc.SpanID.String()))
+		}
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey, logger))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		i.Log(r).LogAttrs(r.Context(), slog.LevelDebug, "request",
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", r.RemoteAddr),
+		)
+	})
+}
+
+// Log returns the logger of the request with its id, method, path, route pattern and the id of
+// the logged in user. The route and user are added when it is called since they are only known
+// once the request was routed and the session loaded. Outside of RequestLogger it is Logger.
+func (i *Imperator) Log(r *http.Request) *slog.Logger {
+	logger, ok := r.Context().Value(loggerKey).(*slog.Logger)
+	if !ok && i.Logger != nil {
+		return i.Logger
+	}
+	if !ok {
+		return slog.Default()
+	}
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			logger = logger.With(slog.String("route", pattern))
+		}
+	}
+	if id := i.Session.GetInt(r.Context(), "userID"); id != 0 {
+		logger = logger.With(slog.Int("user_id", id))
+	}
+	return logger
+}
+
+// LoggerFromContext returns the logger RequestLogger put into the context with the request id,
+// method and path, or the default logger for a context that does not belong to a request
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// rotatingFile is a log file that is renamed to path.TIMESTAMP once it reaches maxSize bytes, of
+// the renamed files only the newest maxBackups are kept
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	// rename moves the full file aside, os.Rename outside of tests
+	rename func(oldpath, newpath string) error
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, rename: os.Rename}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends to the file and rotates it first when p does not fit anymore. When the rotation
+// fails p is still written to the current file and the error of the rotation returned.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, errors.Join(rotateErr, err)
+	}
+	return n, rotateErr
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotate renames the current file, opens a new one and removes the oldest backups. A file that
+// can not be renamed is opened again, so logging goes on in the file that grew too large.
+func (f *rotatingFile) rotate() error {
+	// the file is closed even when Close fails, the open below replaces it either way
+	closeErr := f.file.Close()
+	backup := f.path + "." + time.Now().Format("20060102T150405.000")
+	if err := f.rename(f.path, backup); err != nil {
+		return errors.Join(err, closeErr, f.open())
+	}
+	if err := f.open(); err != nil {
+		return errors.Join(closeErr, err)
+	}
+
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	// the timestamps sort in the order the files were written
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package imperator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestRotatingFile_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "app.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+
+	for n := 0; n < 5; n++ {
+		if _, err := f.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Error("expected 2 backups and got", backups)
+	}
+	content, _ := os.ReadFile(path)
+	if string(content) != "0123456789" {
+		t.Errorf("expected the last line in the current file and got %q", content)
+	}
+}
+
+func TestRotatingFile_RenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	failed := errors.New("rename failed")
+	f.rename = func(string, string) error { return failed }
+
+	if _, err := f.Write([]byte("first line")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.Write([]byte("second line"))
+	if !errors.Is(err, failed) {
+		t.Error("expected the rename error and got", err)
+	}
+	if n != len("second line") {
+		t.Error("line was not written after the failed rotation")
+	}
+
+	// later lines still reach the file and it rotates once renaming works again
+	f.rename = os.Rename
+	if _, err := f.Write([]byte("third line")); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatal("expected one backup and got", backups)
+	}
+	content, _ := os.ReadFile(backups[0])
+	if string(content) != "first linesecond line" {
+		t.Errorf("unexpected backup %q", content)
+	}
+}
+
+func TestImperator_CreateLoggingConfig(t *testing.T) {
+	i := &Imperator{RootPath: "/app", Debug: true}
+	t.Setenv("LOG_FORMAT", "JSON")
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FILE", "logs/app.log")
+	t.Setenv("LOG_MAX_SIZE", "7")
+	t.Setenv("LOG_MAX_BACKUPS", "0")
+
+	c, err := i.createLoggingConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.format != "json" || c.level != slog.LevelDebug || c.file != "/app/logs/app.log" || c.maxSize != 7 || c.maxBackups != 0 {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	t.Setenv("LOG_LEVEL", "warn")
+	if c, _ := i.createLoggingConfig(); c.level != slog.LevelWarn {
+		t.Error("LOG_LEVEL was ignored:", c.level)
+	}
+	t.Setenv("LOG_LEVEL", "loud")
+	if _, err := i.createLoggingConfig(); err == nil {
+		t.Error("unknown LOG_LEVEL was accepted")
+	}
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "xml")
+	if _, err := i.createLoggingConfig(); err == nil {
+		t.Error("unknown LOG_FORMAT was accepted")
+	}
+}
+
+func TestImperator_RequestLogger(t *testing.T) {
+	var out bytes.Buffer
+	i := &Imperator{Session: scs.New()}
+	i.config.logging = loggingConfig{format: "json", level: slog.LevelDebug}
+	i.logOutput = &out
+	i.Logger = slog.New(i.logHandler(false))
+
+	mux := chi.NewRouter()
+	mux.Use(middleware.RequestID, i.Session.LoadAndSave, i.RequestLogger)
+	mux.Get("/things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		i.Session.Put(r.Context(), "userID", 7)
+		i.Log(r).Info("in handler")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/things/1", nil))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("expected the handler and the request line and got", lines)
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["route"] != "/things/{id}" || entry["user_id"] != float64(7) || entry["request_id"] == "" || entry["path"] != "/things/1" {
+			t.Error("missing request fields in", line)
+		}
+	}
+}
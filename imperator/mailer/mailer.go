@@ -0,0 +1,377 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	apimail "github.com/ainsleyclark/go-mail"
+	"github.com/arc41t3ct/imperator/tracing"
+	"github.com/vanng822/go-premailer/premailer"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Mail holds the information to connect to an SMTP server
+type Mail struct {
+	Domain      string
+	Templates   string
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	Encryption  string
+	FromAddress string
+	FromName    string
+	Jobs        chan Message
+	Results     chan Result
+	API         string
+	APIKey      string
+	APIUrl      string
+	// Stopped is closed when ListenForMail returns after Jobs was closed
+	Stopped chan struct{}
+	// Observe is called with the result of every mail ListenForMail sent, nil for none
+	Observe func(Result)
+
+	// mu guards Jobs against sends after Drain closed it
+	mu      sync.RWMutex
+	drained bool
+}
+
+// ErrStopped is returned by Queue and Dispatch once the mailer was drained on shutdown
+var ErrStopped = errors.New("mailer: stopped, the message was not queued")
+
+// Message is the type for an email message
+type Message struct {
+	From        string
+	FromName    string
+	To          string
+	Subject     string
+	Template    string
+	Attachments []string
+	Data        interface{}
+	// Trace is the span the message was queued in, the worker sends it as a child of that span.
+	// Set it with tracing.SpanContextFromContext.
+	Trace tracing.SpanContext
+	// Reply receives the result of this message instead of Results, it needs room for one result
+	Reply chan Result
+	// Done is called with the result of this message instead of sending it to Reply or Results
+	Done func(Result)
+}
+
+type Result struct {
+	Success bool
+	Error   error
+}
+
+// ListenForMail listens to the mail channel and sends mail
+// when it receives a payload. It runs continueally in the
+// background and sends error/success messages back on the
+// results channel until the jobs channel is closed.
+// Notice that if the api and api key are set, it will
+// prefer using an api to send mail
+func (m *Mail) ListenForMail() {
+	if m.Stopped != nil {
+		defer close(m.Stopped)
+	}
+	for msg := range m.Jobs {
+		result := Result{true, nil}
+		if err := m.Send(msg); err != nil {
+			result = Result{false, err}
+		}
+		if m.Observe != nil {
+			m.Observe(result)
+		}
+		if msg.Done != nil {
+			msg.Done(result)
+			continue
+		}
+		if msg.Reply != nil {
+			msg.Reply <- result
+			continue
+		}
+		m.Results <- result
+	}
+}
+
+// Queue hands the message to ListenForMail and waits for its result or for ctx to be done. Every
+// call gets its own reply, so concurrent callers never see each others results. The message is
+// sent as part of the trace in ctx unless it already names one.
+func (m *Mail) Queue(ctx context.Context, msg Message) error {
+	if !msg.Trace.IsValid() {
+		msg.Trace = tracing.SpanContextFromContext(ctx)
+	}
+	msg.Reply = make(chan Result, 1)
+	if err := m.enqueue(ctx, msg); err != nil {
+		return err
+	}
+	select {
+	case result := <-msg.Reply:
+		return result.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dispatch hands the message to ListenForMail without waiting for it to be sent, so the caller
+// takes as long whether a mail goes out or not. The result goes to msg.Done, it is dropped when
+// there is none. An error means the message was not queued.
+func (m *Mail) Dispatch(ctx context.Context, msg Message) error {
+	if !msg.Trace.IsValid() {
+		msg.Trace = tracing.SpanContextFromContext(ctx)
+	}
+	if msg.Done == nil {
+		msg.Done = func(Result) {}
+	}
+	return m.enqueue(ctx, msg)
+}
+
+// enqueue sends the message to Jobs unless Drain already closed it
+func (m *Mail) enqueue(ctx context.Context, msg Message) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.drained {
+		return ErrStopped
+	}
+	select {
+	case m.Jobs <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain closes the jobs channel and waits until the queued messages are sent or ctx is done.
+// Queue and Dispatch return ErrStopped once Drain was called, nothing else may send to Jobs then.
+func (m *Mail) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.drained {
+		m.drained = true
+		close(m.Jobs)
+	}
+	m.mu.Unlock()
+	if m.Stopped == nil {
+		return nil
+	}
+	select {
+	case <-m.Stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send sends the message with the API or over SMTP, as a span of the trace it was queued in or
+// of a trace of its own
+func (m *Mail) Send(msg Message) (err error) {
+	transport := "smtp"
+	if len(m.API) > 0 && len(m.APIKey) > 0 && len(m.APIUrl) > 0 && m.API != "smtp" {
+		transport = m.API
+	}
+	ctx := tracing.ContextWithSpanContext(context.Background(), msg.Trace)
+	_, span := tracing.Start(ctx, "mail send", tracing.KindClient,
+		tracing.String("mail.transport", transport),
+		tracing.String("mail.template", msg.Template),
+	)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	if transport != "smtp" {
+		return m.ChooseAPI(msg)
+	}
+	return m.SendSMTPMessage(msg)
+}
+
+func (m *Mail) ChooseAPI(msg Message) error {
+	switch m.API {
+	case "mailgun", "sparkpost", "sendgrid":
+		return m.SendUsingAPI(msg, m.API)
+	default:
+		return errors.New(fmt.Sprintf("unknown api %s; only mailgun, sparkpost or sendgrid supported", m.API))
+	}
+}
+
+func (m *Mail) SendUsingAPI(msg Message, transport string) error {
+	if msg.From == "" {
+		msg.From = m.FromAddress
+	}
+	if msg.FromName == "" {
+		msg.FromName = m.FromName
+	}
+	cfg := apimail.Config{
+		URL:         m.APIUrl,
+		APIKey:      m.APIKey,
+		Domain:      m.Domain,
+		FromAddress: msg.From,
+		FromName:    msg.FromName,
+	}
+
+	driver, err := apimail.NewClient(transport, cfg)
+	if err != nil {
+		return err
+	}
+	formattedMessage, err := m.buildHTMLMessage(msg)
+	if err != nil {
+		return err
+	}
+	plainMessage, err := m.buildPlainTextMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	tx := &apimail.Transmission{
+		Recipients: []string{msg.To},
+		Subject:    msg.Subject,
+		HTML:       formattedMessage,
+		PlainText:  plainMessage,
+	}
+
+	if err := m.addAPIAttachments(msg, tx); err != nil {
+		return err
+	}
+
+	_, err = driver.Send(tx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Mail) addAPIAttachments(msg Message, tx *apimail.Transmission) error {
+	if len(msg.Attachments) > 0 {
+		var attachments []apimail.Attachment
+		for _, x := range msg.Attachments {
+			var attach apimail.Attachment
+			content, err := os.ReadFile(x)
+			if err != nil {
+				return err
+			}
+			filename := filepath.Base(x)
+			attach.Bytes = content
+			attach.Filename = filename
+			attachments = append(attachments, attach)
+		}
+		tx.Attachments = attachments
+	}
+	return nil
+}
+
+// SendSMTPMessage allows you to send a single message passing Message and returning
+// an error when the sending failed
+func (m *Mail) SendSMTPMessage(msg Message) error {
+	formattedMessage, err := m.buildHTMLMessage(msg)
+	if err != nil {
+		return err
+	}
+	plainMessage, err := m.buildPlainTextMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	server := mail.NewSMTPClient()
+	server.Host = m.Host
+	server.Port = m.Port
+	server.Username = m.Username
+	server.Password = m.Password
+	server.Encryption = m.getEncryption(m.Encryption)
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+	server.SendTimeout = 10 * time.Second
+
+	smtpClient, err := server.Connect()
+	if err != nil {
+		return err
+	}
+
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).
+		AddTo(msg.To).
+		SetSubject(msg.Subject)
+
+	email.SetBody(mail.TextHTML, formattedMessage)
+	email.AddAlternative(mail.TextPlain, plainMessage)
+
+	if len(msg.Attachments) > 0 {
+		for _, a := range msg.Attachments {
+			email.AddAttachment(a)
+		}
+	}
+
+	if err := email.Send(smtpClient); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *Mail) getEncryption(e string) mail.Encryption {
+	switch e {
+	case "tls":
+		return mail.EncryptionSTARTTLS
+	case "ssl":
+		return mail.EncryptionSSL
+	case "none":
+		return mail.EncryptionNone
+	default:
+		return mail.EncryptionSTARTTLS
+	}
+}
+
+func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
+	templateToRender := fmt.Sprintf("%s/%s.html.tmpl", m.Templates, msg.Template)
+	t, err := template.New("email-html").ParseFiles(templateToRender)
+	if err != nil {
+		return "", err
+	}
+	var tpl bytes.Buffer
+	if err = t.ExecuteTemplate(&tpl, "body", msg.Data); err != nil {
+		return "", err
+	}
+	formattedMessage := tpl.String()
+	formattedMessage, err = m.inlineCSS(formattedMessage)
+	if err != nil {
+		return "", err
+	}
+	return formattedMessage, nil
+}
+
+func (m *Mail) buildPlainTextMessage(msg Message) (string, error) {
+	templateToRender := fmt.Sprintf("%s/%s.plain.tmpl", m.Templates, msg.Template)
+	t, err := template.New("email-html").ParseFiles(templateToRender)
+	if err != nil {
+		return "", err
+	}
+	var tpl bytes.Buffer
+	if err = t.ExecuteTemplate(&tpl, "body", msg.Data); err != nil {
+		return "", err
+	}
+	plainMessage := tpl.String()
+	return plainMessage, nil
+}
+
+func (m *Mail) inlineCSS(s string) (string, error) {
+	options := premailer.Options{
+		RemoveClasses:     false,
+		CssToAttributes:   false,
+		KeepBangImportant: true,
+	}
+
+	prem, err := premailer.NewPremailerFromString(s, &options)
+	if err != nil {
+		return "", err
+	}
+
+	html, err := prem.Transform()
+	if err != nil {
+		return "", err
+	}
+
+	return html, nil
+}
@@ -0,0 +1,128 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arc41t3ct/imperator/tracing"
+)
+
+// newTestMail returns a mailer without templates, every message fails with an error naming its
+// template so a test can tell whose result it got
+func newTestMail(t *testing.T) *Mail {
+	m := &Mail{
+		Templates: t.TempDir(),
+		Jobs:      make(chan Message, 20),
+		Results:   make(chan Result, 20),
+		Stopped:   make(chan struct{}),
+	}
+	go m.ListenForMail()
+	return m
+}
+
+func TestMail_QueueReplies(t *testing.T) {
+	m := newTestMail(t)
+	defer func() { _ = m.Drain(context.Background()) }()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			template := fmt.Sprintf("template-%d", n)
+			err := m.Queue(context.Background(), Message{Template: template})
+			if err == nil || !strings.Contains(err.Error(), template+".html.tmpl") {
+				t.Errorf("message %d got the result %v", n, err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	if len(m.Results) != 0 {
+		t.Error("replies of Queue were sent to Results")
+	}
+}
+
+func TestMail_Results(t *testing.T) {
+	m := newTestMail(t)
+	defer func() { _ = m.Drain(context.Background()) }()
+
+	m.Jobs <- Message{Template: "direct"}
+	result := <-m.Results
+	if result.Success || result.Error == nil {
+		t.Error("expected the failed result on Results and got", result)
+	}
+}
+
+func TestMail_QueueAfterDrain(t *testing.T) {
+	m := newTestMail(t)
+	if err := m.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Queue(context.Background(), Message{Template: "late"}); !errors.Is(err, ErrStopped) {
+		t.Error("expected ErrStopped and got", err)
+	}
+	if err := m.Drain(context.Background()); err != nil {
+		t.Error("second drain failed with", err)
+	}
+}
+
+func TestMail_QueueCanceled(t *testing.T) {
+	// no worker, the message stays queued
+	m := &Mail{Jobs: make(chan Message, 1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Queue(ctx, Message{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the deadline and got", err)
+	}
+	// the queue is full now
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Queue(ctx, Message{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the deadline for a full queue and got", err)
+	}
+}
+
+func TestMail_QueueTrace(t *testing.T) {
+	m := &Mail{Jobs: make(chan Message, 1)}
+	sc := tracing.SpanContext{TraceID: tracing.TraceID{1}, SpanID: tracing.SpanID{2}, Sampled: true}
+	ctx, cancel := context.WithTimeout(tracing.ContextWithSpanContext(context.Background(), sc), 20*time.Millisecond)
+	defer cancel()
+	_ = m.Queue(ctx, Message{})
+	if msg := <-m.Jobs; msg.Trace != sc {
+		t.Error("expected the trace of the context and got", msg.Trace)
+	}
+}
+
+func TestMail_Dispatch(t *testing.T) {
+	// no worker, dispatch returns once the message is queued
+	m := &Mail{Jobs: make(chan Message, 1), Results: make(chan Result, 1)}
+	if err := m.Dispatch(context.Background(), Message{Template: "queued"}); err != nil {
+		t.Fatal("failed to dispatch:", err)
+	}
+	if msg := <-m.Jobs; msg.Done == nil {
+		t.Error("a dispatched message without Done would block on Results")
+	}
+
+	m = newTestMail(t)
+	done := make(chan Result, 1)
+	if err := m.Dispatch(context.Background(), Message{Template: "failing", Done: func(result Result) { done <- result }}); err != nil {
+		t.Fatal("failed to dispatch:", err)
+	}
+	if result := <-done; result.Success || result.Error == nil {
+		t.Error("expected the failed result in Done and got", result)
+	}
+	if err := m.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Results) != 0 {
+		t.Error("the result of a dispatched message was sent to Results")
+	}
+	if err := m.Dispatch(context.Background(), Message{Template: "late"}); !errors.Is(err, ErrStopped) {
+		t.Error("expected ErrStopped and got", err)
+	}
+}
@@ -0,0 +1,317 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the Prometheus text
+// exposition format, version 0.0.4, so they can be scraped without the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds in seconds of the histogram buckets for request durations
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything the registry can write
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics of an application
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds a metric, a name can only be used once
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all metrics in the text exposition format in the order they were registered
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec holds the values of a metric per combination of label values
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*T
+	keys   map[string][]string
+}
+
+func newVec[T any](name, help string, labels []string) vec[T] {
+	return vec[T]{name: name, help: help, labels: labels, values: make(map[string]*T), keys: make(map[string][]string)}
+}
+
+// get returns the value for the label values, creating it with create when it is new. It must be
+// called with mu held.
+func (v *vec[T]) get(values []string, create func() *T) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	value, ok := v.values[key]
+	if !ok {
+		value = create()
+		v.values[key] = value
+		v.keys[key] = append([]string(nil), values...)
+	}
+	return value
+}
+
+// sorted returns the keys in a stable order so scrapes are easy to compare. It must be called
+// with mu held.
+func (v *vec[T]) sorted() []string {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, like the number of requests
+type Counter struct {
+	vec[float64]
+}
+
+// NewCounter registers a counter with the names of its labels
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec[float64](name, help, labels)}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the counter with the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the counter with the label values
+func (c *Counter) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.get(values, func() *float64 { return new(float64) }) += delta
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range c.sorted() {
+		writeSample(w, c.name, c.labels, c.keys[key], "", "", *c.values[key])
+	}
+}
+
+// Gauge is a value that goes up and down, like the number of requests in flight
+type Gauge struct {
+	vec[float64]
+}
+
+// NewGauge registers a gauge with the names of its labels
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec[float64](name, help, labels)}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the gauge with the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.get(values, func() *float64 { return new(float64) }) = value
+}
+
+// Add adds delta to the gauge with the label values, a negative delta lowers it
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.get(values, func() *float64 { return new(float64) }) += delta
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range g.sorted() {
+		writeSample(w, g.name, g.labels, g.keys[key], "", "", *g.values[key])
+	}
+}
+
+// funcMetric reads its value when it is scraped, for values kept elsewhere like pool stats
+type funcMetric struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+// NewGaugeFunc registers a gauge that calls value on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "gauge", value: value})
+}
+
+// NewCounterFunc registers a counter that calls value on every scrape, value must never go down
+func (r *Registry) NewCounterFunc(name, help string, value func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "counter", value: value})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	writeSample(w, f.name, nil, nil, "", "", f.value())
+}
+
+// Histogram counts observations, like request durations, in buckets
+type Histogram struct {
+	vec[histogramValue]
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets in increasing order,
+// nil uses DefaultBuckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	h := &Histogram{vec: newVec[histogramValue](name, help, labels), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+// Observe adds the value to the histogram with the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := h.get(values, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	})
+	// the buckets are cumulative when written, here a value is only counted in its own bucket
+	if n := sort.SearchFloat64s(h.buckets, value); n < len(h.buckets) {
+		v.counts[n]++
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range h.sorted() {
+		v, values := h.values[key], h.keys[key]
+		var cumulative uint64
+		for n, bound := range h.buckets {
+			cumulative += v.counts[n]
+			writeSample(w, h.name+"_bucket", h.labels, values, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, values, "le", "+Inf", float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, values, "", "", v.sum)
+		writeSample(w, h.name+"_count", h.labels, values, "", "", float64(v.count))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// writeSample writes one line, extraLabel is the le label of histogram buckets
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for n, label := range labels {
+			if n > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + escapeLabel(values[n]) + `"`)
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
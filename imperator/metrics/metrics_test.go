@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("http_requests_total", "Requests by route.", "method", "route")
+	inFlight := r.NewGauge("http_requests_in_flight", "Requests being served.")
+	duration := r.NewHistogram("http_request_duration_seconds", "Duration of requests.", []float64{0.1, 1}, "route")
+	r.NewGaugeFunc("pool_open", "Open connections.", func() float64 { return 3 })
+	r.NewCounterFunc("cache_hits_total", "Cache hits.", func() float64 { return 1e9 })
+
+	requests.Inc("GET", "/users/{id}")
+	requests.Add(2, "GET", "/")
+	inFlight.Add(2)
+	inFlight.Add(-1)
+	duration.Observe(0.05, "/")
+	duration.Observe(0.1, "/")
+	duration.Observe(0.5, "/")
+	duration.Observe(3, "/")
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d for %d bytes", n, buf.Len())
+	}
+	expected := `# HELP http_requests_total Requests by route.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",route="/"} 2
+http_requests_total{method="GET",route="/users/{id}"} 1
+# HELP http_requests_in_flight Requests being served.
+# TYPE http_requests_in_flight gauge
+http_requests_in_flight 1
+# HELP http_request_duration_seconds Duration of requests.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{route="/",le="0.1"} 2
+http_request_duration_seconds_bucket{route="/",le="1"} 3
+http_request_duration_seconds_bucket{route="/",le="+Inf"} 4
+http_request_duration_seconds_sum{route="/"} 3.65
+http_request_duration_seconds_count{route="/"} 4
+# HELP pool_open Open connections.
+# TYPE pool_open gauge
+pool_open 3
+# HELP cache_hits_total Cache hits.
+# TYPE cache_hits_total counter
+cache_hits_total 1e+09
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected exposition\n%s", buf.String())
+	}
+}
+
+func TestRegistry_Escaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("escaped_total", "Help with \\ and\na new line.", "path")
+	c.Inc("a \"quoted\" \\ path\n")
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP escaped_total Help with \\ and\na new line.
+# TYPE escaped_total counter
+escaped_total{path="a \"quoted\" \\ path\n"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected exposition\n%s", buf.String())
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	for value, expected := range map[float64]string{
+		0:                "0",
+		0.25:             "0.25",
+		1234567:          "1.234567e+06",
+		math.Inf(1):      "+Inf",
+		math.Inf(-1):     "-Inf",
+		math.NaN():       "NaN",
+		-2.5:             "-2.5",
+		1.0 / 3.0 * 3.0:  "1",
+		float64(1 << 53): "9.007199254740992e+15",
+	} {
+		if got := formatFloat(value); got != expected {
+			t.Errorf("formatFloat(%v) = %s, expected %s", value, got, expected)
+		}
+	}
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Error(name, "did not panic")
+			}
+		}()
+		f()
+	}
+	r := NewRegistry()
+	c := r.NewCounter("twice_total", "Registered twice.", "label")
+	expectPanic("second registration", func() { r.NewGauge("twice_total", "Registered twice.") })
+	expectPanic("wrong number of label values", func() { c.Inc() })
+	expectPanic("unsorted buckets", func() { r.NewHistogram("unsorted", "Unsorted buckets.", []float64{1, 0.5}) })
+
+	var buf bytes.Buffer
+	_, _ = r.WriteTo(&buf)
+	if strings.Contains(buf.String(), "unsorted") {
+		t.Error("histogram with unsorted buckets was registered")
+	}
+}
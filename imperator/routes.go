@@ -0,0 +1,29 @@
+package imperator
+
+import (
+	"net/http"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func (i *Imperator) routes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(i.RememberPeer)
+	mux.Use(middleware.RequestID)
+	mux.Use(middleware.RealIP)
+	mux.Use(middleware.CleanPath)
+	mux.Use(i.Trace)
+	mux.Use(i.Instrument)
+	mux.Use(middleware.Recoverer)
+	mux.Use(i.HSTS)
+	mux.Use(i.SessionLoad)
+	mux.Use(i.RequestLogger)
+	mux.Use(i.NoSurf)
+
+	if i.config.metrics.token != "" || len(i.config.metrics.allow) > 0 {
+		mux.Get(metricsPath, i.MetricsHandler)
+	}
+
+	return mux
+}
@@ -0,0 +1,229 @@
+package imperator
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+
+	"github.com/arc41t3ct/imperator/tracing"
+)
+
+// maxTracedQuery is the longest statement put into a span, longer ones are cut off
+const maxTracedQuery = 2048
+
+// openTracedDB opens the database with a driver that records every query run with a context of
+// a sampled trace as a span, queries without one run as before. Arguments are not recorded since
+// they hold passwords and tokens.
+func openTracedDB(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	// no connection was opened yet, this only gave us the driver
+	_ = db.Close()
+
+	var connector driver.Connector = dsnConnector{dsn: dsn, driver: drv}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(tracedConnector{Connector: connector, system: dbSystem(driverName)}), nil
+}
+
+// dbSystem returns the db.system of the semantic conventions for the driver
+func dbSystem(driverName string) string {
+	switch driverName {
+	case "pgx", "postgres", "postgresql":
+		return "postgresql"
+	}
+	return driverName
+}
+
+// dsnConnector is the connector of drivers that only implement Open
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.dsn) }
+
+func (c dsnConnector) Driver() driver.Driver { return c.driver }
+
+type tracedConnector struct {
+	driver.Connector
+	system string
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn, system: c.system}, nil
+}
+
+// startQuery starts the span of a statement named by its operation, like SELECT
+func startQuery(ctx context.Context, system, query string) *tracing.Span {
+	operation := strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	if len(query) > maxTracedQuery {
+		query = query[:maxTracedQuery]
+	}
+	_, span := tracing.StartChild(ctx, operation, tracing.KindClient,
+		tracing.String("db.system", system),
+		tracing.String("db.operation.name", operation),
+		tracing.String("db.query.text", query),
+	)
+	return span
+}
+
+// endQuery ends the span, driver.ErrSkip only tells database/sql to prepare the statement
+func endQuery(span *tracing.Span, err error) {
+	if err != driver.ErrSkip {
+		span.RecordError(err)
+		span.End()
+	}
+}
+
+// tracedConn passes everything on to the connection of the driver, the optional interfaces the
+// driver does not implement are answered the way database/sql treats them as missing
+type tracedConn struct {
+	driver.Conn
+	system string
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuery(ctx, c.system, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	endQuery(span, err)
+	return result, err
+}
+
+// QueryContext records the time until the first rows arrived, reading them is not part of it
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuery(ctx, c.system, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, query: query, system: c.system}, nil
+}
+
+func (c *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	query  string
+	system string
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	span := startQuery(ctx, s.system, s.query)
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedToValues(args); err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+	endQuery(span, err)
+	return result, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	span := startQuery(ctx, s.system, s.query)
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedToValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	endQuery(span, err)
+	return rows, err
+}
+
+func (s *tracedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// namedToValues converts the arguments for drivers that only take positional ones
+func namedToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for n, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("imperator: the driver does not support named arguments")
+		}
+		values[n] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,295 @@
+package imperator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes, the check runs on
+// a handshake so an idle server does not touch the files at all
+const tlsReloadInterval = 10 * time.Second
+
+// selfSignedLifetime is how long a generated development certificate is valid, it is replaced a
+// week before it expires
+const selfSignedLifetime = 365 * 24 * time.Hour
+
+type tlsConfig struct {
+	enabled      bool
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	// redirectPort is the port of the plain http listener that redirects to https, empty for none
+	redirectPort string
+	hsts         string
+}
+
+// createTLSConfig reads the TLS settings from .env. Without certificate files a self signed
+// certificate is generated in debug mode, a production server refuses to start without one.
+func (i *Imperator) createTLSConfig() (tlsConfig, error) {
+	c := tlsConfig{
+		enabled:      strings.ToLower(os.Getenv("SSL_ENABLED")) == "true",
+		certFile:     os.Getenv("TLS_CERT_FILE"),
+		keyFile:      os.Getenv("TLS_KEY_FILE"),
+		clientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+		redirectPort: os.Getenv("HTTP_REDIRECT_PORT"),
+	}
+	if !c.enabled {
+		return c, nil
+	}
+
+	switch strings.ToLower(os.Getenv("TLS_CLIENT_AUTH")) {
+	case "require":
+		c.clientAuth = tls.RequireAndVerifyClientCert
+	case "none":
+		c.clientAuth = tls.NoClientCert
+	case "", "request":
+		// users without a certificate can still log in with their password
+		c.clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return c, fmt.Errorf("imperator: unknown TLS_CLIENT_AUTH %q", os.Getenv("TLS_CLIENT_AUTH"))
+	}
+	if c.clientCAFile == "" {
+		c.clientAuth = tls.NoClientCert
+	}
+
+	if maxAge, err := strconv.Atoi(os.Getenv("HSTS_MAX_AGE")); err == nil && maxAge > 0 {
+		c.hsts = fmt.Sprintf("max-age=%d", maxAge)
+		if strings.ToLower(os.Getenv("HSTS_INCLUDE_SUBDOMAINS")) == "true" {
+			c.hsts += "; includeSubDomains"
+		}
+		if strings.ToLower(os.Getenv("HSTS_PRELOAD")) == "true" {
+			c.hsts += "; preload"
+		}
+	}
+
+	if c.certFile == "" && c.keyFile == "" {
+		if !i.Debug {
+			return c, errors.New("imperator: SSL_ENABLED needs TLS_CERT_FILE and TLS_KEY_FILE outside of debug mode")
+		}
+		dir := filepath.Join(i.RootPath, "tmp", "tls")
+		c.certFile, c.keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if name := os.Getenv("SERVER_NAME"); name != "" && name != "localhost" {
+			hosts = append(hosts, name)
+		}
+		if err := SelfSignedCertificate(c.certFile, c.keyFile, hosts); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// SelfSignedCertificate writes a self signed certificate for the hosts and its key for local
+// development, an existing certificate is kept until a week before it expires. Browsers trust it
+// once it is imported as a certificate authority.
+func SelfSignedCertificate(certFile, keyFile string, hosts []string) error {
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > 7*24*time.Hour {
+			return nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Imperator development"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// certReloader serves the certificate, key and client CA from their files and loads them again
+// when one of the files changed, so renewed certificates are used without a restart
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	errorLog     *log.Logger
+
+	mu      sync.RWMutex
+	config  *tls.Config
+	mods    []time.Time
+	checked time.Time
+}
+
+func newCertReloader(c tlsConfig, errorLog *log.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile:     c.certFile,
+		keyFile:      c.keyFile,
+		clientCAFile: c.clientCAFile,
+		clientAuth:   c.clientAuth,
+		errorLog:     errorLog,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the config for the server, every handshake gets the current files
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			config, _ := r.GetConfigForClient(hello)
+			return &config.Certificates[0], nil
+		},
+		GetConfigForClient: r.GetConfigForClient,
+	}
+}
+
+// GetConfigForClient returns the current config, the files are checked for changes at most once
+// per tlsReloadInterval. A file that can not be loaded is logged and the previous one kept.
+func (r *certReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	config, due := r.config, time.Since(r.checked) > tlsReloadInterval
+	r.mu.RUnlock()
+	if due && r.changed() {
+		if err := r.load(); err != nil {
+			r.errorLog.Println("failed to reload TLS certificate with err:", err)
+		} else {
+			r.mu.RLock()
+			config = r.config
+			r.mu.RUnlock()
+		}
+	}
+	return config, nil
+}
+
+// changed reports whether a file was modified since it was loaded
+func (r *certReloader) changed() bool {
+	mods := r.modTimes()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	for n := range mods {
+		if n >= len(r.mods) || !mods[n].Equal(r.mods[n]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) modTimes() []time.Time {
+	var mods []time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		var mod time.Time
+		if info, err := os.Stat(file); file != "" && err == nil {
+			mod = info.ModTime()
+		}
+		mods = append(mods, mod)
+	}
+	return mods
+}
+
+// load reads the files and replaces the config
+func (r *certReloader) load() error {
+	mods := r.modTimes()
+	pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{pair},
+		NextProtos:   []string{"h2", "http/1.1"},
+		ClientAuth:   r.clientAuth,
+	}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("imperator: no certificates found in %s", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+	r.mods = mods
+	r.checked = time.Now()
+	return nil
+}
+
+// redirectToHTTPS sends plain http requests to the same url on the https port
+func (i *Imperator) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if i.config.port != "" && i.config.port != "443" {
+		host = net.JoinHostPort(host, i.config.port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// HSTS tells browsers to only use https for the site, it is configured with HSTS_MAX_AGE,
+// HSTS_INCLUDE_SUBDOMAINS and HSTS_PRELOAD in .env and only sent on TLS connections
+func (i *Imperator) HSTS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && i.config.tls.hsts != "" {
+			w.Header().Set("Strict-Transport-Security", i.config.tls.hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
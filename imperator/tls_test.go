@@ -0,0 +1,181 @@
+package imperator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// leafSerial returns the serial number of the certificate the reloader currently serves
+func leafSerial(t *testing.T, r *certReloader) string {
+	config, err := r.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.String()
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := SelfSignedCertificate(cert, key, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	before, _ := os.ReadFile(cert)
+	if err := SelfSignedCertificate(cert, key, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.ReadFile(cert)
+	if !bytes.Equal(before, after) {
+		t.Error("a valid certificate was replaced")
+	}
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := SelfSignedCertificate(cert, key, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	r, err := newCertReloader(tlsConfig{certFile: cert, keyFile: key}, log.New(&logged, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := leafSerial(t, r)
+
+	// a renewed certificate is only picked up once the reload interval passed
+	_ = os.Remove(cert)
+	if err := SelfSignedCertificate(cert, key, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(cert, future, future)
+	if leafSerial(t, r) != first {
+		t.Error("certificate reloaded within the interval")
+	}
+	r.checked = time.Now().Add(-2 * tlsReloadInterval)
+	second := leafSerial(t, r)
+	if second == first {
+		t.Error("renewed certificate was not loaded")
+	}
+
+	// a broken file is logged and the previous certificate kept
+	if err := os.WriteFile(cert, []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	_ = os.Chtimes(cert, future, future)
+	r.checked = time.Now().Add(-2 * tlsReloadInterval)
+	if leafSerial(t, r) != second {
+		t.Error("broken certificate replaced the working one")
+	}
+	if logged.Len() == 0 {
+		t.Error("failed reload was not logged")
+	}
+}
+
+func TestImperator_CreateTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	i := &Imperator{RootPath: dir}
+	t.Setenv("SSL_ENABLED", "true")
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CLIENT_CA_FILE", "")
+	t.Setenv("TLS_CLIENT_AUTH", "require")
+	t.Setenv("HSTS_MAX_AGE", "600")
+	t.Setenv("HSTS_INCLUDE_SUBDOMAINS", "true")
+	t.Setenv("HSTS_PRELOAD", "")
+
+	if _, err := i.createTLSConfig(); err == nil {
+		t.Error("production server started without a certificate")
+	}
+
+	i.Debug = true
+	c, err := i.createTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp", "tls", "cert.pem")); err != nil {
+		t.Error("no self signed certificate in debug mode:", err)
+	}
+	if c.clientAuth != tls.NoClientCert {
+		t.Error("client certificates requested without a CA")
+	}
+	if c.hsts != "max-age=600; includeSubDomains" {
+		t.Error("unexpected HSTS header", c.hsts)
+	}
+
+	t.Setenv("TLS_CLIENT_AUTH", "sometimes")
+	if _, err := i.createTLSConfig(); err == nil {
+		t.Error("unknown TLS_CLIENT_AUTH was accepted")
+	}
+}
+
+func TestImperator_RedirectToHTTPS(t *testing.T) {
+	i := &Imperator{}
+	i.config.port = "4443"
+	w := httptest.NewRecorder()
+	i.redirectToHTTPS(w, httptest.NewRequest(http.MethodGet, "http://example.com:4000/a/b?c=d", nil))
+	if w.Code != http.StatusPermanentRedirect {
+		t.Error("expected a permanent redirect and got", w.Code)
+	}
+	if got := w.Header().Get("Location"); got != "https://example.com:4443/a/b?c=d" {
+		t.Error("unexpected location", got)
+	}
+
+	i.config.port = "443"
+	w = httptest.NewRecorder()
+	i.redirectToHTTPS(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if got := w.Header().Get("Location"); got != "https://example.com/" {
+		t.Error("unexpected location for the default port", got)
+	}
+}
+
+func TestImperator_HSTS(t *testing.T) {
+	i := &Imperator{}
+	i.config.tls.hsts = "max-age=600"
+	handler := i.HSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS sent over plain http")
+	}
+
+	srv := httptest.NewTLSServer(handler)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Strict-Transport-Security") != "max-age=600" {
+		t.Error("expected HSTS over TLS and got", resp.Header.Get("Strict-Transport-Security"))
+	}
+}
@@ -0,0 +1,152 @@
+package imperator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/arc41t3ct/imperator/tracing"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// defaultOTLPEndpoint is where a collector on the same host takes OTLP over HTTP
+const defaultOTLPEndpoint = "http://localhost:4318"
+
+// tracedKey marks a request Trace records already, so the Trace of Routes does not start a
+// second span for requests an application router it is mounted in traces
+const tracedKey contextKey = "imperator.traced"
+
+// createTracer sets up Tracer from TRACING_EXPORTER in .env, none by default, otlp, stdout or
+// file. otlp posts to OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT with
+// OTEL_EXPORTER_OTLP_HEADERS, file appends to TRACING_FILE. TRACING_SAMPLE_RATIO is the share of
+// new traces that are recorded and OTEL_SERVICE_NAME the service name, APP_NAME by default.
+func (i *Imperator) createTracer() error {
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = os.Getenv("APP_NAME")
+	}
+
+	var exporter tracing.Exporter
+	switch strings.ToLower(os.Getenv("TRACING_EXPORTER")) {
+	case "", "none":
+		tracing.SetTracer(nil)
+		return nil
+	case "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+		if endpoint == "" {
+			base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+			if base == "" {
+				base = defaultOTLPEndpoint
+			}
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+		headers, err := otlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return err
+		}
+		exporter = &tracing.OTLPExporter{Endpoint: endpoint, Headers: headers, ServiceName: service}
+	case "stdout":
+		exporter = &tracing.WriterExporter{W: os.Stdout, ServiceName: service}
+	case "file":
+		path := os.Getenv("TRACING_FILE")
+		if path == "" {
+			path = filepath.Join("logs", "traces.jsonl")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(i.RootPath, path)
+		}
+		file, err := tracing.NewFileExporter(path, service)
+		if err != nil {
+			return fmt.Errorf("imperator: failed to open TRACING_FILE: %w", err)
+		}
+		exporter = file
+	default:
+		return fmt.Errorf("imperator: unknown TRACING_EXPORTER %q", os.Getenv("TRACING_EXPORTER"))
+	}
+
+	ratio := 1.0
+	if value := os.Getenv("TRACING_SAMPLE_RATIO"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return fmt.Errorf("imperator: TRACING_SAMPLE_RATIO must be between 0 and 1")
+		}
+		ratio = parsed
+	}
+	i.Tracer = tracing.New(exporter, tracing.Options{
+		ServiceName: service,
+		SampleRatio: ratio,
+		ErrorLog: func(err error) {
+			i.ErrorLog.Println(err)
+		},
+	})
+	tracing.SetTracer(i.Tracer)
+	return nil
+}
+
+// otlpHeaders reads key=value pairs separated by commas with URL encoded values
+func otlpHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, encoded, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("imperator: invalid header %q in OTEL_EXPORTER_OTLP_HEADERS", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("imperator: invalid header %q in OTEL_EXPORTER_OTLP_HEADERS", pair)
+		}
+		headers[strings.TrimSpace(key)] = decoded
+	}
+	return headers, nil
+}
+
+// Trace records a server span for every request, continuing the trace of the traceparent header
+// of the caller. The span is named by the route pattern once the request was routed. An
+// application can use it on the router Routes is mounted in to trace its other routes as well.
+func (i *Imperator) Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i.Tracer == nil || r.Context().Value(tracedKey) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), tracedKey, true)
+		if parent, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = tracing.ContextWithSpanContext(ctx, parent)
+		}
+		ctx, span := tracing.Start(ctx, r.Method, tracing.KindServer,
+			tracing.String("http.request.method", r.Method),
+			tracing.String("url.path", r.URL.Path),
+			tracing.String("client.address", r.RemoteAddr),
+			tracing.String("user_agent.original", r.UserAgent()),
+		)
+		r = r.WithContext(ctx)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		if pattern := routePattern(r); pattern != "" {
+			span.SetName(r.Method + " " + pattern)
+			span.SetAttributes(tracing.String("http.route", pattern))
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(tracing.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError, http.StatusText(status))
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package imperator
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arc41t3ct/imperator/tracing"
+	chi "github.com/go-chi/chi/v5"
+)
+
+// exportedSpan is the part of a span in the OTLP JSON the tests look at
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s exportedSpan) attribute(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+// useTestTracer sets a tracer recording every trace, the returned function shuts it down and
+// returns the spans it exported
+func useTestTracer(t *testing.T, i *Imperator) func() []exportedSpan {
+	var buf bytes.Buffer
+	i.Tracer = tracing.New(&tracing.WriterExporter{W: &buf}, tracing.Options{SampleRatio: 1})
+	tracing.SetTracer(i.Tracer)
+	t.Cleanup(func() { tracing.SetTracer(nil) })
+	return func() []exportedSpan {
+		if err := i.Tracer.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var spans []exportedSpan
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var request struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []exportedSpan `json:"spans"`
+					} `json:"scopeSpans"`
+				} `json:"resourceSpans"`
+			}
+			if err := json.Unmarshal([]byte(line), &request); err != nil {
+				t.Fatal(err)
+			}
+			for _, rs := range request.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					spans = append(spans, ss.Spans...)
+				}
+			}
+		}
+		return spans
+	}
+}
+
+func TestImperator_TraceMounted(t *testing.T) {
+	i := newTestImperator(t)
+	spans := useTestTracer(t, i)
+	i.Routes.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	// the application traces its router too, the Trace of Routes must not add a second span
+	api := chi.NewRouter()
+	api.Get("/things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux := chi.NewRouter()
+	mux.Use(i.Trace)
+	mux.Mount("/api/v1", api)
+	mux.Mount("/", i.Routes)
+
+	r := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	mux.ServeHTTP(httptest.NewRecorder(), r)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/things/2", nil))
+
+	got := spans()
+	if len(got) != 2 {
+		t.Fatalf("expected a span per request and got %+v", got)
+	}
+	if got[0].Name != "GET /users/{id}" || got[0].attribute("http.route") != "/users/{id}" {
+		t.Errorf("unexpected span %+v", got[0])
+	}
+	if got[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got[0].ParentSpanID != "00f067aa0ba902b7" {
+		t.Error("the trace of the caller was not continued")
+	}
+	if got[1].Name != "GET /api/v1/things/{id}" || got[1].Status.Code != int(tracing.StatusError) {
+		t.Errorf("unexpected span %+v", got[1])
+	}
+}
+
+// fakeDriver answers every query with no rows, queries containing "fail" fail
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{ driver.Conn }
+
+func (fakeConn) Close() error { return nil }
+
+func (fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errors.New("failed")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (fakeConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string              { return nil }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("imperator-fake", fakeDriver{})
+}
+
+func TestOpenTracedDB(t *testing.T) {
+	i := &Imperator{}
+	spans := useTestTracer(t, i)
+	db, err := openTracedDB("imperator-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, request := tracing.Start(context.Background(), "GET", tracing.KindServer)
+	if _, err := db.ExecContext(ctx, "update users set active = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "delete from fail"); err == nil {
+		t.Fatal("the error of the driver was lost")
+	}
+	rows, err := db.QueryContext(ctx, " select id from users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	// queries outside of a trace are not recorded
+	if _, err := db.Exec("update users set active = 0"); err != nil {
+		t.Fatal(err)
+	}
+	request.End()
+
+	got := spans()
+	if len(got) != 4 {
+		t.Fatalf("expected 3 queries and the request and got %+v", got)
+	}
+	for n, name := range []string{"UPDATE", "DELETE", "SELECT"} {
+		if got[n].Name != name || got[n].ParentSpanID != request.SpanContext().SpanID.String() {
+			t.Errorf("unexpected span %+v", got[n])
+		}
+	}
+	if got[0].attribute("db.query.text") != "update users set active = ?" || got[0].attribute("db.system") != "imperator-fake" {
+		t.Errorf("unexpected attributes %+v", got[0].Attributes)
+	}
+	if got[1].Status.Code != int(tracing.StatusError) {
+		t.Error("the failed query is not marked as an error")
+	}
+}
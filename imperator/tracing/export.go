@@ -0,0 +1,235 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scopeName is the instrumentation scope of the spans
+const scopeName = "github.com/arc41t3ct/imperator"
+
+// Exporter sends ended spans somewhere
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector with OTLP over HTTP in the JSON encoding
+type OTLPExporter struct {
+	// Endpoint is the full URL, like http://localhost:4318/v1/traces
+	Endpoint string
+	// Headers are added to every request, like the API key of a hosted collector
+	Headers     map[string]string
+	ServiceName string
+	Client      *http.Client
+}
+
+// Export posts the spans in one request
+func (e *OTLPExporter) Export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(encodeRequest(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Shutdown does nothing, every export is a request of its own
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// WriterExporter writes every batch of spans as one line of OTLP JSON, to stdout or a file for
+// development and tests. A line is a request body the OTLPExporter would send, so a file can be
+// replayed to a collector.
+type WriterExporter struct {
+	W           io.Writer
+	ServiceName string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter returns a WriterExporter appending to the file, it is closed on Shutdown
+func NewFileExporter(path, serviceName string) (*WriterExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{W: file, ServiceName: serviceName, file: file}, nil
+}
+
+// Export writes the spans
+func (e *WriterExporter) Export(_ context.Context, spans []*Span) error {
+	line, err := json.Marshal(encodeRequest(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.W.Write(append(line, '\n'))
+	return err
+}
+
+// Shutdown closes the file of NewFileExporter, other writers are left open
+func (e *WriterExporter) Shutdown(context.Context) error {
+	if e.file == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// the types below are the JSON encoding of the OTLP ExportTraceServiceRequest, ids are hex and
+// 64 bit integers strings
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func encodeRequest(service string, spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, encodeSpan(span))
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttributes([]Attribute{String("service.name", service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: encoded}},
+	}}}
+}
+
+func encodeSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           s.sc.TraceID.String(),
+		SpanID:            s.sc.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        encodeAttributes(s.attributes),
+		Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+	}
+	if s.parent.IsValid() {
+		span.ParentSpanID = s.parent.String()
+	}
+	for _, event := range s.events {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(event.Time.UnixNano(), 10),
+			Name:         event.Name,
+			Attributes:   encodeAttributes(event.Attributes),
+		})
+	}
+	return span
+}
+
+func encodeAttributes(attributes []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+	for _, a := range attributes {
+		var value otlpValue
+		switch v := a.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpAttribute{Key: a.Key, Value: value})
+	}
+	return encoded
+}
@@ -0,0 +1,455 @@
+// Package tracing records spans of requests and the work done for them and exports them in the
+// OpenTelemetry protocol. Traces are continued from and identified like W3C Trace Context so the
+// spans join those of other services, without depending on the OpenTelemetry SDK.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace, all spans of a request share it
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// IsValid reports whether the id is not all zeros
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether the id is not all zeros
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is what a span passes on to its children, in the context of the process or in the
+// traceparent header to other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled tells whether the spans of the trace are recorded
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the value of the W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent reads a W3C traceparent header, version-traceid-parentid-flags in lower case
+// hex. Versions after 00 may add fields which are ignored.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	header = strings.TrimSpace(header)
+	if len(header) < 55 || (len(header) > 55 && header[55] != '-') {
+		return sc, false
+	}
+	if header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return sc, false
+	}
+	version, ok := decodeHex(header[0:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(header) != 55) {
+		return sc, false
+	}
+	traceID, ok := decodeHex(header[3:35])
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeHex(header[36:52])
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeHex(header[53:55])
+	if !ok {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// decodeHex only accepts lower case hex as the header must be
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// SpanKind tells how a span relates to other services, the values are those of OTLP
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+	KindProducer SpanKind = 4
+	KindConsumer SpanKind = 5
+)
+
+// StatusCode is the outcome of a span, the values are those of OTLP
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key with a string, bool, int64 or float64 value
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+// Int returns an integer attribute
+func Int(key string, value int) Attribute { return Attribute{key, int64(value)} }
+
+// Bool returns a boolean attribute
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// Float64 returns a floating point attribute
+func Float64(key string, value float64) Attribute { return Attribute{key, value} }
+
+// Event is something that happened during a span, like an error
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// Span is an operation of a trace. The methods of a nil span do nothing so callers do not have to
+// check whether the trace is sampled.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+	kind   SpanKind
+	start  time.Time
+
+	mu            sync.Mutex
+	name          string
+	end           time.Time
+	attributes    []Attribute
+	events        []Event
+	statusCode    StatusCode
+	statusMessage string
+	ended         bool
+}
+
+// SpanContext returns the ids of the span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetName renames the span, like a server span once the route is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// SetStatus sets the outcome of the span, the message is only kept for errors
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = code
+	if code == StatusError {
+		s.statusMessage = message
+	}
+}
+
+// RecordError adds the error as an exception event and marks the span as failed, nil is ignored
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, Event{
+		Name:       "exception",
+		Time:       time.Now(),
+		Attributes: []Attribute{String("exception.type", fmt.Sprintf("%T", err)), String("exception.message", err.Error())},
+	})
+	s.mu.Unlock()
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End finishes the span and hands it to the exporter, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+type contextKey int
+
+const (
+	spanContextKey contextKey = iota
+	spanKey
+)
+
+// ContextWithSpanContext returns a context whose spans continue the trace, like one read from a
+// traceparent header or queued with a job
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey, sc)
+}
+
+// SpanContextFromContext returns the span context of the current span, it is not valid outside
+// of a trace
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey).(SpanContext)
+	return sc
+}
+
+// SpanFromContext returns the span started in this process that the context belongs to, nil
+// when there is none or the trace is not sampled
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+var global atomic.Pointer[Tracer]
+
+// SetTracer sets the tracer Start and StartChild use, nil turns tracing off
+func SetTracer(t *Tracer) {
+	global.Store(t)
+}
+
+// Start starts a span as a child of the span in the context or as the root of a new trace. The
+// span is nil when tracing is off or the trace is not sampled, the returned context carries the
+// trace on either way.
+func Start(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, *Span) {
+	t := global.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !parent.IsValid() {
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sample(sc.TraceID)
+	}
+	sc.SpanID = newSpanID()
+	ctx = context.WithValue(ctx, spanContextKey, sc)
+	if !sc.Sampled {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:     t,
+		sc:         sc,
+		parent:     parent.SpanID,
+		kind:       kind,
+		start:      time.Now(),
+		name:       name,
+		attributes: attributes,
+	}
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// StartChild starts a span only when the context belongs to a sampled trace, for operations like
+// queries that are too many to be traces of their own
+func StartChild(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, *Span) {
+	if !SpanContextFromContext(ctx).Sampled {
+		return ctx, nil
+	}
+	return Start(ctx, name, kind, attributes...)
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+// Options configure a tracer, zero values use the defaults
+type Options struct {
+	// ServiceName is the service.name of the spans
+	ServiceName string
+	// SampleRatio is the share of new traces that are recorded, 0 to 1, traces continued from a
+	// traceparent follow the sampled flag of the caller
+	SampleRatio float64
+	// BatchSize is the number of spans exported at once, 512 by default
+	BatchSize int
+	// Interval is how often spans are exported when the batch is not full, 5s by default
+	Interval time.Duration
+	// ErrorLog is called when spans could not be exported
+	ErrorLog func(err error)
+}
+
+// Tracer collects ended spans and exports them in batches in the background
+type Tracer struct {
+	exporter Exporter
+	options  Options
+	spans    chan *Span
+	done     chan struct{}
+	dropped  atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New returns a tracer exporting to the exporter
+func New(exporter Exporter, options Options) *Tracer {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 512
+	}
+	if options.Interval <= 0 {
+		options.Interval = 5 * time.Second
+	}
+	if options.ErrorLog == nil {
+		options.ErrorLog = func(error) {}
+	}
+	t := &Tracer{
+		exporter: exporter,
+		options:  options,
+		spans:    make(chan *Span, 4*options.BatchSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// sample decides by the trace id so all services with the same ratio agree on a trace
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.options.SampleRatio >= 1:
+		return true
+	case t.options.SampleRatio <= 0:
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:]) < uint64(t.options.SampleRatio*(1<<63))*2
+}
+
+// enqueue queues an ended span, it is dropped when the queue is full so tracing never blocks a
+// request
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of spans that were dropped because the queue was full
+func (t *Tracer) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.options.Interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, t.options.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			t.options.ErrorLog(fmt.Errorf("tracing: failed to export %d spans: %w", len(batch), err))
+		}
+		cancel()
+		batch = make([]*Span, 0, t.options.BatchSize)
+	}
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= t.options.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown exports the queued spans and shuts the exporter down, spans ended afterwards are
+// dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exporter.Shutdown(ctx)
+}
@@ -0,0 +1,164 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// recorder is an exporter keeping the spans in memory
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(_ context.Context, spans []*Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *recorder) Shutdown(context.Context) error { return nil }
+
+// useTracer makes a tracer with the ratio the global one for the test, the spans are in the
+// recorder once shutdown was called
+func useTracer(t *testing.T, ratio float64) (*Tracer, *recorder) {
+	rec := &recorder{}
+	tracer := New(rec, Options{ServiceName: "test", SampleRatio: ratio})
+	SetTracer(tracer)
+	t.Cleanup(func() { SetTracer(nil) })
+	return tracer, rec
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for header, valid := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":      true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00":      true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-next": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-next": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":      false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":      false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":      false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":      false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":         false,
+		"": false,
+	} {
+		sc, ok := ParseTraceparent(header)
+		if ok != valid {
+			t.Errorf("ParseTraceparent(%q) = %v, expected %v", header, ok, valid)
+		}
+		if ok && header[:2] == "00" && sc.Traceparent() != header {
+			t.Errorf("traceparent %q came back as %q", header, sc.Traceparent())
+		}
+	}
+}
+
+func TestStart_Children(t *testing.T) {
+	tracer, rec := useTracer(t, 1)
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, server := Start(ContextWithSpanContext(context.Background(), parent), "GET", KindServer)
+	if SpanFromContext(ctx) != server || SpanContextFromContext(ctx) != server.SpanContext() {
+		t.Fatal("the context does not carry the span")
+	}
+	_, query := StartChild(ctx, "SELECT", KindClient, String("db.system", "postgresql"))
+	query.RecordError(errors.New("broken"))
+	query.End()
+	query.End()
+	server.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("expected 2 spans and got %d", len(rec.spans))
+	}
+	got := rec.spans[0]
+	if got.name != "SELECT" || got.parent != server.sc.SpanID || got.sc.TraceID != parent.TraceID {
+		t.Error("the query is not a child of the server span:", got.name, got.parent, got.sc)
+	}
+	if got.statusCode != StatusError || len(got.events) != 1 {
+		t.Error("the error was not recorded")
+	}
+	if rec.spans[1].parent != parent.SpanID {
+		t.Error("the server span does not continue the trace of the caller")
+	}
+}
+
+func TestStart_NotSampled(t *testing.T) {
+	_, _ = useTracer(t, 0)
+
+	ctx, span := Start(context.Background(), "GET", KindServer)
+	if span != nil {
+		t.Error("a trace was sampled with a ratio of 0")
+	}
+	if sc := SpanContextFromContext(ctx); !sc.IsValid() || sc.Sampled {
+		t.Error("the context does not carry the trace on:", sc)
+	}
+	if _, child := StartChild(ctx, "SELECT", KindClient); child != nil {
+		t.Error("a child of a trace that is not sampled was recorded")
+	}
+	// a sampled caller wins over the ratio
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, span := Start(ContextWithSpanContext(context.Background(), parent), "GET", KindServer); span == nil {
+		t.Error("the sampled flag of the caller was ignored")
+	}
+	// nil spans can be used like recorded ones
+	span.SetName("name")
+	span.SetAttributes(Bool("ok", true))
+	span.RecordError(errors.New("ignored"))
+	span.End()
+}
+
+func TestOTLPExporter_Export(t *testing.T) {
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	tracer, rec := useTracer(t, 1)
+	_, span := Start(context.Background(), "job", KindInternal, Int("attempt", 2), Float64("ratio", 0.5))
+	span.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := &OTLPExporter{Endpoint: server.URL, Headers: map[string]string{"X-Api-Key": "secret"}, ServiceName: "app"}
+	if err := exporter.Export(context.Background(), rec.spans); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/json" || header.Get("X-Api-Key") != "secret" {
+		t.Error("missing headers:", header)
+	}
+	var request otlpRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		t.Fatal(err)
+	}
+	resource := request.ResourceSpans[0]
+	if *resource.Resource.Attributes[0].Value.StringValue != "app" {
+		t.Error("missing the service name")
+	}
+	got := resource.ScopeSpans[0].Spans[0]
+	if got.Name != "job" || got.TraceID != span.sc.TraceID.String() || got.ParentSpanID != "" {
+		t.Errorf("unexpected span %+v", got)
+	}
+	if got.Attributes[0].Key != "attempt" || *got.Attributes[0].Value.IntValue != "2" || *got.Attributes[1].Value.DoubleValue != 0.5 {
+		t.Errorf("unexpected attributes %+v", got.Attributes)
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if err := exporter.Export(context.Background(), rec.spans); err == nil {
+		t.Error("a rejected export did not fail")
+	}
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"imperatorapp/auth/ldap"
+	"imperatorapp/auth/oauth"
+	"imperatorapp/auth/oidc"
+	"imperatorapp/auth/password"
+	"imperatorapp/auth/sessions"
+	"imperatorapp/auth/throttle"
 	"imperatorapp/handlers"
 	"imperatorapp/middleware"
 	"imperatorapp/models"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/arc41t3ct/imperator"
 )
@@ -21,10 +29,33 @@ func initApplication() *application {
 	if err != nil {
 		log.Fatal(err)
 	}
+	sessionIndex := sessions.New(imp.Session, imp.EncryptionKey)
 	middle := &middleware.Middleware{}
 	middle.App = imp
+	middle.SessionIndex = sessionIndex
 	hadls := &handlers.Handlers{}
 	hadls.App = imp
+	hadls.SessionIndex = sessionIndex
+	hadls.LoginThrottle = throttle.NewLogin(imp.Cache, loginThrottleConfig(), throttle.DefaultIPConfig)
+	hadls.MailThrottle = throttle.New(imp.Cache, throttle.DefaultMailConfig)
+	hadls.OIDC, err = oidc.FromEnv(os.Getenv("APP_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hadls.LDAP, err = ldap.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	hadls.OAuth = oauth.FromEnv(os.Getenv("APP_URL"), hadls.LoadOAuthKeys)
+	hadls.PasswordPolicy, err = password.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	hasher, err := password.HasherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	models.SetPasswordHasher(hasher)
 	app := &application{}
 	app.App = imp
 	app.Middlware = middle
@@ -33,6 +64,22 @@ func initApplication() *application {
 	app.Models = models.New(app.App.DB.Pool)
 	hadls.Models = app.Models
 	middle.Models = app.Models
+	if err := app.scheduleJobs(); err != nil {
+		log.Fatal(err)
+	}
+	app.registerMetrics()
 
 	return app
 }
+
+// loginThrottleConfig returns the per account login throttle with the lockout settings from .env
+func loginThrottleConfig() throttle.Config {
+	config := throttle.DefaultEmailConfig
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES")); err == nil && n > 0 {
+		config.MaxFailures = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_MINUTES")); err == nil && n > 0 {
+		config.Lockout = time.Duration(n) * time.Minute
+	}
+	return config
+}
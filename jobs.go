@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultAuditRetentionDays is how long audit events are kept when AUDIT_RETENTION_DAYS is not set
+const defaultAuditRetentionDays = 365
+
+// scheduleJobs registers the background jobs of the app on the schedular and starts it with the
+// server, the framework creates the schedular, records the durations of the jobs under their
+// names and stops it on shutdown but leaves starting it to the app
+func (a *application) scheduleJobs() error {
+	if _, err := a.App.Schedule("prune_audit_events", "@daily", a.pruneAuditEvents); err != nil {
+		return err
+	}
+	if _, err := a.App.Schedule("prune_user_tokens", "@hourly", a.pruneUserTokens); err != nil {
+		return err
+	}
+	if _, err := a.App.Schedule("prune_user_sessions", "@hourly", a.pruneUserSessions); err != nil {
+		return err
+	}
+	if _, err := a.App.Schedule("prune_remember_tokens", "@hourly", a.pruneRememberTokens); err != nil {
+		return err
+	}
+	if _, err := a.App.Schedule("prune_oauth_tokens", "@hourly", a.pruneOAuthTokens); err != nil {
+		return err
+	}
+	if _, err := a.App.Schedule("rotate_oauth_keys", "@daily", a.rotateOAuthKeys); err != nil {
+		return err
+	}
+	a.App.OnStart(func(ctx context.Context) error {
+		a.App.Schedular.Start()
+		return nil
+	})
+	// the provider needs a signing key before the first token is issued
+	if a.App.DB.Pool != nil {
+		a.rotateOAuthKeys()
+	}
+	return nil
+}
+
+// pruneAuditEvents deletes the audit events older than the retention from .env
+func (a *application) pruneAuditEvents() {
+	days := auditRetentionDays()
+	if days == 0 {
+		return
+	}
+	removed, err := a.Models.AuditEvents.DeleteOlderThan(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		a.App.ErrorLog.Println("failed to prune audit events with err:", err)
+		return
+	}
+	a.App.InfoLog.Printf("pruned %d audit events older than %d days", removed, days)
+}
+
+// pruneUserTokens deletes the single-use tokens that expired or were used
+func (a *application) pruneUserTokens() {
+	if err := a.Models.UserTokens.DeleteExpired(); err != nil {
+		a.App.ErrorLog.Println("failed to prune user tokens with err:", err)
+	}
+}
+
+// pruneUserSessions removes the sessions from the index that were idle longer than the session
+// lifetime, their data is gone from the store by then
+func (a *application) pruneUserSessions() {
+	if err := a.Models.UserSessions.DeleteStale(time.Now().Add(-a.App.Session.Lifetime)); err != nil {
+		a.App.ErrorLog.Println("failed to prune user sessions with err:", err)
+	}
+}
+
+// pruneRememberTokens deletes the remember me series that expired
+func (a *application) pruneRememberTokens() {
+	if err := a.Models.RememberToken.DeleteExpired(); err != nil {
+		a.App.ErrorLog.Println("failed to prune remember tokens with err:", err)
+	}
+}
+
+// auditRetentionDays reads AUDIT_RETENTION_DAYS from .env, 0 keeps audit events forever
+func auditRetentionDays() int {
+	days, err := strconv.Atoi(os.Getenv("AUDIT_RETENTION_DAYS"))
+	if err != nil || days < 0 {
+		return defaultAuditRetentionDays
+	}
+	return days
+}
+
+// pruneOAuthTokens deletes the authorization codes and refresh tokens that expired
+func (a *application) pruneOAuthTokens() {
+	if err := a.Models.OAuthCodes.DeleteExpired(); err != nil {
+		a.App.ErrorLog.Println("failed to prune oauth codes with err:", err)
+	}
+	if err := a.Models.OAuthRefreshTokens.DeleteExpired(); err != nil {
+		a.App.ErrorLog.Println("failed to prune oauth refresh tokens with err:", err)
+	}
+}
+
+// rotateOAuthKeys generates a new signing key when the current one is due and drops retired keys
+func (a *application) rotateOAuthKeys() {
+	if err := a.Handlers.RotateOAuthKeys(); err != nil {
+		a.App.ErrorLog.Println("failed to rotate oauth keys with err:", err)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// registerMetrics adds the metrics of the app to those the framework records for requests, the
+// database pool, the cache, mails and jobs
+func (a *application) registerMetrics() {
+	if a.App.DB.Pool == nil {
+		return
+	}
+	a.App.Metrics.NewGaugeFunc("sessions_active", "Logged in sessions seen within the session lifetime.", func() float64 {
+		n, err := a.Models.UserSessions.CountActive(time.Now().Add(-a.App.Session.Lifetime))
+		if err != nil {
+			a.App.ErrorLog.Println("failed to count active sessions with err:", err)
+			return 0
+		}
+		return float64(n)
+	})
+}
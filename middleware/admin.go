@@ -5,10 +5,23 @@ import (
 	"strings"
 )
 
+// AdminPermission is the permission needed to enter the admin area
+const AdminPermission = "admin.access"
+
+// Admin guards the admin area. Users waiting for their second factor are not authenticated yet
+// and logged in users need the admin.access permission.
 func (m *Middleware) Admin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.URL.Path, "/admin/area") && !m.App.Session.Exists(r.Context(), "userID") {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		if strings.Contains(r.URL.Path, "/admin/area") {
+			if !m.isAuthenticated(r) {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if !m.userCan(r, AdminPermission) {
+				m.forbidden(w, r)
+				return
+			}
 		}
+		next.ServeHTTP(w, r)
 	})
 }
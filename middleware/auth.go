@@ -2,10 +2,13 @@ package middleware
 
 import "net/http"
 
+// Auth only lets fully authenticated users through. Users waiting for their second factor are rejected.
 func (m *Middleware) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !m.App.Session.Exists(r.Context(), "userID") {
+		if !m.isAuthenticated(r) {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
 		}
+		next.ServeHTTP(w, r)
 	})
 }
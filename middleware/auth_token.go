@@ -1,21 +1,108 @@
 package middleware
 
-import "net/http"
+import (
+	"context"
+	"imperatorapp/models"
+	"net/http"
+)
 
+// contextKey is the type of the request context keys set by the middleware
+type contextKey string
+
+// context keys for the user and token resolved from a bearer token
+const (
+	tokenUserKey   contextKey = "token_user"
+	tokenScopesKey contextKey = "token_scopes"
+)
+
+// AuthToken authenticates the bearer token of the request and puts the user of the token and the
+// scopes granted to it into the request context
 func (m *Middleware) AuthToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := m.Models.Tokens.AuthenticationToken(r)
+		user, err := m.models(r).Tokens.AuthenticationToken(r)
 		if err != nil {
-			var payload struct {
-				Error   bool   `json:"error"`
-				Message string `json:"message"`
+			m.writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenUserKey, user)
+		ctx = context.WithValue(ctx, tokenScopesKey, user.Token.ScopeList())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope only lets requests through whose token was granted all of the scopes, it must run
+// after AuthToken:
+//
+//	r.With(a.Middlware.RequireScope(models.ScopeUsersWrite)).Post("/users", ...)
+func (m *Middleware) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			granted := TokenScopes(r.Context())
+			for _, scope := range scopes {
+				if !containsScope(granted, scope) {
+					m.writeJSONError(w, http.StatusForbidden, "token is missing the "+scope+" scope")
+					return
+				}
 			}
-			payload.Error = true
-			payload.Message = "unauthorized"
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-			if err := m.App.Render.WriteJSON(w, payload, http.StatusUnauthorized); err != nil {
-				m.App.ErrorLog.Println("failed to write json with err:", err)
+// RequireTokenPermission only lets requests through whose token user has been granted the
+// permission through one of their roles, it must run after AuthToken
+func (m *Middleware) RequireTokenPermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := TokenUser(r.Context())
+			if user == nil {
+				m.writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			ok, err := m.models(r).Users.HasPermission(user.ID, permission)
+			if err != nil {
+				m.App.ErrorLog.Println("failed to check permission with err:", err)
 			}
+			if !ok {
+				m.writeJSONError(w, http.StatusForbidden, "user is missing the "+permission+" permission")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TokenUser returns the user of the bearer token that was authenticated by AuthToken
+func TokenUser(ctx context.Context) *models.User {
+	user, _ := ctx.Value(tokenUserKey).(*models.User)
+	return user
+}
+
+// TokenScopes returns the scopes of the bearer token that was authenticated by AuthToken
+func TokenScopes(ctx context.Context) []string {
+	scopes, _ := ctx.Value(tokenScopesKey).([]string)
+	return scopes
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
 		}
-	})
+	}
+	return false
+}
+
+// writeJSONError writes the error payload used by the api
+func (m *Middleware) writeJSONError(w http.ResponseWriter, status int, message string) {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	payload.Error = true
+	payload.Message = message
+
+	if err := m.App.Render.WriteJSON(w, payload, status); err != nil {
+		m.App.ErrorLog.Println("failed to write json with err:", err)
+	}
 }
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"imperatorapp/auth/sessions"
+	"net/http"
+)
+
+// NotImpersonating keeps admins who are logged in as another user away from the security settings
+// of that user, like passwords, second factors and api tokens, and from logging in to other apps
+// as the user
+func (m *Middleware) NotImpersonating(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.App.Session.GetInt(r.Context(), sessions.ImpersonatorKey) != 0 {
+			m.forbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,34 +1,40 @@
 package middleware
 
 import (
-	"fmt"
+	"imperatorapp/auth/remember"
+	"imperatorapp/auth/sessions"
 	"imperatorapp/models"
 	"net/http"
-	"time"
 
 	"github.com/arc41t3ct/imperator"
 )
 
 type Middleware struct {
-	App    *imperator.Imperator
-	Models models.Models
+	App          *imperator.Imperator
+	Models       models.Models
+	SessionIndex *sessions.Index
 }
 
-// deleteRememberCookie deletes the remeber cookie
-func (m *Middleware) deleteRememberCookie(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.RenewToken(r.Context())
-	newCookie := http.Cookie{
-		Name:     fmt.Sprintf("_%s_remeber", m.App.AppName),
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Now().Add(-100 * time.Hour),
-		HttpOnly: true,
-		Domain:   m.App.Session.Cookie.Domain,
-		MaxAge:   -1,
-		Secure:   m.App.Session.Cookie.Secure,
-		SameSite: http.SameSiteStrictMode,
+// models returns the models with their queries bound to the context of the request
+func (m *Middleware) models(r *http.Request) *models.Models {
+	return m.Models.WithContext(r.Context())
+}
+
+// pendingTwoFactorUserID is the session key set by the login handler while a user still has to
+// provide the second factor
+const pendingTwoFactorUserID = "pending_2fa_user_id"
+
+// isAuthenticated checks that a user is logged in and has completed every login step
+func (m *Middleware) isAuthenticated(r *http.Request) bool {
+	if m.App.Session.Exists(r.Context(), pendingTwoFactorUserID) {
+		return false
 	}
-	http.SetCookie(w, &newCookie)
-	m.App.Session.Destroy(r.Context())
+	return m.App.Session.Exists(r.Context(), "userID")
+}
+
+// deleteRememberCookie deletes the remember cookie and starts a fresh session
+func (m *Middleware) deleteRememberCookie(w http.ResponseWriter, r *http.Request) {
+	remember.ClearCookie(w, m.App.Session, m.App.AppName)
+	_ = m.App.Session.Destroy(r.Context())
 	_ = m.App.Session.RenewToken(r.Context())
 }
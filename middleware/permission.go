@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// RequirePermission only lets users through who have been granted the permission through one of
+// their roles. It is meant for chi route groups:
+//
+//	r.Use(a.Middlware.RequirePermission("users.edit"))
+func (m *Middleware) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.isAuthenticated(r) {
+				http.Redirect(w, r, "/admin/user/login", http.StatusSeeOther)
+				return
+			}
+			if !m.userCan(r, permission) {
+				m.forbidden(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userCan checks whether the logged in user has the permission
+func (m *Middleware) userCan(r *http.Request, permission string) bool {
+	ok, err := m.models(r).Users.HasPermission(m.App.Session.GetInt(r.Context(), "userID"), permission)
+	if err != nil {
+		m.App.ErrorLog.Println("failed to check permission with err:", err)
+		return false
+	}
+	return ok
+}
+
+// forbidden renders the 403 page
+func (m *Middleware) forbidden(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	if err := m.App.Render.Page(w, r, "403", nil, nil); err != nil {
+		m.App.ErrorLog.Println("failed to render 403 page with err:", err)
+	}
+}
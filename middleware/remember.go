@@ -1,50 +1,95 @@
 package middleware
 
 import (
-	"fmt"
+	"errors"
+	"imperatorapp/auth/remember"
 	"imperatorapp/models"
 	"net/http"
-	"strconv"
-	"strings"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
 )
 
-// Remember Middleware allows a user to check remember me to be logged in after leaving
+// Remember Middleware allows a user to check remember me to be logged in after leaving. Every
+// automatic login rotates the secret in the cookie, an old secret showing up again means the
+// cookie was copied and ends every session of its series.
 func (m *Middleware) Remember(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !m.App.Session.Exists(r.Context(), "userID") {
-			// user is not logged in
-			cookie, err := r.Cookie(fmt.Sprintf("_%s_remeber", m.App.AppName))
-			if err != nil {
-				// no cookie, so on to the next middleware
-				next.ServeHTTP(w, r)
-			} else {
-				// we found a cookie, so check it
-				key := cookie.Value
-				var u models.User
-				if len(key) > 0 {
-					split := strings.Split(key, "|")
-					uId, hash := split[0], split[1]
-					id, _ := strconv.Atoi(uId)
-					validHash := u.CheckForRememberToken(id, hash)
-					if !validHash {
-						m.deleteRememberCookie(w, r)
-						m.App.Session.Put(r.Context(), "error", "You have been logged out of the sessio")
-						next.ServeHTTP(w, r)
-					} else {
-						// valid hash so log in user
-						user, _ := u.Get(id)
-						m.App.Session.Put(r.Context(), "userID", user.ID)
-						m.App.Session.Put(r.Context(), "remember_token", hash)
-					}
-				} else {
-					// key length is zero, so it's probably left over cookie (user no close browser)
-					m.deleteRememberCookie(w, r)
-					next.ServeHTTP(w, r)
-				}
-			}
-		} else {
+		if m.App.Session.Exists(r.Context(), "userID") {
 			// user is logged in
 			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(remember.CookieName(m.App.AppName))
+		if err != nil {
+			// no cookie, so on to the next middleware
+			next.ServeHTTP(w, r)
+			return
 		}
+		m.rememberUser(w, r, cookie.Value)
+		next.ServeHTTP(w, r)
 	})
 }
+
+// rememberUser logs in the user of a remember me cookie and replaces the cookie with the rotated
+// secret, invalid cookies are deleted
+func (m *Middleware) rememberUser(w http.ResponseWriter, r *http.Request, value string) {
+	series, secret, ok := remember.Decode(value)
+	if !ok {
+		// probably a left over cookie from before series were used
+		m.deleteRememberCookie(w, r)
+		return
+	}
+
+	token, next, err := m.models(r).RememberToken.Rotate(series, secret, remoteIP(r))
+	if errors.Is(err, models.ErrRememberTokenReused) {
+		m.rememberTheft(w, r, token)
+		return
+	}
+	if err != nil {
+		if !errors.Is(err, models.ErrRememberTokenInvalid) {
+			m.App.ErrorLog.Println("failed to rotate remember token with err:", err)
+		}
+		m.deleteRememberCookie(w, r)
+		return
+	}
+
+	user, err := m.models(r).Users.Get(token.UserID)
+	if err != nil || user.Active != 1 {
+		_ = m.models(r).RememberToken.Delete(token.ID)
+		m.deleteRememberCookie(w, r)
+		return
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "userID", user.ID)
+	m.App.Session.Put(r.Context(), remember.SessionKey, series)
+	if next != "" {
+		remember.SetCookie(w, m.App.Session, m.App.AppName, remember.Encode(series, next), token.ExpiresAt)
+	}
+}
+
+// rememberTheft ends every session logged in through a series whose cookie was used by two
+// browsers, it can not be told which one is the owner so both have to log in again
+func (m *Middleware) rememberTheft(w http.ResponseWriter, r *http.Request, token *models.RememberToken) {
+	if err := m.SessionIndex.RevokeRemembered(token.UserID, token.ID); err != nil {
+		m.App.ErrorLog.Println("failed to revoke sessions of a reused remember token with err:", err)
+	}
+
+	event := models.AuditEvent{
+		Action:     models.AuditRememberReused,
+		TargetType: "user",
+		TargetID:   token.UserID,
+		IP:         remoteIP(r),
+		UserAgent:  r.UserAgent(),
+		RequestID:  chimw.GetReqID(r.Context()),
+	}
+	if user, err := m.models(r).Users.Get(token.UserID); err == nil {
+		event.TargetLabel = user.Email
+	}
+	if _, err := m.models(r).AuditEvents.Insert(event); err != nil {
+		m.App.ErrorLog.Println("failed to record audit event with err:", err)
+	}
+
+	m.deleteRememberCookie(w, r)
+	m.App.Session.Put(r.Context(), "error", "Your remember me cookie was used somewhere else, so you have been logged out everywhere it was used. Please log in again and consider changing your password.")
+}
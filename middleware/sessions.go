@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// TrackSession indexes the session of a logged in user so it can be listed and revoked, and ends
+// sessions that were revoked from another device
+func (m *Middleware) TrackSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active, err := m.SessionIndex.Track(r.Context(), remoteIP(r), r.UserAgent())
+		if err != nil {
+			m.App.ErrorLog.Println("failed to track session with err:", err)
+		}
+		if !active {
+			m.App.Session.Put(r.Context(), "error", "Your session has been ended, please log in again.")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP returns the address of the client without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
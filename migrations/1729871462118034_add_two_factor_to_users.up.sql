@@ -0,0 +1,20 @@
+ALTER TABLE users ADD COLUMN totp_secret character varying(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled integer NOT NULL DEFAULT 0;
+
+drop table if exists recovery_codes;
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    code_hash character varying(100) NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON recovery_codes
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
@@ -0,0 +1,23 @@
+drop table if exists credentials;
+
+CREATE TABLE credentials (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    name character varying(255) NOT NULL,
+    credential_id bytea NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    aaguid bytea NOT NULL,
+    transports character varying(255) NOT NULL DEFAULT '',
+    clone_warning integer NOT NULL DEFAULT 0,
+    last_used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX credentials_user_id_idx ON credentials (user_id);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON credentials
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
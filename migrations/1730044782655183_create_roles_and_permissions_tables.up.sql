@@ -0,0 +1,62 @@
+drop table if exists permission_role;
+drop table if exists role_user;
+drop table if exists permissions cascade;
+drop table if exists roles cascade;
+
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name character varying(255) NOT NULL UNIQUE,
+    description character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON roles
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
+
+CREATE TABLE permissions (
+    id SERIAL PRIMARY KEY,
+    name character varying(255) NOT NULL UNIQUE,
+    description character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON permissions
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
+
+CREATE TABLE role_user (
+    role_id integer NOT NULL REFERENCES roles(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (role_id, user_id)
+);
+
+CREATE INDEX role_user_user_id_idx ON role_user (user_id);
+
+CREATE TABLE permission_role (
+    permission_id integer NOT NULL REFERENCES permissions(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    role_id integer NOT NULL REFERENCES roles(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (permission_id, role_id)
+);
+
+-- seed the permissions the portal checks and a super-admin role holding all of them
+INSERT INTO permissions (name, description) VALUES
+    ('admin.access', 'Access the admin area'),
+    ('users.view', 'List and view users'),
+    ('users.create', 'Create users'),
+    ('users.edit', 'Edit users'),
+    ('users.delete', 'Delete users'),
+    ('roles.manage', 'Assign roles to users');
+
+INSERT INTO roles (name, description) VALUES ('super-admin', 'Has every permission');
+
+INSERT INTO permission_role (permission_id, role_id)
+    SELECT p.id, r.id FROM permissions p, roles r WHERE r.name = 'super-admin';
+
+-- the first user becomes super-admin so an existing install does not lock itself out
+INSERT INTO role_user (role_id, user_id)
+    SELECT r.id, u.id FROM roles r, (SELECT id FROM users ORDER BY id LIMIT 1) u WHERE r.name = 'super-admin';
@@ -0,0 +1,14 @@
+DELETE FROM permissions WHERE name = 'tokens.manage';
+
+DROP INDEX IF EXISTS tokens_user_id_idx;
+DROP INDEX IF EXISTS tokens_token_hash_idx;
+
+-- the plain text of hashed tokens is gone so they can not be restored
+DELETE FROM tokens;
+
+ALTER TABLE tokens ALTER COLUMN expiry SET NOT NULL;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_ip;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS scopes;
+ALTER TABLE tokens DROP COLUMN IF EXISTS name;
+ALTER TABLE tokens ADD COLUMN token character varying(255) NOT NULL DEFAULT '';
@@ -0,0 +1,17 @@
+-- tokens are looked up by their sha256 hash only, the plain text is shown once when it is created
+UPDATE tokens SET token_hash = sha256(convert_to(token, 'UTF8'));
+ALTER TABLE tokens DROP COLUMN IF EXISTS token;
+
+ALTER TABLE tokens ADD COLUMN name character varying(255) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN scopes character varying(512) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN last_used_at timestamp without time zone;
+ALTER TABLE tokens ADD COLUMN last_used_ip character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE tokens ALTER COLUMN expiry DROP NOT NULL;
+
+CREATE UNIQUE INDEX tokens_token_hash_idx ON tokens (token_hash);
+CREATE INDEX tokens_user_id_idx ON tokens (user_id);
+
+INSERT INTO permissions (name, description) VALUES ('tokens.manage', 'List and revoke the API tokens of all users');
+
+INSERT INTO permission_role (permission_id, role_id)
+    SELECT p.id, r.id FROM permissions p, roles r WHERE p.name = 'tokens.manage' AND r.name = 'super-admin';
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN email_verified_at timestamp without time zone;
+
+-- users created before self registration existed were created by admins
+UPDATE users SET email_verified_at = created_at;
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE name = 'audit.view';
+
+drop table if exists audit_events;
@@ -0,0 +1,25 @@
+drop table if exists audit_events;
+
+CREATE TABLE audit_events (
+    id SERIAL PRIMARY KEY,
+    actor_id integer NOT NULL DEFAULT 0,
+    actor_email character varying(255) NOT NULL DEFAULT '',
+    action character varying(100) NOT NULL,
+    target_type character varying(50) NOT NULL DEFAULT '',
+    target_id integer NOT NULL DEFAULT 0,
+    target_label character varying(255) NOT NULL DEFAULT '',
+    ip character varying(64) NOT NULL DEFAULT '',
+    user_agent character varying(512) NOT NULL DEFAULT '',
+    request_id character varying(100) NOT NULL DEFAULT '',
+    changes text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX audit_events_action_idx ON audit_events (action);
+
+INSERT INTO permissions (name, description) VALUES ('audit.view', 'View and export the audit log');
+
+INSERT INTO permission_role (permission_id, role_id)
+    SELECT p.id, r.id FROM permissions p, roles r WHERE p.name = 'audit.view' AND r.name = 'super-admin';
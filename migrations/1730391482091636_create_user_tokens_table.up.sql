@@ -0,0 +1,13 @@
+drop table if exists user_tokens;
+
+CREATE TABLE user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    purpose character varying(50) NOT NULL,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    expires_at timestamp without time zone NOT NULL,
+    consumed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX user_tokens_user_id_purpose_idx ON user_tokens (user_id, purpose);
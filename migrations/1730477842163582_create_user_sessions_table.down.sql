@@ -0,0 +1,5 @@
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS ip;
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS user_agent;
+
+drop table if exists user_sessions;
@@ -0,0 +1,21 @@
+drop table if exists user_sessions;
+
+CREATE TABLE user_sessions (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    session_key character varying(64) NOT NULL UNIQUE,
+    store_token text NOT NULL DEFAULT '',
+    token_hash character varying(64) NOT NULL DEFAULT '',
+    remember_token_id integer NOT NULL DEFAULT 0,
+    user_agent character varying(512) NOT NULL DEFAULT '',
+    ip character varying(64) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX user_sessions_user_id_idx ON user_sessions (user_id);
+CREATE INDEX user_sessions_last_seen_at_idx ON user_sessions (last_seen_at);
+
+ALTER TABLE remember_tokens ADD COLUMN user_agent character varying(512) NOT NULL DEFAULT '';
+ALTER TABLE remember_tokens ADD COLUMN ip character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE remember_tokens ADD COLUMN last_used_at timestamp without time zone;
@@ -0,0 +1,9 @@
+DELETE FROM remember_tokens;
+
+DROP INDEX IF EXISTS remember_tokens_expires_at_idx;
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS rotated_at;
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS previous_hash;
+ALTER TABLE remember_tokens DROP COLUMN IF EXISTS series;
+ALTER TABLE remember_tokens ALTER COLUMN token_hash TYPE character varying(100);
+ALTER TABLE remember_tokens RENAME COLUMN token_hash TO remember_token;
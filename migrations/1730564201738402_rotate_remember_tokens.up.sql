@@ -0,0 +1,11 @@
+-- old tokens are stored in plain text and can not be turned into series, they are logged out
+DELETE FROM remember_tokens;
+
+ALTER TABLE remember_tokens RENAME COLUMN remember_token TO token_hash;
+ALTER TABLE remember_tokens ALTER COLUMN token_hash TYPE character varying(64);
+ALTER TABLE remember_tokens ADD COLUMN series character varying(64) NOT NULL UNIQUE;
+ALTER TABLE remember_tokens ADD COLUMN previous_hash character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE remember_tokens ADD COLUMN rotated_at timestamp without time zone;
+ALTER TABLE remember_tokens ADD COLUMN expires_at timestamp without time zone NOT NULL;
+
+CREATE INDEX remember_tokens_expires_at_idx ON remember_tokens (expires_at);
@@ -0,0 +1,14 @@
+drop table if exists user_identities;
+
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    provider character varying(64) NOT NULL,
+    subject character varying(255) NOT NULL,
+    email character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_login_at timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
@@ -0,0 +1,7 @@
+DELETE FROM permissions WHERE name = 'oauth.manage';
+
+drop table if exists oauth_consents;
+drop table if exists oauth_refresh_tokens;
+drop table if exists oauth_codes;
+drop table if exists oauth_keys;
+drop table if exists oauth_clients;
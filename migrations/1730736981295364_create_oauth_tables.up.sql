@@ -0,0 +1,85 @@
+drop table if exists oauth_consents;
+drop table if exists oauth_refresh_tokens;
+drop table if exists oauth_codes;
+drop table if exists oauth_keys;
+drop table if exists oauth_clients;
+
+CREATE TABLE oauth_clients (
+    id SERIAL PRIMARY KEY,
+    client_id character varying(64) NOT NULL UNIQUE,
+    name character varying(255) NOT NULL,
+    secret_hash character varying(64) NOT NULL DEFAULT '',
+    redirect_uris text NOT NULL DEFAULT '',
+    scopes character varying(512) NOT NULL DEFAULT '',
+    grant_types character varying(255) NOT NULL DEFAULT '',
+    confidential boolean NOT NULL DEFAULT true,
+    trusted boolean NOT NULL DEFAULT false,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON oauth_clients
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
+
+CREATE TABLE oauth_codes (
+    id SERIAL PRIMARY KEY,
+    code_hash character varying(64) NOT NULL UNIQUE,
+    client_id character varying(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    nonce character varying(255) NOT NULL DEFAULT '',
+    code_challenge character varying(128) NOT NULL,
+    family character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    consumed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX oauth_codes_expires_at_idx ON oauth_codes (expires_at);
+
+CREATE TABLE oauth_refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    family character varying(64) NOT NULL,
+    client_id character varying(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    expires_at timestamp without time zone NOT NULL,
+    consumed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX oauth_refresh_tokens_family_idx ON oauth_refresh_tokens (family);
+CREATE INDEX oauth_refresh_tokens_user_id_idx ON oauth_refresh_tokens (user_id);
+CREATE INDEX oauth_refresh_tokens_expires_at_idx ON oauth_refresh_tokens (expires_at);
+
+CREATE TABLE oauth_consents (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    client_id character varying(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (user_id, client_id)
+);
+
+CREATE TRIGGER set_timestamp
+    BEFORE UPDATE ON oauth_consents
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_set_timestamp();
+
+-- the private keys are encrypted with the KEY from .env
+CREATE TABLE oauth_keys (
+    id SERIAL PRIMARY KEY,
+    kid character varying(64) NOT NULL UNIQUE,
+    private_key text NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+INSERT INTO permissions (name, description) VALUES ('oauth.manage', 'Register and manage OAuth clients');
+
+INSERT INTO permission_role (permission_id, role_id)
+    SELECT p.id, r.id FROM permissions p, roles r WHERE p.name = 'oauth.manage' AND r.name = 'super-admin';
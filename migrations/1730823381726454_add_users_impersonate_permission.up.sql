@@ -0,0 +1,4 @@
+INSERT INTO permissions (name, description) VALUES ('users.impersonate', 'Log in as another user');
+
+INSERT INTO permission_role (permission_id, role_id)
+    SELECT p.id, r.id FROM permissions p, roles r WHERE p.name = 'users.impersonate' AND r.name = 'super-admin';
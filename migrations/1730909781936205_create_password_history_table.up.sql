@@ -0,0 +1,14 @@
+drop table if exists password_history;
+
+CREATE TABLE password_history (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    password_hash character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX password_history_user_id_idx ON password_history (user_id);
+
+-- the current passwords start the history
+INSERT INTO password_history (user_id, password_hash, created_at)
+    SELECT id, password, updated_at FROM users;
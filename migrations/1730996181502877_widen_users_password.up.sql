@@ -0,0 +1,2 @@
+-- argon2id hashes in PHC format are longer than the 60 characters of bcrypt
+ALTER TABLE users ALTER COLUMN password TYPE character varying(255);
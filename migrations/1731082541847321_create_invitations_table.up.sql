@@ -0,0 +1,16 @@
+drop table if exists invitations;
+
+CREATE TABLE invitations (
+    id SERIAL PRIMARY KEY,
+    email character varying(255) NOT NULL,
+    role_id integer NOT NULL DEFAULT 0,
+    invited_by integer NOT NULL DEFAULT 0,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    expires_at timestamp without time zone NOT NULL,
+    accepted_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX invitations_email_idx ON invitations (email);
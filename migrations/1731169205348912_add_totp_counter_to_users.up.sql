@@ -0,0 +1,2 @@
+-- the counter of the last accepted totp code, a code is only accepted once
+ALTER TABLE users ADD COLUMN totp_counter bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,250 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// actions recorded in the audit log
+const (
+	AuditLogin                = "login"
+	AuditLoginFailed          = "login.failed"
+	AuditLoginLocked          = "login.locked"
+	AuditLogout               = "logout"
+	AuditPasswordForgot       = "password.reset_requested"
+	AuditPasswordReset        = "password.reset"
+	AuditMagicLinkSent        = "magic_link.sent"
+	AuditUserCreated          = "user.created"
+	AuditUserUpdated          = "user.updated"
+	AuditUserDeleted          = "user.deleted"
+	AuditUserActivated        = "user.activated"
+	AuditUserDeactivated      = "user.deactivated"
+	AuditUserUnlocked         = "user.unlocked"
+	AuditUserRegistered       = "user.registered"
+	AuditUserVerified         = "user.verified"
+	AuditTwoFactorEnabled     = "two_factor.enabled"
+	AuditTwoFactorOff         = "two_factor.disabled"
+	AuditSessionRevoked       = "session.revoked"
+	AuditSessionsRevoked      = "sessions.revoked"
+	AuditRememberRevoked      = "remember.revoked"
+	AuditRememberReused       = "remember.reused"
+	AuditIdentityLinked       = "identity.linked"
+	AuditUserProvisioned      = "user.provisioned"
+	AuditUserRolesSynced      = "user.roles_synced"
+	AuditOAuthClientCreated   = "oauth_client.created"
+	AuditOAuthClientUpdated   = "oauth_client.updated"
+	AuditOAuthClientDeleted   = "oauth_client.deleted"
+	AuditOAuthSecretRotated   = "oauth_client.secret_rotated"
+	AuditOAuthConsent         = "oauth.consent_granted"
+	AuditOAuthTokenReused     = "oauth.token_reused"
+	AuditImpersonationStarted = "impersonation.started"
+	AuditImpersonationStopped = "impersonation.stopped"
+	AuditInvitationSent       = "invitation.sent"
+	AuditInvitationRevoked    = "invitation.revoked"
+	AuditInvitationAccepted   = "invitation.accepted"
+)
+
+// AuditActions lists the recorded actions for filters
+var AuditActions = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditLoginLocked,
+	AuditLogout,
+	AuditPasswordForgot,
+	AuditPasswordReset,
+	AuditMagicLinkSent,
+	AuditUserCreated,
+	AuditUserUpdated,
+	AuditUserDeleted,
+	AuditUserActivated,
+	AuditUserDeactivated,
+	AuditUserUnlocked,
+	AuditUserRegistered,
+	AuditUserVerified,
+	AuditTwoFactorEnabled,
+	AuditTwoFactorOff,
+	AuditSessionRevoked,
+	AuditSessionsRevoked,
+	AuditRememberRevoked,
+	AuditRememberReused,
+	AuditIdentityLinked,
+	AuditUserProvisioned,
+	AuditUserRolesSynced,
+	AuditOAuthClientCreated,
+	AuditOAuthClientUpdated,
+	AuditOAuthClientDeleted,
+	AuditOAuthSecretRotated,
+	AuditOAuthConsent,
+	AuditOAuthTokenReused,
+	AuditImpersonationStarted,
+	AuditImpersonationStopped,
+	AuditInvitationSent,
+	AuditInvitationRevoked,
+	AuditInvitationAccepted,
+}
+
+// AuditEvent is a security relevant event. Actor and target are copied by value so events
+// survive the deletion of the users they are about.
+type AuditEvent struct {
+	ID          int       `db:"id,omitempty"`
+	ActorID     int       `db:"actor_id"`
+	ActorEmail  string    `db:"actor_email"`
+	Action      string    `db:"action"`
+	TargetType  string    `db:"target_type"`
+	TargetID    int       `db:"target_id"`
+	TargetLabel string    `db:"target_label"`
+	IP          string    `db:"ip"`
+	UserAgent   string    `db:"user_agent"`
+	RequestID   string    `db:"request_id"`
+	Changes     string    `db:"changes"`
+	CreatedAt   time.Time `db:"created_at"`
+
+	ctx context.Context
+}
+
+// AuditFilter narrows down the audit events, empty fields do not filter
+type AuditFilter struct {
+	// Actor and Target match a part of the email or label
+	Actor  string
+	Target string
+	Action string
+	From   time.Time
+	// To is exclusive
+	To time.Time
+}
+
+// Table returns the table name for the AuditEvent
+func (a *AuditEvent) Table() string {
+	return "audit_events"
+}
+
+// Insert records an audit event
+func (a *AuditEvent) Insert(event AuditEvent) (int, error) {
+	event.CreatedAt = time.Now()
+	if len(event.UserAgent) > 512 {
+		event.UserAgent = event.UserAgent[:512]
+	}
+	collection := dbSession(a.ctx).Collection(a.Table())
+	res, err := collection.Insert(event)
+	if err != nil {
+		return 0, err
+	}
+	return getInsertID(res.ID()), nil
+}
+
+// Search returns a page of the events matching the filter newest first and the number of all
+// matching events
+func (a *AuditEvent) Search(filter AuditFilter, page, perPage int) ([]*AuditEvent, int, error) {
+	var events []*AuditEvent
+	res := a.find(filter)
+	total, err := res.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := res.Paginate(uint(perPage)).Page(uint(page)).All(&events); err != nil {
+		return nil, 0, err
+	}
+	return events, int(total), nil
+}
+
+// Each calls fn with every event matching the filter newest first without loading them all at
+// once, it is used for exports
+func (a *AuditEvent) Each(filter AuditFilter, fn func(*AuditEvent) error) error {
+	res := a.find(filter)
+	defer func() { _ = res.Close() }()
+	for {
+		var event AuditEvent
+		if !res.Next(&event) {
+			break
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	return res.Err()
+}
+
+// DeleteOlderThan removes the events created before t and returns how many were removed
+func (a *AuditEvent) DeleteOlderThan(t time.Time) (int64, error) {
+	res, err := dbSession(a.ctx).SQL().DeleteFrom(a.Table()).Where("created_at < ?", t).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (a *AuditEvent) find(filter AuditFilter) up.Result {
+	var conds []up.LogicalExpr
+	if filter.Actor != "" {
+		conds = append(conds, up.Raw("LOWER(actor_email) LIKE ?", "%"+strings.ToLower(filter.Actor)+"%"))
+	}
+	if filter.Target != "" {
+		conds = append(conds, up.Raw("LOWER(target_label) LIKE ?", "%"+strings.ToLower(filter.Target)+"%"))
+	}
+	if filter.Action != "" {
+		conds = append(conds, up.Cond{"action =": filter.Action})
+	}
+	if !filter.From.IsZero() {
+		conds = append(conds, up.Cond{"created_at >=": filter.From})
+	}
+	if !filter.To.IsZero() {
+		conds = append(conds, up.Cond{"created_at <": filter.To})
+	}
+	collection := dbSession(a.ctx).Collection(a.Table())
+	res := collection.Find()
+	if len(conds) > 0 {
+		res = collection.Find(up.And(conds...))
+	}
+	return res.OrderBy("-created_at", "-id")
+}
+
+// auditSkipFields are never written to the audit log, either because they are secret or because
+// they change on every update
+var auditSkipFields = map[string]bool{
+	"password":    true,
+	"totp_secret": true,
+	"created_at":  true,
+	"updated_at":  true,
+}
+
+// AuditDiff returns the fields that differ between two values of the same struct type as json
+// in the form {"column": {"from": old, "to": new}}, fields are named by their db tag. Secrets
+// and timestamps are left out. An empty string is returned when nothing changed.
+func AuditDiff(before, after interface{}) (string, error) {
+	b := reflect.Indirect(reflect.ValueOf(before))
+	a := reflect.Indirect(reflect.ValueOf(after))
+	if b.Kind() != reflect.Struct || b.Type() != a.Type() {
+		return "", fmt.Errorf("can not diff %T and %T", before, after)
+	}
+
+	type change struct {
+		From interface{} `json:"from"`
+		To   interface{} `json:"to"`
+	}
+	changes := make(map[string]change)
+	for i := 0; i < b.NumField(); i++ {
+		field := b.Type().Field(i)
+		name := strings.Split(field.Tag.Get("db"), ",")[0]
+		if name == "" || name == "-" || auditSkipFields[name] || !field.IsExported() {
+			continue
+		}
+		from, to := b.Field(i).Interface(), a.Field(i).Interface()
+		if !reflect.DeepEqual(from, to) {
+			changes[name] = change{From: from, To: to}
+		}
+	}
+	if len(changes) == 0 {
+		return "", nil
+	}
+	out, err := json.Marshal(changes)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
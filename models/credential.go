@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// Credential is a webauthn public key credential (passkey or security key) registered by a user
+type Credential struct {
+	ID           int        `db:"id,omitempty"`
+	UserID       int        `db:"user_id"`
+	Name         string     `db:"name"`
+	CredentialID []byte     `db:"credential_id"`
+	PublicKey    []byte     `db:"public_key"`
+	SignCount    int64      `db:"sign_count"`
+	AAGUID       []byte     `db:"aaguid"`
+	Transports   string     `db:"transports"`
+	CloneWarning int        `db:"clone_warning"`
+	LastUsedAt   *time.Time `db:"last_used_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the Credential
+func (c *Credential) Table() string {
+	return "credentials"
+}
+
+// Get gets a credential from the database by passing the id
+func (c *Credential) Get(id int) (*Credential, error) {
+	var item Credential
+	collection := dbSession(c.ctx).Collection(c.Table())
+	res := collection.Find(up.Cond{"id =": id})
+	if err := res.One(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetByCredentialID gets a credential by the raw id the authenticator returned
+func (c *Credential) GetByCredentialID(credentialID []byte) (*Credential, error) {
+	var item Credential
+	collection := dbSession(c.ctx).Collection(c.Table())
+	res := collection.Find(up.Cond{"credential_id =": credentialID})
+	if err := res.One(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetAllForUser returns all credentials of a user given the user id
+func (c *Credential) GetAllForUser(userID int) ([]*Credential, error) {
+	var all []*Credential
+	collection := dbSession(c.ctx).Collection(c.Table())
+	res := collection.Find(up.Cond{"user_id =": userID}).OrderBy("created_at")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// CountForUser returns the number of credentials a user has registered
+func (c *Credential) CountForUser(userID int) (int, error) {
+	collection := dbSession(c.ctx).Collection(c.Table())
+	count, err := collection.Find(up.Cond{"user_id =": userID}).Count()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// Insert stores a new credential given the item
+func (c *Credential) Insert(item Credential) (int, error) {
+	item.CreatedAt = time.Now()
+	item.UpdatedAt = time.Now()
+	collection := dbSession(c.ctx).Collection(c.Table())
+	res, err := collection.Insert(item)
+	if err != nil {
+		return 0, err
+	}
+	id := getInsertID(res.ID())
+	return id, nil
+}
+
+// MarkUsed stores the new signature counter and the time of the last successful login
+func (c *Credential) MarkUsed(id int, signCount int64) error {
+	item, err := c.Get(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	item.SignCount = signCount
+	item.LastUsedAt = &now
+	item.UpdatedAt = now
+	collection := dbSession(c.ctx).Collection(c.Table())
+	return collection.Find(id).Update(item)
+}
+
+// FlagCloned marks a credential whose signature counter went backwards so it can no longer
+// be used until an admin or the user removes and registers it again
+func (c *Credential) FlagCloned(id int) error {
+	item, err := c.Get(id)
+	if err != nil {
+		return err
+	}
+	item.CloneWarning = 1
+	item.UpdatedAt = time.Now()
+	collection := dbSession(c.ctx).Collection(c.Table())
+	return collection.Find(id).Update(item)
+}
+
+// DeleteForUser deletes a credential given its id and the id of the user who owns it
+func (c *Credential) DeleteForUser(id, userID int) error {
+	collection := dbSession(c.ctx).Collection(c.Table())
+	res := collection.Find(up.Cond{"id =": id, "user_id =": userID})
+	if err := res.Delete(); err != nil {
+		return err
+	}
+	return nil
+}
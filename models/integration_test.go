@@ -7,14 +7,19 @@ package models
 // these integration test start a docker image with postgres, then they add tables and perform
 // CRUD operations on them
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"imperatorapp/auth/password"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/arc41t3ct/imperator"
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -23,12 +28,12 @@ import (
 )
 
 var (
-	host     = "localhost"
-	user     = "imperator"
-	password = "password"
-	dbName   = "imperator_test"
-	port     = "5435"
-	dsn      = "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=UTC connect_timeout=5"
+	host       = "localhost"
+	user       = "imperator"
+	dbPassword = "password"
+	dbName     = "imperator_test"
+	port       = "5435"
+	dsn        = "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=UTC connect_timeout=5"
 )
 
 var dummyUser = User{
@@ -39,6 +44,9 @@ var dummyUser = User{
 	Password:  "password",
 }
 
+// dummyToken keeps the plain text of the token inserted for dummyUser since only its hash is stored
+var dummyToken *Token
+
 var models Models
 var testDB *sql.DB
 var resource *dockertest.Resource
@@ -61,7 +69,7 @@ func TestMain(m *testing.M) {
 		Tag:        "13.4",
 		Env: []string{
 			"POSTGRES_USER=" + user,
-			"POSTGRES_PASSWORD=" + password,
+			"POSTGRES_PASSWORD=" + dbPassword,
 			"POSTGRES_DB=" + dbName,
 		},
 		ExposedPorts: []string{"5432"},
@@ -80,7 +88,7 @@ func TestMain(m *testing.M) {
 
 	if err := pool.Retry(func() error {
 		var err error
-		testDB, err = sql.Open("pgx", fmt.Sprintf(dsn, host, port, user, password, dbName))
+		testDB, err = sql.Open("pgx", fmt.Sprintf(dsn, host, port, user, dbPassword, dbName))
 		if err != nil {
 			return err
 		}
@@ -128,7 +136,10 @@ CREATE TABLE users (
     last_name character varying(255) NOT NULL,
     user_active integer NOT NULL DEFAULT 0,
     email character varying(255) NOT NULL UNIQUE,
-    password character varying(60) NOT NULL,
+    password character varying(255) NOT NULL,
+    totp_secret character varying(255) NOT NULL DEFAULT '',
+    totp_enabled integer NOT NULL DEFAULT 0,
+    email_verified_at timestamp without time zone,
     created_at timestamp without time zone NOT NULL DEFAULT now(),
     updated_at timestamp without time zone NOT NULL DEFAULT now()
 );
@@ -143,7 +154,14 @@ drop table if exists remember_tokens;
 CREATE TABLE remember_tokens (
     id SERIAL PRIMARY KEY,
     user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
-    remember_token character varying(100) NOT NULL,
+    series character varying(64) NOT NULL UNIQUE,
+    token_hash character varying(64) NOT NULL,
+    previous_hash character varying(64) NOT NULL DEFAULT '',
+    rotated_at timestamp without time zone,
+    user_agent character varying(512) NOT NULL DEFAULT '',
+    ip character varying(64) NOT NULL DEFAULT '',
+    last_used_at timestamp without time zone,
+    expires_at timestamp without time zone NOT NULL,
     created_at timestamp without time zone NOT NULL DEFAULT now(),
     updated_at timestamp without time zone NOT NULL DEFAULT now()
 );
@@ -153,6 +171,67 @@ CREATE TRIGGER set_timestamp
     FOR EACH ROW
     EXECUTE PROCEDURE trigger_set_timestamp();
 
+drop table if exists recovery_codes;
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    code_hash character varying(100) NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists credentials;
+
+CREATE TABLE credentials (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    name character varying(255) NOT NULL,
+    credential_id bytea NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    aaguid bytea NOT NULL,
+    transports character varying(255) NOT NULL DEFAULT '',
+    clone_warning integer NOT NULL DEFAULT 0,
+    last_used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists permission_role;
+drop table if exists role_user;
+drop table if exists permissions cascade;
+drop table if exists roles cascade;
+
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name character varying(255) NOT NULL UNIQUE,
+    description character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE permissions (
+    id SERIAL PRIMARY KEY,
+    name character varying(255) NOT NULL UNIQUE,
+    description character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE role_user (
+    role_id integer NOT NULL REFERENCES roles(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (role_id, user_id)
+);
+
+CREATE TABLE permission_role (
+    permission_id integer NOT NULL REFERENCES permissions(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    role_id integer NOT NULL REFERENCES roles(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (permission_id, role_id)
+);
+
 drop table if exists tokens;
 
 CREATE TABLE tokens (
@@ -160,11 +239,14 @@ CREATE TABLE tokens (
     user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
     first_name character varying(255) NOT NULL,
     email character varying(255) NOT NULL,
-    token character varying(255) NOT NULL,
-    token_hash bytea NOT NULL,
+    name character varying(255) NOT NULL DEFAULT '',
+    token_hash bytea NOT NULL UNIQUE,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    last_used_at timestamp without time zone,
+    last_used_ip character varying(64) NOT NULL DEFAULT '',
     created_at timestamp without time zone NOT NULL DEFAULT now(),
     updated_at timestamp without time zone NOT NULL DEFAULT now(),
-    expiry timestamp without time zone NOT NULL
+    expiry timestamp without time zone
 );
 
 CREATE TRIGGER set_timestamp
@@ -172,6 +254,151 @@ CREATE TRIGGER set_timestamp
     FOR EACH ROW
     EXECUTE PROCEDURE trigger_set_timestamp();
 
+drop table if exists user_tokens;
+
+CREATE TABLE user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    purpose character varying(50) NOT NULL,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    expires_at timestamp without time zone NOT NULL,
+    consumed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists password_history;
+
+CREATE TABLE password_history (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    password_hash character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists user_sessions;
+
+CREATE TABLE user_sessions (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    session_key character varying(64) NOT NULL UNIQUE,
+    store_token text NOT NULL DEFAULT '',
+    token_hash character varying(64) NOT NULL DEFAULT '',
+    remember_token_id integer NOT NULL DEFAULT 0,
+    user_agent character varying(512) NOT NULL DEFAULT '',
+    ip character varying(64) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists user_identities;
+
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    provider character varying(64) NOT NULL,
+    subject character varying(255) NOT NULL,
+    email character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_login_at timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (provider, subject)
+);
+
+drop table if exists audit_events;
+
+CREATE TABLE audit_events (
+    id SERIAL PRIMARY KEY,
+    actor_id integer NOT NULL DEFAULT 0,
+    actor_email character varying(255) NOT NULL DEFAULT '',
+    action character varying(100) NOT NULL,
+    target_type character varying(50) NOT NULL DEFAULT '',
+    target_id integer NOT NULL DEFAULT 0,
+    target_label character varying(255) NOT NULL DEFAULT '',
+    ip character varying(64) NOT NULL DEFAULT '',
+    user_agent character varying(512) NOT NULL DEFAULT '',
+    request_id character varying(100) NOT NULL DEFAULT '',
+    changes text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists oauth_consents;
+drop table if exists oauth_refresh_tokens;
+drop table if exists oauth_codes;
+drop table if exists oauth_keys;
+drop table if exists oauth_clients;
+
+CREATE TABLE oauth_clients (
+    id SERIAL PRIMARY KEY,
+    client_id character varying(64) NOT NULL UNIQUE,
+    name character varying(255) NOT NULL,
+    secret_hash character varying(64) NOT NULL DEFAULT '',
+    redirect_uris text NOT NULL DEFAULT '',
+    scopes character varying(512) NOT NULL DEFAULT '',
+    grant_types character varying(255) NOT NULL DEFAULT '',
+    confidential boolean NOT NULL DEFAULT true,
+    trusted boolean NOT NULL DEFAULT false,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE oauth_codes (
+    id SERIAL PRIMARY KEY,
+    code_hash character varying(64) NOT NULL UNIQUE,
+    client_id character varying(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    nonce character varying(255) NOT NULL DEFAULT '',
+    code_challenge character varying(128) NOT NULL,
+    family character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    consumed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE oauth_refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    family character varying(64) NOT NULL,
+    client_id character varying(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    expires_at timestamp without time zone NOT NULL,
+    consumed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE oauth_consents (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    client_id character varying(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    scopes character varying(512) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (user_id, client_id)
+);
+
+CREATE TABLE oauth_keys (
+    id SERIAL PRIMARY KEY,
+    kid character varying(64) NOT NULL UNIQUE,
+    private_key text NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+drop table if exists invitations;
+
+CREATE TABLE invitations (
+    id SERIAL PRIMARY KEY,
+    email character varying(255) NOT NULL,
+    role_id integer NOT NULL DEFAULT 0,
+    invited_by integer NOT NULL DEFAULT 0,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    expires_at timestamp without time zone NOT NULL,
+    accepted_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
 `
 	_, err := db.Exec(stmt)
 	if err != nil {
@@ -335,10 +562,11 @@ func TestToken_Insert(t *testing.T) {
 		t.Error("error generating token:", err)
 	}
 
-	err = models.Tokens.Insert(*token, *u)
+	_, err = models.Tokens.Insert(*token, *u)
 	if err != nil {
 		t.Error("error inserting token:", err)
 	}
+	dummyToken = token
 }
 
 func TestToken_GetUserForToken(t *testing.T) {
@@ -349,14 +577,11 @@ func TestToken_GetUserForToken(t *testing.T) {
 		t.Error("error expected but not received when getting user with bad token")
 	}
 
-	u, err := models.Users.GetByEmail(dummyUser.Email)
-	if err != nil {
-		t.Error("failed to get the user:", err)
-	}
-
-	_, err = models.Tokens.GetUserForToken(u.Token.PlainText)
+	u, err := models.Tokens.GetUserForToken(dummyToken.PlainText)
 	if err != nil {
 		t.Error("failed to get user with valid token:", err)
+	} else if u.Email != dummyUser.Email {
+		t.Error("wrong user returned for token:", u.Email)
 	}
 }
 
@@ -392,9 +617,11 @@ func TestToken_GetByToken(t *testing.T) {
 		t.Error("failed to get the user:", err)
 	}
 
-	_, err = models.Tokens.GetByToken(u.Token.PlainText)
+	tok, err := models.Tokens.GetByToken(dummyToken.PlainText)
 	if err != nil {
 		t.Error("error getting token by token:", err)
+	} else if tok.UserID != u.ID {
+		t.Error("token returned for the wrong user")
 	}
 
 	_, err = models.Tokens.GetByToken("fake")
@@ -421,11 +648,7 @@ func TestToken_AuthenticateToken(t *testing.T) {
 	for _, tt := range authData {
 		token := ""
 		if tt.email == dummyUser.Email {
-			user, err := models.Users.GetByEmail(tt.email)
-			if err != nil {
-				t.Error("failed to get user:", err)
-			}
-			token = user.Token.PlainText
+			token = dummyToken.PlainText
 		} else {
 			token = tt.token
 		}
@@ -446,14 +669,13 @@ func TestToken_AuthenticateToken(t *testing.T) {
 
 func TestToken_Delete(t *testing.T) {
 	fmt.Println("TestToken_Delete...")
-	u, err := models.Users.GetByEmail(dummyUser.Email)
+	err := models.Tokens.DeleteByToken(dummyToken.PlainText)
 	if err != nil {
-		t.Error("error getting the user:", err)
+		t.Error("error deleting token:", err)
 	}
 
-	err = models.Tokens.DeleteByToken(u.Token.PlainText)
-	if err != nil {
-		t.Error("error deleting token:", err)
+	if _, err := models.Tokens.GetByToken(dummyToken.PlainText); err == nil {
+		t.Error("token still found after deleting it")
 	}
 }
 
@@ -470,7 +692,7 @@ func TestToken_ExpiredToken(t *testing.T) {
 		t.Error("error generating token:", err)
 	}
 
-	err = models.Tokens.Insert(*token, *u)
+	_, err = models.Tokens.Insert(*token, *u)
 	if err != nil {
 		t.Error("error inserting token:", err)
 	}
@@ -517,7 +739,7 @@ func TestToken_BadHeader(t *testing.T) {
 		t.Error("failed to generate a token:", err)
 	}
 
-	err = models.Tokens.Insert(*token, newUser)
+	_, err = models.Tokens.Insert(*token, newUser)
 	if err != nil {
 		t.Error("failed to insert token for user:", err)
 	}
@@ -553,7 +775,7 @@ func TestToken_ValidToken(t *testing.T) {
 		t.Error("failed to generate token:", err)
 	}
 
-	err = models.Tokens.Insert(*newToken, *u)
+	_, err = models.Tokens.Insert(*newToken, *u)
 	if err != nil {
 		t.Error("failed to insert token:", err)
 	}
@@ -581,7 +803,7 @@ func TestToken_ValidToken(t *testing.T) {
 		t.Error("failed to delete token:", err)
 	}
 
-	ok, err = models.Tokens.ValidToken(u.Token.PlainText)
+	ok, err = models.Tokens.ValidToken(newToken.PlainText)
 	if err == nil {
 		t.Error("token is not valid:", err)
 	}
@@ -589,3 +811,818 @@ func TestToken_ValidToken(t *testing.T) {
 		t.Error("no error reported when validation non-existing token")
 	}
 }
+
+func TestToken_MultipleScopedTokens(t *testing.T) {
+	fmt.Println("TestToken_MultipleScopedTokens...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	var plain []string
+	for _, scopes := range []string{ScopeUsersRead, ScopeUsersRead + " " + ScopeUsersWrite} {
+		token, err := models.Tokens.GenerateToken(u.ID, 0)
+		if err != nil {
+			t.Error("failed to generate token:", err)
+		}
+		token.Name = "token " + scopes
+		token.Scopes = scopes
+		if _, err := models.Tokens.Insert(*token, *u); err != nil {
+			t.Error("failed to insert token:", err)
+		}
+		plain = append(plain, token.PlainText)
+	}
+
+	tokens, err := models.Tokens.GetTokensForUser(u.ID)
+	if err != nil {
+		t.Error("failed to get tokens:", err)
+	}
+	if len(tokens) < 2 {
+		t.Error("inserting a token removed the other tokens of the user")
+	}
+	for _, tok := range tokens {
+		if tok.PlainText != "" {
+			t.Error("plain text token loaded from the database")
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.10:4711"
+	req.Header.Add("Authorization", "Bearer "+plain[0])
+	user, err := models.Tokens.AuthenticationToken(req)
+	if err != nil {
+		t.Fatal("failed to authenticate token without expiry:", err)
+	}
+	if !user.Token.HasScope(ScopeUsersRead) || user.Token.HasScope(ScopeUsersWrite) {
+		t.Error("wrong scopes for token:", user.Token.Scopes)
+	}
+	tok, _ := models.Tokens.Get(user.Token.ID)
+	if tok.LastUsedAt == nil || tok.LastUsedIP != "192.0.2.10" {
+		t.Error("token use was not recorded")
+	}
+
+	if err := models.Tokens.DeleteForUser(tok.ID, u.ID+1); err != nil {
+		t.Error("failed to delete token:", err)
+	}
+	if _, err := models.Tokens.Get(tok.ID); err != nil {
+		t.Error("token deleted for the wrong user")
+	}
+	if err := models.Tokens.DeleteForUser(tok.ID, u.ID); err != nil {
+		t.Error("failed to delete token:", err)
+	}
+	if ok, _ := models.Tokens.ValidToken(plain[0]); ok {
+		t.Error("revoked token is still valid")
+	}
+	if ok, _ := models.Tokens.ValidToken(plain[1]); !ok {
+		t.Error("revoking a token revoked the other tokens of the user")
+	}
+}
+
+func TestRecoveryCode_GenerateAndUse(t *testing.T) {
+	fmt.Println("TestRecoveryCode_GenerateAndUse...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	codes, err := models.RecoveryCodes.Generate(u.ID)
+	if err != nil {
+		t.Error("failed to generate recovery codes:", err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Errorf("expected %d recovery codes and got %d", RecoveryCodeCount, len(codes))
+	}
+
+	ok, err := models.RecoveryCodes.Use(u.ID, codes[0])
+	if err != nil {
+		t.Error("error using recovery code:", err)
+	}
+	if !ok {
+		t.Error("valid recovery code reported as invalid")
+	}
+
+	ok, _ = models.RecoveryCodes.Use(u.ID, codes[0])
+	if ok {
+		t.Error("recovery code could be used twice")
+	}
+
+	remaining, err := models.RecoveryCodes.Remaining(u.ID)
+	if err != nil {
+		t.Error("error counting remaining recovery codes:", err)
+	}
+	if remaining != RecoveryCodeCount-1 {
+		t.Errorf("expected %d remaining recovery codes and got %d", RecoveryCodeCount-1, remaining)
+	}
+}
+
+func TestUser_TwoFactor(t *testing.T) {
+	fmt.Println("TestUser_TwoFactor...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	err = models.Users.EnableTwoFactor(u.ID, "encrypted-secret")
+	if err != nil {
+		t.Error("failed to enable two factor:", err)
+	}
+	u, _ = models.Users.Get(u.ID)
+	if !u.HasTwoFactor() {
+		t.Error("two factor not enabled after enabling it")
+	}
+
+	err = models.Users.DisableTwoFactor(u.ID)
+	if err != nil {
+		t.Error("failed to disable two factor:", err)
+	}
+	u, _ = models.Users.Get(u.ID)
+	if u.HasTwoFactor() {
+		t.Error("two factor still enabled after disabling it")
+	}
+}
+
+func TestUser_UseTOTPCounter(t *testing.T) {
+	fmt.Println("TestUser_UseTOTPCounter...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	if err := models.Users.UseTOTPCounter(u.ID, 100); err != nil {
+		t.Error("failed to use a totp counter:", err)
+	}
+	if err := models.Users.UseTOTPCounter(u.ID, 100); !errors.Is(err, ErrTOTPCodeUsed) {
+		t.Error("the same totp counter could be used twice:", err)
+	}
+	if err := models.Users.UseTOTPCounter(u.ID, 99); !errors.Is(err, ErrTOTPCodeUsed) {
+		t.Error("an older totp counter could be used:", err)
+	}
+	// saving the whole user must not reset the counter
+	if err := u.Update(*u); err != nil {
+		t.Error("failed to update the user:", err)
+	}
+	if err := models.Users.UseTOTPCounter(u.ID, 100); !errors.Is(err, ErrTOTPCodeUsed) {
+		t.Error("updating the user reset the totp counter:", err)
+	}
+	if err := models.Users.UseTOTPCounter(u.ID, 101); err != nil {
+		t.Error("failed to use a later totp counter:", err)
+	}
+}
+
+func TestCredential_InsertAndUse(t *testing.T) {
+	fmt.Println("TestCredential_InsertAndUse...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	id, err := models.Credentials.Insert(Credential{
+		UserID:       u.ID,
+		Name:         "security key",
+		CredentialID: []byte{1, 2, 3, 4},
+		PublicKey:    []byte{5, 6, 7, 8},
+		AAGUID:       make([]byte, 16),
+	})
+	if err != nil {
+		t.Error("failed to insert credential:", err)
+	}
+
+	c, err := models.Credentials.GetByCredentialID([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Error("failed to get credential by credential id:", err)
+	}
+	if c.ID != id {
+		t.Error("wrong credential returned")
+	}
+
+	if err := models.Credentials.MarkUsed(id, 5); err != nil {
+		t.Error("failed to mark credential used:", err)
+	}
+	c, _ = models.Credentials.Get(id)
+	if c.SignCount != 5 || c.LastUsedAt == nil {
+		t.Error("sign count or last used not stored")
+	}
+
+	if err := models.Credentials.DeleteForUser(id, u.ID+1); err != nil {
+		t.Error("error deleting credential of other user:", err)
+	}
+	if n, _ := models.Credentials.CountForUser(u.ID); n != 1 {
+		t.Error("credential of a user deleted through another user")
+	}
+	if err := models.Credentials.DeleteForUser(id, u.ID); err != nil {
+		t.Error("failed to delete credential:", err)
+	}
+}
+
+func TestRole_Permissions(t *testing.T) {
+	fmt.Println("TestRole_Permissions...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	roleID, err := models.Roles.Insert(Role{Name: "editor"})
+	if err != nil {
+		t.Error("failed to insert role:", err)
+	}
+	permissionID, err := models.Permissions.Insert(Permission{Name: "users.edit"})
+	if err != nil {
+		t.Error("failed to insert permission:", err)
+	}
+	if err := models.Roles.GrantPermission(roleID, permissionID); err != nil {
+		t.Error("failed to grant permission:", err)
+	}
+
+	ok, err := models.Users.HasPermission(u.ID, "users.edit")
+	if err != nil {
+		t.Error("error checking permission:", err)
+	}
+	if ok {
+		t.Error("user has permission without a role")
+	}
+
+	if err := models.Roles.AssignToUser(roleID, u.ID); err != nil {
+		t.Error("failed to assign role:", err)
+	}
+	// assigning twice must not fail on the primary key
+	if err := models.Roles.AssignToUser(roleID, u.ID); err != nil {
+		t.Error("failed to assign role a second time:", err)
+	}
+
+	ok, _ = models.Users.HasPermission(u.ID, "users.edit")
+	if !ok {
+		t.Error("user is missing permission granted through role")
+	}
+	ok, _ = models.Users.HasPermission(u.ID, "users.delete")
+	if ok {
+		t.Error("user has permission that was never granted")
+	}
+
+	superID, err := models.Roles.Insert(Role{Name: SuperAdminRole})
+	if err != nil {
+		t.Error("failed to insert super admin role:", err)
+	}
+	if err := models.Roles.SetForUser(u.ID, []int{superID}); err != nil {
+		t.Error("failed to set roles:", err)
+	}
+	ok, _ = models.Users.HasPermission(u.ID, "users.delete")
+	if !ok {
+		t.Error("super admin is missing a permission")
+	}
+}
+
+func TestUser_SearchAndSetActive(t *testing.T) {
+	fmt.Println("TestUser_SearchAndSetActive...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Error("failed to get the user:", err)
+	}
+
+	users, total, err := models.Users.Search(strings.ToUpper(dummyUser.LastName), "email", true, 1, 20)
+	if err != nil {
+		t.Error("failed to search users:", err)
+	}
+	if total != 1 || len(users) != 1 || users[0].ID != u.ID {
+		t.Error("search did not find the user by last name")
+	}
+	_, total, _ = models.Users.Search("no such user", "", false, 1, 20)
+	if total != 0 {
+		t.Error("search found users that do not match")
+	}
+
+	if err := models.Users.SetActive(u.ID, false); err != nil {
+		t.Error("failed to deactivate user:", err)
+	}
+	u, _ = models.Users.Get(u.ID)
+	if u.Active != 0 {
+		t.Error("user still active after deactivating")
+	}
+	if err := models.Users.SetActive(u.ID, true); err != nil {
+		t.Error("failed to activate user:", err)
+	}
+
+	validator := &imperator.Validation{Errors: make(map[string]string)}
+	models.Users.ValidateUniqueEmail(validator, 0, dummyUser.Email)
+	if validator.Valid() {
+		t.Error("duplicate email passed validation")
+	}
+	validator = &imperator.Validation{Errors: make(map[string]string)}
+	models.Users.ValidateUniqueEmail(validator, u.ID, dummyUser.Email)
+	if !validator.Valid() {
+		t.Error("own email failed unique validation")
+	}
+}
+
+func TestUser_VerifyEmail(t *testing.T) {
+	fmt.Println("TestUser_VerifyEmail...")
+	id, err := models.Users.Insert(User{
+		FirstName: "Self",
+		LastName:  "Registered",
+		Email:     "self@registered.com",
+		Password:  "password",
+	})
+	if err != nil {
+		t.Fatal("failed to insert user:", err)
+	}
+	defer func() { _ = models.Users.Delete(id) }()
+
+	u, _ := models.Users.Get(id)
+	if u.IsVerified() || u.Active != 0 {
+		t.Error("new user should be unverified and inactive")
+	}
+	if err := models.Users.VerifyEmail(id); err != nil {
+		t.Error("failed to verify email:", err)
+	}
+	u, _ = models.Users.Get(id)
+	if !u.IsVerified() || u.Active != 1 {
+		t.Error("verified user should be active")
+	}
+}
+
+func TestAuditEvent_SearchAndPrune(t *testing.T) {
+	fmt.Println("TestAuditEvent_SearchAndPrune...")
+	events := []AuditEvent{
+		{ActorID: 1, ActorEmail: "admin@example.com", Action: AuditUserUpdated, TargetType: "user", TargetID: 2, TargetLabel: "bob@example.com", Changes: `{"first_name":{"from":"Bob","to":"Rob"}}`},
+		{Action: AuditLoginFailed, TargetType: "user", TargetLabel: "nobody@example.com", IP: "10.0.0.1"},
+	}
+	for _, e := range events {
+		if _, err := models.AuditEvents.Insert(e); err != nil {
+			t.Fatal("failed to insert audit event:", err)
+		}
+	}
+
+	found, total, err := models.AuditEvents.Search(AuditFilter{Actor: "ADMIN@"}, 1, 10)
+	if err != nil {
+		t.Error("failed to search audit events:", err)
+	}
+	if total != 1 || len(found) != 1 || found[0].Action != AuditUserUpdated {
+		t.Error("search by actor did not find the event")
+	}
+	_, total, _ = models.AuditEvents.Search(AuditFilter{Action: AuditLoginFailed, Target: "nobody"}, 1, 10)
+	if total != 1 {
+		t.Error("search by action and target did not find the event")
+	}
+	_, total, _ = models.AuditEvents.Search(AuditFilter{From: time.Now().Add(time.Hour)}, 1, 10)
+	if total != 0 {
+		t.Error("search found events after the from date")
+	}
+
+	count := 0
+	err = models.AuditEvents.Each(AuditFilter{}, func(*AuditEvent) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Error("expected to iterate over 2 events, got", count, err)
+	}
+
+	removed, err := models.AuditEvents.DeleteOlderThan(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Error("failed to prune audit events:", err)
+	}
+	if removed != 2 {
+		t.Error("expected 2 pruned events, got", removed)
+	}
+}
+
+func TestUserToken_SingleUse(t *testing.T) {
+	fmt.Println("TestUserToken_SingleUse...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("failed to get the user:", err)
+	}
+
+	plain, err := models.UserTokens.Issue(u.ID, PurposePasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal("failed to issue token:", err)
+	}
+	if _, err := models.UserTokens.Peek(plain, PurposePasswordReset); err != nil {
+		t.Error("fresh token is not valid:", err)
+	}
+	if _, err := models.UserTokens.Peek(plain, "other"); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Error("token is valid for another purpose")
+	}
+	token, err := models.UserTokens.Consume(plain, PurposePasswordReset)
+	if err != nil || token.UserID != u.ID {
+		t.Error("failed to consume token:", err)
+	}
+	if _, err := models.UserTokens.Consume(plain, PurposePasswordReset); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Error("token could be consumed twice")
+	}
+
+	expired, _ := models.UserTokens.Issue(u.ID, PurposePasswordReset, -time.Minute)
+	if _, err := models.UserTokens.Peek(expired, PurposePasswordReset); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Error("expired token is valid")
+	}
+
+	first, _ := models.UserTokens.Issue(u.ID, PurposePasswordReset, time.Hour)
+	second, _ := models.UserTokens.Issue(u.ID, PurposePasswordReset, time.Hour)
+	if _, err := models.UserTokens.Peek(first, PurposePasswordReset); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Error("older token still valid after issuing a new one")
+	}
+	if err := models.Users.ResetPassword(u.ID, "password"); err != nil {
+		t.Error("failed to reset password:", err)
+	}
+	if _, err := models.UserTokens.Peek(second, PurposePasswordReset); !errors.Is(err, ErrUserTokenInvalid) {
+		t.Error("token still valid after the password changed")
+	}
+
+	if err := models.UserTokens.DeleteExpired(); err != nil {
+		t.Error("failed to delete expired tokens:", err)
+	}
+}
+
+func TestUserSession_IndexAndRevoke(t *testing.T) {
+	fmt.Println("TestUserSession_IndexAndRevoke...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("failed to get the user:", err)
+	}
+
+	rt, _, err := models.RememberToken.Issue(u.ID, "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", "192.0.2.1", time.Hour)
+	if err != nil {
+		t.Fatal("failed to issue remember token:", err)
+	}
+	rememberID := rt.ID
+	if found, err := models.RememberToken.GetBySeries(rt.Series); err != nil || found.ID != rememberID {
+		t.Error("failed to get remember token by series:", err)
+	}
+	if err := models.RememberToken.MarkUsed(rememberID, "192.0.2.2"); err != nil {
+		t.Error("failed to mark remember token used:", err)
+	}
+	devices, err := models.RememberToken.GetForUser(u.ID)
+	if err != nil || len(devices) != 1 || devices[0].LastUsedAt == nil || devices[0].IP != "192.0.2.2" {
+		t.Error("expected one used remember me device, got", devices, err)
+	}
+
+	first, err := models.UserSessions.Insert(UserSession{UserID: u.ID, SessionKey: "first", RememberTokenID: rememberID})
+	if err != nil {
+		t.Fatal("failed to insert session:", err)
+	}
+	second, _ := models.UserSessions.Insert(UserSession{UserID: u.ID, SessionKey: "second"})
+	if err := models.UserSessions.Touch(second, "store", "hash", "192.0.2.3"); err != nil {
+		t.Error("failed to touch session:", err)
+	}
+	if s, err := models.UserSessions.GetByKey("second"); err != nil || s.TokenHash != "hash" || s.IP != "192.0.2.3" {
+		t.Error("touch was not stored:", s, err)
+	}
+	all, err := models.UserSessions.GetForUser(u.ID)
+	if err != nil || len(all) != 2 || all[0].ID != second {
+		t.Error("expected 2 sessions with the last touched first, got", all, err)
+	}
+
+	if err := models.RememberToken.DeleteAllForUser(u.ID, rememberID); err != nil {
+		t.Error("failed to delete remember tokens:", err)
+	}
+	if devices, _ := models.RememberToken.GetForUser(u.ID); len(devices) != 1 {
+		t.Error("kept remember token was deleted")
+	}
+	if err := models.RememberToken.DeleteForUser(rememberID, u.ID+1); err != nil {
+		t.Error("failed to delete remember token:", err)
+	}
+	if devices, _ := models.RememberToken.GetForUser(u.ID); len(devices) != 1 {
+		t.Error("remember token deleted for another user")
+	}
+	if err := models.RememberToken.DeleteAllForUser(u.ID, 0); err != nil {
+		t.Error("failed to delete remember tokens:", err)
+	}
+
+	if n, err := models.UserSessions.CountActive(time.Now().Add(-time.Minute)); err != nil || n < 2 {
+		t.Error("expected both sessions to be active, got", n, err)
+	}
+	if n, _ := models.UserSessions.CountActive(time.Now().Add(time.Minute)); n != 0 {
+		t.Error("expected no sessions seen in the future, got", n)
+	}
+
+	if err := models.UserSessions.Delete(first); err != nil {
+		t.Error("failed to delete session:", err)
+	}
+	if err := models.UserSessions.DeleteStale(time.Now().Add(time.Minute)); err != nil {
+		t.Error("failed to delete stale sessions:", err)
+	}
+	if all, _ := models.UserSessions.GetForUser(u.ID); len(all) != 0 {
+		t.Error("expected no sessions left, got", len(all))
+	}
+}
+
+func TestRememberToken_Rotate(t *testing.T) {
+	fmt.Println("TestRememberToken_Rotate...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("failed to get the user:", err)
+	}
+
+	rt, first, err := models.RememberToken.Issue(u.ID, "", "192.0.2.1", time.Hour)
+	if err != nil {
+		t.Fatal("failed to issue remember token:", err)
+	}
+	if rt.TokenHash == first {
+		t.Error("secret is stored in plain text")
+	}
+	if _, _, err := models.RememberToken.Rotate(rt.Series, "wrong", "192.0.2.1"); !errors.Is(err, ErrRememberTokenReused) {
+		t.Error("expected a wrong secret to be treated as reuse, got", err)
+	}
+	if _, _, err := models.RememberToken.Rotate(rt.Series, first, "192.0.2.1"); !errors.Is(err, ErrRememberTokenInvalid) {
+		t.Error("series still valid after reuse, got", err)
+	}
+
+	rt, first, _ = models.RememberToken.Issue(u.ID, "", "192.0.2.1", time.Hour)
+	_, second, err := models.RememberToken.Rotate(rt.Series, first, "192.0.2.2")
+	if err != nil || second == "" || second == first {
+		t.Fatal("failed to rotate the secret:", err)
+	}
+	// a parallel request with the replaced secret is accepted without another rotation
+	if _, next, err := models.RememberToken.Rotate(rt.Series, first, "192.0.2.2"); err != nil || next != "" {
+		t.Error("replaced secret not accepted during the grace period:", next, err)
+	}
+	_, third, err := models.RememberToken.Rotate(rt.Series, second, "192.0.2.2")
+	if err != nil || third == "" {
+		t.Fatal("failed to rotate the secret again:", err)
+	}
+	// the first secret is two rotations old now
+	reused, _, err := models.RememberToken.Rotate(rt.Series, first, "192.0.2.3")
+	if !errors.Is(err, ErrRememberTokenReused) || reused == nil || reused.ID != rt.ID {
+		t.Error("expected reuse of an old secret to be detected, got", err)
+	}
+	if _, _, err := models.RememberToken.Rotate(rt.Series, third, "192.0.2.2"); !errors.Is(err, ErrRememberTokenInvalid) {
+		t.Error("series still valid after theft was detected, got", err)
+	}
+
+	expired, secret, _ := models.RememberToken.Issue(u.ID, "", "192.0.2.1", -time.Minute)
+	if _, _, err := models.RememberToken.Rotate(expired.Series, secret, "192.0.2.1"); !errors.Is(err, ErrRememberTokenInvalid) {
+		t.Error("expired series is valid, got", err)
+	}
+	if err := models.RememberToken.DeleteExpired(); err != nil {
+		t.Error("failed to delete expired remember tokens:", err)
+	}
+	if err := models.RememberToken.DeleteAllForUser(u.ID, 0); err != nil {
+		t.Error("failed to delete remember tokens:", err)
+	}
+}
+
+func TestUserIdentity_Link(t *testing.T) {
+	fmt.Println("TestUserIdentity_Link...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("failed to get the user:", err)
+	}
+
+	id, err := models.Identities.Insert(UserIdentity{UserID: u.ID, Provider: "corp", Subject: "abc", Email: u.Email})
+	if err != nil {
+		t.Fatal("failed to link identity:", err)
+	}
+	if _, err := models.Identities.Insert(UserIdentity{UserID: u.ID, Provider: "corp", Subject: "abc"}); err == nil {
+		t.Error("the same identity could be linked twice")
+	}
+	identity, err := models.Identities.GetBySubject("corp", "abc")
+	if err != nil || identity.ID != id || identity.UserID != u.ID {
+		t.Error("failed to get identity by subject:", err)
+	}
+	if _, err := models.Identities.GetBySubject("other", "abc"); err == nil {
+		t.Error("identity found for another provider")
+	}
+	if err := models.Identities.Touch(id, "new@example.com"); err != nil {
+		t.Error("failed to touch identity:", err)
+	}
+	all, err := models.Identities.GetForUser(u.ID)
+	if err != nil || len(all) != 1 || all[0].Email != "new@example.com" {
+		t.Error("expected one identity with the new email, got", all, err)
+	}
+}
+
+func TestOAuthCode_SingleUse(t *testing.T) {
+	fmt.Println("TestOAuthCode_SingleUse...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("failed to get the user:", err)
+	}
+	_, _, err = models.OAuthClients.Insert(OAuthClient{Name: "App", RedirectURIs: "https://app.example.com/cb", Scopes: "openid", GrantTypes: "authorization_code", Confidential: true})
+	if err != nil {
+		t.Fatal("failed to insert client:", err)
+	}
+	clients, err := models.OAuthClients.GetAll()
+	if err != nil || len(clients) == 0 {
+		t.Fatal("failed to get clients:", err)
+	}
+	client := clients[0]
+
+	plain, err := models.OAuthCodes.Issue(OAuthCode{ClientID: client.ClientID, UserID: u.ID, RedirectURI: "https://app.example.com/cb", Scopes: "openid", CodeChallenge: "challenge"}, time.Minute)
+	if err != nil {
+		t.Fatal("failed to issue code:", err)
+	}
+	// another client can not use up the code of the client
+	if _, err := models.OAuthCodes.Consume(plain, "other"); !errors.Is(err, ErrOAuthCodeInvalid) {
+		t.Error("expected the code of another client to be invalid, got", err)
+	}
+	code, err := models.OAuthCodes.Consume(plain, client.ClientID)
+	if err != nil || code.UserID != u.ID || code.Family == "" {
+		t.Fatal("failed to consume code:", err)
+	}
+	reused, err := models.OAuthCodes.Consume(plain, client.ClientID)
+	if !errors.Is(err, ErrOAuthCodeReused) || reused == nil || reused.Family != code.Family {
+		t.Error("expected reuse of the code to be detected, got", err)
+	}
+	if _, err := models.OAuthCodes.Consume("unknown", client.ClientID); !errors.Is(err, ErrOAuthCodeInvalid) {
+		t.Error("expected an unknown code to be invalid, got", err)
+	}
+
+	expired, _ := models.OAuthCodes.Issue(OAuthCode{ClientID: client.ClientID, UserID: u.ID, RedirectURI: "https://app.example.com/cb", CodeChallenge: "challenge"}, -time.Minute)
+	if _, err := models.OAuthCodes.Consume(expired, client.ClientID); !errors.Is(err, ErrOAuthCodeInvalid) {
+		t.Error("expected an expired code to be invalid, got", err)
+	}
+	if err := models.OAuthCodes.DeleteExpired(); err != nil {
+		t.Error("failed to delete expired codes:", err)
+	}
+}
+
+func TestOAuthRefreshToken_Rotate(t *testing.T) {
+	fmt.Println("TestOAuthRefreshToken_Rotate...")
+	u, err := models.Users.GetByEmail(dummyUser.Email)
+	if err != nil {
+		t.Fatal("failed to get the user:", err)
+	}
+	clients, err := models.OAuthClients.GetAll()
+	if err != nil || len(clients) == 0 {
+		t.Fatal("failed to get clients:", err)
+	}
+	client := clients[0]
+
+	first, err := models.OAuthRefreshTokens.Issue(OAuthRefreshToken{Family: "family", ClientID: client.ClientID, UserID: u.ID, Scopes: "openid"}, time.Hour)
+	if err != nil {
+		t.Fatal("failed to issue refresh token:", err)
+	}
+	if _, err := models.OAuthRefreshTokens.Use(first, "other"); !errors.Is(err, ErrOAuthRefreshInvalid) {
+		t.Error("expected the token to be invalid for another client, got", err)
+	}
+	token, err := models.OAuthRefreshTokens.Use(first, client.ClientID)
+	if err != nil || token.Family != "family" {
+		t.Fatal("failed to use refresh token:", err)
+	}
+	second, err := models.OAuthRefreshTokens.Issue(OAuthRefreshToken{Family: token.Family, ClientID: client.ClientID, UserID: u.ID, Scopes: "openid"}, time.Hour)
+	if err != nil {
+		t.Fatal("failed to rotate refresh token:", err)
+	}
+	if _, err := models.OAuthRefreshTokens.Use(first, client.ClientID); !errors.Is(err, ErrOAuthRefreshReused) {
+		t.Error("expected reuse of the token to be detected, got", err)
+	}
+	if _, err := models.OAuthRefreshTokens.Use(second, client.ClientID); !errors.Is(err, ErrOAuthRefreshInvalid) {
+		t.Error("family still valid after reuse, got", err)
+	}
+
+	if err := models.OAuthConsents.Grant(u.ID, client.ClientID, []string{"openid"}); err != nil {
+		t.Fatal("failed to grant consent:", err)
+	}
+	if err := models.OAuthConsents.Grant(u.ID, client.ClientID, []string{"email"}); err != nil {
+		t.Fatal("failed to extend consent:", err)
+	}
+	consent, err := models.OAuthConsents.Get(u.ID, client.ClientID)
+	if err != nil || !consent.Covers([]string{"openid", "email"}) {
+		t.Error("expected the consent to cover both scopes:", err)
+	}
+}
+
+func TestPasswordHistory_Recent(t *testing.T) {
+	fmt.Println("TestPasswordHistory_Recent...")
+	id, err := models.Users.Insert(User{FirstName: "History", LastName: "User", Email: "history@example.com", Password: "first-password"})
+	if err != nil {
+		t.Fatal("failed to insert user:", err)
+	}
+	if err := models.Users.ResetPassword(id, "second-password"); err != nil {
+		t.Fatal("failed to reset password:", err)
+	}
+	hashes, err := models.PasswordHistory.Recent(id, 5)
+	if err != nil || len(hashes) != 2 {
+		t.Fatal("expected 2 hashes in the history:", len(hashes), err)
+	}
+	if matches, _ := password.Verify(hashes[0], "second-password"); !matches {
+		t.Error("expected the newest password first")
+	}
+
+	for i := 0; i < passwordHistoryLimit+3; i++ {
+		if err := models.PasswordHistory.Add(id, fmt.Sprintf("hash-%d", i)); err != nil {
+			t.Fatal("failed to add to the history:", err)
+		}
+	}
+	hashes, _ = models.PasswordHistory.Recent(id, 100)
+	if len(hashes) != passwordHistoryLimit || hashes[0] != fmt.Sprintf("hash-%d", passwordHistoryLimit+2) {
+		t.Errorf("expected the history to keep the newest %d hashes, got %d", passwordHistoryLimit, len(hashes))
+	}
+}
+
+func TestUser_PasswordMatchesRehash(t *testing.T) {
+	fmt.Println("TestUser_PasswordMatchesRehash...")
+	defer SetPasswordHasher(password.DefaultBcrypt)
+	SetPasswordHasher(password.Bcrypt{Cost: 4})
+	id, err := models.Users.Insert(User{FirstName: "Rehash", LastName: "User", Email: "rehash@example.com", Password: "rehash-password"})
+	if err != nil {
+		t.Fatal("failed to insert user:", err)
+	}
+
+	argon := password.Argon2id{Memory: 64, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+	SetPasswordHasher(argon)
+	u, _ := models.Users.Get(id)
+	if matches, _ := u.PasswordMatches("wrong-password"); matches || !strings.HasPrefix(u.Password, "$2a$") {
+		t.Error("a failed match must not rehash")
+	}
+	if matches, err := u.PasswordMatches("rehash-password"); !matches || err != nil {
+		t.Fatal("expected the bcrypt hash to match:", err)
+	}
+	u, _ = models.Users.Get(id)
+	if !strings.HasPrefix(u.Password, "$argon2id$") {
+		t.Errorf("expected the hash to be replaced with argon2id, got %s", u.Password)
+	}
+	if matches, _ := u.PasswordMatches("rehash-password"); !matches {
+		t.Error("expected the new hash to match")
+	}
+	if hashes, _ := models.PasswordHistory.Recent(id, 5); len(hashes) != 1 {
+		t.Errorf("a rehash is not a new password, expected 1 hash in the history, got %d", len(hashes))
+	}
+}
+
+func TestInvitation_Lifecycle(t *testing.T) {
+	fmt.Println("TestInvitation_Lifecycle...")
+	invitation, plain, err := models.Invitations.Create("invitee@example.com", 0, 1, time.Hour)
+	if err != nil {
+		t.Fatal("failed to create invitation:", err)
+	}
+	validator := &imperator.Validation{Errors: make(map[string]string)}
+	models.Invitations.ValidateUniqueEmail(validator, "invitee@example.com")
+	if validator.Valid() {
+		t.Error("expected an open invitation to block a second one")
+	}
+	if _, err := models.Invitations.Peek(invitation.ID, plain); err != nil {
+		t.Error("fresh invitation is not valid:", err)
+	}
+	if _, err := models.Invitations.Peek(invitation.ID+1, plain); !errors.Is(err, ErrInvitationInvalid) {
+		t.Error("token is valid for another invitation")
+	}
+
+	renewed, err := models.Invitations.Renew(invitation.ID, time.Hour)
+	if err != nil {
+		t.Fatal("failed to renew invitation:", err)
+	}
+	if _, err := models.Invitations.Peek(invitation.ID, plain); !errors.Is(err, ErrInvitationInvalid) {
+		t.Error("the link sent before the resend still works")
+	}
+	if _, err := models.Invitations.Accept(invitation.ID, renewed); err != nil {
+		t.Fatal("failed to accept invitation:", err)
+	}
+	if _, err := models.Invitations.Accept(invitation.ID, renewed); !errors.Is(err, ErrInvitationInvalid) {
+		t.Error("invitation could be accepted twice")
+	}
+	if err := models.Invitations.Revoke(invitation.ID); !errors.Is(err, ErrInvitationInvalid) {
+		t.Error("an accepted invitation could be revoked")
+	}
+
+	revoked, plain, _ := models.Invitations.Create("revoked@example.com", 0, 1, time.Hour)
+	if err := models.Invitations.Revoke(revoked.ID); err != nil {
+		t.Fatal("failed to revoke invitation:", err)
+	}
+	if _, err := models.Invitations.Accept(revoked.ID, plain); !errors.Is(err, ErrInvitationInvalid) {
+		t.Error("a revoked invitation could be accepted")
+	}
+
+	expired, plain, _ := models.Invitations.Create("expired@example.com", 0, 1, -time.Minute)
+	if _, err := models.Invitations.Peek(expired.ID, plain); !errors.Is(err, ErrInvitationInvalid) {
+		t.Error("an expired invitation is valid")
+	}
+	pending, err := models.Invitations.Pending()
+	if err != nil || len(pending) != 1 || pending[0].ID != expired.ID || !pending[0].IsExpired() {
+		t.Error("expected only the expired invitation to be pending:", err)
+	}
+}
+
+func TestModels_Tx(t *testing.T) {
+	fmt.Println("TestModels_Tx...")
+	failed := errors.New("failed")
+	err := models.Tx(context.Background(), func(tx *Models) error {
+		if _, err := tx.Users.Insert(User{FirstName: "Roll", LastName: "Back", Email: "rollback@example.com", Active: 1, Password: "password"}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Error("expected the error of the function, got", err)
+	}
+	if _, err := models.Users.GetByEmail("rollback@example.com"); err == nil {
+		t.Error("the insert was not rolled back")
+	}
+
+	// the password history is written in the transaction too, outside of it the insert would
+	// wait for the uncommitted user forever
+	var id int
+	err = models.Tx(context.Background(), func(tx *Models) error {
+		var err error
+		id, err = tx.Users.Insert(User{FirstName: "Com", LastName: "Mit", Email: "commit@example.com", Active: 1, Password: "password"})
+		return err
+	})
+	if err != nil {
+		t.Fatal("failed to commit:", err)
+	}
+	if _, err := models.Users.GetByEmail("commit@example.com"); err != nil {
+		t.Error("the insert was not committed:", err)
+	}
+	if hashes, err := models.PasswordHistory.Recent(id, 1); err != nil || len(hashes) != 1 {
+		t.Error("the password history was not committed:", hashes, err)
+	}
+}
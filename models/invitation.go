@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/arc41t3ct/imperator"
+	up "github.com/upper/db/v4"
+)
+
+// ErrInvitationInvalid is returned for invitations that do not exist, have expired, were revoked
+// or were accepted already
+var ErrInvitationInvalid = errors.New("invitation is invalid or expired")
+
+// Invitation lets someone create their own account with the role an admin picked for them. The
+// link in the invitation carries a token of which only the sha256 hash is stored, resending the
+// invitation replaces the token so earlier links stop working.
+type Invitation struct {
+	ID         int        `db:"id,omitempty"`
+	Email      string     `db:"email"`
+	RoleID     int        `db:"role_id"`
+	InvitedBy  int        `db:"invited_by"`
+	TokenHash  string     `db:"token_hash"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	AcceptedAt *time.Time `db:"accepted_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+	UpdatedAt  time.Time  `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the Invitation
+func (i *Invitation) Table() string {
+	return "invitations"
+}
+
+// IsExpired reports if the invitation can no longer be accepted without being resent
+func (i *Invitation) IsExpired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+// Create stores an invitation for the email that is valid for ttl and returns it with the plain
+// text token, roleID is 0 for an invitation without a role
+func (i *Invitation) Create(email string, roleID, invitedBy int, ttl time.Duration) (*Invitation, string, error) {
+	plain, err := newInvitationToken()
+	if err != nil {
+		return nil, "", err
+	}
+	invitation := Invitation{
+		Email:     email,
+		RoleID:    roleID,
+		InvitedBy: invitedBy,
+		TokenHash: hashUserToken(plain),
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	collection := dbSession(i.ctx).Collection(i.Table())
+	res, err := collection.Insert(invitation)
+	if err != nil {
+		return nil, "", err
+	}
+	invitation.ID = getInsertID(res.ID())
+	return &invitation, plain, nil
+}
+
+// Get gets an invitation from the database by passing the id
+func (i *Invitation) Get(id int) (*Invitation, error) {
+	var invitation Invitation
+	collection := dbSession(i.ctx).Collection(i.Table())
+	if err := collection.Find(up.Cond{"id =": id}).One(&invitation); err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// Pending returns the invitations that were neither accepted nor revoked newest first, expired
+// ones included so they can be resent
+func (i *Invitation) Pending() ([]*Invitation, error) {
+	var all []*Invitation
+	collection := dbSession(i.ctx).Collection(i.Table())
+	res := collection.Find(up.Cond{"accepted_at": nil, "revoked_at": nil}).OrderBy("-created_at", "-id")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// ValidateUniqueEmail adds an error when the email has an invitation that can still be accepted
+func (i *Invitation) ValidateUniqueEmail(validator *imperator.Validation, email string) {
+	collection := dbSession(i.ctx).Collection(i.Table())
+	n, err := collection.Find(up.Cond{
+		"email =":      email,
+		"accepted_at":  nil,
+		"revoked_at":   nil,
+		"expires_at >": time.Now(),
+	}).Count()
+	if err == nil && n > 0 {
+		validator.AddError("email", "This email has been invited already, resend the invitation instead")
+	}
+}
+
+// Renew replaces the token of a pending invitation and extends it by ttl, it returns the new
+// plain text token
+func (i *Invitation) Renew(id int, ttl time.Duration) (string, error) {
+	plain, err := newInvitationToken()
+	if err != nil {
+		return "", err
+	}
+	res, err := dbSession(i.ctx).SQL().
+		Update(i.Table()).
+		Set("token_hash", hashUserToken(plain), "expires_at", time.Now().Add(ttl), "updated_at", time.Now()).
+		Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", id).
+		Exec()
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return "", ErrInvitationInvalid
+	}
+	return plain, nil
+}
+
+// Revoke stops a pending invitation from being accepted
+func (i *Invitation) Revoke(id int) error {
+	res, err := dbSession(i.ctx).SQL().
+		Update(i.Table()).
+		Set("revoked_at", time.Now(), "updated_at", time.Now()).
+		Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", id).
+		Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrInvitationInvalid
+	}
+	return nil
+}
+
+// Peek returns the invitation for the id and plain text token when it can still be accepted
+// without accepting it, it is used to decide if the accept form should be shown at all
+func (i *Invitation) Peek(id int, plain string) (*Invitation, error) {
+	if plain == "" {
+		return nil, ErrInvitationInvalid
+	}
+	var invitation Invitation
+	collection := dbSession(i.ctx).Collection(i.Table())
+	res := collection.Find(up.Cond{
+		"id =":         id,
+		"token_hash =": hashUserToken(plain),
+		"accepted_at":  nil,
+		"revoked_at":   nil,
+		"expires_at >": time.Now(),
+	})
+	if err := res.One(&invitation); err != nil {
+		if errors.Is(err, up.ErrNoMoreRows) {
+			return nil, ErrInvitationInvalid
+		}
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// Accept uses up the invitation for the id and plain text token and returns it. An invitation
+// can only be accepted once, even by concurrent requests.
+func (i *Invitation) Accept(id int, plain string) (*Invitation, error) {
+	invitation, err := i.Peek(id, plain)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	res, err := dbSession(i.ctx).SQL().
+		Update(i.Table()).
+		Set("accepted_at", now, "updated_at", now).
+		Where("id = ? AND token_hash = ? AND accepted_at IS NULL AND revoked_at IS NULL", invitation.ID, invitation.TokenHash).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return nil, ErrInvitationInvalid
+	}
+	invitation.AcceptedAt = &now
+	return invitation, nil
+}
+
+// newInvitationToken returns a random token of 256 bits
+func newInvitationToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -19,6 +20,24 @@ type Models struct {
 	Users         User
 	Tokens        Token
 	RememberToken RememberToken
+	UserSessions  UserSession
+	Identities    UserIdentity
+	RecoveryCodes RecoveryCode
+	Credentials   Credential
+	Roles         Role
+	Permissions   Permission
+	AuditEvents   AuditEvent
+	UserTokens    UserToken
+	// PasswordHistory keeps the hashes of previous passwords
+	PasswordHistory PasswordHistory
+	// Invitations let people create their own account
+	Invitations Invitation
+	// OAuth provider
+	OAuthClients       OAuthClient
+	OAuthCodes         OAuthCode
+	OAuthRefreshTokens OAuthRefreshToken
+	OAuthConsents      OAuthConsent
+	OAuthKeys          OAuthKey
 }
 
 // New creates a new database pool based on our .env DATABASE_TYPE and returns
@@ -35,10 +54,73 @@ func New(databasePool *sql.DB) Models {
 		// load no DBs
 	}
 	return Models{
-		Users:         User{},
-		Tokens:        Token{},
-		RememberToken: RememberToken{},
+		Users:           User{},
+		Tokens:          Token{},
+		RememberToken:   RememberToken{},
+		UserSessions:    UserSession{},
+		Identities:      UserIdentity{},
+		RecoveryCodes:   RecoveryCode{},
+		Credentials:     Credential{},
+		Roles:           Role{},
+		Permissions:     Permission{},
+		AuditEvents:     AuditEvent{},
+		UserTokens:      UserToken{},
+		PasswordHistory: PasswordHistory{},
+		Invitations:     Invitation{},
+
+		OAuthClients:       OAuthClient{},
+		OAuthCodes:         OAuthCode{},
+		OAuthRefreshTokens: OAuthRefreshToken{},
+		OAuthConsents:      OAuthConsent{},
+		OAuthKeys:          OAuthKey{},
+	}
+}
+
+// WithContext returns the models with their queries bound to ctx, so a query is canceled with the
+// request it runs for and recorded in its trace. Use it with the context of the request.
+func (m Models) WithContext(ctx context.Context) *Models {
+	m.Users.ctx = ctx
+	m.Tokens.ctx = ctx
+	m.RememberToken.ctx = ctx
+	m.UserSessions.ctx = ctx
+	m.Identities.ctx = ctx
+	m.RecoveryCodes.ctx = ctx
+	m.Credentials.ctx = ctx
+	m.Roles.ctx = ctx
+	m.Permissions.ctx = ctx
+	m.AuditEvents.ctx = ctx
+	m.UserTokens.ctx = ctx
+	m.PasswordHistory.ctx = ctx
+	m.Invitations.ctx = ctx
+	m.OAuthClients.ctx = ctx
+	m.OAuthCodes.ctx = ctx
+	m.OAuthRefreshTokens.ctx = ctx
+	m.OAuthConsents.ctx = ctx
+	m.OAuthKeys.ctx = ctx
+	return &m
+}
+
+// txKey holds the session of the transaction Models.Tx runs in the context of its models
+type txKey struct{}
+
+// Tx runs fn with models whose queries all run in one transaction. It is committed when fn
+// returns nil and rolled back when fn returns an error, which Tx returns.
+func (m Models) Tx(ctx context.Context, fn func(tx *Models) error) error {
+	return dbSession(ctx).Tx(func(sess db2.Session) error {
+		return fn(m.WithContext(context.WithValue(ctx, txKey{}, sess)))
+	})
+}
+
+// dbSession returns the database session bound to ctx, or the transaction of Models.Tx. Models
+// that were not taken from Models.WithContext query with the background context.
+func dbSession(ctx context.Context) db2.Session {
+	if ctx == nil || upper == nil {
+		return upper
+	}
+	if sess, ok := ctx.Value(txKey{}).(db2.Session); ok {
+		return sess
 	}
+	return upper.WithContext(ctx)
 }
 
 // getInsertID handles how IDs are returned from mysql or postgres type databases with different
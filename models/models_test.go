@@ -4,8 +4,11 @@ package models
 
 import (
 	"fmt"
+	"imperatorapp/auth/password"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	db2 "github.com/upper/db/v4"
@@ -46,3 +49,60 @@ func TestGetInsertID(t *testing.T) {
 		t.Error("wrong type", fmt.Sprintf("%T", returnedID))
 	}
 }
+
+func TestAuditDiff(t *testing.T) {
+	before := User{ID: 1, FirstName: "Bob", Email: "bob@example.com", Password: "old", Active: 1}
+	after := before
+	after.FirstName = "Rob"
+	after.Password = "new"
+	after.UpdatedAt = time.Now()
+
+	changes, err := AuditDiff(before, &after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes != `{"first_name":{"from":"Bob","to":"Rob"}}` {
+		t.Error("unexpected changes:", changes)
+	}
+
+	changes, _ = AuditDiff(before, before)
+	if changes != "" {
+		t.Error("expected no changes, got", changes)
+	}
+
+	if _, err := AuditDiff(before, Role{}); err == nil {
+		t.Error("expected an error for different types")
+	}
+}
+
+// countingHasher counts the hashes it makes
+type countingHasher struct {
+	password.Bcrypt
+	hashes *int
+}
+
+func (c countingHasher) Hash(plain string) (string, error) {
+	*c.hashes++
+	return c.Bcrypt.Hash(plain)
+}
+
+func TestPasswordMatchesNone(t *testing.T) {
+	defer SetPasswordHasher(password.DefaultBcrypt)
+	var hashes int
+	SetPasswordHasher(countingHasher{Bcrypt: password.Bcrypt{Cost: 4}, hashes: &hashes})
+
+	var u User
+	u.PasswordMatchesNone("secret")
+	u.PasswordMatchesNone("secret")
+	if hashes != 1 {
+		t.Error("expected the dummy hash to be made once and it was made", hashes)
+	}
+	SetPasswordHasher(countingHasher{Bcrypt: password.Bcrypt{Cost: 5}, hashes: &hashes})
+	u.PasswordMatchesNone("secret")
+	if hashes != 2 {
+		t.Error("a new hasher did not make a new dummy hash")
+	}
+	if !strings.HasPrefix(dummyHash.hash, "$2a$05$") {
+		t.Error("the dummy hash was not made by the configured hasher:", dummyHash.hash)
+	}
+}
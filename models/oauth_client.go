@@ -0,0 +1,179 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// OAuthClient is an app that logs its users in through the portal. Confidential clients
+// authenticate with a secret of which only the sha256 hash is stored, public clients like single
+// page apps have no secret and rely on PKCE alone.
+type OAuthClient struct {
+	ID           int       `db:"id,omitempty"`
+	ClientID     string    `db:"client_id"`
+	Name         string    `db:"name"`
+	SecretHash   string    `db:"secret_hash" json:"-"`
+	RedirectURIs string    `db:"redirect_uris"`
+	Scopes       string    `db:"scopes"`
+	GrantTypes   string    `db:"grant_types"`
+	Confidential bool      `db:"confidential"`
+	Trusted      bool      `db:"trusted"`
+	CreatedAt    time.Time `db:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the OAuthClient
+func (c *OAuthClient) Table() string {
+	return "oauth_clients"
+}
+
+// RedirectURIList returns the registered redirect uris, one per line
+func (c *OAuthClient) RedirectURIList() []string {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// ScopeList returns the scopes the client may request
+func (c *OAuthClient) ScopeList() []string {
+	return strings.Fields(c.Scopes)
+}
+
+// GrantTypeList returns the grant types the client may use
+func (c *OAuthClient) GrantTypeList() []string {
+	return strings.Fields(c.GrantTypes)
+}
+
+// AllowsGrant checks if the client may use the grant type
+func (c *OAuthClient) AllowsGrant(grantType string) bool {
+	for _, g := range c.GrantTypeList() {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRedirectURI checks that the uri is one of the registered ones, uris must match exactly
+func (c *OAuthClient) AllowsRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIList() {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretMatches checks the secret of a confidential client
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if !c.Confidential || c.SecretHash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashUserToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// GetAll returns all clients by name
+func (c *OAuthClient) GetAll() ([]*OAuthClient, error) {
+	var all []*OAuthClient
+	collection := dbSession(c.ctx).Collection(c.Table())
+	if err := collection.Find().OrderBy("name").All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Get returns a client by its id
+func (c *OAuthClient) Get(id int) (*OAuthClient, error) {
+	var client OAuthClient
+	collection := dbSession(c.ctx).Collection(c.Table())
+	if err := collection.Find(up.Cond{"id =": id}).One(&client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// GetByClientID returns a client by the client id it sends
+func (c *OAuthClient) GetByClientID(clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	collection := dbSession(c.ctx).Collection(c.Table())
+	if err := collection.Find(up.Cond{"client_id =": clientID}).One(&client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// Insert registers a client with a new client id and returns its id and, for confidential
+// clients, the plain text secret which is only shown once
+func (c *OAuthClient) Insert(client OAuthClient) (int, string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return 0, "", err
+	}
+	client.ClientID = hex.EncodeToString(randomBytes)
+	secret := ""
+	client.SecretHash = ""
+	if client.Confidential {
+		var err error
+		if secret, err = randomOAuthToken(); err != nil {
+			return 0, "", err
+		}
+		client.SecretHash = hashUserToken(secret)
+	}
+	client.CreatedAt = time.Now()
+	client.UpdatedAt = time.Now()
+	collection := dbSession(c.ctx).Collection(c.Table())
+	res, err := collection.Insert(client)
+	if err != nil {
+		return 0, "", err
+	}
+	return getInsertID(res.ID()), secret, nil
+}
+
+// Update saves the settings of a client, the client id and secret are not changed. A client that
+// becomes public loses its secret.
+func (c *OAuthClient) Update(client OAuthClient) error {
+	changes := map[string]interface{}{
+		"name":          client.Name,
+		"redirect_uris": client.RedirectURIs,
+		"scopes":        client.Scopes,
+		"grant_types":   client.GrantTypes,
+		"confidential":  client.Confidential,
+		"trusted":       client.Trusted,
+		"updated_at":    time.Now(),
+	}
+	if !client.Confidential {
+		changes["secret_hash"] = ""
+	}
+	collection := dbSession(c.ctx).Collection(c.Table())
+	return collection.Find(up.Cond{"id =": client.ID}).Update(changes)
+}
+
+// RotateSecret gives a confidential client a new secret and returns it, the old one stops
+// working right away
+func (c *OAuthClient) RotateSecret(id int) (string, error) {
+	secret, err := randomOAuthToken()
+	if err != nil {
+		return "", err
+	}
+	collection := dbSession(c.ctx).Collection(c.Table())
+	err = collection.Find(up.Cond{"id =": id, "confidential": true}).Update(map[string]interface{}{
+		"secret_hash": hashUserToken(secret),
+		"updated_at":  time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Delete removes a client with its codes, refresh tokens and consents
+func (c *OAuthClient) Delete(id int) error {
+	collection := dbSession(c.ctx).Collection(c.Table())
+	return collection.Find(up.Cond{"id =": id}).Delete()
+}
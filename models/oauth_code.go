@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+var (
+	// ErrOAuthCodeInvalid is returned for codes that do not exist or have expired
+	ErrOAuthCodeInvalid = errors.New("authorization code is invalid or expired")
+	// ErrOAuthCodeReused is returned for codes that were exchanged before, the code may have been
+	// stolen so the tokens issued for it are revoked
+	ErrOAuthCodeReused = errors.New("authorization code was already used")
+)
+
+// OAuthCode is an authorization code issued to a client for a user. Only the sha256 hash of the
+// code is stored. Family is shared by the refresh tokens issued for the code.
+type OAuthCode struct {
+	ID            int        `db:"id,omitempty"`
+	CodeHash      string     `db:"code_hash"`
+	ClientID      string     `db:"client_id"`
+	UserID        int        `db:"user_id"`
+	RedirectURI   string     `db:"redirect_uri"`
+	Scopes        string     `db:"scopes"`
+	Nonce         string     `db:"nonce"`
+	CodeChallenge string     `db:"code_challenge"`
+	Family        string     `db:"family"`
+	ExpiresAt     time.Time  `db:"expires_at"`
+	ConsumedAt    *time.Time `db:"consumed_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the OAuthCode
+func (c *OAuthCode) Table() string {
+	return "oauth_codes"
+}
+
+// Issue stores the code valid for ttl and returns its plain text
+func (c *OAuthCode) Issue(code OAuthCode, ttl time.Duration) (string, error) {
+	plain, err := randomOAuthToken()
+	if err != nil {
+		return "", err
+	}
+	if code.Family, err = randomOAuthToken(); err != nil {
+		return "", err
+	}
+	code.CodeHash = hashUserToken(plain)
+	code.ExpiresAt = time.Now().Add(ttl)
+	code.ConsumedAt = nil
+	code.CreatedAt = time.Now()
+	collection := dbSession(c.ctx).Collection(c.Table())
+	if _, err := collection.Insert(code); err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// Consume uses up the code of the client and returns it. A code can only be exchanged once, even
+// by concurrent requests. ErrOAuthCodeReused is returned with the code when it was exchanged before.
+func (c *OAuthCode) Consume(plain, clientID string) (*OAuthCode, error) {
+	if plain == "" {
+		return nil, ErrOAuthCodeInvalid
+	}
+	var code OAuthCode
+	collection := dbSession(c.ctx).Collection(c.Table())
+	if err := collection.Find(up.Cond{"code_hash =": hashUserToken(plain)}).One(&code); err != nil {
+		if errors.Is(err, up.ErrNoMoreRows) {
+			return nil, ErrOAuthCodeInvalid
+		}
+		return nil, err
+	}
+	// a code of another client is not touched, the client could not have been given it
+	if code.ClientID != clientID {
+		return nil, ErrOAuthCodeInvalid
+	}
+	if code.ConsumedAt != nil {
+		return &code, ErrOAuthCodeReused
+	}
+	if code.ExpiresAt.Before(time.Now()) {
+		return nil, ErrOAuthCodeInvalid
+	}
+	now := time.Now()
+	res, err := dbSession(c.ctx).SQL().
+		Update(c.Table()).
+		Set("consumed_at", now).
+		Where("id = ? AND consumed_at IS NULL", code.ID).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return &code, ErrOAuthCodeReused
+	}
+	code.ConsumedAt = &now
+	return &code, nil
+}
+
+// DeleteExpired removes the codes that can no longer be exchanged. Used codes are kept until they
+// expire so a replay is still recognized.
+func (c *OAuthCode) DeleteExpired() error {
+	_, err := dbSession(c.ctx).SQL().
+		DeleteFrom(c.Table()).
+		Where("expires_at < ?", time.Now()).
+		Exec()
+	return err
+}
+
+func randomOAuthToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
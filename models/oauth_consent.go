@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// OAuthConsent records the scopes a user allowed a client, the consent screen is only shown again
+// when the client asks for more
+type OAuthConsent struct {
+	ID        int       `db:"id,omitempty"`
+	UserID    int       `db:"user_id"`
+	ClientID  string    `db:"client_id"`
+	Scopes    string    `db:"scopes"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the OAuthConsent
+func (c *OAuthConsent) Table() string {
+	return "oauth_consents"
+}
+
+// Covers checks that every scope was allowed before
+func (c *OAuthConsent) Covers(scopes []string) bool {
+	granted := strings.Fields(c.Scopes)
+	for _, s := range scopes {
+		found := false
+		for _, g := range granted {
+			if g == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the consent of the user for the client
+func (c *OAuthConsent) Get(userID int, clientID string) (*OAuthConsent, error) {
+	var consent OAuthConsent
+	collection := dbSession(c.ctx).Collection(c.Table())
+	if err := collection.Find(up.Cond{"user_id =": userID, "client_id =": clientID}).One(&consent); err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+// Grant adds the scopes to the consent of the user for the client
+func (c *OAuthConsent) Grant(userID int, clientID string, scopes []string) error {
+	consent, err := c.Get(userID, clientID)
+	if errors.Is(err, up.ErrNoMoreRows) {
+		collection := dbSession(c.ctx).Collection(c.Table())
+		_, err := collection.Insert(OAuthConsent{
+			UserID:    userID,
+			ClientID:  clientID,
+			Scopes:    strings.Join(scopes, " "),
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	granted := strings.Fields(consent.Scopes)
+	for _, s := range scopes {
+		if !consent.Covers([]string{s}) {
+			granted = append(granted, s)
+		}
+	}
+	collection := dbSession(c.ctx).Collection(c.Table())
+	return collection.Find(up.Cond{"id =": consent.ID}).Update(map[string]interface{}{
+		"scopes":     strings.Join(granted, " "),
+		"updated_at": time.Now(),
+	})
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// OAuthKey is a key the OAuth provider signs tokens with. PrivateKey holds the PEM of the key
+// encrypted with the encryption key of the app.
+type OAuthKey struct {
+	ID         int       `db:"id,omitempty"`
+	KeyID      string    `db:"kid"`
+	PrivateKey string    `db:"private_key" json:"-"`
+	CreatedAt  time.Time `db:"created_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the OAuthKey
+func (k *OAuthKey) Table() string {
+	return "oauth_keys"
+}
+
+// GetAll returns all keys, newest first
+func (k *OAuthKey) GetAll() ([]*OAuthKey, error) {
+	var all []*OAuthKey
+	collection := dbSession(k.ctx).Collection(k.Table())
+	if err := collection.Find().OrderBy("-created_at").All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Insert stores a key
+func (k *OAuthKey) Insert(key OAuthKey) (int, error) {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	collection := dbSession(k.ctx).Collection(k.Table())
+	res, err := collection.Insert(key)
+	if err != nil {
+		return 0, err
+	}
+	return getInsertID(res.ID()), nil
+}
+
+// DeleteOlderThan removes the keys created before t
+func (k *OAuthKey) DeleteOlderThan(t time.Time) error {
+	collection := dbSession(k.ctx).Collection(k.Table())
+	return collection.Find(up.Cond{"created_at <": t}).Delete()
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+var (
+	// ErrOAuthRefreshInvalid is returned for refresh tokens that do not exist, have expired or
+	// belong to another client
+	ErrOAuthRefreshInvalid = errors.New("refresh token is invalid or expired")
+	// ErrOAuthRefreshReused is returned when a rotated refresh token is used again, the whole
+	// family is revoked since either the client or an attacker holds a stolen token
+	ErrOAuthRefreshReused = errors.New("refresh token was already used")
+)
+
+// OAuthRefreshToken is a refresh token issued to a client for a user. Every use rotates it: the
+// token is used up and a new one of the same family is issued. Only the sha256 hash is stored.
+type OAuthRefreshToken struct {
+	ID         int        `db:"id,omitempty"`
+	TokenHash  string     `db:"token_hash"`
+	Family     string     `db:"family"`
+	ClientID   string     `db:"client_id"`
+	UserID     int        `db:"user_id"`
+	Scopes     string     `db:"scopes"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	ConsumedAt *time.Time `db:"consumed_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the OAuthRefreshToken
+func (t *OAuthRefreshToken) Table() string {
+	return "oauth_refresh_tokens"
+}
+
+// Issue stores a refresh token of the family valid for ttl and returns its plain text
+func (t *OAuthRefreshToken) Issue(token OAuthRefreshToken, ttl time.Duration) (string, error) {
+	plain, err := randomOAuthToken()
+	if err != nil {
+		return "", err
+	}
+	token.TokenHash = hashUserToken(plain)
+	token.ExpiresAt = time.Now().Add(ttl)
+	token.ConsumedAt = nil
+	token.CreatedAt = time.Now()
+	collection := dbSession(t.ctx).Collection(t.Table())
+	if _, err := collection.Insert(token); err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// Peek returns the refresh token for the plain text when it can still be used without using it
+// up, it is used by the introspection endpoint
+func (t *OAuthRefreshToken) Peek(plain string) (*OAuthRefreshToken, error) {
+	if plain == "" {
+		return nil, ErrOAuthRefreshInvalid
+	}
+	var token OAuthRefreshToken
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find(up.Cond{"token_hash =": hashUserToken(plain)})
+	if err := res.One(&token); err != nil {
+		if errors.Is(err, up.ErrNoMoreRows) {
+			return nil, ErrOAuthRefreshInvalid
+		}
+		return nil, err
+	}
+	if token.ConsumedAt != nil || token.ExpiresAt.Before(time.Now()) {
+		return nil, ErrOAuthRefreshInvalid
+	}
+	return &token, nil
+}
+
+// Use uses up the refresh token of the client and returns it, the caller issues the next token of
+// the family. A token used a second time revokes its family and returns ErrOAuthRefreshReused
+// with the token.
+func (t *OAuthRefreshToken) Use(plain, clientID string) (*OAuthRefreshToken, error) {
+	if plain == "" {
+		return nil, ErrOAuthRefreshInvalid
+	}
+	var token OAuthRefreshToken
+	collection := dbSession(t.ctx).Collection(t.Table())
+	if err := collection.Find(up.Cond{"token_hash =": hashUserToken(plain)}).One(&token); err != nil {
+		if errors.Is(err, up.ErrNoMoreRows) {
+			return nil, ErrOAuthRefreshInvalid
+		}
+		return nil, err
+	}
+	// a token of another client is not touched, the client could not have been given it
+	if token.ClientID != clientID || token.ExpiresAt.Before(time.Now()) {
+		return nil, ErrOAuthRefreshInvalid
+	}
+	if token.ConsumedAt != nil {
+		return t.reused(&token)
+	}
+	now := time.Now()
+	res, err := dbSession(t.ctx).SQL().
+		Update(t.Table()).
+		Set("consumed_at", now).
+		Where("id = ? AND consumed_at IS NULL", token.ID).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return t.reused(&token)
+	}
+	token.ConsumedAt = &now
+	return &token, nil
+}
+
+// reused revokes the family of a token that was used again
+func (t *OAuthRefreshToken) reused(token *OAuthRefreshToken) (*OAuthRefreshToken, error) {
+	if err := t.RevokeFamily(token.Family); err != nil {
+		return nil, err
+	}
+	return token, ErrOAuthRefreshReused
+}
+
+// RevokeFamily deletes every refresh token of the family
+func (t *OAuthRefreshToken) RevokeFamily(family string) error {
+	collection := dbSession(t.ctx).Collection(t.Table())
+	return collection.Find(up.Cond{"family =": family}).Delete()
+}
+
+// RevokeForUser deletes the refresh tokens of the user for all clients, they are issued again
+// when the user logs in to the client next time
+func (t *OAuthRefreshToken) RevokeForUser(userID int) error {
+	collection := dbSession(t.ctx).Collection(t.Table())
+	return collection.Find(up.Cond{"user_id =": userID}).Delete()
+}
+
+// DeleteExpired removes the refresh tokens that expired. Used tokens are kept until they expire so
+// a replay is still recognized.
+func (t *OAuthRefreshToken) DeleteExpired() error {
+	_, err := dbSession(t.ctx).SQL().
+		DeleteFrom(t.Table()).
+		Where("expires_at < ?", time.Now()).
+		Exec()
+	return err
+}
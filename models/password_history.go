@@ -0,0 +1,72 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// passwordHistoryLimit is the number of password hashes kept per user, the password policy can
+// look back this far at most
+const passwordHistoryLimit = 24
+
+// PasswordHistory is a hash of a password a user had, it keeps users from going back to an old one
+type PasswordHistory struct {
+	ID           int       `db:"id,omitempty"`
+	UserID       int       `db:"user_id"`
+	PasswordHash string    `db:"password_hash"`
+	CreatedAt    time.Time `db:"created_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the PasswordHistory
+func (p *PasswordHistory) Table() string {
+	return "password_history"
+}
+
+// Add stores the hash of the new password of a user and forgets the ones past the limit
+func (p *PasswordHistory) Add(userID int, hash string) error {
+	collection := dbSession(p.ctx).Collection(p.Table())
+	item := PasswordHistory{
+		UserID:       userID,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+	if _, err := collection.Insert(item); err != nil {
+		return err
+	}
+
+	var old []PasswordHistory
+	res := collection.Find(up.Cond{"user_id =": userID}).OrderBy("-id").Offset(passwordHistoryLimit)
+	if err := res.All(&old); err != nil {
+		return err
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(old))
+	for _, item := range old {
+		ids = append(ids, item.ID)
+	}
+	return collection.Find(up.Cond{"id IN": ids}).Delete()
+}
+
+// Recent returns the hashes of the last n passwords of a user, newest first
+func (p *PasswordHistory) Recent(userID, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	var all []PasswordHistory
+	collection := dbSession(p.ctx).Collection(p.Table())
+	res := collection.Find(up.Cond{"user_id =": userID}).OrderBy("-id").Limit(n)
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(all))
+	for _, item := range all {
+		hashes = append(hashes, item.PasswordHash)
+	}
+	return hashes, nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// Permission is a named ability like "users.edit" that is granted to roles
+type Permission struct {
+	ID          int       `db:"id,omitempty"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the Permission
+func (p *Permission) Table() string {
+	return "permissions"
+}
+
+// GetByName gets a permission from the database by its unique name
+func (p *Permission) GetByName(name string) (*Permission, error) {
+	var permission Permission
+	collection := dbSession(p.ctx).Collection(p.Table())
+	res := collection.Find(up.Cond{"name =": name})
+	if err := res.One(&permission); err != nil {
+		return nil, err
+	}
+	return &permission, nil
+}
+
+// GetAll returns all permissions ordered by name
+func (p *Permission) GetAll() ([]*Permission, error) {
+	var all []*Permission
+	collection := dbSession(p.ctx).Collection(p.Table())
+	res := collection.Find().OrderBy("name")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// GetForRole returns the permissions granted to a role
+func (p *Permission) GetForRole(roleID int) ([]*Permission, error) {
+	var all []*Permission
+	q := dbSession(p.ctx).SQL().
+		Select("p.*").
+		From(p.Table()+" p").
+		Join("permission_role pr").On("pr.permission_id = p.id").
+		Where("pr.role_id = ?", roleID).
+		OrderBy("p.name")
+	if err := q.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// GetForUser returns the permissions a user has through all of their roles
+func (p *Permission) GetForUser(userID int) ([]*Permission, error) {
+	var all []*Permission
+	q := dbSession(p.ctx).SQL().
+		Select("p.*").Distinct().
+		From(p.Table()+" p").
+		Join("permission_role pr").On("pr.permission_id = p.id").
+		Join("role_user ru").On("ru.role_id = pr.role_id").
+		Where("ru.user_id = ?", userID).
+		OrderBy("p.name")
+	if err := q.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Insert creates a new permission given the item
+func (p *Permission) Insert(permission Permission) (int, error) {
+	permission.CreatedAt = time.Now()
+	permission.UpdatedAt = time.Now()
+	collection := dbSession(p.ctx).Collection(p.Table())
+	res, err := collection.Insert(permission)
+	if err != nil {
+		return 0, err
+	}
+	id := getInsertID(res.ID())
+	return id, nil
+}
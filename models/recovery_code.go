@@ -0,0 +1,132 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// RecoveryCodeCount is the number of one-time recovery codes generated for a user
+const RecoveryCodeCount = 10
+
+// RecoveryCode is a hashed one-time code a user can use instead of a totp code
+type RecoveryCode struct {
+	ID        int        `db:"id,omitempty"`
+	UserID    int        `db:"user_id"`
+	CodeHash  string     `db:"code_hash"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the RecoveryCode
+func (m *RecoveryCode) Table() string {
+	return "recovery_codes"
+}
+
+// GetAllForUser returns all recovery codes of a user given the user id
+func (m *RecoveryCode) GetAllForUser(userID int) ([]*RecoveryCode, error) {
+	var all []*RecoveryCode
+	collection := dbSession(m.ctx).Collection(m.Table())
+	res := collection.Find(up.Cond{"user_id =": userID}).OrderBy("id")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// DeleteAllForUser deletes all recovery codes of a user given the user id
+func (m *RecoveryCode) DeleteAllForUser(userID int) error {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	res := collection.Find(up.Cond{"user_id =": userID})
+	if err := res.Delete(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Generate replaces all recovery codes of a user with a fresh set and returns the plain
+// text codes. They are only stored hashed, so this is the only time they can be shown.
+func (m *RecoveryCode) Generate(userID int) ([]string, error) {
+	if err := m.DeleteAllForUser(userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, RecoveryCodeCount)
+	collection := dbSession(m.ctx).Collection(m.Table())
+	for i := 0; i < RecoveryCodeCount; i++ {
+		randomBytes := make([]byte, 10)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, err
+		}
+		plain := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+		code := plain[:8] + "-" + plain[8:]
+		item := RecoveryCode{
+			UserID:    userID,
+			CodeHash:  hashRecoveryCode(code),
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if _, err := collection.Insert(item); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Use checks the code against the unused recovery codes of a user and marks it as used
+// when it matches, so every code can only be used once
+func (m *RecoveryCode) Use(userID int, code string) (bool, error) {
+	hash := hashRecoveryCode(code)
+	codes, err := m.GetAllForUser(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range codes {
+		if c.UsedAt != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(c.CodeHash), []byte(hash)) == 1 {
+			now := time.Now()
+			c.UsedAt = &now
+			c.UpdatedAt = now
+			collection := dbSession(m.ctx).Collection(m.Table())
+			if err := collection.Find(c.ID).Update(c); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Remaining returns the number of unused recovery codes of a user
+func (m *RecoveryCode) Remaining(userID int) (int, error) {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	count, err := collection.Find(up.Cond{"user_id =": userID, "used_at": nil}).Count()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// hashRecoveryCode normalizes a code the way users tend to type it and hashes it. The codes
+// are random with 80 bits of entropy so a fast hash is sufficient here.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == 16 {
+		code = code[:8] + "-" + code[8:]
+	}
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
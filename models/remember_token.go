@@ -1,6 +1,11 @@
 package models
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"time"
 
 	up "github.com/upper/db/v4"
@@ -8,12 +13,36 @@ import (
 
 // Note - item.UpdatedAt is handled from the database
 
+// rememberRotationGrace is how long the secret replaced by a rotation is still accepted, so
+// requests the browser sent in parallel with the old cookie do not look like a stolen cookie
+const rememberRotationGrace = 30 * time.Second
+
+var (
+	// ErrRememberTokenInvalid is returned for series that do not exist or have expired
+	ErrRememberTokenInvalid = errors.New("remember me token is invalid or expired")
+	// ErrRememberTokenReused is returned when an old secret of a series is presented, which means
+	// the cookie was copied. The series is deleted when this happens.
+	ErrRememberTokenReused = errors.New("remember me token was reused")
+)
+
+// RememberToken is a remember me device. The cookie holds the series, which stays the same for
+// the device, and a secret that is replaced on every automatic login. Only the sha256 hash of the
+// secret is stored.
 type RememberToken struct {
-	ID            int       `db:"id,omitempty"`
-	UserID        int       `db:"user_id"`
-	RememberToken string    `db:"remember_token"`
-	CreatedAt     time.Time `db:"created_at"`
-	UpdatedAt     time.Time `db:"updated_at"`
+	ID           int        `db:"id,omitempty"`
+	UserID       int        `db:"user_id"`
+	Series       string     `db:"series"`
+	TokenHash    string     `db:"token_hash"`
+	PreviousHash string     `db:"previous_hash"`
+	RotatedAt    *time.Time `db:"rotated_at"`
+	UserAgent    string     `db:"user_agent"`
+	IP           string     `db:"ip"`
+	LastUsedAt   *time.Time `db:"last_used_at"`
+	ExpiresAt    time.Time  `db:"expires_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+
+	ctx context.Context
 }
 
 // Table returns the table name for the RememberToken
@@ -24,7 +53,7 @@ func (m *RememberToken) Table() string {
 // Get gets a RememberToken from the database by passing the id
 func (m *RememberToken) Get(id int) (*RememberToken, error) {
 	var item *RememberToken
-	collection := upper.Collection(m.Table())
+	collection := dbSession(m.ctx).Collection(m.Table())
 	res := collection.Find(up.Cond{"id =": id})
 	if err := res.One(&item); err != nil {
 		return nil, err
@@ -32,9 +61,145 @@ func (m *RememberToken) Get(id int) (*RememberToken, error) {
 	return item, nil
 }
 
+// GetBySeries gets the RememberToken of a series
+func (m *RememberToken) GetBySeries(series string) (*RememberToken, error) {
+	var item RememberToken
+	collection := dbSession(m.ctx).Collection(m.Table())
+	res := collection.Find(up.Cond{"series =": series})
+	if err := res.One(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetForUser returns the remember me devices of a user, the most recently created first
+func (m *RememberToken) GetForUser(userID int) ([]*RememberToken, error) {
+	var all []*RememberToken
+	collection := dbSession(m.ctx).Collection(m.Table())
+	res := collection.Find(up.Cond{"user_id =": userID}).OrderBy("-created_at", "-id")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Issue creates a new series for the user that expires after ttl and returns it with the plain
+// text secret for the cookie
+func (m *RememberToken) Issue(userID int, userAgent, ip string, ttl time.Duration) (*RememberToken, string, error) {
+	series, err := randomRememberValue(18)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomRememberValue(32)
+	if err != nil {
+		return nil, "", err
+	}
+	item := RememberToken{
+		UserID:    userID,
+		Series:    series,
+		TokenHash: hashUserToken(secret),
+		UserAgent: userAgent,
+		IP:        ip,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	id, err := m.Insert(item)
+	if err != nil {
+		return nil, "", err
+	}
+	item.ID = id
+	return &item, secret, nil
+}
+
+// Rotate checks the secret of a series and replaces it with a new one, which is returned. The
+// new secret is empty when the request raced with another rotation of the same cookie and the
+// previous secret was accepted. Presenting any other old secret deletes the series and returns
+// ErrRememberTokenReused with the token, so the sessions it created can be ended.
+func (m *RememberToken) Rotate(series, secret, ip string) (*RememberToken, string, error) {
+	item, err := m.GetBySeries(series)
+	if err != nil {
+		if errors.Is(err, up.ErrNoMoreRows) {
+			return nil, "", ErrRememberTokenInvalid
+		}
+		return nil, "", err
+	}
+	if time.Now().After(item.ExpiresAt) {
+		if err := m.Delete(item.ID); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRememberTokenInvalid
+	}
+
+	hash := hashUserToken(secret)
+	if !rememberHashEqual(hash, item.TokenHash) {
+		if item.inGrace(hash) {
+			return item, "", m.MarkUsed(item.ID, ip)
+		}
+		if err := m.Delete(item.ID); err != nil {
+			return nil, "", err
+		}
+		return item, "", ErrRememberTokenReused
+	}
+
+	next, err := randomRememberValue(32)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	res, err := dbSession(m.ctx).SQL().
+		Update(m.Table()).
+		Set(
+			"token_hash", hashUserToken(next),
+			"previous_hash", item.TokenHash,
+			"rotated_at", now,
+			"last_used_at", now,
+			"ip", ip,
+		).
+		Where("id = ? AND token_hash = ?", item.ID, item.TokenHash).
+		Exec()
+	if err != nil {
+		return nil, "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		// another request rotated the secret first, its new cookie wins
+		return item, "", nil
+	}
+	item.PreviousHash, item.TokenHash = item.TokenHash, hashUserToken(next)
+	item.RotatedAt, item.LastUsedAt, item.IP = &now, &now, ip
+	return item, next, nil
+}
+
+// inGrace reports if hash is the secret replaced by a rotation moments ago
+func (m *RememberToken) inGrace(hash string) bool {
+	return m.RotatedAt != nil &&
+		rememberHashEqual(hash, m.PreviousHash) &&
+		time.Since(*m.RotatedAt) < rememberRotationGrace
+}
+
+// DeleteForUser deletes a RememberToken given the id only when it belongs to the user
+func (m *RememberToken) DeleteForUser(id, userID int) error {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	return collection.Find(up.Cond{"id =": id, "user_id =": userID}).Delete()
+}
+
+// DeleteAllForUser deletes the RememberTokens of a user except the one with the id keep, pass 0
+// to delete all of them
+func (m *RememberToken) DeleteAllForUser(userID, keep int) error {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	return collection.Find(up.Cond{"user_id =": userID, "id <>": keep}).Delete()
+}
+
+// MarkUsed records that the RememberToken logged a user in
+func (m *RememberToken) MarkUsed(id int, ip string) error {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	return collection.Find(id).Update(map[string]interface{}{
+		"last_used_at": time.Now(),
+		"ip":           ip,
+	})
+}
+
 // Delete deletes a RememberToken given the id
 func (m *RememberToken) Delete(id int) error {
-	collection := upper.Collection(m.Table())
+	collection := dbSession(m.ctx).Collection(m.Table())
 	res := collection.Find(id)
 	if err := res.Delete(); err != nil {
 		return err
@@ -42,21 +207,30 @@ func (m *RememberToken) Delete(id int) error {
 	return nil
 }
 
-// Delete deletes a RememberToken given the id
-func (m *RememberToken) DeleteByToken(token string) error {
-	collection := upper.Collection(m.Table())
-	res := collection.Find(up.Cond{"remember_token": token})
+// DeleteBySeries deletes the RememberToken of a series
+func (m *RememberToken) DeleteBySeries(series string) error {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	res := collection.Find(up.Cond{"series": series})
 	if err := res.Delete(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// DeleteExpired removes the series that can no longer log anybody in
+func (m *RememberToken) DeleteExpired() error {
+	collection := dbSession(m.ctx).Collection(m.Table())
+	return collection.Find(up.Cond{"expires_at <": time.Now()}).Delete()
+}
+
 // Insert creates a new RememberToken given the item
 func (m *RememberToken) Insert(item RememberToken) (int, error) {
 	item.CreatedAt = time.Now()
+	if len(item.UserAgent) > 512 {
+		item.UserAgent = item.UserAgent[:512]
+	}
 
-	collection := upper.Collection(m.Table())
+	collection := dbSession(m.ctx).Collection(m.Table())
 	res, err := collection.Insert(item)
 	if err != nil {
 		return 0, err
@@ -64,3 +238,15 @@ func (m *RememberToken) Insert(item RememberToken) (int, error) {
 	id := getInsertID(res.ID())
 	return id, nil
 }
+
+func randomRememberValue(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+func rememberHashEqual(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// SuperAdminRole is the name of the seeded role that is granted every permission
+const SuperAdminRole = "super-admin"
+
+// Role groups permissions and is assigned to users through the role_user table
+type Role struct {
+	ID          int       `db:"id,omitempty"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+
+	ctx context.Context
+}
+
+// roleUser is a row of the role_user pivot table
+type roleUser struct {
+	RoleID int `db:"role_id"`
+	UserID int `db:"user_id"`
+}
+
+// permissionRole is a row of the permission_role pivot table
+type permissionRole struct {
+	PermissionID int `db:"permission_id"`
+	RoleID       int `db:"role_id"`
+}
+
+// Table returns the table name for the Role
+func (r *Role) Table() string {
+	return "roles"
+}
+
+// Get gets a role from the database by passing the id
+func (r *Role) Get(id int) (*Role, error) {
+	var role Role
+	collection := dbSession(r.ctx).Collection(r.Table())
+	res := collection.Find(up.Cond{"id =": id})
+	if err := res.One(&role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// GetByName gets a role from the database by its unique name
+func (r *Role) GetByName(name string) (*Role, error) {
+	var role Role
+	collection := dbSession(r.ctx).Collection(r.Table())
+	res := collection.Find(up.Cond{"name =": name})
+	if err := res.One(&role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// GetAll returns all roles ordered by name
+func (r *Role) GetAll() ([]*Role, error) {
+	var all []*Role
+	collection := dbSession(r.ctx).Collection(r.Table())
+	res := collection.Find().OrderBy("name")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// GetForUser returns the roles assigned to a user
+func (r *Role) GetForUser(userID int) ([]*Role, error) {
+	var all []*Role
+	q := dbSession(r.ctx).SQL().
+		Select("r.*").
+		From(r.Table()+" r").
+		Join("role_user ru").On("ru.role_id = r.id").
+		Where("ru.user_id = ?", userID).
+		OrderBy("r.name")
+	if err := q.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Insert creates a new role given the item
+func (r *Role) Insert(role Role) (int, error) {
+	role.CreatedAt = time.Now()
+	role.UpdatedAt = time.Now()
+	collection := dbSession(r.ctx).Collection(r.Table())
+	res, err := collection.Insert(role)
+	if err != nil {
+		return 0, err
+	}
+	id := getInsertID(res.ID())
+	return id, nil
+}
+
+// Delete deletes a role given the id, assignments are removed by the foreign keys
+func (r *Role) Delete(id int) error {
+	collection := dbSession(r.ctx).Collection(r.Table())
+	res := collection.Find(id)
+	if err := res.Delete(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AssignToUser gives a user a role, assigning a role twice is not an error
+func (r *Role) AssignToUser(roleID, userID int) error {
+	collection := dbSession(r.ctx).Collection("role_user")
+	exists, err := collection.Find(up.Cond{"role_id =": roleID, "user_id =": userID}).Exists()
+	if err != nil || exists {
+		return err
+	}
+	_, err = collection.Insert(roleUser{RoleID: roleID, UserID: userID})
+	return err
+}
+
+// RemoveFromUser takes a role away from a user
+func (r *Role) RemoveFromUser(roleID, userID int) error {
+	collection := dbSession(r.ctx).Collection("role_user")
+	return collection.Find(up.Cond{"role_id =": roleID, "user_id =": userID}).Delete()
+}
+
+// SetForUser replaces all roles of a user with the given role ids
+func (r *Role) SetForUser(userID int, roleIDs []int) error {
+	collection := dbSession(r.ctx).Collection("role_user")
+	if err := collection.Find(up.Cond{"user_id =": userID}).Delete(); err != nil {
+		return err
+	}
+	for _, roleID := range roleIDs {
+		if _, err := collection.Insert(roleUser{RoleID: roleID, UserID: userID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GrantPermission adds a permission to a role, granting it twice is not an error
+func (r *Role) GrantPermission(roleID, permissionID int) error {
+	collection := dbSession(r.ctx).Collection("permission_role")
+	exists, err := collection.Find(up.Cond{"permission_id =": permissionID, "role_id =": roleID}).Exists()
+	if err != nil || exists {
+		return err
+	}
+	_, err = collection.Insert(permissionRole{PermissionID: permissionID, RoleID: roleID})
+	return err
+}
+
+// RevokePermission removes a permission from a role
+func (r *Role) RevokePermission(roleID, permissionID int) error {
+	collection := dbSession(r.ctx).Collection("permission_role")
+	return collection.Find(up.Cond{"permission_id =": permissionID, "role_id =": roleID}).Delete()
+}
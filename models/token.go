@@ -1,10 +1,12 @@
 package models
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
 	"errors"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -12,43 +14,112 @@ import (
 	up "github.com/upper/db/v4"
 )
 
+// scopes that can be granted to a personal access token
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// TokenScope describes a scope on the token forms
+type TokenScope struct {
+	Name        string
+	Description string
+}
+
+// TokenScopes lists every scope a token can be granted
+var TokenScopes = []TokenScope{
+	{ScopeUsersRead, "List and view users"},
+	{ScopeUsersWrite, "Create, update and delete users"},
+}
+
+// Token is a personal access token. Only the sha256 hash is stored, PlainText is set when the
+// token is generated so it can be shown once and is empty for tokens loaded from the database.
 type Token struct {
-	ID        int       `db:"id,omitempty" json:"id"`
-	UserID    int       `db:"user_id" json:"user_id"`
-	FirstName string    `db:"first_name" json:"first_name"`
-	Email     string    `db:"email" json:"email"`
-	PlainText string    `db:"token" json:"token"`
-	Hash      []byte    `db:"token_hash" json:"-"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
-	Expires   time.Time `db:"expiry" json:"expiry"`
+	ID         int        `db:"id,omitempty" json:"id"`
+	UserID     int        `db:"user_id" json:"user_id"`
+	FirstName  string     `db:"first_name" json:"first_name"`
+	Email      string     `db:"email" json:"email"`
+	Name       string     `db:"name" json:"name"`
+	PlainText  string     `db:"-" json:"token,omitempty"`
+	Hash       []byte     `db:"token_hash" json:"-"`
+	Scopes     string     `db:"scopes" json:"scopes"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+	LastUsedIP string     `db:"last_used_ip" json:"last_used_ip"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time  `db:"updated_at" json:"updated_at"`
+	Expires    *time.Time `db:"expiry" json:"expiry"`
+
+	ctx context.Context
 }
 
 func (t *Token) Table() string {
 	return "tokens"
 }
 
+// ScopeList returns the scopes granted to the token
+func (t *Token) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope checks if the token was granted the scope
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired reports whether the token has an expiry date in the past
+func (t *Token) IsExpired() bool {
+	return t.Expires != nil && t.Expires.Before(time.Now())
+}
+
+// ValidScopes returns the known scopes out of the given ones as a space separated list
+func (t *Token) ValidScopes(scopes []string) string {
+	var valid []string
+	for _, known := range TokenScopes {
+		for _, s := range scopes {
+			if s == known.Name {
+				valid = append(valid, s)
+				break
+			}
+		}
+	}
+	return strings.Join(valid, " ")
+}
+
 func (t *Token) GetUserForToken(token string) (*User, error) {
 	var u User
-	var tok Token
-	collection := upper.Collection(t.Table())
-	res := collection.Find(up.Cond{"token": token})
-	if err := res.One(&tok); err != nil {
+	tok, err := t.GetByToken(token)
+	if err != nil {
 		return nil, err
 	}
-	collection = upper.Collection(u.Table())
-	res = collection.Find(up.Cond{"id": tok.UserID})
+	collection := dbSession(t.ctx).Collection(u.Table())
+	res := collection.Find(up.Cond{"id": tok.UserID})
 	if err := res.One(&u); err != nil {
 		return nil, err
 	}
-	u.Token = tok
+	u.Token = *tok
 	return &u, nil
 }
 
 func (t *Token) GetTokensForUser(id int) ([]*Token, error) {
 	var tokens []*Token
-	collection := upper.Collection(t.Table())
-	res := collection.Find(up.Cond{"user_id": id})
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find(up.Cond{"user_id": id}).OrderBy("-created_at")
+	if err := res.All(&tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GetAll returns the tokens of all users, newest first
+func (t *Token) GetAll() ([]*Token, error) {
+	var tokens []*Token
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find().OrderBy("-created_at")
 	if err := res.All(&tokens); err != nil {
 		return nil, err
 	}
@@ -57,7 +128,7 @@ func (t *Token) GetTokensForUser(id int) ([]*Token, error) {
 
 func (t *Token) Get(id int) (*Token, error) {
 	var token Token
-	collection := upper.Collection(t.Table())
+	collection := dbSession(t.ctx).Collection(t.Table())
 	res := collection.Find(up.Cond{"id": id})
 	if err := res.One(&token); err != nil {
 		return nil, err
@@ -65,10 +136,11 @@ func (t *Token) Get(id int) (*Token, error) {
 	return &token, nil
 }
 
+// GetByToken looks up a token by the hash of the plain text token
 func (t *Token) GetByToken(plainTextToken string) (*Token, error) {
 	var token Token
-	collection := upper.Collection(t.Table())
-	res := collection.Find(up.Cond{"token": plainTextToken})
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find(up.Cond{"token_hash": hashToken(plainTextToken)})
 	if err := res.One(&token); err != nil {
 		return nil, err
 	}
@@ -76,7 +148,7 @@ func (t *Token) GetByToken(plainTextToken string) (*Token, error) {
 }
 
 func (t *Token) Delete(id int) error {
-	collection := upper.Collection(t.Table())
+	collection := dbSession(t.ctx).Collection(t.Table())
 	res := collection.Find(id)
 	if err := res.Delete(); err != nil {
 		return err
@@ -84,36 +156,68 @@ func (t *Token) Delete(id int) error {
 	return nil
 }
 
-func (t *Token) DeleteByToken(plainTextToken string) error {
-	collection := upper.Collection(t.Table())
-	res := collection.Find(up.Cond{"token": plainTextToken})
+// DeleteForUser deletes a token given its id and the id of the user who owns it
+func (t *Token) DeleteForUser(id, userID int) error {
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find(up.Cond{"id": id, "user_id": userID})
 	if err := res.Delete(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (t *Token) Insert(token Token, user User) error {
-	collection := upper.Collection(t.Table())
-	res := collection.Find(up.Cond{"user_id": user.ID})
+// DeleteAllForUser deletes every token of the user
+func (t *Token) DeleteAllForUser(userID int) error {
+	collection := dbSession(t.ctx).Collection(t.Table())
+	return collection.Find(up.Cond{"user_id": userID}).Delete()
+}
+
+func (t *Token) DeleteByToken(plainTextToken string) error {
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find(up.Cond{"token_hash": hashToken(plainTextToken)})
 	if err := res.Delete(); err != nil {
 		return err
 	}
+	return nil
+}
+
+// Insert stores a new token for the user, existing tokens of the user are kept
+func (t *Token) Insert(token Token, user User) (int, error) {
+	if len(token.Hash) == 0 {
+		return 0, errors.New("token has no hash")
+	}
 	token.CreatedAt = time.Now()
 	token.UpdatedAt = time.Now()
 	token.FirstName = user.FirstName
 	token.Email = user.Email
-	_, err := collection.Insert(token)
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res, err := collection.Insert(token)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	id := getInsertID(res.ID())
+	return id, nil
+}
+
+// MarkUsed stores when and from which ip address the token was last used
+func (t *Token) MarkUsed(id int, ip string) error {
+	now := time.Now()
+	collection := dbSession(t.ctx).Collection(t.Table())
+	return collection.Find(id).Update(map[string]interface{}{
+		"last_used_at": now,
+		"last_used_ip": ip,
+		"updated_at":   now,
+	})
 }
 
+// GenerateToken creates a new random token for the user, a ttl of 0 creates a token that never expires
 func (t *Token) GenerateToken(userID int, ttl time.Duration) (*Token, error) {
 	token := &Token{
-		UserID:  userID,
-		Expires: time.Now().Add(ttl),
+		UserID: userID,
+	}
+	if ttl != 0 {
+		expires := time.Now().Add(ttl)
+		token.Expires = &expires
 	}
 	randomBytes := make([]byte, 16)
 	_, err := rand.Read(randomBytes)
@@ -121,11 +225,12 @@ func (t *Token) GenerateToken(userID int, ttl time.Duration) (*Token, error) {
 		return nil, err
 	}
 	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-	hash := sha256.Sum256([]byte(token.PlainText))
-	token.Hash = hash[:]
+	token.Hash = hashToken(token.PlainText)
 	return token, nil
 }
 
+// AuthenticationToken returns the user of the bearer token in the request with the token in
+// user.Token and records the use of the token
 func (t *Token) AuthenticationToken(r *http.Request) (*User, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
@@ -141,18 +246,21 @@ func (t *Token) AuthenticationToken(r *http.Request) (*User, error) {
 		return nil, errors.New("token malformed")
 	}
 
-	tok, err := t.GetByToken(token)
+	user, err := t.GetUserForToken(token)
 	if err != nil {
-		return nil, errors.New("no matching token found")
+		return nil, errors.New("no matching user found")
 	}
 
-	if tok.Expires.Before(time.Now()) {
+	if user.Token.IsExpired() {
 		return nil, errors.New("expired token")
 	}
 
-	user, err := tok.GetUserForToken(token)
-	if err != nil {
-		return nil, errors.New("no matching user found")
+	if user.Active != 1 {
+		return nil, errors.New("user is not active")
+	}
+
+	if err := t.MarkUsed(user.Token.ID, clientIP(r)); err != nil {
+		return nil, err
 	}
 
 	return user, nil
@@ -164,14 +272,24 @@ func (t *Token) ValidToken(token string) (bool, error) {
 		return false, errors.New("no matching user found")
 	}
 
-	if user.Token.PlainText == "" {
-		return false, errors.New("no matching token found")
-	}
-
-	if user.Token.Expires.Before(time.Now()) {
+	if user.Token.IsExpired() {
 		return false, errors.New("expired token")
 	}
 
 	return true, nil
 }
 
+// hashToken returns the sha256 hash under which a plain text token is stored
+func hashToken(plainTextToken string) []byte {
+	hash := sha256.Sum256([]byte(plainTextToken))
+	return hash[:]
+}
+
+// clientIP returns the ip address of the request without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,24 +1,54 @@
 package models
 
 import (
+	"context"
 	"errors"
+	"imperatorapp/auth/password"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/arc41t3ct/imperator"
 	up "github.com/upper/db/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrTOTPCodeUsed is returned for a totp code of a period a code was already accepted for
+var ErrTOTPCodeUsed = errors.New("totp code was already used")
+
+// passwordHasher hashes new passwords, hashes made with other algorithms or weaker settings are
+// replaced when the user logs in next
+var passwordHasher password.Hasher = password.DefaultBcrypt
+
+// dummyHash is made with passwordHasher for the logins without an account, it is made when it is
+// first needed
+var dummyHash struct {
+	sync.Mutex
+	hash string
+}
+
+// SetPasswordHasher sets the hasher for new passwords
+func SetPasswordHasher(hasher password.Hasher) {
+	passwordHasher = hasher
+	dummyHash.Lock()
+	dummyHash.hash = ""
+	dummyHash.Unlock()
+}
+
 type User struct {
-	ID        int       `db:"id,omitempty"`
-	FirstName string    `db:"first_name"`
-	LastName  string    `db:"last_name"`
-	Active    int       `db:"user_active"`
-	Email     string    `db:"email"`
-	Password  string    `db:"password"`
-	CreatedAt time.Time `db:"created_at"`
-	UpdatedAt time.Time `db:"updated_at"`
-	Token     Token     `db:"-"`
+	ID              int        `db:"id,omitempty"`
+	FirstName       string     `db:"first_name"`
+	LastName        string     `db:"last_name"`
+	Active          int        `db:"user_active"`
+	Email           string     `db:"email"`
+	Password        string     `db:"password"`
+	TOTPSecret      string     `db:"totp_secret"`
+	TOTPEnabled     int        `db:"totp_enabled"`
+	EmailVerifiedAt *time.Time `db:"email_verified_at"`
+	CreatedAt       time.Time  `db:"created_at"`
+	UpdatedAt       time.Time  `db:"updated_at"`
+	Token           Token      `db:"-"`
+
+	ctx context.Context
 }
 
 func (u *User) Table() string {
@@ -32,8 +62,46 @@ func (u *User) Validate(validator *imperator.Validation) {
 	validator.IsEmail("email", u.Email)
 }
 
+// ValidateUniqueEmail adds an error when the email is already taken by another user than id
+func (u *User) ValidateUniqueEmail(validator *imperator.Validation, id int, email string) {
+	var existing *User
+	collection := dbSession(u.ctx).Collection(u.Table())
+	err := collection.Find(up.Cond{"email =": email}).One(&existing)
+	if err == nil && existing.ID != id {
+		validator.AddError("email", "Email is already in use")
+	}
+}
+
+// SetActive activates or deactivates a user
+func (u *User) SetActive(id int, active bool) error {
+	user, err := u.Get(id)
+	if err != nil {
+		return err
+	}
+	user.Active = 0
+	if active {
+		user.Active = 1
+	}
+	return user.Update(*user)
+}
+
+// IsVerified reports if the user has verified their email, only self registered users start unverified
+func (u *User) IsVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// VerifyEmail marks the email of the user as verified and activates the user
+func (u *User) VerifyEmail(id int) error {
+	collection := dbSession(u.ctx).Collection(u.Table())
+	return collection.Find(id).Update(map[string]interface{}{
+		"email_verified_at": time.Now(),
+		"user_active":       1,
+		"updated_at":        time.Now(),
+	})
+}
+
 func (u *User) GetAll() ([]*User, error) {
-	collection := upper.Collection(u.Table())
+	collection := dbSession(u.ctx).Collection(u.Table())
 	var all []*User
 	res := collection.Find().OrderBy("created_at")
 	if err := res.All(&all); err != nil {
@@ -42,9 +110,54 @@ func (u *User) GetAll() ([]*User, error) {
 	return all, nil
 }
 
+// userSortColumns maps the sort keys accepted from the admin user list to columns
+var userSortColumns = map[string]string{
+	"name":    "last_name",
+	"email":   "email",
+	"active":  "user_active",
+	"created": "created_at",
+}
+
+// Search returns one page of users matching the query on name or email together with the total
+// number of matches. Unknown sort keys fall back to sorting by creation date.
+func (u *User) Search(query, sort string, desc bool, page, perPage int) ([]*User, int, error) {
+	collection := dbSession(u.ctx).Collection(u.Table())
+	res := collection.Find()
+	if query = strings.ToLower(strings.TrimSpace(query)); query != "" {
+		like := "%" + query + "%"
+		res = collection.Find(up.Or(
+			up.Raw("LOWER(first_name) LIKE ?", like),
+			up.Raw("LOWER(last_name) LIKE ?", like),
+			up.Raw("LOWER(email) LIKE ?", like),
+		))
+	}
+
+	total, err := res.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	column, ok := userSortColumns[sort]
+	if !ok {
+		column = "created_at"
+	}
+	if desc {
+		column = "-" + column
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	var users []*User
+	if err := res.OrderBy(column, "id").Paginate(uint(perPage)).Page(uint(page)).All(&users); err != nil {
+		return nil, 0, err
+	}
+	return users, int(total), nil
+}
+
 func (u *User) GetByEmail(email string) (*User, error) {
 	var user *User
-	collection := upper.Collection((u.Table()))
+	collection := dbSession(u.ctx).Collection((u.Table()))
 	res := collection.Find(up.Cond{"email =": email})
 	if err := res.One(&user); err != nil {
 		return nil, err
@@ -59,12 +172,12 @@ func (u *User) GetByEmail(email string) (*User, error) {
 
 func (u *User) Get(id int) (*User, error) {
 	var user *User
-	collection := upper.Collection((u.Table()))
+	collection := dbSession(u.ctx).Collection((u.Table()))
 	res := collection.Find(up.Cond{"id =": id})
 	if err := res.One(&user); err != nil {
 		return nil, err
 	}
-	token, err := u.getToken()
+	token, err := user.getToken()
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +188,7 @@ func (u *User) Get(id int) (*User, error) {
 // Update updates a user based on the user model it is passed
 func (u *User) Update(user User) error {
 	user.UpdatedAt = time.Now()
-	collection := upper.Collection(u.Table())
+	collection := dbSession(u.ctx).Collection(u.Table())
 	res := collection.Find(user.ID)
 	if err := res.Update(&user); err != nil {
 		return err
@@ -85,7 +198,7 @@ func (u *User) Update(user User) error {
 
 // Delete deletes a user given the user's id
 func (u *User) Delete(id int) error {
-	collection := upper.Collection(u.Table())
+	collection := dbSession(u.ctx).Collection(u.Table())
 	res := collection.Find(id)
 	if err := res.Delete(); err != nil {
 		return err
@@ -95,26 +208,31 @@ func (u *User) Delete(id int) error {
 
 // Insert creates a new user given a user
 func (u *User) Insert(user User) (int, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hash, err := passwordHasher.Hash(user.Password)
 	if err != nil {
 		return 0, err
 	}
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
-	user.Password = string(hash)
+	user.Password = hash
 
-	collection := upper.Collection(u.Table())
+	collection := dbSession(u.ctx).Collection(u.Table())
 	res, err := collection.Insert(user)
 	if err != nil {
 		return 0, err
 	}
 	id := getInsertID(res.ID())
+	history := PasswordHistory{ctx: u.ctx}
+	if err := history.Add(id, user.Password); err != nil {
+		return id, err
+	}
 	return id, nil
 }
 
-// ResetPassword resets the password of a user given the id and new password
-func (u *User) ResetPassword(id int, password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+// ResetPassword resets the password of a user given the id and new password, password reset
+// links sent before stop working
+func (u *User) ResetPassword(id int, plain string) error {
+	hash, err := passwordHasher.Hash(plain)
 	if err != nil {
 		return err
 	}
@@ -123,34 +241,70 @@ func (u *User) ResetPassword(id int, password string) error {
 		return err
 	}
 
-	u.UpdatedAt = time.Now()
-	u.Password = string(hash)
-	if err := user.Update(*u); err != nil {
+	user.UpdatedAt = time.Now()
+	user.Password = hash
+	if err := u.Update(*user); err != nil {
 		return err
 	}
-	return nil
+	history := PasswordHistory{ctx: u.ctx}
+	if err := history.Add(id, user.Password); err != nil {
+		return err
+	}
+	tokens := UserToken{ctx: u.ctx}
+	return tokens.RevokeForUser(id, PurposePasswordReset)
 }
 
-// PasswordMatches check the supplied passwordInput and the hashed password to see if they match
+// PasswordMatches check the supplied passwordInput and the hashed password to see if they match.
+// A hash made with another algorithm or weaker settings than configured is replaced on a match,
+// failing to do so does not fail the match.
 func (u *User) PasswordMatches(passwordInput string) (bool, error) {
-	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(passwordInput)); err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
+	matches, err := password.Verify(u.Password, passwordInput)
+	if err != nil || !matches {
+		return false, err
+	}
+	if passwordHasher.NeedsRehash(u.Password) {
+		if hash, err := passwordHasher.Hash(passwordInput); err == nil && u.updatePasswordHash(u.ID, hash) == nil {
+			u.Password = hash
 		}
 	}
 	return true, nil
 }
 
+// PasswordMatchesNone checks the password against a hash made by the configured hasher for a
+// login without an account, it takes as long as a wrong password so the time does not tell who
+// has an account
+func (u *User) PasswordMatchesNone(passwordInput string) {
+	dummyHash.Lock()
+	if dummyHash.hash == "" {
+		hash, err := passwordHasher.Hash("no account has this password")
+		if err != nil {
+			dummyHash.Unlock()
+			return
+		}
+		dummyHash.hash = hash
+	}
+	hash := dummyHash.hash
+	dummyHash.Unlock()
+	_, _ = password.Verify(hash, passwordInput)
+}
+
+// updatePasswordHash replaces the hash of the same password, unlike ResetPassword it is not a new
+// password so the history and the reset links are left alone
+func (u *User) updatePasswordHash(id int, hash string) error {
+	collection := dbSession(u.ctx).Collection(u.Table())
+	return collection.Find(id).Update(map[string]interface{}{
+		"password": hash,
+	})
+}
+
 // getToken return a Token used which is used for authentiction
 func (u *User) getToken() (Token, error) {
 	var token Token
-	collection := upper.Collection(token.Table())
-	res := collection.Find(up.Cond{
-		"user_id =": u.ID, "expiry >": time.Now(),
-	}).OrderBy("created_at desc")
+	collection := dbSession(u.ctx).Collection(token.Table())
+	res := collection.Find(
+		up.Cond{"user_id =": u.ID},
+		up.Or(up.Cond{"expiry": nil}, up.Cond{"expiry >": time.Now()}),
+	).OrderBy("created_at desc")
 	err := res.One(&token)
 	if err != nil {
 		if err != up.ErrNilRecord && err != up.ErrNoMoreRows {
@@ -160,11 +314,94 @@ func (u *User) getToken() (Token, error) {
 	return token, nil
 }
 
-func (u *User) CheckForRememberToken(id int, token string) bool {
-	var remeberToken RememberToken
-	rt := RememberToken{}
-	collection := upper.Collection(rt.Table())
-	res := collection.Find(up.Cond{"user_id": id, "remeber_token": token})
-	err := res.One(&remeberToken)
-	return err == nil
+// HasTwoFactor reports whether the user has completed totp enrollment
+func (u *User) HasTwoFactor() bool {
+	return u.TOTPEnabled == 1 && u.TOTPSecret != ""
+}
+
+// EnableTwoFactor stores the already encrypted totp secret for a user and turns on the
+// second login step
+func (u *User) EnableTwoFactor(id int, encryptedSecret string) error {
+	user, err := u.Get(id)
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = encryptedSecret
+	user.TOTPEnabled = 1
+	return user.Update(*user)
+}
+
+// UseTOTPCounter records that a totp code of the period counter was accepted for the user. It
+// returns ErrTOTPCodeUsed when a code of this or a later period was accepted before, even by a
+// concurrent request. The counter is not part of User so an Update can not reset it.
+func (u *User) UseTOTPCounter(id int, counter uint64) error {
+	res, err := dbSession(u.ctx).SQL().
+		Update(u.Table()).
+		Set("totp_counter", int64(counter)).
+		Where("id = ? AND totp_counter < ?", id, int64(counter)).
+		Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+// DisableTwoFactor removes the totp secret and all recovery codes of a user
+func (u *User) DisableTwoFactor(id int) error {
+	user, err := u.Get(id)
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabled = 0
+	if err := user.Update(*user); err != nil {
+		return err
+	}
+	var rc RecoveryCode
+	return rc.DeleteAllForUser(id)
+}
+
+// IsSuperAdmin reports whether the user has the super-admin role which passes every permission check
+func (u *User) IsSuperAdmin(id int) (bool, error) {
+	var r Role
+	roles, err := r.GetForUser(id)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if role.Name == SuperAdminRole {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PermissionNames returns the names of all permissions a user has through their roles
+func (u *User) PermissionNames(id int) (map[string]bool, error) {
+	var p Permission
+	permissions, err := p.GetForUser(id)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(permissions))
+	for _, permission := range permissions {
+		names[permission.Name] = true
+	}
+	return names, nil
+}
+
+// HasPermission checks whether a user has been granted the permission through any of their roles
+func (u *User) HasPermission(id int, permission string) (bool, error) {
+	super, err := u.IsSuperAdmin(id)
+	if err != nil || super {
+		return super, err
+	}
+	names, err := u.PermissionNames(id)
+	if err != nil {
+		return false, err
+	}
+	return names[permission], nil
 }
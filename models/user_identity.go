@@ -0,0 +1,69 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// UserIdentity links a user to their account at an OpenID Connect provider. Subject is the
+// stable id the provider gives the user, the email is only used to link the first login.
+type UserIdentity struct {
+	ID          int       `db:"id,omitempty"`
+	UserID      int       `db:"user_id"`
+	Provider    string    `db:"provider"`
+	Subject     string    `db:"subject"`
+	Email       string    `db:"email"`
+	CreatedAt   time.Time `db:"created_at"`
+	LastLoginAt time.Time `db:"last_login_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the UserIdentity
+func (i *UserIdentity) Table() string {
+	return "user_identities"
+}
+
+// GetBySubject returns the identity of the provider with the subject
+func (i *UserIdentity) GetBySubject(provider, subject string) (*UserIdentity, error) {
+	var identity UserIdentity
+	collection := dbSession(i.ctx).Collection(i.Table())
+	res := collection.Find(up.Cond{"provider =": provider, "subject =": subject})
+	if err := res.One(&identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// GetForUser returns the identities linked to a user
+func (i *UserIdentity) GetForUser(userID int) ([]*UserIdentity, error) {
+	var all []*UserIdentity
+	collection := dbSession(i.ctx).Collection(i.Table())
+	if err := collection.Find(up.Cond{"user_id =": userID}).OrderBy("provider").All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Insert links an identity to a user
+func (i *UserIdentity) Insert(identity UserIdentity) (int, error) {
+	identity.CreatedAt = time.Now()
+	identity.LastLoginAt = time.Now()
+	collection := dbSession(i.ctx).Collection(i.Table())
+	res, err := collection.Insert(identity)
+	if err != nil {
+		return 0, err
+	}
+	return getInsertID(res.ID()), nil
+}
+
+// Touch records a login with the identity and the email the provider has for it now
+func (i *UserIdentity) Touch(id int, email string) error {
+	collection := dbSession(i.ctx).Collection(i.Table())
+	return collection.Find(id).Update(map[string]interface{}{
+		"email":         email,
+		"last_login_at": time.Now(),
+	})
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// UserSession indexes a logged in session by user so sessions can be listed and revoked no matter
+// which store holds the session data. SessionKey is a random id kept inside the session and
+// StoreToken is the encrypted token of the session store.
+type UserSession struct {
+	ID              int       `db:"id,omitempty"`
+	UserID          int       `db:"user_id"`
+	SessionKey      string    `db:"session_key"`
+	StoreToken      string    `db:"store_token"`
+	TokenHash       string    `db:"token_hash"`
+	RememberTokenID int       `db:"remember_token_id"`
+	UserAgent       string    `db:"user_agent"`
+	IP              string    `db:"ip"`
+	CreatedAt       time.Time `db:"created_at"`
+	LastSeenAt      time.Time `db:"last_seen_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the UserSession
+func (s *UserSession) Table() string {
+	return "user_sessions"
+}
+
+// Insert indexes a new session
+func (s *UserSession) Insert(session UserSession) (int, error) {
+	session.CreatedAt = time.Now()
+	session.LastSeenAt = time.Now()
+	if len(session.UserAgent) > 512 {
+		session.UserAgent = session.UserAgent[:512]
+	}
+	collection := dbSession(s.ctx).Collection(s.Table())
+	res, err := collection.Insert(session)
+	if err != nil {
+		return 0, err
+	}
+	return getInsertID(res.ID()), nil
+}
+
+// Get returns a session given its id
+func (s *UserSession) Get(id int) (*UserSession, error) {
+	var session UserSession
+	collection := dbSession(s.ctx).Collection(s.Table())
+	if err := collection.Find(up.Cond{"id =": id}).One(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetByKey returns the session with the key stored inside the session data
+func (s *UserSession) GetByKey(key string) (*UserSession, error) {
+	var session UserSession
+	collection := dbSession(s.ctx).Collection(s.Table())
+	if err := collection.Find(up.Cond{"session_key =": key}).One(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetForUser returns the sessions of a user, the most recently used first
+func (s *UserSession) GetForUser(userID int) ([]*UserSession, error) {
+	var all []*UserSession
+	collection := dbSession(s.ctx).Collection(s.Table())
+	res := collection.Find(up.Cond{"user_id =": userID}).OrderBy("-last_seen_at", "-id")
+	if err := res.All(&all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Touch records that the session was used and the store token it has now
+func (s *UserSession) Touch(id int, storeToken, tokenHash, ip string) error {
+	collection := dbSession(s.ctx).Collection(s.Table())
+	return collection.Find(id).Update(map[string]interface{}{
+		"store_token":  storeToken,
+		"token_hash":   tokenHash,
+		"ip":           ip,
+		"last_seen_at": time.Now(),
+	})
+}
+
+// Delete removes a session from the index
+func (s *UserSession) Delete(id int) error {
+	collection := dbSession(s.ctx).Collection(s.Table())
+	return collection.Find(id).Delete()
+}
+
+// CountActive returns the number of sessions seen since
+func (s *UserSession) CountActive(since time.Time) (int, error) {
+	collection := dbSession(s.ctx).Collection(s.Table())
+	count, err := collection.Find(up.Cond{"last_seen_at >=": since}).Count()
+	return int(count), err
+}
+
+// DeleteStale removes the sessions not seen since before, their data has expired in the store
+func (s *UserSession) DeleteStale(before time.Time) error {
+	collection := dbSession(s.ctx).Collection(s.Table())
+	return collection.Find(up.Cond{"last_seen_at <": before}).Delete()
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	up "github.com/upper/db/v4"
+)
+
+// purposes of user tokens, a token can only be used for the purpose it was issued for
+const (
+	PurposePasswordReset = "password_reset"
+	PurposeMagicLink     = "magic_link"
+)
+
+// ErrUserTokenInvalid is returned for tokens that do not exist, have expired or were used
+var ErrUserTokenInvalid = errors.New("token is invalid or expired")
+
+// UserToken is a single-use secret sent to a user by email, like a password reset link. Only
+// the sha256 hash of the token is stored.
+type UserToken struct {
+	ID         int        `db:"id,omitempty"`
+	UserID     int        `db:"user_id"`
+	Purpose    string     `db:"purpose"`
+	TokenHash  string     `db:"token_hash"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	ConsumedAt *time.Time `db:"consumed_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+
+	ctx context.Context
+}
+
+// Table returns the table name for the UserToken
+func (t *UserToken) Table() string {
+	return "user_tokens"
+}
+
+// Issue creates a token for the user and purpose that is valid for ttl and returns the plain
+// text token. Earlier tokens of the user for the same purpose stop working.
+func (t *UserToken) Issue(userID int, purpose string, ttl time.Duration) (string, error) {
+	if err := t.RevokeForUser(userID, purpose); err != nil {
+		return "", err
+	}
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	plain := base64.RawURLEncoding.EncodeToString(randomBytes)
+	token := UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashUserToken(plain),
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+	collection := dbSession(t.ctx).Collection(t.Table())
+	if _, err := collection.Insert(token); err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// Peek returns the token for the plain text and purpose when it can still be used without
+// using it up, it is used to decide if a form should be shown at all
+func (t *UserToken) Peek(plain, purpose string) (*UserToken, error) {
+	if plain == "" {
+		return nil, ErrUserTokenInvalid
+	}
+	var token UserToken
+	collection := dbSession(t.ctx).Collection(t.Table())
+	res := collection.Find(up.Cond{
+		"token_hash =": hashUserToken(plain),
+		"purpose =":    purpose,
+		"consumed_at":  nil,
+		"expires_at >": time.Now(),
+	})
+	if err := res.One(&token); err != nil {
+		if errors.Is(err, up.ErrNoMoreRows) {
+			return nil, ErrUserTokenInvalid
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Consume uses up the token for the plain text and purpose and returns it. A token can only be
+// consumed once, even by concurrent requests.
+func (t *UserToken) Consume(plain, purpose string) (*UserToken, error) {
+	token, err := t.Peek(plain, purpose)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	res, err := dbSession(t.ctx).SQL().
+		Update(t.Table()).
+		Set("consumed_at", now).
+		Where("id = ? AND consumed_at IS NULL", token.ID).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return nil, ErrUserTokenInvalid
+	}
+	token.ConsumedAt = &now
+	return token, nil
+}
+
+// RevokeForUser uses up all open tokens of the user for the purpose
+func (t *UserToken) RevokeForUser(userID int, purpose string) error {
+	_, err := dbSession(t.ctx).SQL().
+		Update(t.Table()).
+		Set("consumed_at", time.Now()).
+		Where("user_id = ? AND purpose = ? AND consumed_at IS NULL", userID, purpose).
+		Exec()
+	return err
+}
+
+// DeleteExpired removes the tokens that can no longer be used
+func (t *UserToken) DeleteExpired() error {
+	_, err := dbSession(t.ctx).SQL().
+		DeleteFrom(t.Table()).
+		Where("expires_at < ? OR consumed_at IS NOT NULL", time.Now()).
+		Exec()
+	return err
+}
+
+// hashUserToken hashes a plain text token, tokens carry 256 random bits so a fast hash is
+// sufficient
+func hashUserToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
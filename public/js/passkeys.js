@@ -0,0 +1,81 @@
+// Browser side of the webauthn ceremonies. The server exchanges all binary values as base64url
+// strings so we convert them to and from ArrayBuffers here.
+
+function b64urlDecode(value) {
+  let s = value.replace(/-/g, "+").replace(/_/g, "/");
+  while (s.length % 4) {
+    s += "=";
+  }
+  return Uint8Array.from(atob(s), c => c.charCodeAt(0)).buffer;
+}
+
+function b64urlEncode(buffer) {
+  let s = String.fromCharCode(...new Uint8Array(buffer));
+  return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+async function passkeyPost(url, body) {
+  let res = await fetch(url, {
+    method: "POST",
+    credentials: "same-origin",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]').content,
+    },
+    body: JSON.stringify(body || {}),
+  });
+  let data = await res.json();
+  if (data.error) {
+    throw new Error(data.message);
+  }
+  return data;
+}
+
+function passkeyDescriptors(list) {
+  return (list || []).map(c => Object.assign({}, c, { id: b64urlDecode(c.id) }));
+}
+
+async function passkeyRegister(name) {
+  let begin = await passkeyPost("/admin/user/passkeys/register/begin");
+  let opts = begin.options;
+  opts.challenge = b64urlDecode(opts.challenge);
+  opts.user.id = b64urlDecode(opts.user.id);
+  opts.excludeCredentials = passkeyDescriptors(opts.excludeCredentials);
+
+  let cred = await navigator.credentials.create({ publicKey: opts });
+  let finish = await passkeyPost("/admin/user/passkeys/register/finish", {
+    name: name,
+    credential: {
+      id: cred.id,
+      rawId: b64urlEncode(cred.rawId),
+      type: cred.type,
+      response: {
+        clientDataJSON: b64urlEncode(cred.response.clientDataJSON),
+        attestationObject: b64urlEncode(cred.response.attestationObject),
+        transports: cred.response.getTransports ? cred.response.getTransports() : [],
+      },
+    },
+  });
+  window.location = finish.redirect;
+}
+
+async function passkeyLogin() {
+  let begin = await passkeyPost("/admin/user/passkeys/login/begin");
+  let opts = begin.options;
+  opts.challenge = b64urlDecode(opts.challenge);
+  opts.allowCredentials = passkeyDescriptors(opts.allowCredentials);
+
+  let cred = await navigator.credentials.get({ publicKey: opts });
+  let finish = await passkeyPost("/admin/user/passkeys/login/finish", {
+    id: cred.id,
+    rawId: b64urlEncode(cred.rawId),
+    type: cred.type,
+    response: {
+      clientDataJSON: b64urlEncode(cred.response.clientDataJSON),
+      authenticatorData: b64urlEncode(cred.response.authenticatorData),
+      signature: b64urlEncode(cred.response.signature),
+      userHandle: cred.response.userHandle ? b64urlEncode(cred.response.userHandle) : "",
+    },
+  });
+  window.location = finish.redirect;
+}
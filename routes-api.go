@@ -0,0 +1,45 @@
+package main
+
+import (
+	"imperatorapp/models"
+
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// apiRoutes returns the router of the json api, requests are authenticated with bearer tokens
+func (a *application) apiRoutes() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(middleware.CleanPath)
+	r.Use(middleware.Recoverer)
+	if a.App.Debug {
+		r.Use(middleware.Logger)
+	}
+
+	r.Post("/tokens", a.Handlers.APITokenCreate)
+
+	r.Group(func(r chi.Router) {
+		r.Use(a.Middlware.AuthToken)
+		r.Delete("/tokens", a.Handlers.APITokenRevoke)
+		r.Delete("/tokens/{id}", a.Handlers.APITokenRevoke)
+
+		r.Group(func(r chi.Router) {
+			r.Use(a.Middlware.RequireScope(models.ScopeUsersRead))
+			r.With(a.Middlware.RequireTokenPermission("users.view")).Get("/users", a.Handlers.APIUsers)
+			r.With(a.Middlware.RequireTokenPermission("users.view")).Get("/users/{id}", a.Handlers.APIUser)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(a.Middlware.RequireScope(models.ScopeUsersWrite))
+			r.With(a.Middlware.RequireTokenPermission("users.create")).Post("/users", a.Handlers.APIUserCreate)
+			r.With(a.Middlware.RequireTokenPermission("users.edit")).Put("/users/{id}", a.Handlers.APIUserUpdate)
+			r.With(a.Middlware.RequireTokenPermission("users.edit")).Patch("/users/{id}", a.Handlers.APIUserUpdate)
+			r.With(a.Middlware.RequireTokenPermission("users.delete")).Delete("/users/{id}", a.Handlers.APIUserDelete)
+		})
+	})
+
+	r.NotFound(a.Handlers.APINotFound)
+	r.MethodNotAllowed(a.Handlers.APIMethodNotAllowed)
+	return r
+}
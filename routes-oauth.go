@@ -0,0 +1,27 @@
+package main
+
+import (
+	chi "github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// oauthRoutes adds the endpoints of the OAuth provider that clients call directly. They skip the
+// session and csrf middleware of the web routes since clients authenticate with their
+// credentials or a bearer token, the authorization endpoint is a web route.
+func (a *application) oauthRoutes(mux chi.Router) {
+	mux.Group(func(r chi.Router) {
+		r.Use(middleware.RequestID)
+		r.Use(middleware.RealIP)
+		r.Use(middleware.Recoverer)
+		if a.App.Debug {
+			r.Use(middleware.Logger)
+		}
+
+		r.Get("/.well-known/openid-configuration", a.Handlers.OAuthDiscovery)
+		r.Get("/oauth/jwks", a.Handlers.OAuthJWKS)
+		r.Post("/oauth/token", a.Handlers.OAuthToken)
+		r.Post("/oauth/introspect", a.Handlers.OAuthIntrospect)
+		r.Get("/oauth/userinfo", a.Handlers.OAuthUserInfo)
+		r.Post("/oauth/userinfo", a.Handlers.OAuthUserInfo)
+	})
+}
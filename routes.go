@@ -10,21 +10,121 @@ func (a *application) routes() *chi.Mux {
 	// middleware must come before any routes using aliases
 	a.use(a.Middlware.Admin)
 	a.use(a.Middlware.Remember)
+	a.use(a.Middlware.TrackSession)
 	// routes go here using the aloases
 	a.get("/", a.Handlers.Home)
 
 	a.get("/admin/area", a.Handlers.Admin)
 	a.get("/admin/user/login", a.Handlers.Login)
 	a.post("/admin/user/login", a.Handlers.LoginPost)
+	a.post("/admin/user/login/certificate", a.Handlers.CertificateLogin)
 	a.get("/admin/user/logout", a.Handlers.Logout)
 	a.get("/admin/user/reset", a.Handlers.PasswordReset)
 	a.get("/admin/user/forgot-password", a.Handlers.PasswordForgot)
 	a.post("/admin/user/forgot-password", a.Handlers.PasswordForgotPost)
 	a.get("/admin/user/reset-password", a.Handlers.PasswordReset)
 	a.post("/admin/user/reset-password", a.Handlers.PasswordResetPost)
+	a.get("/admin/user/magic-link", a.Handlers.MagicLink)
+	a.post("/admin/user/magic-link", a.Handlers.MagicLinkPost)
+	a.get("/admin/user/magic-link/verify", a.Handlers.MagicLinkVerify)
+	a.get("/admin/user/two-factor", a.Handlers.TwoFactor)
+	a.post("/admin/user/two-factor", a.Handlers.TwoFactorPost)
+	a.post("/admin/user/passkeys/login/begin", a.Handlers.PasskeyLoginBegin)
+	a.post("/admin/user/passkeys/login/finish", a.Handlers.PasskeyLoginFinish)
+	a.get("/auth/oidc/{provider}", a.Handlers.OIDCLogin)
+	a.get("/auth/oidc/{provider}/callback", a.Handlers.OIDCCallback)
+	// an admin logged in as a user can not log in to other apps as them, not even with a consent
+	// the user gave before
+	a.App.Routes.With(a.Middlware.NotImpersonating).Get("/oauth/authorize", a.Handlers.OAuthAuthorize)
+	a.App.Routes.With(a.Middlware.NotImpersonating).Post("/oauth/authorize", a.Handlers.OAuthAuthorizePost)
+	a.get("/user/register", a.Handlers.Register)
+	a.post("/user/register", a.Handlers.RegisterPost)
+	a.get("/user/verify", a.Handlers.Verify)
+	a.get("/user/verify/resend", a.Handlers.ResendVerification)
+	a.post("/user/verify/resend", a.Handlers.ResendVerificationPost)
+	a.get("/user/invitation", a.Handlers.InvitationAccept)
+	a.post("/user/invitation", a.Handlers.InvitationAcceptPost)
+
+	// routes that need a fully authenticated user
+	a.App.Routes.Group(func(r chi.Router) {
+		r.Use(a.Middlware.Auth)
+		r.Get("/admin/user/passkeys", a.Handlers.Passkeys)
+		r.Get("/admin/user/tokens", a.Handlers.Tokens)
+		r.Get("/admin/user/sessions", a.Handlers.Sessions)
+		r.Post("/admin/user/impersonate/stop", a.Handlers.ImpersonateStop)
+
+		// the security settings of an account are off limits to an admin logged in as its user
+		r.Group(func(r chi.Router) {
+			r.Use(a.Middlware.NotImpersonating)
+			r.Get("/admin/user/two-factor/enroll", a.Handlers.TwoFactorEnroll)
+			r.Post("/admin/user/two-factor/enroll", a.Handlers.TwoFactorEnrollPost)
+			r.Post("/admin/user/two-factor/disable", a.Handlers.TwoFactorDisable)
+			r.Post("/admin/user/passkeys/register/begin", a.Handlers.PasskeyRegisterBegin)
+			r.Post("/admin/user/passkeys/register/finish", a.Handlers.PasskeyRegisterFinish)
+			r.Post("/admin/user/passkeys/delete", a.Handlers.PasskeyDelete)
+			r.Post("/admin/user/tokens", a.Handlers.TokenCreatePost)
+			r.Post("/admin/user/tokens/{id}/revoke", a.Handlers.TokenRevoke)
+			r.Post("/admin/user/sessions/revoke-others", a.Handlers.SessionsRevokeOthers)
+			r.Post("/admin/user/sessions/{session}/revoke", a.Handlers.SessionRevoke)
+			r.Post("/admin/user/sessions/devices/{device}/revoke", a.Handlers.RememberRevoke)
+		})
+
+		// user management
+		r.With(a.Middlware.RequirePermission("users.view")).Get("/admin/users", a.Handlers.Users)
+		r.With(a.Middlware.RequirePermission("users.create")).Get("/admin/users/create", a.Handlers.UserCreate)
+		r.With(a.Middlware.NotImpersonating, a.Middlware.RequirePermission("users.create")).Post("/admin/users/create", a.Handlers.UserCreatePost)
+		r.With(a.Middlware.RequirePermission("users.edit")).Get("/admin/users/{id}/edit", a.Handlers.UserEdit)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/edit", a.Handlers.UserEditPost)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/activate", a.Handlers.UserActivate)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/deactivate", a.Handlers.UserDeactivate)
+		r.With(a.Middlware.NotImpersonating, a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/send-reset", a.Handlers.UserSendReset)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/unlock", a.Handlers.UserUnlock)
+		r.With(a.Middlware.RequirePermission("users.edit")).Get("/admin/users/{id}/sessions", a.Handlers.UserSessions)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/sessions/revoke-all", a.Handlers.UserSessionsRevokeAll)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/sessions/{session}/revoke", a.Handlers.UserSessionRevoke)
+		r.With(a.Middlware.RequirePermission("users.edit")).Post("/admin/users/{id}/sessions/devices/{device}/revoke", a.Handlers.UserRememberRevoke)
+		r.With(a.Middlware.NotImpersonating, a.Middlware.RequirePermission("users.impersonate")).Post("/admin/users/{id}/impersonate", a.Handlers.UserImpersonate)
+		r.With(a.Middlware.RequirePermission("users.delete")).Get("/admin/users/{id}/delete", a.Handlers.UserDelete)
+		r.With(a.Middlware.RequirePermission("users.delete")).Post("/admin/users/{id}/delete", a.Handlers.UserDeletePost)
+
+		// invitations to create an account
+		r.With(a.Middlware.RequirePermission("users.create")).Get("/admin/invitations", a.Handlers.Invitations)
+		r.With(a.Middlware.RequirePermission("users.create")).Get("/admin/invitations/create", a.Handlers.InvitationCreate)
+		r.With(a.Middlware.NotImpersonating, a.Middlware.RequirePermission("users.create")).Post("/admin/invitations/create", a.Handlers.InvitationCreatePost)
+		r.With(a.Middlware.NotImpersonating, a.Middlware.RequirePermission("users.create")).Post("/admin/invitations/{id}/resend", a.Handlers.InvitationResend)
+		r.With(a.Middlware.RequirePermission("users.create")).Post("/admin/invitations/{id}/revoke", a.Handlers.InvitationRevoke)
+
+		// api tokens of all users
+		r.With(a.Middlware.RequirePermission("tokens.manage")).Get("/admin/tokens", a.Handlers.AdminTokens)
+		r.With(a.Middlware.RequirePermission("tokens.manage")).Post("/admin/tokens/{id}/revoke", a.Handlers.AdminTokenRevoke)
+
+		// apps that log their users in through the portal
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Get("/admin/oauth/clients", a.Handlers.OAuthClients)
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Get("/admin/oauth/clients/create", a.Handlers.OAuthClientCreate)
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Post("/admin/oauth/clients/create", a.Handlers.OAuthClientCreatePost)
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Get("/admin/oauth/clients/{id}/edit", a.Handlers.OAuthClientEdit)
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Post("/admin/oauth/clients/{id}/edit", a.Handlers.OAuthClientEditPost)
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Post("/admin/oauth/clients/{id}/secret", a.Handlers.OAuthClientSecret)
+		r.With(a.Middlware.RequirePermission("oauth.manage")).Post("/admin/oauth/clients/{id}/delete", a.Handlers.OAuthClientDelete)
+
+		// audit log
+		r.With(a.Middlware.RequirePermission("audit.view")).Get("/admin/audit", a.Handlers.AuditLog)
+		r.With(a.Middlware.RequirePermission("audit.view")).Get("/admin/audit/export", a.Handlers.AuditExport)
+	})
 
 	// static routes do not edit below here
 	fileServer := http.FileServer(http.Dir("./public"))
 	a.App.Routes.Handle("/public/*", http.StripPrefix("/public", fileServer))
-	return a.App.Routes
+
+	// the api is mounted next to the web routes so it skips their session and csrf middleware
+	mux := chi.NewRouter()
+	// the api and oauth routes use RealIP, the throttles need the address of the connection
+	mux.Use(a.App.RememberPeer)
+	// the api and oauth endpoints are traced and measured like the web routes
+	mux.Use(a.App.Trace)
+	mux.Use(a.App.Instrument)
+	mux.Mount("/api/v1", a.apiRoutes())
+	a.oauthRoutes(mux)
+	mux.Mount("/", a.App.Routes)
+	return mux
 }
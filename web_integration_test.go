@@ -0,0 +1,838 @@
+//go:build integration
+
+// run tests with this command: go test -tags integration -run TestWeb .
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"imperatorapp/auth/ldap"
+	"imperatorapp/auth/oidc"
+	"imperatorapp/auth/oidc/oidctest"
+	"imperatorapp/auth/remember"
+	"imperatorapp/auth/throttle"
+	"imperatorapp/auth/totp"
+	"imperatorapp/auth/webauthn/webauthntest"
+	"imperatorapp/models"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arc41t3ct/imperator"
+	"github.com/arc41t3ct/imperator/mailer"
+)
+
+// webURL is the APP_URL of the tests, sign-in links and passkeys are made for it
+const webURL = "http://localhost:4000"
+
+const webEncryptionKey = "0123456789abcdef0123456789abcdef"
+
+var webApp *application
+var webRoutes http.Handler
+
+// webMail receives every mail the handlers queue
+var webMail = make(chan mailer.Message, 100)
+
+// mailWait is how long a test waits for a mail, a dispatched mail may arrive after the response
+const mailWait = time.Second
+
+// captureMail answers the mail queue of the app instead of a mail server
+func captureMail(imp *imperator.Imperator) {
+	imp.Mail.Jobs = make(chan mailer.Message)
+	go func() {
+		for msg := range imp.Mail.Jobs {
+			webMail <- msg
+			if msg.Done != nil {
+				msg.Done(mailer.Result{Success: true})
+				continue
+			}
+			msg.Reply <- mailer.Result{Success: true}
+		}
+	}()
+}
+
+// browser is one visitor of the web routes keeping its cookies. Every browser has an address of
+// its own so the failures of one test do not throttle the next.
+type browser struct {
+	t    *testing.T
+	jar  *cookiejar.Jar
+	addr string
+	// tls is the connection state of the requests, it carries the client certificate
+	tls *tls.ConnectionState
+}
+
+var browsers int
+
+func newBrowser(t *testing.T) *browser {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browsers++
+	return &browser{t: t, jar: jar, addr: fmt.Sprintf("192.0.2.%d:4711", browsers)}
+}
+
+// do sends the request through the routes of the app and keeps the cookies of the response
+func (b *browser) do(method, target, contentType string, body io.Reader) *http.Response {
+	b.t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = b.addr
+	r.TLS = b.tls
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	site := &url.URL{Scheme: "http", Host: "localhost", Path: r.URL.Path}
+	for _, c := range b.jar.Cookies(site) {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	webRoutes.ServeHTTP(w, r)
+	resp := w.Result()
+	b.jar.SetCookies(site, resp.Cookies())
+	return resp
+}
+
+func (b *browser) get(target string) *http.Response {
+	b.t.Helper()
+	return b.do(http.MethodGet, target, "", nil)
+}
+
+func (b *browser) post(target string, form url.Values) *http.Response {
+	b.t.Helper()
+	return b.do(http.MethodPost, target, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
+
+func (b *browser) postJSON(target string, v interface{}) *http.Response {
+	b.t.Helper()
+	body, _ := json.Marshal(v)
+	return b.do(http.MethodPost, target, "application/json", strings.NewReader(string(body)))
+}
+
+// login logs in with the password form and returns where it was sent
+func (b *browser) login(email string) string {
+	b.t.Helper()
+	return b.post("/admin/user/login", url.Values{"email": {email}, "password": {"password"}}).Header.Get("Location")
+}
+
+// loggedIn reports whether the browser gets past the Auth middleware
+func (b *browser) loggedIn() bool {
+	b.t.Helper()
+	return b.get("/admin/user/sessions").StatusCode != http.StatusUnauthorized
+}
+
+// ip returns the address the login throttle counts the browser by
+func (b *browser) ip() string {
+	host, _, _ := net.SplitHostPort(b.addr)
+	return host
+}
+
+// expectRedirect fails the test unless the response redirects to the location
+func expectRedirect(t *testing.T, what string, resp *http.Response, location string) {
+	t.Helper()
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != location {
+		t.Errorf("%s: expected a redirect to %s and got %d to %q", what, location, resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+// webUser inserts a user with the password "password"
+func webUser(t *testing.T, email string, active int, verified bool) *models.User {
+	t.Helper()
+	user := models.User{FirstName: "Web", LastName: "User", Email: email, Active: active, Password: "password"}
+	if verified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	id, err := apiModels.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := apiModels.Users.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// deactivate sets the user inactive directly, like an admin would in another request
+func deactivate(t *testing.T, user *models.User) {
+	t.Helper()
+	u, err := apiModels.Users.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Active = 0
+	if err := apiModels.Users.Update(*u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// linkDirectory links the user to an LDAP entry and turns LDAP on for the test, linked users may
+// only log in through the directory
+func linkDirectory(t *testing.T, user *models.User) {
+	t.Helper()
+	if _, err := apiModels.Identities.Insert(models.UserIdentity{
+		UserID: user.ID, Provider: "ldap", Subject: "uid=" + user.Email, Email: user.Email,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	webApp.Handlers.LDAP = ldap.New(ldap.Config{})
+	t.Cleanup(func() { webApp.Handlers.LDAP = nil })
+}
+
+// auditCount returns the number of events of the action about the target
+func auditCount(t *testing.T, action, target string) int {
+	t.Helper()
+	_, total, err := apiModels.AuditEvents.Search(models.AuditFilter{Action: action, Target: target}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+func TestWeb_LoginGates(t *testing.T) {
+	webUser(t, "web-login@example.com", 1, true)
+	webUser(t, "web-login-inactive@example.com", 0, true)
+	webUser(t, "web-login-unverified@example.com", 1, false)
+
+	for _, test := range []struct {
+		name, email, password, location string
+	}{
+		{"wrong password", "web-login@example.com", "wrong", "/admin/user/login"},
+		{"unknown email", "web-nobody@example.com", "password", "/admin/user/login"},
+		{"deactivated user", "web-login-inactive@example.com", "password", "/admin/user/login"},
+		{"unverified user", "web-login-unverified@example.com", "password", "/user/verify/resend"},
+	} {
+		b := newBrowser(t)
+		resp := b.post("/admin/user/login", url.Values{"email": {test.email}, "password": {test.password}})
+		expectRedirect(t, test.name, resp, test.location)
+		if b.loggedIn() {
+			t.Errorf("%s: logged in", test.name)
+		}
+	}
+
+	b := newBrowser(t)
+	if location := b.login("web-login@example.com"); location != "/admin/area" || !b.loggedIn() {
+		t.Error("failed to log in, sent to", location)
+	}
+}
+
+func TestWeb_TwoFactorReplay(t *testing.T) {
+	user := webUser(t, "web-totp@example.com", 1, true)
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := (&imperator.Encryption{Key: []byte(webEncryptionKey)}).Encrypt(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiModels.Users.EnableTwoFactor(user.ID, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newBrowser(t)
+	if location := b.login(user.Email); location != "/admin/user/two-factor" || b.loggedIn() {
+		t.Fatal("the password alone logged in, sent to", location)
+	}
+	expectRedirect(t, "first code", b.post("/admin/user/two-factor", url.Values{"code": {code}}), "/admin/area")
+	if !b.loggedIn() {
+		t.Error("the code did not log in")
+	}
+
+	// whoever saw the code can not use it again
+	thief := newBrowser(t)
+	thief.login(user.Email)
+	expectRedirect(t, "replayed code", thief.post("/admin/user/two-factor", url.Values{"code": {code}}), "/admin/user/two-factor")
+	if thief.loggedIn() {
+		t.Error("a used code logged in again")
+	}
+}
+
+func TestWeb_CertificateGates(t *testing.T) {
+	active := webUser(t, "web-cert@example.com", 1, true)
+	webUser(t, "web-cert-inactive@example.com", 0, true)
+	webUser(t, "web-cert-unverified@example.com", 1, false)
+	linked := webUser(t, "web-cert-ldap@example.com", 1, true)
+
+	withCertificate := func(email string) *browser {
+		b := newBrowser(t)
+		if email != "" {
+			leaf := &x509.Certificate{EmailAddresses: []string{email}}
+			b.tls = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+		}
+		return b
+	}
+
+	for _, test := range []struct {
+		name, email string
+	}{
+		{"no certificate", ""},
+		{"unknown email", "web-cert-nobody@example.com"},
+		{"deactivated user", "web-cert-inactive@example.com"},
+		{"unverified user", "web-cert-unverified@example.com"},
+	} {
+		b := withCertificate(test.email)
+		expectRedirect(t, test.name, b.post("/admin/user/login/certificate", nil), "/admin/user/login")
+		if b.loggedIn() {
+			t.Errorf("%s: logged in", test.name)
+		}
+	}
+
+	b := withCertificate(active.Email)
+	expectRedirect(t, "active user", b.post("/admin/user/login/certificate", nil), "/admin/area")
+	if !b.loggedIn() {
+		t.Error("the certificate did not log in")
+	}
+
+	linkDirectory(t, linked)
+	b = withCertificate(linked.Email)
+	expectRedirect(t, "directory user", b.post("/admin/user/login/certificate", nil), "/admin/user/login")
+	if b.loggedIn() {
+		t.Error("a directory user logged in without the directory")
+	}
+}
+
+// magicLink requests a sign-in link in the browser and returns the path of the link in the mail
+func (b *browser) magicLink(email string) string {
+	b.t.Helper()
+	expectRedirect(b.t, "request sign-in link", b.post("/admin/user/magic-link", url.Values{"email": {email}}), "/admin/user/login")
+	select {
+	case msg := <-webMail:
+		if msg.To != email || msg.Template != "magic_link" {
+			b.t.Fatalf("expected a sign-in link for %s and got %s for %s", email, msg.Template, msg.To)
+		}
+		link := reflect.ValueOf(msg.Data).FieldByName("Link").String()
+		return strings.TrimPrefix(link, webURL)
+	case <-time.After(mailWait):
+		b.t.Fatal("no sign-in link was sent to", email)
+	}
+	return ""
+}
+
+func TestWeb_MagicLink(t *testing.T) {
+	user := webUser(t, "web-magic@example.com", 1, true)
+	owner := newBrowser(t)
+	link := owner.magicLink(user.Email)
+
+	// a link opened in another browser fails without counting against the account, anyone who
+	// can request links for the email could lock its owner out otherwise
+	other := newBrowser(t)
+	for i := 0; i <= throttle.DefaultEmailConfig.FreeAttempts; i++ {
+		expectRedirect(t, "other browser", other.get(link), "/admin/user/magic-link")
+	}
+	if other.loggedIn() {
+		t.Error("the link logged in another browser")
+	}
+	byEmail, _ := webApp.Handlers.LoginThrottle.Email.Check(context.Background(), throttle.Key(user.Email))
+	byIP, _ := webApp.Handlers.LoginThrottle.IP.Check(context.Background(), throttle.Key(other.ip()))
+	if byEmail.Failures != 0 || byIP.Failures == 0 {
+		t.Errorf("expected the failures on the address and not the account, got %d and %d", byIP.Failures, byEmail.Failures)
+	}
+	if auditCount(t, models.AuditLoginFailed, user.Email) == 0 {
+		t.Error("the failed sign-in was not audited")
+	}
+
+	// the failed attempts did not use up the link
+	expectRedirect(t, "owner", owner.get(link), "/admin/area")
+	if !owner.loggedIn() {
+		t.Error("the link did not log in")
+	}
+	expectRedirect(t, "used link", owner.get(link), "/admin/user/magic-link")
+
+	// the account is checked again when the link is used
+	user = webUser(t, "web-magic-deactivated@example.com", 1, true)
+	b := newBrowser(t)
+	link = b.magicLink(user.Email)
+	deactivate(t, user)
+	expectRedirect(t, "deactivated user", b.get(link), "/admin/user/magic-link")
+	if b.loggedIn() {
+		t.Error("a link logged in a deactivated user")
+	}
+
+	// accounts that can not use a link do not get one
+	linked := webUser(t, "web-magic-ldap@example.com", 1, true)
+	linkDirectory(t, linked)
+	for _, user := range []*models.User{
+		webUser(t, "web-magic-inactive@example.com", 0, true),
+		webUser(t, "web-magic-unverified@example.com", 1, false),
+		linked,
+	} {
+		expectRedirect(t, user.Email, newBrowser(t).post("/admin/user/magic-link", url.Values{"email": {user.Email}}), "/admin/user/login")
+	}
+	select {
+	case msg := <-webMail:
+		t.Error("a sign-in link was sent to", msg.To)
+	case <-time.After(mailWait):
+	}
+}
+
+// passkeyLogin runs a passwordless login with the authenticator, it returns the status of the finish
+func (b *browser) passkeyLogin(key *webauthntest.Authenticator) int {
+	b.t.Helper()
+	resp := b.postJSON("/admin/user/passkeys/login/begin", nil)
+	var begin struct {
+		Options struct {
+			Challenge string `json:"challenge"`
+		} `json:"options"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&begin); err != nil || begin.Options.Challenge == "" {
+		b.t.Fatal("no passkey challenge:", resp.StatusCode, err)
+	}
+	return b.postJSON("/admin/user/passkeys/login/finish", key.Get(begin.Options.Challenge, true)).StatusCode
+}
+
+// passkey registers a credential of a new software authenticator for the user
+func passkey(t *testing.T, user *models.User) *webauthntest.Authenticator {
+	t.Helper()
+	key := webauthntest.New("localhost", webURL)
+	key.UserHandle = []byte(strconv.Itoa(user.ID))
+	if _, err := apiModels.Credentials.Insert(models.Credential{
+		UserID:       user.ID,
+		Name:         "test key",
+		CredentialID: key.CredentialID,
+		PublicKey:    key.PublicKey(),
+		AAGUID:       make([]byte, 16),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestWeb_PasskeyGates(t *testing.T) {
+	active := webUser(t, "web-passkey@example.com", 1, true)
+	key := passkey(t, active)
+	b := newBrowser(t)
+	if status := b.passkeyLogin(key); status != http.StatusOK || !b.loggedIn() {
+		t.Error("the passkey did not log in:", status)
+	}
+
+	deactivate(t, active)
+	b = newBrowser(t)
+	if status := b.passkeyLogin(key); status != http.StatusUnauthorized || b.loggedIn() {
+		t.Error("a deactivated user logged in with a passkey:", status)
+	}
+
+	unverified := webUser(t, "web-passkey-unverified@example.com", 1, false)
+	b = newBrowser(t)
+	if status := b.passkeyLogin(passkey(t, unverified)); status != http.StatusUnauthorized || b.loggedIn() {
+		t.Error("an unverified user logged in with a passkey:", status)
+	}
+
+	linked := webUser(t, "web-passkey-ldap@example.com", 1, true)
+	key = passkey(t, linked)
+	linkDirectory(t, linked)
+	b = newBrowser(t)
+	if status := b.passkeyLogin(key); status != http.StatusUnauthorized || b.loggedIn() {
+		t.Error("a directory user logged in with a passkey:", status)
+	}
+}
+
+func TestWeb_RememberGates(t *testing.T) {
+	withCookie := func(user *models.User) *browser {
+		token, secret, err := apiModels.RememberToken.Issue(user.ID, "test", "192.0.2.1", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newBrowser(t)
+		b.jar.SetCookies(&url.URL{Scheme: "http", Host: "localhost", Path: "/"}, []*http.Cookie{{
+			Name: remember.CookieName(webApp.App.AppName), Value: remember.Encode(token.Series, secret), Path: "/",
+		}})
+		return b
+	}
+
+	active := webUser(t, "web-remember@example.com", 1, true)
+	if !withCookie(active).loggedIn() {
+		t.Error("the remember me cookie did not log in")
+	}
+
+	inactive := webUser(t, "web-remember-inactive@example.com", 1, true)
+	b := withCookie(inactive)
+	deactivate(t, inactive)
+	if b.loggedIn() {
+		t.Error("the remember me cookie logged in a deactivated user")
+	}
+	if tokens, _ := apiModels.RememberToken.GetForUser(inactive.ID); len(tokens) != 0 {
+		t.Error("the remember me device of a deactivated user was kept")
+	}
+}
+
+func TestWeb_OIDCGates(t *testing.T) {
+	idp := oidctest.NewServer("portal", "secret")
+	defer idp.Close()
+	webApp.Handlers.OIDC = oidc.NewRegistry(oidc.New(oidc.Config{
+		Name:         "fake",
+		Issuer:       idp.Issuer(),
+		ClientID:     "portal",
+		ClientSecret: "secret",
+		RedirectURL:  webURL + "/auth/oidc/fake/callback",
+		Trusted:      true,
+	}), oidc.New(oidc.Config{
+		Name:         "untrusted",
+		Issuer:       idp.Issuer(),
+		ClientID:     "portal",
+		ClientSecret: "secret",
+		RedirectURL:  webURL + "/auth/oidc/untrusted/callback",
+	}))
+	defer func() { webApp.Handlers.OIDC = nil }()
+
+	// loginWith runs the flow at the provider and returns the response of the callback
+	loginWith := func(provider string, b *browser, user oidctest.User) *http.Response {
+		idp.User = user
+		resp := b.get("/auth/oidc/" + provider)
+		reply, err := idp.Authorize(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.get("/auth/oidc/" + provider + "/callback?" + reply.Encode())
+	}
+	login := func(b *browser, user oidctest.User) *http.Response {
+		return loginWith("fake", b, user)
+	}
+
+	user := webUser(t, "web-oidc@example.com", 1, true)
+	identity := oidctest.User{Subject: "web-oidc", Email: user.Email, EmailVerified: true}
+	b := newBrowser(t)
+	expectRedirect(t, "active user", login(b, identity), "/admin/area")
+	if !b.loggedIn() {
+		t.Error("the provider did not log in")
+	}
+	select {
+	case msg := <-webMail:
+		if msg.To != user.Email || msg.Template != "identity_linked" {
+			t.Errorf("expected the link to be mailed to %s and got %s for %s", user.Email, msg.Template, msg.To)
+		}
+	case <-time.After(mailWait):
+		t.Error("the owner was not told about the linked login")
+	}
+
+	deactivate(t, user)
+	b = newBrowser(t)
+	expectRedirect(t, "deactivated user", login(b, identity), "/admin/user/login")
+	if b.loggedIn() {
+		t.Error("a deactivated user logged in through the provider")
+	}
+
+	// someone else may have registered the email, the account is not linked before it is verified
+	unverified := webUser(t, "web-oidc-unverified@example.com", 1, false)
+	b = newBrowser(t)
+	expectRedirect(t, "unverified user", login(b, oidctest.User{Subject: "web-oidc-unverified", Email: unverified.Email, EmailVerified: true}), "/admin/user/login")
+	if b.loggedIn() {
+		t.Error("an unverified account was logged in through the provider")
+	}
+
+	// a provider that is not trusted is only linked by the owner while logged in to the account
+	owner := webUser(t, "web-oidc-owner@example.com", 1, true)
+	other := oidctest.User{Subject: "web-oidc-other", Email: owner.Email, EmailVerified: true}
+	b = newBrowser(t)
+	expectRedirect(t, "untrusted provider", loginWith("untrusted", b, other), "/admin/user/login")
+	if b.loggedIn() {
+		t.Error("a provider that is not trusted was linked by the email")
+	}
+	b = newBrowser(t)
+	b.login(webUser(t, "web-oidc-stranger@example.com", 1, true).Email)
+	expectRedirect(t, "untrusted provider for another user", loginWith("untrusted", b, other), "/admin/user/login")
+	if identities, _ := apiModels.Identities.GetForUser(owner.ID); len(identities) != 0 {
+		t.Error("a provider that is not trusted was linked for another user")
+	}
+
+	b = newBrowser(t)
+	b.login(owner.Email)
+	expectRedirect(t, "untrusted provider for the owner", loginWith("untrusted", b, other), "/admin/area")
+	if identities, _ := apiModels.Identities.GetForUser(owner.ID); len(identities) != 1 {
+		t.Error("the owner failed to link a provider that is not trusted")
+	}
+	select {
+	case msg := <-webMail:
+		if msg.To != owner.Email || msg.Template != "identity_linked" {
+			t.Errorf("expected the link to be mailed to %s and got %s for %s", owner.Email, msg.Template, msg.To)
+		}
+	case <-time.After(mailWait):
+		t.Error("the owner was not told about the linked login")
+	}
+	b = newBrowser(t)
+	expectRedirect(t, "linked untrusted provider", loginWith("untrusted", b, other), "/admin/area")
+	if !b.loggedIn() {
+		t.Error("the linked provider did not log in")
+	}
+}
+
+func TestWeb_OAuthGates(t *testing.T) {
+	user := webUser(t, "web-oauth@example.com", 1, true)
+	id, _, err := apiModels.OAuthClients.Insert(models.OAuthClient{
+		Name: "Web", RedirectURIs: "https://app.example.com/cb", Scopes: "openid email", GrantTypes: "authorization_code", Trusted: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := apiModels.OAuthClients.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := strings.Repeat("verifier", 6)
+	sum := sha256.Sum256([]byte(verifier))
+	authorize := "/oauth/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {"https://app.example.com/cb"},
+		"scope":                 {"openid email"},
+		"state":                 {"state"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	// code returns the code the trusted client gets for the logged in user
+	code := func(b *browser) string {
+		resp := b.get(authorize)
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || location.Host != "app.example.com" || location.Query().Get("code") == "" {
+			t.Fatalf("expected a code for the client and got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		return location.Query().Get("code")
+	}
+	exchange := func(code string) int {
+		return newBrowser(t).post("/oauth/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"https://app.example.com/cb"},
+			"client_id":     {client.ClientID},
+			"code_verifier": {verifier},
+		}).StatusCode
+	}
+
+	b := newBrowser(t)
+	b.login(user.Email)
+	if status := exchange(code(b)); status != http.StatusOK {
+		t.Error("failed to exchange the code:", status)
+	}
+
+	// a user deactivated after the code was issued gets no tokens and no new codes
+	issued := code(b)
+	deactivate(t, user)
+	if status := exchange(issued); status != http.StatusBadRequest {
+		t.Error("the code of a deactivated user was exchanged:", status)
+	}
+	expectRedirect(t, "deactivated user", b.get(authorize), "/admin/user/login")
+}
+
+func TestWeb_Impersonation(t *testing.T) {
+	admin := webUser(t, "web-impersonator@example.com", 1, true)
+	role, err := apiModels.Roles.GetByName(models.SuperAdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiModels.Roles.AssignToUser(role.ID, admin.ID); err != nil {
+		t.Fatal(err)
+	}
+	user := webUser(t, "web-impersonated@example.com", 1, true)
+	inactive := webUser(t, "web-impersonated-inactive@example.com", 0, true)
+
+	b := newBrowser(t)
+	b.login(admin.Email)
+	expectRedirect(t, "impersonate an inactive user", b.post(fmt.Sprintf("/admin/users/%d/impersonate", inactive.ID), nil), "/admin/users")
+	expectRedirect(t, "impersonate", b.post(fmt.Sprintf("/admin/users/%d/impersonate", user.ID), nil), "/admin/area")
+	if auditCount(t, models.AuditImpersonationStarted, user.Email) != 1 {
+		t.Error("the impersonation was not audited")
+	}
+
+	// the session has the permissions of the user now and not those of the admin
+	if status := b.get("/admin/users").StatusCode; status != http.StatusForbidden {
+		t.Error("the admin kept their permissions while impersonating:", status)
+	}
+	// the security settings of the user, other apps and further impersonations are off limits
+	for path, resp := range map[string]*http.Response{
+		"tokens":      b.post("/admin/user/tokens", url.Values{"name": {"stolen"}}),
+		"two-factor":  b.post("/admin/user/two-factor/disable", nil),
+		"authorize":   b.get("/oauth/authorize"),
+		"impersonate": b.post(fmt.Sprintf("/admin/users/%d/impersonate", admin.ID), nil),
+	} {
+		if resp.StatusCode != http.StatusForbidden {
+			t.Error("an impersonating admin got through to", path, resp.StatusCode)
+		}
+	}
+
+	expectRedirect(t, "stop", b.post("/admin/user/impersonate/stop", nil), "/admin/users")
+	if auditCount(t, models.AuditImpersonationStopped, user.Email) != 1 {
+		t.Error("the end of the impersonation was not audited")
+	}
+	if status := b.get("/admin/users").StatusCode; status == http.StatusForbidden || status == http.StatusUnauthorized {
+		t.Error("the admin did not get their session back:", status)
+	}
+	expectRedirect(t, "stop again", b.post("/admin/user/impersonate/stop", nil), "/admin/area")
+}
+
+// roleWith creates a role with the permissions and gives it to the user
+func roleWith(t *testing.T, user *models.User, name string, permissions ...string) {
+	t.Helper()
+	roleID, err := apiModels.Roles.Insert(models.Role{Name: name, Description: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, permission := range permissions {
+		p, err := apiModels.Permissions.GetByName(permission)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := apiModels.Roles.GrantPermission(roleID, p.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := apiModels.Roles.AssignToUser(roleID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeb_ManageOutrankedUsers(t *testing.T) {
+	editor := webUser(t, "web-editor@example.com", 1, true)
+	roleWith(t, editor, "web-editors", "admin.access", "users.view", "users.edit", "users.delete")
+	super := webUser(t, "web-super@example.com", 1, true)
+	role, err := apiModels.Roles.GetByName(models.SuperAdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiModels.Roles.AssignToUser(role.ID, super.ID); err != nil {
+		t.Fatal(err)
+	}
+	plain := webUser(t, "web-plain@example.com", 1, true)
+
+	b := newBrowser(t)
+	b.login(editor.Email)
+	path := fmt.Sprintf("/admin/users/%d", super.ID)
+	for what, resp := range map[string]*http.Response{
+		"edit form":   b.get(path + "/edit"),
+		"edit":        b.post(path+"/edit", url.Values{"first_name": {"Taken"}, "last_name": {"Over"}, "email": {"web-taken@example.com"}, "active": {"1"}}),
+		"send reset":  b.post(path+"/send-reset", nil),
+		"deactivate":  b.post(path+"/deactivate", nil),
+		"revoke all":  b.post(path+"/sessions/revoke-all", nil),
+		"delete":      b.post(path+"/delete", nil),
+		"delete form": b.get(path + "/delete"),
+	} {
+		expectRedirect(t, what, resp, "/admin/users")
+	}
+	after, err := apiModels.Users.Get(super.ID)
+	if err != nil {
+		t.Fatal("the super admin was deleted:", err)
+	}
+	if after.Email != super.Email || after.Active != 1 {
+		t.Error("the super admin was changed by an admin they outrank")
+	}
+	select {
+	case msg := <-webMail:
+		t.Error("a reset link was sent to", msg.To)
+	case <-time.After(mailWait):
+	}
+
+	// users without more permissions than the admin can still be managed
+	expectRedirect(t, "deactivate", b.post(fmt.Sprintf("/admin/users/%d/deactivate", plain.ID), nil), "/admin/users")
+	if after, _ := apiModels.Users.Get(plain.ID); after.Active != 0 {
+		t.Error("failed to deactivate a user the admin outranks")
+	}
+}
+
+func TestWeb_UserRolesTogether(t *testing.T) {
+	super := webUser(t, "web-roles-super@example.com", 1, true)
+	role, err := apiModels.Roles.GetByName(models.SuperAdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiModels.Roles.AssignToUser(role.ID, super.ID); err != nil {
+		t.Fatal(err)
+	}
+	plain := webUser(t, "web-roles-plain@example.com", 1, true)
+
+	b := newBrowser(t)
+	b.login(super.Email)
+	// a role that does not exist makes storing the roles fail
+	resp := b.post("/admin/users/create", url.Values{
+		"first_name": {"Half"}, "last_name": {"Made"}, "email": {"web-half@example.com"}, "active": {"1"},
+		"password": {"a-Long-passw0rd-for-roles"}, "password_confirmation": {"a-Long-passw0rd-for-roles"},
+		"roles": {"999999"},
+	})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Error("a failed role assignment was reported as created:", resp.StatusCode)
+	}
+	if _, err := apiModels.Users.GetByEmail("web-half@example.com"); err == nil {
+		t.Error("the user was created without their roles")
+	}
+
+	resp = b.post(fmt.Sprintf("/admin/users/%d/edit", plain.ID), url.Values{
+		"first_name": {"Half"}, "last_name": {"Edited"}, "email": {plain.Email}, "roles": {"999999"},
+	})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Error("a failed role assignment was reported as updated:", resp.StatusCode)
+	}
+	if after, _ := apiModels.Users.Get(plain.ID); after.LastName == "Edited" {
+		t.Error("the user was updated without their roles")
+	}
+}
+
+func TestWeb_EditKeepsActive(t *testing.T) {
+	super := webUser(t, "web-active-super@example.com", 1, true)
+	role, err := apiModels.Roles.GetByName(models.SuperAdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiModels.Roles.AssignToUser(role.ID, super.ID); err != nil {
+		t.Fatal(err)
+	}
+	active := webUser(t, "web-active@example.com", 1, true)
+	inactive := webUser(t, "web-inactive@example.com", 0, true)
+
+	b := newBrowser(t)
+	b.login(super.Email)
+	// the edit form has no active field, the account keeps the state it had
+	for _, user := range []*models.User{active, inactive, super} {
+		resp := b.post(fmt.Sprintf("/admin/users/%d/edit", user.ID), url.Values{
+			"first_name": {"Still"}, "last_name": {"Same"}, "email": {user.Email},
+		})
+		expectRedirect(t, user.Email, resp, "/admin/users")
+		after, err := apiModels.Users.Get(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.LastName != "Same" {
+			t.Error("the user was not updated:", user.Email)
+		}
+		if after.Active != user.Active {
+			t.Errorf("editing %s changed active from %d to %d", user.Email, user.Active, after.Active)
+		}
+	}
+}
+
+func TestWeb_PasswordForgot(t *testing.T) {
+	user := webUser(t, "web-forgot@example.com", 1, true)
+	for _, email := range []string{user.Email, "web-forgot-unknown@example.com"} {
+		expectRedirect(t, email, newBrowser(t).post("/admin/user/forgot-password", url.Values{"email": {email}}), "/admin/user/login")
+	}
+	select {
+	case msg := <-webMail:
+		if msg.To != user.Email || msg.Template != "password_reset" {
+			t.Errorf("expected a reset link for %s and got %s for %s", user.Email, msg.Template, msg.To)
+		}
+	case <-time.After(mailWait):
+		t.Fatal("no reset link was sent to", user.Email)
+	}
+	select {
+	case msg := <-webMail:
+		t.Error("a reset link was sent to", msg.To)
+	case <-time.After(mailWait):
+	}
+}